@@ -3,20 +3,37 @@
 package front
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"golang.org/x/text/language"
 
 	"github.com/merlincox/cardapi/db"
 	"github.com/merlincox/cardapi/models"
 	"github.com/merlincox/cardapi/utils"
 )
 
+const (
+	// The time reserved before a request's deadline for building and returning the response
+	RESPONSE_MARGIN = 500 * time.Millisecond
+
+	// A request header which, when "true", makes the request read from the primary database rather than a replica
+	READ_YOUR_WRITES_HEADER = "X-Read-Your-Writes"
+
+	// The value of the format query-string parameter which adds amounts formatted for the language of the request
+	DISPLAY_FORMAT = "display"
+)
+
+// The language amounts are formatted in for requests without an Accept-Language header
+var DEFAULT_LANGUAGE = language.BritishEnglish
+
 type Front struct {
 	dbi         db.Dbi
 	status      models.Status
@@ -24,7 +41,49 @@ type Front struct {
 	cacheMaxAge int
 }
 
-type innerHandler func(request events.APIGatewayProxyRequest) (interface{}, models.ApiError)
+type innerHandler func(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError)
+
+// The method and resource path templates routed by getHandlerForRoute, used to resolve the resource path and path
+// parameters of requests which do not come through API Gateway
+var routeTemplates = []string{
+	"GET/status",
+	"GET/calc/{op}",
+	"POST/authorise",
+	"POST/refund",
+	"POST/reverse",
+	"POST/top-up",
+	"POST/transfer",
+	"POST/capture",
+	"POST/card",
+	"POST/customer",
+	"POST/vendor",
+	"GET/card/{id}",
+	"GET/vendor/{id}",
+	"GET/customer/{id}",
+	"GET/authorisation/{id}",
+	"GET/vendors",
+	"GET/customers",
+	"GET/ledger/entries",
+	"GET/admin/reconcile",
+	"POST/admin/expire",
+	"POST/card/{id}/status",
+	"GET/card/{id}/limits",
+	"POST/card/{id}/limits",
+	"POST/customer/{id}/limits",
+	"POST/authorisation/{id}/clear",
+	"POST/authorisation/{id}/dispute",
+	"POST/admin/settle",
+	"GET/vendor/{id}/settlements",
+	"GET/vendor/{id}/fees",
+	"POST/vendor/{id}/fees",
+	"POST/category/{category}/fees",
+	"GET/card/{id}/mcc-controls",
+	"POST/card/{id}/mcc-controls",
+	"POST/mandate",
+	"GET/mandate/{id}",
+	"POST/mandate/{id}/status",
+	"POST/admin/mandates",
+}
 
 // NewFront creates a new Front object
 func NewFront(dbi db.Dbi, status models.Status, cacheMaxAge int) Front {
@@ -42,10 +101,16 @@ func NewFront(dbi db.Dbi, status models.Status, cacheMaxAge int) Front {
 
 // Front.Handler takes an APIGatewayProxyRequest and returns an APIGatewayProxyResponse with an error which should be nil
 //
-// Any downstream panic should be recovered and wrapped into an ApiErrorBody, and the trace logged
-func (front Front) Handler(request events.APIGatewayProxyRequest) (response events.APIGatewayProxyResponse, err error) {
+// Any downstream panic should be recovered and wrapped into an ApiErrorBody, and the trace logged.
+// Database operations are abandoned with a 504 once the context's deadline, less RESPONSE_MARGIN, has passed.
+// With ?format=display the amounts of the response are also formatted for the language of its Accept-Language header,
+// and the amounts in error messages are always formatted for it when the header is given
+func (front Front) Handler(ctx context.Context, request events.APIGatewayProxyRequest) (response events.APIGatewayProxyResponse, err error) {
 
-	useCache := request.RequestContext.HTTPMethod == "GET"
+	readYourWrites := strings.EqualFold(getHeader(request, READ_YOUR_WRITES_HEADER), "true")
+
+	// a response read from the primary to see a recent write should not be reused for later requests
+	useCache := request.RequestContext.HTTPMethod == "GET" && !readYourWrites
 
 	defer func() {
 
@@ -58,9 +123,39 @@ func (front Front) Handler(request events.APIGatewayProxyRequest) (response even
 	}()
 
 	route := getRoute(request)
-	log.Println("Handling a request for %v.", route)
+	log.Printf("Handling a request for %v.", route)
+
+	ctx, cancel := withResponseMargin(ctx)
+	defer cancel()
+
+	if readYourWrites {
+		ctx = db.WithReadYourWrites(ctx)
+	}
+
+	format, apiErr := getFormat(request)
+
+	if apiErr != nil {
+		response = front.buildResponse(nil, apiErr, useCache)
+		return
+	}
+
+	data, apiErr := front.router(route)(ctx, request)
+
+	// a driver may report a query abandoned at the deadline as a failure of its own rather than the deadline
+	if apiErr != nil && apiErr.StatusCode() == http.StatusInternalServerError && ctx.Err() == context.DeadlineExceeded {
+		apiErr = models.ErrorWrap(ctx.Err())
+	}
+
+	tag, explicit := requestLanguage(request)
+
+	if apiErr != nil && explicit {
+		apiErr = models.LocalizeError(apiErr, tag)
+	}
+
+	if apiErr == nil && format == DISPLAY_FORMAT {
+		data = models.Display(data, tag)
+	}
 
-	data, apiErr := front.router(route)(request)
 	response = front.buildResponse(data, apiErr, useCache)
 
 	return
@@ -80,6 +175,7 @@ func (front *Front) getHandlerForRoute(route string) innerHandler {
 		"POST/refund",
 		"POST/reverse",
 		"POST/top-up",
+		"POST/transfer",
 		"POST/capture":
 		return front.codeRequestHandler
 
@@ -109,6 +205,66 @@ func (front *Front) getHandlerForRoute(route string) innerHandler {
 
 	case "GET/customers":
 		return front.getCustomersHandler
+
+	case "GET/ledger/entries":
+		return front.getLedgerEntriesHandler
+
+	case "GET/admin/reconcile":
+		return front.reconcileHandler
+
+	case "POST/admin/expire":
+		return front.expireHandler
+
+	case "POST/card/{id}/status":
+		return front.setCardStatusHandler
+
+	case "GET/card/{id}/limits":
+		return front.getCardLimitsHandler
+
+	case "POST/card/{id}/limits":
+		return front.setCardLimitsHandler
+
+	case "POST/customer/{id}/limits":
+		return front.setCustomerLimitsHandler
+
+	case "POST/authorisation/{id}/clear":
+		return front.clearAuthorisationHandler
+
+	case "POST/authorisation/{id}/dispute":
+		return front.disputeHandler
+
+	case "POST/admin/settle":
+		return front.settleHandler
+
+	case "GET/vendor/{id}/settlements":
+		return front.getSettlementsHandler
+
+	case "GET/vendor/{id}/fees":
+		return front.getVendorFeesHandler
+
+	case "POST/vendor/{id}/fees":
+		return front.setVendorFeesHandler
+
+	case "POST/category/{category}/fees":
+		return front.setCategoryFeesHandler
+
+	case "GET/card/{id}/mcc-controls":
+		return front.getCardMccControlsHandler
+
+	case "POST/card/{id}/mcc-controls":
+		return front.setCardMccControlsHandler
+
+	case "POST/mandate":
+		return front.addMandateHandler
+
+	case "GET/mandate/{id}":
+		return front.getMandateHandler
+
+	case "POST/mandate/{id}/status":
+		return front.setMandateStatusHandler
+
+	case "POST/admin/mandates":
+		return front.runMandatesHandler
 	}
 
 	return front.unknownRouteHandler
@@ -119,7 +275,51 @@ func getRoute(request events.APIGatewayProxyRequest) string {
 	return request.RequestContext.HTTPMethod + request.RequestContext.ResourcePath
 }
 
-func (front Front) unknownRouteHandler(request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+// Shorten the deadline of a context, such as the Lambda's, so that a request which overruns it is abandoned in time
+// to return an error response, rather than being killed by the Lambda timeout without one
+func withResponseMargin(ctx context.Context) (context.Context, context.CancelFunc) {
+
+	deadline, ok := ctx.Deadline()
+
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithDeadline(ctx, deadline.Add(-RESPONSE_MARGIN))
+}
+
+// Returns the format query-string parameter of a request, which is either empty or DISPLAY_FORMAT
+func getFormat(request events.APIGatewayProxyRequest) (string, models.ApiError) {
+
+	format := request.QueryStringParameters["format"]
+
+	if format != "" && format != DISPLAY_FORMAT {
+		return "", models.ConstructApiError(http.StatusBadRequest, "Unknown format: %v (must be %v)", format, DISPLAY_FORMAT)
+	}
+
+	return format, nil
+}
+
+// Returns the preferred language of the Accept-Language header of a request, and whether it had one. Requests without
+// one, or with one which cannot be parsed, are in DEFAULT_LANGUAGE
+func requestLanguage(request events.APIGatewayProxyRequest) (language.Tag, bool) {
+
+	header := getHeader(request, "Accept-Language")
+
+	if header == "" {
+		return DEFAULT_LANGUAGE, false
+	}
+
+	tags, _, err := language.ParseAcceptLanguage(header)
+
+	if err != nil || len(tags) == 0 {
+		return DEFAULT_LANGUAGE, false
+	}
+
+	return tags[0], true
+}
+
+func (front Front) unknownRouteHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
 
 	return nil, models.ConstructApiError(http.StatusNotFound, "No such route as %v", getRoute(request))
 }
@@ -161,6 +361,7 @@ func (front *Front) buildResponse(data interface{}, err models.ApiError, useCach
 		StatusCode: statusCode,
 		Headers: map[string]string{
 			"Cache-Control":               cacheValue,
+			"Vary":                        "Accept-Language",
 			"Access-Control-Allow-Origin": "*",
 			"X-Timestamp":                 time.Now().UTC().Format(time.RFC3339Nano),
 		}}
@@ -1,27 +1,34 @@
 package front
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log"
 	"math"
 	"strconv"
+	"strings"
 
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
 
 	"github.com/aws/aws-lambda-go/events"
 
+	"github.com/merlincox/cardapi/db"
 	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
 )
 
-func (front Front) statusHandler(request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+func (front Front) statusHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
 
 	return front.status, nil
 }
 
-type codeRequestHandler func(request models.CodeRequest) (int, models.ApiError)
+type codeRequestHandler func(ctx context.Context, request models.CodeRequest) (int, models.ApiError)
 
-func (front Front) addCustomerHandler(request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+func (front Front) addCustomerHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
 
 	c := models.Customer{}
 
@@ -31,10 +38,10 @@ func (front Front) addCustomerHandler(request events.APIGatewayProxyRequest) (in
 		return nil, models.ErrorWrap(err)
 	}
 
-	return front.dbi.AddOrUpdateCustomer(c)
+	return front.dbi.AddOrUpdateCustomer(ctx, c)
 }
 
-func (front Front) addCardHandler(request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+func (front Front) addCardHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
 
 	c := models.Customer{}
 
@@ -44,10 +51,11 @@ func (front Front) addCardHandler(request events.APIGatewayProxyRequest) (interf
 		return nil, models.ErrorWrap(err)
 	}
 
-	return front.dbi.AddCard(c.Id)
+	// the currency of the card is optional, defaulting to pounds
+	return front.dbi.AddCard(ctx, c.Id, request.QueryStringParameters["currency"])
 }
 
-func (front Front) addVendorHandler(request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+func (front Front) addVendorHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
 
 	v := models.Vendor{}
 
@@ -57,10 +65,10 @@ func (front Front) addVendorHandler(request events.APIGatewayProxyRequest) (inte
 		return nil, models.ErrorWrap(err)
 	}
 
-	return front.dbi.AddOrUpdateVendor(v)
+	return front.dbi.AddOrUpdateVendor(ctx, v)
 }
 
-func (front Front) codeRequestHandler(request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+func (front Front) codeRequestHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
 
 	cr := models.CodeRequest{}
 
@@ -77,6 +85,9 @@ func (front Front) codeRequestHandler(request events.APIGatewayProxyRequest) (in
 	case "/top-up":
 		subHandler = front.topUpHandler
 
+	case "/transfer":
+		subHandler = front.transferHandler
+
 	case "/authorise":
 		subHandler = front.authoriseHandler
 
@@ -93,7 +104,77 @@ func (front Front) codeRequestHandler(request events.APIGatewayProxyRequest) (in
 		return nil, models.ConstructApiError(400, "Unsupported code request route: %v", request.RequestContext.ResourcePath)
 	}
 
-	id, apiErr := subHandler(cr)
+	key := getHeader(request, IDEMPOTENCY_KEY_HEADER)
+
+	if key == "" {
+		return codeResponse(subHandler(ctx, cr))
+	}
+
+	return front.idempotentCodeRequest(ctx, key, codeRequestFingerprint(getRoute(request), cr), cr, subHandler)
+}
+
+const (
+	IDEMPOTENCY_KEY_HEADER     = "Idempotency-Key"
+	MAX_IDEMPOTENCY_KEY_LENGTH = 255
+)
+
+// Handle a code request with an idempotency key. A repeat of a completed request replays its response, whereas a
+// repeat with a different request, or while the original request is still being handled, is a conflict.
+// The key is released if the request fails, so that it can be retried, and a key whose request was abandoned before
+// completing it can be claimed again by a repeat after db.IDEMPOTENCY_CLAIM_TIMEOUT. Keys with the prefix of those of
+// the mandate scheduler are refused.
+func (front Front) idempotentCodeRequest(ctx context.Context, key, fingerprint string, cr models.CodeRequest, subHandler codeRequestHandler) (interface{}, models.ApiError) {
+
+	if len(key) > MAX_IDEMPOTENCY_KEY_LENGTH {
+		return nil, models.ConstructApiError(400, "Malformed %v header: must be at most %v characters", IDEMPOTENCY_KEY_HEADER, MAX_IDEMPOTENCY_KEY_LENGTH)
+	}
+
+	if strings.HasPrefix(key, db.MANDATE_IDEMPOTENCY_KEY_PREFIX) {
+		return nil, models.ConstructApiError(400, "Malformed %v header: the prefix %v is reserved", IDEMPOTENCY_KEY_HEADER, db.MANDATE_IDEMPOTENCY_KEY_PREFIX)
+	}
+
+	k, claimed, apiErr := front.dbi.ClaimIdempotencyKey(ctx, key, fingerprint)
+
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	if !claimed {
+
+		if k.Fingerprint != fingerprint {
+			return nil, models.ConstructApiError(409, "%v %v has already been used for a different request", IDEMPOTENCY_KEY_HEADER, key)
+		}
+
+		if !k.Completed {
+			return nil, models.ConstructApiError(409, "%v %v is in use by a request which has not completed", IDEMPOTENCY_KEY_HEADER, key)
+		}
+
+		return codeResponse(k.ResponseId, nil)
+	}
+
+	id, apiErr := subHandler(ctx, cr)
+
+	if apiErr != nil {
+
+		// released without the request's context, which has expired if the request failed by exceeding its deadline
+		if releaseErr := front.dbi.ReleaseIdempotencyKey(context.Background(), key); releaseErr != nil {
+			log.Printf("ERROR: Failed to release %v %v: %v", IDEMPOTENCY_KEY_HEADER, key, releaseErr.Error())
+		}
+
+		return nil, apiErr
+	}
+
+	// the operation has been committed, so its code is returned even if the key cannot be completed, which is done
+	// without the request's context in case its deadline has passed. A key left claimed is taken over by a repeat of
+	// the request after db.IDEMPOTENCY_CLAIM_TIMEOUT
+	if completeErr := front.dbi.CompleteIdempotencyKey(context.Background(), key, id); completeErr != nil {
+		log.Printf("ERROR: Failed to complete %v %v with %v: %v", IDEMPOTENCY_KEY_HEADER, key, id, completeErr.Error())
+	}
+
+	return codeResponse(id, nil)
+}
+
+func codeResponse(id int, apiErr models.ApiError) (interface{}, models.ApiError) {
 
 	if apiErr != nil {
 		return nil, apiErr
@@ -104,52 +185,81 @@ func (front Front) codeRequestHandler(request events.APIGatewayProxyRequest) (in
 	}, nil
 }
 
-func (front Front) authoriseHandler(cr models.CodeRequest) (int, models.ApiError) {
+// A fingerprint of a code request to a route, which does not depend on the formatting of the request body
+func codeRequestFingerprint(route string, cr models.CodeRequest) string {
+
+	sum := sha256.Sum256([]byte(route + utils.JsonStringify(cr)))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Header names are case-insensitive, and are not canonicalised by API Gateway
+func getHeader(request events.APIGatewayProxyRequest, name string) string {
+
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+
+	return ""
+}
+
+func (front Front) authoriseHandler(ctx context.Context, cr models.CodeRequest) (int, models.ApiError) {
 
 	if cr.VendorId < 1 || cr.CardId < 1 || cr.Amount < 1 || cr.Description == "" {
 		return -1, models.ConstructApiError(400, "Malformed authorisation request: valid vendorId, cardId, amount, description required")
 	}
 
-	return front.dbi.Authorise(cr.CardId, cr.VendorId, cr.Amount, cr.Description)
+	return front.dbi.Authorise(ctx, cr.CardId, cr.VendorId, cr.Amount, cr.Currency, cr.Description)
 }
 
-func (front Front) captureHandler(cr models.CodeRequest) (int, models.ApiError) {
+func (front Front) captureHandler(ctx context.Context, cr models.CodeRequest) (int, models.ApiError) {
 
 	if cr.AuthorisationId < 1 || cr.Amount < 1 {
 		return -1, models.ConstructApiError(400, "Malformed capture request: valid authorisationId, amount required")
 	}
 
-	return front.dbi.Capture(cr.AuthorisationId, cr.Amount)
+	return front.dbi.Capture(ctx, cr.AuthorisationId, cr.Amount, cr.Currency)
 }
 
-func (front Front) refundHandler(cr models.CodeRequest) (int, models.ApiError) {
+func (front Front) refundHandler(ctx context.Context, cr models.CodeRequest) (int, models.ApiError) {
 
 	if cr.AuthorisationId < 1 || cr.Amount < 1 || cr.Description == "" {
 		return -1, models.ConstructApiError(400, "Malformed refund request: valid authorisationId, amount, description required")
 	}
 
-	return front.dbi.Refund(cr.AuthorisationId, cr.Amount, cr.Description)
+	return front.dbi.Refund(ctx, cr.AuthorisationId, cr.Amount, cr.Currency, cr.Description)
 }
 
-func (front Front) reverseHandler(cr models.CodeRequest) (int, models.ApiError) {
+func (front Front) reverseHandler(ctx context.Context, cr models.CodeRequest) (int, models.ApiError) {
 
 	if cr.AuthorisationId < 1 || cr.Amount < 1 || cr.Description == "" {
 		return -1, models.ConstructApiError(400, "Malformed reversal request: valid authorisationId, amount, description required")
 	}
 
-	return front.dbi.Reverse(cr.AuthorisationId, cr.Amount, cr.Description)
+	return front.dbi.Reverse(ctx, cr.AuthorisationId, cr.Amount, cr.Currency, cr.Description)
 }
 
-func (front Front) topUpHandler(cr models.CodeRequest) (int, models.ApiError) {
+func (front Front) topUpHandler(ctx context.Context, cr models.CodeRequest) (int, models.ApiError) {
 
 	if cr.CardId < 1 || cr.Amount < 1 || cr.Description == "" {
 		return -1, models.ConstructApiError(400, "Malformed top-up request: valid cardId, amount, description required")
 	}
 
-	return front.dbi.TopUp(cr.CardId, cr.Amount, cr.Description)
+	return front.dbi.TopUp(ctx, cr.CardId, cr.Amount, cr.Currency, cr.Description)
+}
+
+func (front Front) transferHandler(ctx context.Context, cr models.CodeRequest) (int, models.ApiError) {
+
+	if cr.CardId < 1 || cr.ToCardId < 1 || cr.Amount < 1 || cr.Description == "" {
+		return -1, models.ConstructApiError(400, "Malformed transfer request: valid cardId, toCardId, amount, description required")
+	}
+
+	return front.dbi.Transfer(ctx, cr.CardId, cr.ToCardId, cr.Amount, cr.Currency, cr.Description)
 }
 
-func (front Front) getCardHandler(request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+func (front Front) getCardHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
 
 	ids := request.PathParameters["id"]
 
@@ -160,58 +270,210 @@ func (front Front) getCardHandler(request events.APIGatewayProxyRequest) (interf
 
 	}
 
-	return front.dbi.GetCard(int(id))
+	return front.dbi.GetCard(ctx, int(id))
 }
 
-func (front Front) getVendorHandler(request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+func (front Front) setCardStatusHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
 
 	ids := request.PathParameters["id"]
 
 	id, err := strconv.ParseInt(ids, 0, 0)
 
 	if err != nil {
-		return nil, models.ConstructApiError(400, "GetVendor: malformed id: %v", ids)
+		return nil, models.ConstructApiError(400, "SetCardStatus: malformed id: %v", ids)
+
+	}
+
+	cr := models.CardStatusRequest{}
+
+	err = json.Unmarshal([]byte(request.Body), &cr)
+
+	if err != nil {
+		return nil, models.ErrorWrap(err)
+	}
+
+	return front.dbi.SetCardStatus(ctx, int(id), cr.Status, cr.Description)
+}
+
+func (front Front) getCardLimitsHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	ids := request.PathParameters["id"]
+
+	id, err := strconv.ParseInt(ids, 0, 0)
+
+	if err != nil {
+		return nil, models.ConstructApiError(400, "GetCardLimits: malformed id: %v", ids)
+	}
+
+	return front.dbi.GetCardLimits(ctx, int(id))
+}
+
+func (front Front) setCardLimitsHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	ids := request.PathParameters["id"]
+
+	id, err := strconv.ParseInt(ids, 0, 0)
+
+	if err != nil {
+		return nil, models.ConstructApiError(400, "SetCardLimits: malformed id: %v", ids)
+	}
+
+	limits := models.SpendingLimits{}
+
+	err = json.Unmarshal([]byte(request.Body), &limits)
 
+	if err != nil {
+		return nil, models.ErrorWrap(err)
+	}
+
+	return front.dbi.SetCardLimits(ctx, int(id), limits)
+}
+
+func (front Front) setCustomerLimitsHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	ids := request.PathParameters["id"]
+
+	id, err := strconv.ParseInt(ids, 0, 0)
+
+	if err != nil {
+		return nil, models.ConstructApiError(400, "SetCustomerLimits: malformed id: %v", ids)
+	}
+
+	limits := models.SpendingLimits{}
+
+	err = json.Unmarshal([]byte(request.Body), &limits)
+
+	if err != nil {
+		return nil, models.ErrorWrap(err)
 	}
 
-	return front.dbi.GetVendor(int(id))
+	return front.dbi.SetCustomerLimits(ctx, int(id), limits)
 }
 
-func (front Front) getVendorsHandler(request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+func (front Front) getVendorHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
 
-	//for now, offset and limit are ignored
+	ids := request.PathParameters["id"]
 
-	vendors, err := front.dbi.GetVendors()
+	id, err := strconv.ParseInt(ids, 0, 0)
 
 	if err != nil {
-		return nil, err
+		return nil, models.ConstructApiError(400, "GetVendor: malformed id: %v", ids)
+
+	}
+
+	return front.dbi.GetVendor(ctx, int(id))
+}
+
+const (
+	DEFAULT_PAGE_LIMIT = 100
+	MAX_PAGE_LIMIT     = 1000
+)
+
+// Parse and validate the offset and limit query-string parameters of a list request
+func getPaginationFromRequest(request events.APIGatewayProxyRequest, context string) (offset, limit int, apiErr models.ApiError) {
+
+	offset = 0
+	limit = DEFAULT_PAGE_LIMIT
+
+	if val, ok := request.QueryStringParameters["offset"]; ok {
+
+		parsed, err := strconv.ParseInt(val, 10, 0)
+
+		if err != nil || parsed < 0 {
+			return 0, 0, models.ConstructApiError(400, "%v: malformed offset: %v", context, val)
+		}
+
+		offset = int(parsed)
+	}
+
+	if val, ok := request.QueryStringParameters["limit"]; ok {
+
+		parsed, err := strconv.ParseInt(val, 10, 0)
+
+		if err != nil || parsed < 1 || parsed > MAX_PAGE_LIMIT {
+			return 0, 0, models.ConstructApiError(400, "%v: malformed limit: %v (must be between 1 and %v)", context, val, MAX_PAGE_LIMIT)
+		}
+
+		limit = int(parsed)
+	}
+
+	return
+}
+
+func (front Front) getVendorsHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	offset, limit, apiErr := getPaginationFromRequest(request, "GetVendors")
+
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	vendors, total, apiErr := front.dbi.GetVendors(ctx, offset, limit)
+
+	if apiErr != nil {
+		return nil, apiErr
 	}
 
 	return models.VendorList{
 		Items:  vendors,
-		Offset: 0,
-		Total:  len(vendors),
+		Offset: offset,
+		Total:  total,
 	}, nil
 }
 
-func (front Front) getCustomersHandler(request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+func (front Front) getCustomersHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	offset, limit, apiErr := getPaginationFromRequest(request, "GetCustomers")
 
-	//for now, offset and limit are ignored
+	if apiErr != nil {
+		return nil, apiErr
+	}
 
-	customers, err := front.dbi.GetCustomers()
+	customers, total, apiErr := front.dbi.GetCustomers(ctx, offset, limit)
 
-	if err != nil {
-		return nil, err
+	if apiErr != nil {
+		return nil, apiErr
 	}
 
 	return models.CustomerList{
 		Items:  customers,
-		Offset: 0,
-		Total:  len(customers),
+		Offset: offset,
+		Total:  total,
 	}, nil
 }
 
-func (front Front) getCustomerHandler(request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+func (front Front) getLedgerEntriesHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	offset, limit, apiErr := getPaginationFromRequest(request, "GetLedgerEntries")
+
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	entries, total, apiErr := front.dbi.GetLedgerEntries(ctx, offset, limit)
+
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	return models.LedgerEntryList{
+		Items:  entries,
+		Offset: offset,
+		Total:  total,
+	}, nil
+}
+
+func (front Front) reconcileHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	return front.dbi.Reconcile(ctx)
+}
+
+func (front Front) expireHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	return front.dbi.ExpireAuthorisations(ctx)
+}
+
+func (front Front) getCustomerHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
 
 	ids := request.PathParameters["id"]
 
@@ -222,10 +484,10 @@ func (front Front) getCustomerHandler(request events.APIGatewayProxyRequest) (in
 
 	}
 
-	return front.dbi.GetCustomer(int(id))
+	return front.dbi.GetCustomer(ctx, int(id))
 }
 
-func (front Front) getAuthorisationHandler(request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+func (front Front) getAuthorisationHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
 
 	ids := request.PathParameters["id"]
 
@@ -236,12 +498,37 @@ func (front Front) getAuthorisationHandler(request events.APIGatewayProxyRequest
 
 	}
 
-	return front.dbi.GetAuthorisation(int(id))
+	return front.dbi.GetAuthorisation(ctx, int(id))
+}
+
+func (front Front) clearAuthorisationHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	ids := request.PathParameters["id"]
+
+	id, err := strconv.ParseInt(ids, 0, 0)
+
+	if err != nil {
+		return nil, models.ConstructApiError(400, "ClearAuthorisation: malformed id: %v", ids)
+	}
+
+	cr := models.ClearRequest{}
+
+	// the body is optional
+	if request.Body != "" {
+
+		err = json.Unmarshal([]byte(request.Body), &cr)
+
+		if err != nil {
+			return nil, models.ErrorWrap(err)
+		}
+	}
+
+	return front.dbi.ClearAuthorisation(ctx, int(id), cr.Description)
 }
 
 //left for backwards compatibility: please ignore
 
-func (front Front) calcHandler(request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+func (front Front) calcHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
 
 	var (
 		result float64
@@ -333,3 +620,201 @@ func getFloatFromRequest(request events.APIGatewayProxyRequest, key string) (res
 
 	return
 }
+
+func (front Front) disputeHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	ids := request.PathParameters["id"]
+
+	id, err := strconv.ParseInt(ids, 0, 0)
+
+	if err != nil {
+		return nil, models.ConstructApiError(400, "Dispute: malformed id: %v", ids)
+	}
+
+	dr := models.DisputeRequest{}
+
+	err = json.Unmarshal([]byte(request.Body), &dr)
+
+	if err != nil {
+		return nil, models.ErrorWrap(err)
+	}
+
+	// a request without a status opens a dispute
+	if dr.Status == "" || dr.Status == db.DISPUTE_STATUS_OPEN {
+
+		if dr.Amount < 1 {
+			return nil, models.ConstructApiError(400, "Malformed dispute request: valid amount required")
+		}
+
+		return front.dbi.OpenDispute(ctx, int(id), dr.Amount, dr.Currency, dr.Description)
+	}
+
+	return front.dbi.SetDisputeStatus(ctx, int(id), dr.Status, dr.Description)
+}
+
+func (front Front) settleHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	return front.dbi.SettleVendors(ctx)
+}
+
+func (front Front) getSettlementsHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	ids := request.PathParameters["id"]
+
+	id, err := strconv.ParseInt(ids, 0, 0)
+
+	if err != nil {
+		return nil, models.ConstructApiError(400, "GetSettlements: malformed id: %v", ids)
+	}
+
+	offset, limit, apiErr := getPaginationFromRequest(request, "GetSettlements")
+
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	settlements, total, apiErr := front.dbi.GetSettlements(ctx, int(id), offset, limit)
+
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	return models.SettlementList{
+		Items:  settlements,
+		Offset: offset,
+		Total:  total,
+	}, nil
+}
+
+func (front Front) getVendorFeesHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	ids := request.PathParameters["id"]
+
+	id, err := strconv.ParseInt(ids, 0, 0)
+
+	if err != nil {
+		return nil, models.ConstructApiError(400, "GetVendorFees: malformed id: %v", ids)
+	}
+
+	return front.dbi.GetVendorFees(ctx, int(id))
+}
+
+func (front Front) setVendorFeesHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	ids := request.PathParameters["id"]
+
+	id, err := strconv.ParseInt(ids, 0, 0)
+
+	if err != nil {
+		return nil, models.ConstructApiError(400, "SetVendorFees: malformed id: %v", ids)
+	}
+
+	fees := models.FeeSchedule{}
+
+	err = json.Unmarshal([]byte(request.Body), &fees)
+
+	if err != nil {
+		return nil, models.ErrorWrap(err)
+	}
+
+	return front.dbi.SetVendorFees(ctx, int(id), fees)
+}
+
+func (front Front) setCategoryFeesHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	fees := models.FeeSchedule{}
+
+	err := json.Unmarshal([]byte(request.Body), &fees)
+
+	if err != nil {
+		return nil, models.ErrorWrap(err)
+	}
+
+	return front.dbi.SetCategoryFees(ctx, request.PathParameters["category"], fees)
+}
+
+func (front Front) getCardMccControlsHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	ids := request.PathParameters["id"]
+
+	id, err := strconv.ParseInt(ids, 0, 0)
+
+	if err != nil {
+		return nil, models.ConstructApiError(400, "GetCardMccControls: malformed id: %v", ids)
+	}
+
+	return front.dbi.GetCardMccControls(ctx, int(id))
+}
+
+func (front Front) setCardMccControlsHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	ids := request.PathParameters["id"]
+
+	id, err := strconv.ParseInt(ids, 0, 0)
+
+	if err != nil {
+		return nil, models.ConstructApiError(400, "SetCardMccControls: malformed id: %v", ids)
+	}
+
+	controls := models.MccControls{}
+
+	err = json.Unmarshal([]byte(request.Body), &controls)
+
+	if err != nil {
+		return nil, models.ErrorWrap(err)
+	}
+
+	return front.dbi.SetCardMccControls(ctx, int(id), controls)
+}
+
+func (front Front) addMandateHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	m := models.Mandate{}
+
+	err := json.Unmarshal([]byte(request.Body), &m)
+
+	if err != nil {
+		return nil, models.ErrorWrap(err)
+	}
+
+	return front.dbi.AddOrUpdateMandate(ctx, m)
+}
+
+func (front Front) getMandateHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	ids := request.PathParameters["id"]
+
+	id, err := strconv.ParseInt(ids, 0, 0)
+
+	if err != nil {
+		return nil, models.ConstructApiError(400, "GetMandate: malformed id: %v", ids)
+	}
+
+	return front.dbi.GetMandate(ctx, int(id))
+}
+
+func (front Front) setMandateStatusHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	ids := request.PathParameters["id"]
+
+	id, err := strconv.ParseInt(ids, 0, 0)
+
+	if err != nil {
+		return nil, models.ConstructApiError(400, "SetMandateStatus: malformed id: %v", ids)
+	}
+
+	sr := models.MandateStatusRequest{}
+
+	err = json.Unmarshal([]byte(request.Body), &sr)
+
+	if err != nil {
+		return nil, models.ErrorWrap(err)
+	}
+
+	return front.dbi.SetMandateStatus(ctx, int(id), sr.Status)
+}
+
+func (front Front) runMandatesHandler(ctx context.Context, request events.APIGatewayProxyRequest) (interface{}, models.ApiError) {
+
+	return front.dbi.RunMandates(ctx)
+}
@@ -1,6 +1,7 @@
 package front
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
@@ -9,6 +10,7 @@ import (
 	"github.com/golang/mock/gomock"
 	. "github.com/smartystreets/goconvey/convey"
 
+	"github.com/merlincox/cardapi/db"
 	"github.com/merlincox/cardapi/mocks"
 	"github.com/merlincox/cardapi/models"
 	"github.com/merlincox/cardapi/utils"
@@ -52,7 +54,7 @@ func TestStatusRoute(t *testing.T) {
 		}
 
 		Convey("Then it should return the status", func() {
-			response, err := testFront.Handler(request)
+			response, err := testFront.Handler(context.Background(), request)
 			So(response.Body, ShouldEqual, utils.JsonStringify(expected))
 			So(response.Headers["Access-Control-Allow-Origin"], ShouldEqual, "*")
 			So(response.Headers["Cache-Control"], ShouldEqual, "max-age=123")
@@ -94,7 +96,7 @@ func testCalc(t *testing.T, val1, val2 float64, locale, result, op, fullop strin
 		}
 
 		Convey("Then it should return the correct result", func() {
-			response, err := testFront.Handler(request)
+			response, err := testFront.Handler(context.Background(), request)
 
 			// Do not differentiate non-breaking spaces from ordinary spaces for testing purposes
 			body := strings.Replace(response.Body, "\u00A0", " ", -1)
@@ -142,7 +144,7 @@ func TestCalcRouteRootEn(t *testing.T) {
 	testCalc(t, 16, 2, "en-GB", "4", "roo", "root")
 }
 
-func testCalcRouteBad(t *testing.T, val1, val2 float64, op, context, msg string) {
+func testCalcRouteBad(t *testing.T, val1, val2 float64, op, scenario, msg string) {
 
 	testFront := makeFront(t)
 
@@ -151,7 +153,7 @@ func testCalcRouteBad(t *testing.T, val1, val2 float64, op, context, msg string)
 		Code:    400,
 	}
 
-	Convey(context, t, func() {
+	Convey(scenario, t, func() {
 
 		request := events.APIGatewayProxyRequest{
 			QueryStringParameters: map[string]string{
@@ -171,7 +173,7 @@ func testCalcRouteBad(t *testing.T, val1, val2 float64, op, context, msg string)
 		}
 
 		Convey("Then it should return the correct error", func() {
-			response, err := testFront.Handler(request)
+			response, err := testFront.Handler(context.Background(), request)
 			So(response.Body, ShouldEqual, utils.JsonStringify(expected))
 			So(response.Headers["Access-Control-Allow-Origin"], ShouldEqual, "*")
 			So(response.Headers["Cache-Control"], ShouldEqual, "max-age=123")
@@ -239,9 +241,9 @@ func TestCustomersRoute(t *testing.T) {
 		Total:  len(cs),
 	}
 
-	mockDbi.EXPECT().GetCustomers().Return(cs, nil).Times(1)
+	mockDbi.EXPECT().GetCustomers(gomock.Any(), 0, DEFAULT_PAGE_LIMIT).Return(cs, len(cs), nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
 	utils.AssertEquals(t, "Data from GetCustomers", response.Body, utils.JsonStringify(expected))
 	utils.AssertEquals(t, "Http code from GetCustomers", response.StatusCode, 200)
@@ -277,9 +279,9 @@ func TestGetCustomerRoute(t *testing.T) {
 		Id:       1001,
 	}
 
-	mockDbi.EXPECT().GetCustomer(1001).Return(expected, nil).Times(1)
+	mockDbi.EXPECT().GetCustomer(gomock.Any(), 1001).Return(expected, nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
 	utils.AssertEquals(t, "Data from GetCustomer", utils.JsonStringify(expected), response.Body)
 	utils.AssertEquals(t, "Http code from GetCustomer", 200, response.StatusCode)
@@ -312,9 +314,9 @@ func TestGetCustomerRoute404(t *testing.T) {
 
 	expected := models.ConstructApiError(404, "GetCustomer: no customer with id: 1001")
 
-	mockDbi.EXPECT().GetCustomer(1001).Return(models.Customer{}, expected).Times(1)
+	mockDbi.EXPECT().GetCustomer(gomock.Any(), 1001).Return(models.Customer{}, expected).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
 	utils.AssertEquals(t, "Data from GetCustomer with invalid id", utils.JsonStringify(expected.ErrorBody()), response.Body)
 	utils.AssertEquals(t, "Http code from GetCustomer with invalid id", 404, response.StatusCode)
@@ -347,7 +349,7 @@ func TestGetCustomerRouteMalformedId(t *testing.T) {
 
 	expected := models.ConstructApiError(400, "GetCustomer: malformed id: badid")
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
 	utils.AssertEquals(t, "Data from GetCustomer", utils.JsonStringify(expected.ErrorBody()), response.Body)
 	utils.AssertEquals(t, "Http code from GetCustomer", 400, response.StatusCode)
@@ -385,9 +387,9 @@ func TestAddOrUpdateCustomerRouteAdd(t *testing.T) {
 		Body: utils.JsonStringify(body),
 	}
 
-	mockDbi.EXPECT().AddOrUpdateCustomer(body).Return(expected, nil).Times(1)
+	mockDbi.EXPECT().AddOrUpdateCustomer(gomock.Any(), body).Return(expected, nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
 	utils.AssertEquals(t, "Data from AddOrUpdateCustomer", utils.JsonStringify(expected), response.Body)
 	utils.AssertEquals(t, "Http code from GetCustomer", 200, response.StatusCode)
@@ -435,15 +437,15 @@ func TestVendorsRoute(t *testing.T) {
 		Total:  len(cs),
 	}
 
-	mockDbi.EXPECT().GetVendors().Return(cs, nil).Times(1)
+	mockDbi.EXPECT().GetVendors(gomock.Any(), 0, DEFAULT_PAGE_LIMIT).Return(cs, len(cs), nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
 	utils.AssertEquals(t, "Data from GetVendors", response.Body, utils.JsonStringify(expected))
 	utils.AssertEquals(t, "Http code from GetVendors", response.StatusCode, 200)
 }
 
-func TestGetVendorRoute(t *testing.T) {
+func TestVendorsRoutePaginated(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -459,199 +461,244 @@ func TestGetVendorRoute(t *testing.T) {
 	}, 123)
 
 	request := events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{
+			"offset": "20",
+			"limit":  "10",
+		},
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/vendor/{id}`,
+			ResourcePath: `/vendors`,
 			HTTPMethod:   `GET`,
 		},
-		PathParameters: map[string]string{
-			"id": "1001",
+	}
+
+	cs := []models.Vendor{
+		{
+			VendorName: "Pub",
+			Id:         1021,
 		},
 	}
 
-	expected := models.Vendor{
-		VendorName: "Coffee shop",
-		Id:         1001,
+	expected := models.VendorList{
+		Items:  cs,
+		Offset: 20,
+		Total:  21,
 	}
 
-	mockDbi.EXPECT().GetVendor(1001).Return(expected, nil).Times(1)
+	mockDbi.EXPECT().GetVendors(gomock.Any(), 20, 10).Return(cs, 21, nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from GetVendor", utils.JsonStringify(expected), response.Body)
-	utils.AssertEquals(t, "Http code from GetVendor", 200, response.StatusCode)
+	utils.AssertEquals(t, "Data from GetVendors with offset and limit", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetVendors with offset and limit", 200, response.StatusCode)
 }
 
-func TestGetVendorRoute404(t *testing.T) {
+func testListRouteBadPagination(t *testing.T, resourcePath, offset, limit, msg string) {
+
+	testFront := makeFront(t)
+
+	request := events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{
+			"offset": offset,
+			"limit":  limit,
+		},
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: resourcePath,
+			HTTPMethod:   `GET`,
+		},
+	}
+
+	expected := models.ConstructApiError(400, msg)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from "+resourcePath+" with bad pagination", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from "+resourcePath+" with bad pagination", 400, response.StatusCode)
+}
+
+func TestVendorsRouteBadOffset(t *testing.T) {
+	testListRouteBadPagination(t, "/vendors", "-1", "10", "GetVendors: malformed offset: -1")
+}
+
+func TestVendorsRouteBadLimit(t *testing.T) {
+	testListRouteBadPagination(t, "/vendors", "0", "0", "GetVendors: malformed limit: 0 (must be between 1 and 1000)")
+}
+
+func TestCustomersRouteBadOffset(t *testing.T) {
+	testListRouteBadPagination(t, "/customers", "first", "10", "GetCustomers: malformed offset: first")
+}
+
+func TestCustomersRouteBadLimit(t *testing.T) {
+	testListRouteBadPagination(t, "/customers", "0", "1001", "GetCustomers: malformed limit: 1001 (must be between 1 and 1000)")
+}
+
+func TestLedgerEntriesRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
 	request := events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{
+			"offset": "10",
+		},
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/vendor/{id}`,
+			ResourcePath: `/ledger/entries`,
 			HTTPMethod:   `GET`,
 		},
-		PathParameters: map[string]string{
-			"id": "1001",
+	}
+
+	es := []models.LedgerEntry{
+		{
+			Id:          1011,
+			EntryType:   "TOP-UP",
+			Description: "Transfer from Bank",
+			Reference:   1005,
+			Ts:          "2019-01-24 01:00:10",
+			Postings: []models.LedgerPosting{
+				{Id: 1021, EntryId: 1011, Account: "funding", Amount: -2000},
+				{Id: 1022, EntryId: 1011, Account: "card-available:100001", Amount: 2000},
+			},
 		},
 	}
 
-	expected := models.ConstructApiError(404, "GetVendor: no vendor with id: 1001")
+	expected := models.LedgerEntryList{
+		Items:  es,
+		Offset: 10,
+		Total:  11,
+	}
 
-	mockDbi.EXPECT().GetVendor(1001).Return(models.Vendor{}, expected).Times(1)
+	mockDbi.EXPECT().GetLedgerEntries(gomock.Any(), 10, DEFAULT_PAGE_LIMIT).Return(es, 11, nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from GetVendor with invalid id", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from GetVendor with invalid id", 404, response.StatusCode)
+	utils.AssertEquals(t, "Data from GetLedgerEntries", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetLedgerEntries", 200, response.StatusCode)
 }
 
-func TestGetVendorRouteMalformedId(t *testing.T) {
+func TestLedgerEntriesRouteBadLimit(t *testing.T) {
+	testListRouteBadPagination(t, "/ledger/entries", "0", "x", "GetLedgerEntries: malformed limit: x (must be between 1 and 1000)")
+}
+
+func TestReconcileRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/vendor/{id}`,
+			ResourcePath: `/admin/reconcile`,
 			HTTPMethod:   `GET`,
 		},
-		PathParameters: map[string]string{
-			"id": "badid",
+	}
+
+	expected := models.ReconciliationReport{
+		CardsChecked:          1,
+		AuthorisationsChecked: 1,
+		VendorsChecked:        1,
+		Breaks: []models.ReconciliationBreak{
+			{
+				Check:       "card-balance-movements",
+				ObjectType:  "card",
+				Id:          100001,
+				Expected:    900,
+				Actual:      1000,
+				Description: "card 100001: balance 1000 does not equal the sum of its movements 900",
+			},
 		},
 	}
 
-	expected := models.ConstructApiError(400, "GetVendor: malformed id: badid")
+	mockDbi.EXPECT().Reconcile(gomock.Any()).Return(expected, nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from GetVendor", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from GetVendor", 400, response.StatusCode)
+	utils.AssertEquals(t, "Data from Reconcile", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from Reconcile", 200, response.StatusCode)
 }
 
-func TestAddOrUpdateVendorRoute(t *testing.T) {
+func TestExpireRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
-
-	body := models.Vendor{
-		VendorName: "Coffee shop",
-	}
-
-	expected := models.Vendor{
-		VendorName: "Coffee shop",
-		Id:         1001,
-	}
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/vendor`,
+			ResourcePath: `/admin/expire`,
 			HTTPMethod:   `POST`,
 		},
-		Body: utils.JsonStringify(body),
 	}
 
-	mockDbi.EXPECT().AddOrUpdateVendor(body).Return(expected, nil).Times(1)
+	expected := models.ExpiryReport{
+		AuthorisationsExpired: 2,
+		AmountReleased:        450,
+		Codes:                 []int{1011, 1012},
+	}
 
-	response, _ := testFront.Handler(request)
+	mockDbi.EXPECT().ExpireAuthorisations(gomock.Any()).Return(expected, nil).Times(1)
 
-	utils.AssertEquals(t, "Data from AddOrUpdateVendor", utils.JsonStringify(expected), response.Body)
-	utils.AssertEquals(t, "Http code from GetVendor", 200, response.StatusCode)
-}
+	response, _ := testFront.Handler(context.Background(), request)
 
-// authorisation
+	utils.AssertEquals(t, "Data from ExpireAuthorisations", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from ExpireAuthorisations", 200, response.StatusCode)
+	utils.AssertEquals(t, "Cache-Control from ExpireAuthorisations", "no-cache", response.Headers["Cache-Control"])
+}
 
-func TestGetAuthorisationRoute(t *testing.T) {
+func TestSettleRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/authorisation/{id}`,
-			HTTPMethod:   `GET`,
-		},
-		PathParameters: map[string]string{
-			"id": "1001",
+			ResourcePath: `/admin/settle`,
+			HTTPMethod:   `POST`,
 		},
 	}
 
-	expected := models.Authorisation{
-		CardId:      100001,
-		Id:          1001,
-		Captured:    0,
-		Refunded:    0,
-		Reversed:    0,
-		Amount:      210,
-		Description: "Cake",
+	expected := models.SettlementReport{
+		Settlements: []models.Settlement{
+			{Id: 1005, VendorId: 1001, Captured: 2600, Refunded: 100, Fees: 58, Net: 2442, Currency: "GBP", Ts: "2019-01-24 01:00:10"},
+		},
 	}
 
-	mockDbi.EXPECT().GetAuthorisation(1001).Return(expected, nil).Times(1)
+	mockDbi.EXPECT().SettleVendors(gomock.Any()).Return(expected, nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from GetAuthorisation", utils.JsonStringify(expected), response.Body)
-	utils.AssertEquals(t, "Http code from GetAuthorisation", 200, response.StatusCode)
+	utils.AssertEquals(t, "Data from SettleVendors", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from SettleVendors", 200, response.StatusCode)
+	utils.AssertEquals(t, "Cache-Control from SettleVendors", "no-cache", response.Headers["Cache-Control"])
 }
 
-func TestGetAuthorisationRoute404(t *testing.T) {
+func TestGetSettlementsRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
 	request := events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{
+			"limit": "10",
+		},
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/authorisation/{id}`,
+			ResourcePath: `/vendor/{id}/settlements`,
 			HTTPMethod:   `GET`,
 		},
 		PathParameters: map[string]string{
@@ -659,315 +706,260 @@ func TestGetAuthorisationRoute404(t *testing.T) {
 		},
 	}
 
-	expected := models.ConstructApiError(404, "GetAuthorisation: no authorisation with id: 1001")
+	ss := []models.Settlement{
+		{Id: 1005, VendorId: 1001, Captured: 2600, Refunded: 100, Fees: 58, Net: 2442, Currency: "GBP", Ts: "2019-01-24 01:00:10"},
+	}
 
-	mockDbi.EXPECT().GetAuthorisation(1001).Return(models.Authorisation{}, expected).Times(1)
+	expected := models.SettlementList{
+		Items:  ss,
+		Offset: 0,
+		Total:  1,
+	}
 
-	response, _ := testFront.Handler(request)
+	mockDbi.EXPECT().GetSettlements(gomock.Any(), 1001, 0, 10).Return(ss, 1, nil).Times(1)
 
-	utils.AssertEquals(t, "Data from GetAuthorisation with invalid id", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from GetAuthorisation with invalid id", 404, response.StatusCode)
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from GetSettlements", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetSettlements", 200, response.StatusCode)
 }
 
-func TestGetAuthorisationRouteMalformedId(t *testing.T) {
+func TestGetSettlementsRouteBadId(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/authorisation/{id}`,
+			ResourcePath: `/vendor/{id}/settlements`,
 			HTTPMethod:   `GET`,
 		},
 		PathParameters: map[string]string{
-			"id": "badid",
+			"id": "abc",
 		},
 	}
 
-	expected := models.ConstructApiError(400, "GetAuthorisation: malformed id: badid")
+	expected := models.ConstructApiError(400, "GetSettlements: malformed id: abc")
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from GetAuthorisation", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from GetAuthorisation", 400, response.StatusCode)
+	utils.AssertEquals(t, "Data from GetSettlements", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from GetSettlements", 400, response.StatusCode)
 }
 
-// card
-
-func TestGetCardRoute(t *testing.T) {
+func TestGetVendorFeesRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/card/{id}`,
+			ResourcePath: `/vendor/{id}/fees`,
 			HTTPMethod:   `GET`,
 		},
 		PathParameters: map[string]string{
-			"id": "100001",
+			"id": "1001",
 		},
 	}
 
-	expected := models.Card{
-		Id: 100001,
+	expected := models.FeeSchedule{
+		BasisPoints: 150,
+		Fixed:       20,
 	}
 
-	mockDbi.EXPECT().GetCard(100001).Return(expected, nil).Times(1)
+	mockDbi.EXPECT().GetVendorFees(gomock.Any(), 1001).Return(expected, nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from GetCard", utils.JsonStringify(expected), response.Body)
-	utils.AssertEquals(t, "Http code from GetCard", 200, response.StatusCode)
+	utils.AssertEquals(t, "Data from GetVendorFees", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetVendorFees", 200, response.StatusCode)
 }
 
-func TestGetCardRoute404(t *testing.T) {
+func TestSetVendorFeesRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	body := models.FeeSchedule{
+		BasisPoints: 150,
+		Fixed:       20,
+	}
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/card/{id}`,
-			HTTPMethod:   `GET`,
+			ResourcePath: `/vendor/{id}/fees`,
+			HTTPMethod:   `POST`,
 		},
 		PathParameters: map[string]string{
 			"id": "1001",
 		},
+		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.ConstructApiError(404, "GetCard: no card with id: 1001")
-
-	mockDbi.EXPECT().GetCard(1001).Return(models.Card{}, expected).Times(1)
+	mockDbi.EXPECT().SetVendorFees(gomock.Any(), 1001, body).Return(body, nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from GetCard with invalid id", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from GetCard with invalid id", 404, response.StatusCode)
+	utils.AssertEquals(t, "Data from SetVendorFees", utils.JsonStringify(body), response.Body)
+	utils.AssertEquals(t, "Http code from SetVendorFees", 200, response.StatusCode)
 }
 
-func TestGetCardRouteMalformedId(t *testing.T) {
-
-	mockCtrl := gomock.NewController(t)
-	defer mockCtrl.Finish()
-
-	mockDbi := mocks.NewMockDbi(mockCtrl)
+func TestSetVendorFeesRouteBadId(t *testing.T) {
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
+	testFront := makeFront(t)
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/card/{id}`,
-			HTTPMethod:   `GET`,
+			ResourcePath: `/vendor/{id}/fees`,
+			HTTPMethod:   `POST`,
 		},
 		PathParameters: map[string]string{
-			"id": "badid",
+			"id": "abc",
 		},
+		Body: "{}",
 	}
 
-	expected := models.ConstructApiError(400, "GetCard: malformed id: badid")
+	expected := models.ConstructApiError(400, "SetVendorFees: malformed id: abc")
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from GetCard", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from GetCard", 400, response.StatusCode)
+	utils.AssertEquals(t, "Data from SetVendorFees", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from SetVendorFees", 400, response.StatusCode)
 }
 
-func TestAddCardRoute(t *testing.T) {
+func TestSetCategoryFeesRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
-
-	body := models.Customer{
-		Fullname: "Fred Bloggs",
-		Id:       1001,
-	}
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
-	expected := models.Card{
-		Id:         100001,
-		CustomerId: 1001,
-		Balance:    0,
-		Available:  0,
+	body := models.FeeSchedule{
+		BasisPoints: 100,
 	}
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/card`,
+			ResourcePath: `/category/{category}/fees`,
 			HTTPMethod:   `POST`,
 		},
+		PathParameters: map[string]string{
+			"category": "cafe",
+		},
 		Body: utils.JsonStringify(body),
 	}
 
-	mockDbi.EXPECT().AddCard(body.Id).Return(expected, nil).Times(1)
+	mockDbi.EXPECT().SetCategoryFees(gomock.Any(), "cafe", body).Return(body, nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from AddCard", utils.JsonStringify(expected), response.Body)
-	utils.AssertEquals(t, "Http code from GetCard", 200, response.StatusCode)
+	utils.AssertEquals(t, "Data from SetCategoryFees", utils.JsonStringify(body), response.Body)
+	utils.AssertEquals(t, "Http code from SetCategoryFees", 200, response.StatusCode)
 }
 
-// code requests
-
-func TestTopUpRoute(t *testing.T) {
+func TestGetCardMccControlsRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
-
-	body := models.CodeRequest{
-		Amount:      20000,
-		CardId:      100001,
-		Description: "Top-up from bank",
-	}
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/top-up`,
-			HTTPMethod:   `POST`,
+			ResourcePath: `/card/{id}/mcc-controls`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "100001",
 		},
-		Body: utils.JsonStringify(body),
-	}
-
-	expected := models.CodeResponse{
-		Id: 10009,
 	}
 
-	mockDbi.EXPECT().TopUp(body.CardId, body.Amount, body.Description).Return(expected.Id, nil).Times(1)
+	expected := models.MccControls{
+		Allowed: []string{},
+		Blocked: []string{"7995"},
+	}
 
-	response, _ := testFront.Handler(request)
+	mockDbi.EXPECT().GetCardMccControls(gomock.Any(), 100001).Return(expected, nil).Times(1)
 
-	utils.AssertEquals(t, "Data from TopUp", utils.JsonStringify(expected), response.Body)
-	utils.AssertEquals(t, "Http code from TopUp", 200, response.StatusCode)
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from GetCardMccControls", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetCardMccControls", 200, response.StatusCode)
 }
 
-func TestTopUpRouteBad1(t *testing.T) {
+func TestSetCardMccControlsRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
-	body := models.CodeRequest{
-		Amount:      20000,
-		Description: "Top-up from bank",
+	body := models.MccControls{
+		Allowed: []string{"5812", "5814"},
+		Blocked: []string{},
 	}
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/top-up`,
+			ResourcePath: `/card/{id}/mcc-controls`,
 			HTTPMethod:   `POST`,
 		},
+		PathParameters: map[string]string{
+			"id": "100001",
+		},
 		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.ConstructApiError(400, "Malformed top-up request: valid cardId, amount, description required")
+	mockDbi.EXPECT().SetCardMccControls(gomock.Any(), 100001, body).Return(body, nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from TopUp with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from TopUp with incomplete code request data", 400, response.StatusCode)
+	utils.AssertEquals(t, "Data from SetCardMccControls", utils.JsonStringify(body), response.Body)
+	utils.AssertEquals(t, "Http code from SetCardMccControls", 200, response.StatusCode)
 }
 
-func TestTopUpRouteBad2(t *testing.T) {
-
-	mockCtrl := gomock.NewController(t)
-	defer mockCtrl.Finish()
-
-	mockDbi := mocks.NewMockDbi(mockCtrl)
-
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
+func TestSetCardMccControlsRouteBadId(t *testing.T) {
 
-	body := models.CodeRequest{
-		CardId:      10001,
-		Description: "Top-up from bank",
-	}
+	testFront := makeFront(t)
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/top-up`,
+			ResourcePath: `/card/{id}/mcc-controls`,
 			HTTPMethod:   `POST`,
 		},
-		Body: utils.JsonStringify(body),
+		PathParameters: map[string]string{
+			"id": "abc",
+		},
+		Body: "{}",
 	}
 
-	expected := models.ConstructApiError(400, "Malformed top-up request: valid cardId, amount, description required")
+	expected := models.ConstructApiError(400, "SetCardMccControls: malformed id: abc")
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from TopUp with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from TopUp with incomplete code request data", 400, response.StatusCode)
+	utils.AssertEquals(t, "Data from SetCardMccControls", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from SetCardMccControls", 400, response.StatusCode)
 }
 
-func TestTopUpRouteBad3(t *testing.T) {
+func TestGetVendorRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -982,28 +974,30 @@ func TestTopUpRouteBad3(t *testing.T) {
 		Timestamp: "2019-01-02T14:52:36.951375973Z",
 	}, 123)
 
-	body := models.CodeRequest{
-		CardId: 10001,
-		Amount: 20000,
-	}
-
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/top-up`,
-			HTTPMethod:   `POST`,
+			ResourcePath: `/vendor/{id}`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "1001",
 		},
-		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.ConstructApiError(400, "Malformed top-up request: valid cardId, amount, description required")
+	expected := models.Vendor{
+		VendorName: "Coffee shop",
+		Id:         1001,
+	}
 
-	response, _ := testFront.Handler(request)
+	mockDbi.EXPECT().GetVendor(gomock.Any(), 1001).Return(expected, nil).Times(1)
 
-	utils.AssertEquals(t, "Data from TopUp with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from TopUp with incomplete code request data", 400, response.StatusCode)
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from GetVendor", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetVendor", 200, response.StatusCode)
 }
 
-func TestAuthoriseRoute(t *testing.T) {
+func TestGetVendorRoute404(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -1018,34 +1012,27 @@ func TestAuthoriseRoute(t *testing.T) {
 		Timestamp: "2019-01-02T14:52:36.951375973Z",
 	}, 123)
 
-	body := models.CodeRequest{
-		Amount:      200,
-		CardId:      100001,
-		VendorId:    1001,
-		Description: "Coffee",
-	}
-
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/authorise`,
-			HTTPMethod:   `POST`,
+			ResourcePath: `/vendor/{id}`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "1001",
 		},
-		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.CodeResponse{
-		Id: 10009,
-	}
+	expected := models.ConstructApiError(404, "GetVendor: no vendor with id: 1001")
 
-	mockDbi.EXPECT().Authorise(body.CardId, body.VendorId, body.Amount, body.Description).Return(expected.Id, nil).Times(1)
+	mockDbi.EXPECT().GetVendor(gomock.Any(), 1001).Return(models.Vendor{}, expected).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from Authorise", utils.JsonStringify(expected), response.Body)
-	utils.AssertEquals(t, "Http code from Authorise", 200, response.StatusCode)
+	utils.AssertEquals(t, "Data from GetVendor with invalid id", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from GetVendor with invalid id", 404, response.StatusCode)
 }
 
-func TestAuthoriseRouteBad1(t *testing.T) {
+func TestGetVendorRouteMalformedId(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -1060,29 +1047,25 @@ func TestAuthoriseRouteBad1(t *testing.T) {
 		Timestamp: "2019-01-02T14:52:36.951375973Z",
 	}, 123)
 
-	body := models.CodeRequest{
-		Amount:      200,
-		VendorId:    1002,
-		Description: "Cake",
-	}
-
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/authorise`,
-			HTTPMethod:   `POST`,
+			ResourcePath: `/vendor/{id}`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "badid",
 		},
-		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.ConstructApiError(400, "Malformed authorisation request: valid vendorId, cardId, amount, description required")
+	expected := models.ConstructApiError(400, "GetVendor: malformed id: badid")
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from Authorise with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from Authorise with incomplete code request data", 400, response.StatusCode)
+	utils.AssertEquals(t, "Data from GetVendor", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from GetVendor", 400, response.StatusCode)
 }
 
-func TestAuthoriseRouteBad2(t *testing.T) {
+func TestAddOrUpdateVendorRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -1097,29 +1080,34 @@ func TestAuthoriseRouteBad2(t *testing.T) {
 		Timestamp: "2019-01-02T14:52:36.951375973Z",
 	}, 123)
 
-	body := models.CodeRequest{
-		Amount:      200,
-		CardId:      100001,
-		Description: "Cake",
+	body := models.Vendor{
+		VendorName: "Coffee shop",
+	}
+
+	expected := models.Vendor{
+		VendorName: "Coffee shop",
+		Id:         1001,
 	}
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/authorise`,
+			ResourcePath: `/vendor`,
 			HTTPMethod:   `POST`,
 		},
 		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.ConstructApiError(400, "Malformed authorisation request: valid vendorId, cardId, amount, description required")
+	mockDbi.EXPECT().AddOrUpdateVendor(gomock.Any(), body).Return(expected, nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from Authorise with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from Authorise with incomplete code request data", 400, response.StatusCode)
+	utils.AssertEquals(t, "Data from AddOrUpdateVendor", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetVendor", 200, response.StatusCode)
 }
 
-func TestAuthoriseRouteBad3(t *testing.T) {
+// authorisation
+
+func TestGetAuthorisationRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -1134,29 +1122,35 @@ func TestAuthoriseRouteBad3(t *testing.T) {
 		Timestamp: "2019-01-02T14:52:36.951375973Z",
 	}, 123)
 
-	body := models.CodeRequest{
-		VendorId:    1002,
-		CardId:      100001,
-		Description: "Cake",
-	}
-
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/authorise`,
-			HTTPMethod:   `POST`,
+			ResourcePath: `/authorisation/{id}`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "1001",
 		},
-		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.ConstructApiError(400, "Malformed authorisation request: valid vendorId, cardId, amount, description required")
+	expected := models.Authorisation{
+		CardId:      100001,
+		Id:          1001,
+		Captured:    0,
+		Refunded:    0,
+		Reversed:    0,
+		Amount:      210,
+		Description: "Cake",
+	}
 
-	response, _ := testFront.Handler(request)
+	mockDbi.EXPECT().GetAuthorisation(gomock.Any(), 1001).Return(expected, nil).Times(1)
 
-	utils.AssertEquals(t, "Data from Authorise with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from Authorise with incomplete code request data", 400, response.StatusCode)
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from GetAuthorisation", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetAuthorisation", 200, response.StatusCode)
 }
 
-func TestAuthoriseRouteBad4(t *testing.T) {
+func TestGetAuthorisationRoute404(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -1171,29 +1165,27 @@ func TestAuthoriseRouteBad4(t *testing.T) {
 		Timestamp: "2019-01-02T14:52:36.951375973Z",
 	}, 123)
 
-	body := models.CodeRequest{
-		Amount:   200,
-		VendorId: 1002,
-		CardId:   100001,
-	}
-
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/authorise`,
-			HTTPMethod:   `POST`,
+			ResourcePath: `/authorisation/{id}`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "1001",
 		},
-		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.ConstructApiError(400, "Malformed authorisation request: valid vendorId, cardId, amount, description required")
+	expected := models.ConstructApiError(404, "GetAuthorisation: no authorisation with id: 1001")
 
-	response, _ := testFront.Handler(request)
+	mockDbi.EXPECT().GetAuthorisation(gomock.Any(), 1001).Return(models.Authorisation{}, expected).Times(1)
 
-	utils.AssertEquals(t, "Data from Authorise with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from Authorise with incomplete code request data", 400, response.StatusCode)
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from GetAuthorisation with invalid id", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from GetAuthorisation with invalid id", 404, response.StatusCode)
 }
 
-func TestCaptureRoute(t *testing.T) {
+func TestGetAuthorisationRouteMalformedId(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -1208,32 +1200,27 @@ func TestCaptureRoute(t *testing.T) {
 		Timestamp: "2019-01-02T14:52:36.951375973Z",
 	}, 123)
 
-	body := models.CodeRequest{
-		Amount:          200,
-		AuthorisationId: 1001,
-	}
-
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/capture`,
-			HTTPMethod:   `POST`,
+			ResourcePath: `/authorisation/{id}`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "badid",
 		},
-		Body: utils.JsonStringify(body),
-	}
-
-	expected := models.CodeResponse{
-		Id: 10009,
 	}
 
-	mockDbi.EXPECT().Capture(body.AuthorisationId, body.Amount).Return(expected.Id, nil).Times(1)
+	expected := models.ConstructApiError(400, "GetAuthorisation: malformed id: badid")
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from Capture", utils.JsonStringify(expected), response.Body)
-	utils.AssertEquals(t, "Http code from Capture", 200, response.StatusCode)
+	utils.AssertEquals(t, "Data from GetAuthorisation", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from GetAuthorisation", 400, response.StatusCode)
 }
 
-func TestCaptureRouteBad1(t *testing.T) {
+// card
+
+func TestGetCardRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -1248,103 +1235,184 @@ func TestCaptureRouteBad1(t *testing.T) {
 		Timestamp: "2019-01-02T14:52:36.951375973Z",
 	}, 123)
 
-	body := models.CodeRequest{
-		Amount: 20000,
-	}
-
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/capture`,
-			HTTPMethod:   `POST`,
+			ResourcePath: `/card/{id}`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "100001",
 		},
-		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.ConstructApiError(400, "Malformed capture request: valid authorisationId, amount required")
+	expected := models.Card{
+		Id: 100001,
+	}
 
-	response, _ := testFront.Handler(request)
+	mockDbi.EXPECT().GetCard(gomock.Any(), 100001).Return(expected, nil).Times(1)
 
-	utils.AssertEquals(t, "Data from Capture with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from Capture with incomplete code request data", 400, response.StatusCode)
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from GetCard", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetCard", 200, response.StatusCode)
 }
 
-func TestCaptureRouteBad2(t *testing.T) {
+func TestGetCardRouteReadYourWrites(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
-	body := models.CodeRequest{
-		AuthorisationId: 1002,
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/card/{id}`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "100001",
+		},
+		Headers: map[string]string{
+			"x-read-your-writes": "true",
+		},
+	}
+
+	expected := models.Card{
+		Id: 100001,
 	}
 
+	mockDbi.EXPECT().GetCard(gomock.Any(), 100001).DoAndReturn(func(ctx context.Context, id int) (models.Card, models.ApiError) {
+
+		utils.AssertTrue(t, "Reads pinned to the primary for GetCard", db.ReadYourWrites(ctx))
+
+		return expected, nil
+
+	}).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from GetCard", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetCard", 200, response.StatusCode)
+	utils.AssertEquals(t, "Cache-Control from GetCard", "no-cache", response.Headers["Cache-Control"])
+}
+
+func TestGetCardRouteDisplay(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/capture`,
-			HTTPMethod:   `POST`,
+			ResourcePath: `/card/{id}`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "100001",
+		},
+		QueryStringParameters: map[string]string{
+			"format": "display",
+		},
+		Headers: map[string]string{
+			"Accept-Language": "de-DE,de;q=0.9,en;q=0.8",
 		},
-		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.ConstructApiError(400, "Malformed capture request: valid authorisationId, amount required")
+	card := models.Card{
+		Id:        100001,
+		Balance:   123450,
+		Available: 100000,
+		Currency:  "GBP",
+	}
 
-	response, _ := testFront.Handler(request)
+	mockDbi.EXPECT().GetCard(gomock.Any(), 100001).Return(card, nil).Times(1)
 
-	utils.AssertEquals(t, "Data from Capture with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from Capture with incomplete code request data", 400, response.StatusCode)
+	response, _ := testFront.Handler(context.Background(), request)
+
+	expected := card
+	expected.Display = map[string]string{
+		"balance":   "1.234,50\u00a0£",
+		"available": "1.000,00\u00a0£",
+	}
+
+	utils.AssertEquals(t, "Data from GetCard for display in German", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetCard for display in German", 200, response.StatusCode)
+	utils.AssertEquals(t, "Vary from GetCard", "Accept-Language", response.Headers["Vary"])
 }
 
-func TestRefundRoute(t *testing.T) {
+func TestGetCardRouteUnknownFormat(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
-	body := models.CodeRequest{
-		Amount:          200,
-		AuthorisationId: 1001,
-		Description:     "Bad coffee",
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/card/{id}`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "100001",
+		},
+		QueryStringParameters: map[string]string{
+			"format": "pretty",
+		},
 	}
 
+	response, _ := testFront.Handler(context.Background(), request)
+
+	expected := models.ConstructApiError(400, "Unknown format: pretty (must be display)")
+
+	utils.AssertEquals(t, "Data from GetCard with an unknown format", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from GetCard with an unknown format", 400, response.StatusCode)
+}
+
+func TestGetCardRouteLocalizedError(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/refund`,
-			HTTPMethod:   `POST`,
+			ResourcePath: `/card/{id}`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "100001",
+		},
+		Headers: map[string]string{
+			"accept-language": "fr",
 		},
-		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.CodeResponse{
-		Id: 10009,
-	}
+	apiErr := models.ConstructApiError(400, "%v: insufficient funds for amount %v", "GetCard", models.Money{Amount: 123450, Currency: "EUR"})
 
-	mockDbi.EXPECT().Refund(body.AuthorisationId, body.Amount, body.Description).Return(expected.Id, nil).Times(1)
+	mockDbi.EXPECT().GetCard(gomock.Any(), 100001).Return(models.Card{}, apiErr).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from Refund", utils.JsonStringify(expected), response.Body)
-	utils.AssertEquals(t, "Http code from Refund", 200, response.StatusCode)
+	expected := models.ApiErrorBody{
+		Message: "GetCard: insufficient funds for amount 1\u00a0234,50\u00a0€",
+		Code:    400,
+	}
+
+	utils.AssertEquals(t, "Data from GetCard with an error in French", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetCard with an error in French", 400, response.StatusCode)
 }
 
-func TestRefundRouteBad1(t *testing.T) {
+func TestGetCardRoute404(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -1359,28 +1427,27 @@ func TestRefundRouteBad1(t *testing.T) {
 		Timestamp: "2019-01-02T14:52:36.951375973Z",
 	}, 123)
 
-	body := models.CodeRequest{
-		AuthorisationId: 1001,
-		Description:     "Bad coffee",
-	}
-
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/refund`,
-			HTTPMethod:   `POST`,
+			ResourcePath: `/card/{id}`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "1001",
 		},
-		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.ConstructApiError(400, "Malformed refund request: valid authorisationId, amount, description required")
+	expected := models.ConstructApiError(404, "GetCard: no card with id: 1001")
 
-	response, _ := testFront.Handler(request)
+	mockDbi.EXPECT().GetCard(gomock.Any(), 1001).Return(models.Card{}, expected).Times(1)
 
-	utils.AssertEquals(t, "Data from Refund with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from Refund with incomplete code request data", 400, response.StatusCode)
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from GetCard with invalid id", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from GetCard with invalid id", 404, response.StatusCode)
 }
 
-func TestRefundRouteBad2(t *testing.T) {
+func TestGetCardRouteMalformedId(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -1395,28 +1462,25 @@ func TestRefundRouteBad2(t *testing.T) {
 		Timestamp: "2019-01-02T14:52:36.951375973Z",
 	}, 123)
 
-	body := models.CodeRequest{
-		Amount:      200,
-		Description: "Bad coffee",
-	}
-
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/refund`,
-			HTTPMethod:   `POST`,
+			ResourcePath: `/card/{id}`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "badid",
 		},
-		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.ConstructApiError(400, "Malformed refund request: valid authorisationId, amount, description required")
+	expected := models.ConstructApiError(400, "GetCard: malformed id: badid")
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from Refund with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from Refund with incomplete code request data", 400, response.StatusCode)
+	utils.AssertEquals(t, "Data from GetCard", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from GetCard", 400, response.StatusCode)
 }
 
-func TestRefundRouteBad3(t *testing.T) {
+func TestAddCardRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -1431,172 +1495,1645 @@ func TestRefundRouteBad3(t *testing.T) {
 		Timestamp: "2019-01-02T14:52:36.951375973Z",
 	}, 123)
 
-	body := models.CodeRequest{
-		Amount:          200,
-		AuthorisationId: 1001,
+	body := models.Customer{
+		Fullname: "Fred Bloggs",
+		Id:       1001,
+	}
+
+	expected := models.Card{
+		Id:         100001,
+		CustomerId: 1001,
+		Balance:    0,
+		Available:  0,
 	}
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/refund`,
+			ResourcePath: `/card`,
 			HTTPMethod:   `POST`,
 		},
 		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.ConstructApiError(400, "Malformed refund request: valid authorisationId, amount, description required")
+	mockDbi.EXPECT().AddCard(gomock.Any(), body.Id, "").Return(expected, nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from Refund with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from Refund with incomplete code request data", 400, response.StatusCode)
+	utils.AssertEquals(t, "Data from AddCard", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetCard", 200, response.StatusCode)
 }
 
-func TestReverseRoute(t *testing.T) {
+func TestSetCardStatusRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
-	body := models.CodeRequest{
-		Amount:          200,
-		AuthorisationId: 1001,
-		Description:     "Bad coffee",
+	body := models.CardStatusRequest{
+		Status:      "FROZEN",
+		Description: "Lost in the park",
+	}
+
+	expected := models.Card{
+		Id:         100001,
+		CustomerId: 1001,
+		Balance:    1000,
+		Available:  750,
+		Status:     "FROZEN",
 	}
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/reverse`,
+			ResourcePath: `/card/{id}/status`,
 			HTTPMethod:   `POST`,
 		},
+		PathParameters: map[string]string{
+			"id": "100001",
+		},
 		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.CodeResponse{
-		Id: 10009,
-	}
-
-	mockDbi.EXPECT().Reverse(body.AuthorisationId, body.Amount, body.Description).Return(expected.Id, nil).Times(1)
+	mockDbi.EXPECT().SetCardStatus(gomock.Any(), 100001, body.Status, body.Description).Return(expected, nil).Times(1)
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from Reverse", utils.JsonStringify(expected), response.Body)
-	utils.AssertEquals(t, "Http code from Reverse", 200, response.StatusCode)
+	utils.AssertEquals(t, "Data from SetCardStatus", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from SetCardStatus", 200, response.StatusCode)
 }
 
-func TestReverseRouteBad1(t *testing.T) {
+func TestSetCardStatusRouteMalformedId(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
-
-	body := models.CodeRequest{
-		AuthorisationId: 1001,
-		Description:     "Bad coffee",
-	}
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/reverse`,
+			ResourcePath: `/card/{id}/status`,
 			HTTPMethod:   `POST`,
 		},
-		Body: utils.JsonStringify(body),
+		PathParameters: map[string]string{
+			"id": "badid",
+		},
+		Body: `{"status":"FROZEN"}`,
 	}
 
-	expected := models.ConstructApiError(400, "Malformed reversal request: valid authorisationId, amount, description required")
+	expected := models.ConstructApiError(400, "SetCardStatus: malformed id: badid")
 
-	response, _ := testFront.Handler(request)
+	response, _ := testFront.Handler(context.Background(), request)
 
-	utils.AssertEquals(t, "Data from Reverse with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from Reverse with incomplete code request data", 400, response.StatusCode)
+	utils.AssertEquals(t, "Data from SetCardStatus", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from SetCardStatus", 400, response.StatusCode)
 }
 
-func TestReverseRouteBad2(t *testing.T) {
+func TestSetCardLimitsRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
-	body := models.CodeRequest{
-		Amount:      200,
-		Description: "Bad coffee",
+	body := models.SpendingLimits{
+		MaxTransaction: 5000,
+		DailySpend:     20000,
 	}
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/reverse`,
+			ResourcePath: `/card/{id}/limits`,
 			HTTPMethod:   `POST`,
 		},
+		PathParameters: map[string]string{
+			"id": "100001",
+		},
 		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.ConstructApiError(400, "Malformed reversal request: valid authorisationId, amount, description required")
+	expected := body
+	expected.MonthlySpend = 100000
 
-	response, _ := testFront.Handler(request)
+	mockDbi.EXPECT().SetCardLimits(gomock.Any(), 100001, body).Return(expected, nil).Times(1)
 
-	utils.AssertEquals(t, "Data from Reverse with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from Reverse with incomplete code request data", 400, response.StatusCode)
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from SetCardLimits", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from SetCardLimits", 200, response.StatusCode)
 }
 
-func TestReverseRouteBad3(t *testing.T) {
+func TestGetCardLimitsRoute(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockDbi := mocks.NewMockDbi(mockCtrl)
 
-	testFront := NewFront(mockDbi, models.Status{
-		Branch:    "testing",
-		Platform:  "test",
-		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
-		Release:   "1.0.1",
-		Timestamp: "2019-01-02T14:52:36.951375973Z",
-	}, 123)
-
-	body := models.CodeRequest{
-		Amount:          200,
-		AuthorisationId: 1001,
-	}
+	testFront := NewFront(mockDbi, models.Status{}, 123)
 
 	request := events.APIGatewayProxyRequest{
 		RequestContext: events.APIGatewayProxyRequestContext{
-			ResourcePath: `/reverse`,
-			HTTPMethod:   `POST`,
+			ResourcePath: `/card/{id}/limits`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "100001",
 		},
-		Body: utils.JsonStringify(body),
 	}
 
-	expected := models.ConstructApiError(400, "Malformed reversal request: valid authorisationId, amount, description required")
+	expected := models.SpendingLimits{
+		HourlyAuthorisations: 10,
+	}
 
-	response, _ := testFront.Handler(request)
+	mockDbi.EXPECT().GetCardLimits(gomock.Any(), 100001).Return(expected, nil).Times(1)
 
-	utils.AssertEquals(t, "Data from Reverse with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
-	utils.AssertEquals(t, "Http code from Reverse with incomplete code request data", 400, response.StatusCode)
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from GetCardLimits", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetCardLimits", 200, response.StatusCode)
+}
+
+func TestSetCustomerLimitsRoute(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	body := models.SpendingLimits{
+		VendorDailySpend: 10000,
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/customer/{id}/limits`,
+			HTTPMethod:   `POST`,
+		},
+		PathParameters: map[string]string{
+			"id": "1001",
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	mockDbi.EXPECT().SetCustomerLimits(gomock.Any(), 1001, body).Return(body, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from SetCustomerLimits", utils.JsonStringify(body), response.Body)
+	utils.AssertEquals(t, "Http code from SetCustomerLimits", 200, response.StatusCode)
+}
+
+func TestSetCustomerLimitsRouteMalformedId(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/customer/{id}/limits`,
+			HTTPMethod:   `POST`,
+		},
+		PathParameters: map[string]string{
+			"id": "badid",
+		},
+		Body: `{"dailySpend":1000}`,
+	}
+
+	expected := models.ConstructApiError(400, "SetCustomerLimits: malformed id: badid")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from SetCustomerLimits", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from SetCustomerLimits", 400, response.StatusCode)
+}
+
+func TestClearAuthorisationRoute(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	body := models.ClearRequest{
+		Description: "Confirmed by the customer",
+	}
+
+	expected := models.Authorisation{
+		Id:       1005,
+		Amount:   30000,
+		CardId:   100001,
+		VendorId: 1001,
+		Status:   "APPROVED",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/authorisation/{id}/clear`,
+			HTTPMethod:   `POST`,
+		},
+		PathParameters: map[string]string{
+			"id": "1005",
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	mockDbi.EXPECT().ClearAuthorisation(gomock.Any(), 1005, body.Description).Return(expected, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from ClearAuthorisation", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from ClearAuthorisation", 200, response.StatusCode)
+}
+
+func TestClearAuthorisationRouteNoBody(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	expected := models.ConstructApiError(409, "ClearAuthorisation: authorisation 1005 is not held for review")
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/authorisation/{id}/clear`,
+			HTTPMethod:   `POST`,
+		},
+		PathParameters: map[string]string{
+			"id": "1005",
+		},
+	}
+
+	mockDbi.EXPECT().ClearAuthorisation(gomock.Any(), 1005, "").Return(models.Authorisation{}, expected).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from ClearAuthorisation", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from ClearAuthorisation", 409, response.StatusCode)
+}
+
+func TestOpenDisputeRoute(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	body := models.DisputeRequest{
+		Amount:      250,
+		Description: "Not delivered",
+	}
+
+	expected := models.Authorisation{
+		Id:            1005,
+		Amount:        250,
+		CardId:        100001,
+		VendorId:      1001,
+		Captured:      250,
+		Disputed:      250,
+		DisputeStatus: "OPEN",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/authorisation/{id}/dispute`,
+			HTTPMethod:   `POST`,
+		},
+		PathParameters: map[string]string{
+			"id": "1005",
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	mockDbi.EXPECT().OpenDispute(gomock.Any(), 1005, 250, "", body.Description).Return(expected, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from OpenDispute", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from OpenDispute", 200, response.StatusCode)
+}
+
+func TestSetDisputeStatusRoute(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	body := models.DisputeRequest{
+		Status: "WON",
+	}
+
+	expected := models.ConstructApiError(409, "SetDisputeStatus: dispute on authorisation 1005 cannot change from LOST to WON")
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/authorisation/{id}/dispute`,
+			HTTPMethod:   `POST`,
+		},
+		PathParameters: map[string]string{
+			"id": "1005",
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	mockDbi.EXPECT().SetDisputeStatus(gomock.Any(), 1005, "WON", "").Return(models.Authorisation{}, expected).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from SetDisputeStatus", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from SetDisputeStatus", 409, response.StatusCode)
+}
+
+func TestOpenDisputeRouteBadAmount(t *testing.T) {
+
+	testFront := makeFront(t)
+
+	for _, amount := range []int{0, -5000} {
+
+		request := events.APIGatewayProxyRequest{
+			RequestContext: events.APIGatewayProxyRequestContext{
+				ResourcePath: `/authorisation/{id}/dispute`,
+				HTTPMethod:   `POST`,
+			},
+			PathParameters: map[string]string{
+				"id": "1005",
+			},
+			Body: utils.JsonStringify(models.DisputeRequest{Amount: amount, Description: "Not delivered"}),
+		}
+
+		expected := models.ConstructApiError(400, "Malformed dispute request: valid amount required")
+
+		response, _ := testFront.Handler(context.Background(), request)
+
+		utils.AssertEquals(t, fmt.Sprintf("Data from OpenDispute for %v", amount), utils.JsonStringify(expected.ErrorBody()), response.Body)
+		utils.AssertEquals(t, fmt.Sprintf("Http code from OpenDispute for %v", amount), 400, response.StatusCode)
+	}
+}
+
+// code requests
+
+func TestTopUpRoute(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:      20000,
+		CardId:      100001,
+		Description: "Top-up from bank",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/top-up`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.CodeResponse{
+		Id: 10009,
+	}
+
+	mockDbi.EXPECT().TopUp(gomock.Any(), body.CardId, body.Amount, body.Currency, body.Description).Return(expected.Id, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from TopUp", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from TopUp", 200, response.StatusCode)
+}
+
+func TestTopUpRouteBad1(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:      20000,
+		Description: "Top-up from bank",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/top-up`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed top-up request: valid cardId, amount, description required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from TopUp with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from TopUp with incomplete code request data", 400, response.StatusCode)
+}
+
+func TestTransferRoute(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:      2500,
+		CardId:      100001,
+		ToCardId:    100002,
+		Description: "Share of dinner",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/transfer`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.CodeResponse{
+		Id: 10009,
+	}
+
+	mockDbi.EXPECT().Transfer(gomock.Any(), body.CardId, body.ToCardId, body.Amount, body.Currency, body.Description).Return(expected.Id, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Transfer", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from Transfer", 200, response.StatusCode)
+}
+
+func TestTransferRouteBad(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:      2500,
+		CardId:      100001,
+		Description: "Share of dinner",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/transfer`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed transfer request: valid cardId, toCardId, amount, description required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Transfer without a toCardId", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from Transfer without a toCardId", 400, response.StatusCode)
+}
+
+func TestTopUpRouteBad2(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		CardId:      10001,
+		Description: "Top-up from bank",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/top-up`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed top-up request: valid cardId, amount, description required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from TopUp with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from TopUp with incomplete code request data", 400, response.StatusCode)
+}
+
+func TestTopUpRouteBad3(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		CardId: 10001,
+		Amount: 20000,
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/top-up`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed top-up request: valid cardId, amount, description required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from TopUp with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from TopUp with incomplete code request data", 400, response.StatusCode)
+}
+
+func TestAuthoriseRoute(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:      200,
+		CardId:      100001,
+		VendorId:    1001,
+		Description: "Coffee",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/authorise`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.CodeResponse{
+		Id: 10009,
+	}
+
+	mockDbi.EXPECT().Authorise(gomock.Any(), body.CardId, body.VendorId, body.Amount, body.Currency, body.Description).Return(expected.Id, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Authorise", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from Authorise", 200, response.StatusCode)
+}
+
+func TestAuthoriseRouteBad1(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:      200,
+		VendorId:    1002,
+		Description: "Cake",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/authorise`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed authorisation request: valid vendorId, cardId, amount, description required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Authorise with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from Authorise with incomplete code request data", 400, response.StatusCode)
+}
+
+func TestAuthoriseRouteBad2(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:      200,
+		CardId:      100001,
+		Description: "Cake",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/authorise`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed authorisation request: valid vendorId, cardId, amount, description required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Authorise with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from Authorise with incomplete code request data", 400, response.StatusCode)
+}
+
+func TestAuthoriseRouteBad3(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		VendorId:    1002,
+		CardId:      100001,
+		Description: "Cake",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/authorise`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed authorisation request: valid vendorId, cardId, amount, description required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Authorise with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from Authorise with incomplete code request data", 400, response.StatusCode)
+}
+
+func TestAuthoriseRouteBad4(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:   200,
+		VendorId: 1002,
+		CardId:   100001,
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/authorise`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed authorisation request: valid vendorId, cardId, amount, description required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Authorise with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from Authorise with incomplete code request data", 400, response.StatusCode)
+}
+
+func TestCaptureRoute(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:          200,
+		AuthorisationId: 1001,
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/capture`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.CodeResponse{
+		Id: 10009,
+	}
+
+	mockDbi.EXPECT().Capture(gomock.Any(), body.AuthorisationId, body.Amount, body.Currency).Return(expected.Id, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Capture", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from Capture", 200, response.StatusCode)
+}
+
+func TestCaptureRouteBad1(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount: 20000,
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/capture`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed capture request: valid authorisationId, amount required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Capture with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from Capture with incomplete code request data", 400, response.StatusCode)
+}
+
+func TestCaptureRouteBad2(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		AuthorisationId: 1002,
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/capture`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed capture request: valid authorisationId, amount required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Capture with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from Capture with incomplete code request data", 400, response.StatusCode)
+}
+
+func TestRefundRoute(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:          200,
+		AuthorisationId: 1001,
+		Description:     "Bad coffee",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/refund`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.CodeResponse{
+		Id: 10009,
+	}
+
+	mockDbi.EXPECT().Refund(gomock.Any(), body.AuthorisationId, body.Amount, body.Currency, body.Description).Return(expected.Id, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Refund", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from Refund", 200, response.StatusCode)
+}
+
+func TestRefundRouteBad1(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		AuthorisationId: 1001,
+		Description:     "Bad coffee",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/refund`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed refund request: valid authorisationId, amount, description required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Refund with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from Refund with incomplete code request data", 400, response.StatusCode)
+}
+
+func TestRefundRouteBad2(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:      200,
+		Description: "Bad coffee",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/refund`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed refund request: valid authorisationId, amount, description required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Refund with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from Refund with incomplete code request data", 400, response.StatusCode)
+}
+
+func TestRefundRouteBad3(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:          200,
+		AuthorisationId: 1001,
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/refund`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed refund request: valid authorisationId, amount, description required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Refund with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from Refund with incomplete code request data", 400, response.StatusCode)
+}
+
+func TestReverseRoute(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:          200,
+		AuthorisationId: 1001,
+		Description:     "Bad coffee",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/reverse`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.CodeResponse{
+		Id: 10009,
+	}
+
+	mockDbi.EXPECT().Reverse(gomock.Any(), body.AuthorisationId, body.Amount, body.Currency, body.Description).Return(expected.Id, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Reverse", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from Reverse", 200, response.StatusCode)
+}
+
+func TestReverseRouteBad1(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		AuthorisationId: 1001,
+		Description:     "Bad coffee",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/reverse`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed reversal request: valid authorisationId, amount, description required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Reverse with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from Reverse with incomplete code request data", 400, response.StatusCode)
+}
+
+func TestReverseRouteBad2(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:      200,
+		Description: "Bad coffee",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/reverse`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed reversal request: valid authorisationId, amount, description required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Reverse with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from Reverse with incomplete code request data", 400, response.StatusCode)
+}
+
+func TestReverseRouteBad3(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{
+		Branch:    "testing",
+		Platform:  "test",
+		Commit:    "a00eaaf45694163c9b728a7b5668e3d510eb3eb0",
+		Release:   "1.0.1",
+		Timestamp: "2019-01-02T14:52:36.951375973Z",
+	}, 123)
+
+	body := models.CodeRequest{
+		Amount:          200,
+		AuthorisationId: 1001,
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/reverse`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := models.ConstructApiError(400, "Malformed reversal request: valid authorisationId, amount, description required")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from Reverse with incomplete code request data", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from Reverse with incomplete code request data", 400, response.StatusCode)
+}
+
+// idempotent code requests
+
+func idempotentTopUpRequest(key string, body models.CodeRequest) events.APIGatewayProxyRequest {
+
+	return events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/top-up`,
+			HTTPMethod:   `POST`,
+		},
+		Headers: map[string]string{
+			"idempotency-key": key,
+		},
+		Body: utils.JsonStringify(body),
+	}
+}
+
+func TestTopUpRouteIdempotent(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	body := models.CodeRequest{
+		Amount:      20000,
+		CardId:      100001,
+		Description: "Top-up from bank",
+	}
+
+	fingerprint := codeRequestFingerprint("POST/top-up", body)
+
+	expected := models.CodeResponse{
+		Id: 10009,
+	}
+
+	gomock.InOrder(
+		mockDbi.EXPECT().ClaimIdempotencyKey(gomock.Any(), "key-1", fingerprint).Return(models.IdempotencyKey{Key: "key-1", Fingerprint: fingerprint}, true, nil),
+		mockDbi.EXPECT().TopUp(gomock.Any(), body.CardId, body.Amount, body.Currency, body.Description).Return(expected.Id, nil),
+		mockDbi.EXPECT().CompleteIdempotencyKey(gomock.Any(), "key-1", expected.Id).Return(nil),
+	)
+
+	response, _ := testFront.Handler(context.Background(), idempotentTopUpRequest("key-1", body))
+
+	utils.AssertEquals(t, "Data from TopUp with a new idempotency key", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from TopUp with a new idempotency key", 200, response.StatusCode)
+}
+
+func TestTopUpRouteIdempotentCompleteFails(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	body := models.CodeRequest{
+		Amount:      20000,
+		CardId:      100001,
+		Description: "Top-up from bank",
+	}
+
+	fingerprint := codeRequestFingerprint("POST/top-up", body)
+
+	expected := models.CodeResponse{
+		Id: 10009,
+	}
+
+	gomock.InOrder(
+		mockDbi.EXPECT().ClaimIdempotencyKey(gomock.Any(), "key-1", fingerprint).Return(models.IdempotencyKey{Key: "key-1", Fingerprint: fingerprint}, true, nil),
+		mockDbi.EXPECT().TopUp(gomock.Any(), body.CardId, body.Amount, body.Currency, body.Description).Return(expected.Id, nil),
+		mockDbi.EXPECT().CompleteIdempotencyKey(gomock.Any(), "key-1", expected.Id).Return(models.ConstructApiError(500, "Connection lost")),
+	)
+
+	response, _ := testFront.Handler(context.Background(), idempotentTopUpRequest("key-1", body))
+
+	utils.AssertEquals(t, "Data from TopUp when completing the idempotency key fails", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from TopUp when completing the idempotency key fails", 200, response.StatusCode)
+}
+
+func TestTopUpRouteIdempotentReplay(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	body := models.CodeRequest{
+		Amount:      20000,
+		CardId:      100001,
+		Description: "Top-up from bank",
+	}
+
+	fingerprint := codeRequestFingerprint("POST/top-up", body)
+
+	existing := models.IdempotencyKey{
+		Key:         "key-1",
+		Fingerprint: fingerprint,
+		ResponseId:  10009,
+		Completed:   true,
+	}
+
+	mockDbi.EXPECT().ClaimIdempotencyKey(gomock.Any(), "key-1", fingerprint).Return(existing, false, nil).Times(1)
+
+	// the body is formatted differently from the original request, but is the same request
+	request := idempotentTopUpRequest("key-1", body)
+	request.Body = `{ "description": "Top-up from bank", "cardId": 100001, "amount": 20000 }`
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from a repeated TopUp", `{"id":10009}`, response.Body)
+	utils.AssertEquals(t, "Http code from a repeated TopUp", 200, response.StatusCode)
+}
+
+func TestTopUpRouteIdempotentConflict(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	body := models.CodeRequest{
+		Amount:      20000,
+		CardId:      100001,
+		Description: "Top-up from bank",
+	}
+
+	fingerprint := codeRequestFingerprint("POST/top-up", body)
+
+	existing := models.IdempotencyKey{
+		Key:         "key-1",
+		Fingerprint: codeRequestFingerprint("POST/top-up", models.CodeRequest{Amount: 10000, CardId: 100001, Description: "Top-up from bank"}),
+		ResponseId:  10009,
+		Completed:   true,
+	}
+
+	mockDbi.EXPECT().ClaimIdempotencyKey(gomock.Any(), "key-1", fingerprint).Return(existing, false, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), idempotentTopUpRequest("key-1", body))
+
+	expected := models.ConstructApiError(409, "Idempotency-Key key-1 has already been used for a different request")
+
+	utils.AssertEquals(t, "Data from TopUp with a reused idempotency key", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from TopUp with a reused idempotency key", 409, response.StatusCode)
+}
+
+func TestTopUpRouteIdempotentInProgress(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	body := models.CodeRequest{
+		Amount:      20000,
+		CardId:      100001,
+		Description: "Top-up from bank",
+	}
+
+	fingerprint := codeRequestFingerprint("POST/top-up", body)
+
+	existing := models.IdempotencyKey{
+		Key:         "key-1",
+		Fingerprint: fingerprint,
+	}
+
+	mockDbi.EXPECT().ClaimIdempotencyKey(gomock.Any(), "key-1", fingerprint).Return(existing, false, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), idempotentTopUpRequest("key-1", body))
+
+	expected := models.ConstructApiError(409, "Idempotency-Key key-1 is in use by a request which has not completed")
+
+	utils.AssertEquals(t, "Data from TopUp while the original request is in progress", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from TopUp while the original request is in progress", 409, response.StatusCode)
+}
+
+func TestTopUpRouteIdempotentFailure(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	body := models.CodeRequest{
+		Amount:      20000,
+		CardId:      100001,
+		Description: "Top-up from bank",
+	}
+
+	fingerprint := codeRequestFingerprint("POST/top-up", body)
+
+	expected := models.ConstructApiError(400, "TopUp: no card with id: 100001")
+
+	gomock.InOrder(
+		mockDbi.EXPECT().ClaimIdempotencyKey(gomock.Any(), "key-1", fingerprint).Return(models.IdempotencyKey{Key: "key-1", Fingerprint: fingerprint}, true, nil),
+		mockDbi.EXPECT().TopUp(gomock.Any(), body.CardId, body.Amount, body.Currency, body.Description).Return(-1, expected),
+		mockDbi.EXPECT().ReleaseIdempotencyKey(gomock.Any(), "key-1").Return(nil),
+	)
+
+	response, _ := testFront.Handler(context.Background(), idempotentTopUpRequest("key-1", body))
+
+	utils.AssertEquals(t, "Data from a failed TopUp with an idempotency key", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from a failed TopUp with an idempotency key", 400, response.StatusCode)
+}
+
+func TestTopUpRouteIdempotencyKeyTooLong(t *testing.T) {
+
+	testFront := makeFront(t)
+
+	body := models.CodeRequest{
+		Amount:      20000,
+		CardId:      100001,
+		Description: "Top-up from bank",
+	}
+
+	response, _ := testFront.Handler(context.Background(), idempotentTopUpRequest(strings.Repeat("k", MAX_IDEMPOTENCY_KEY_LENGTH+1), body))
+
+	expected := models.ConstructApiError(400, "Malformed Idempotency-Key header: must be at most 255 characters")
+
+	utils.AssertEquals(t, "Data from TopUp with an overlong idempotency key", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from TopUp with an overlong idempotency key", 400, response.StatusCode)
+}
+
+func TestTopUpRouteIdempotencyKeyReserved(t *testing.T) {
+
+	testFront := makeFront(t)
+
+	body := models.CodeRequest{
+		Amount:      20000,
+		CardId:      100001,
+		Description: "Top-up from bank",
+	}
+
+	response, _ := testFront.Handler(context.Background(), idempotentTopUpRequest("mandate-1001-2019-01-24 01:00:10", body))
+
+	expected := models.ConstructApiError(400, "Malformed Idempotency-Key header: the prefix mandate- is reserved")
+
+	utils.AssertEquals(t, "Data from TopUp with a mandate idempotency key", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from TopUp with a mandate idempotency key", 400, response.StatusCode)
+}
+
+func TestAddMandateRoute(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	body := models.Mandate{
+		CardId:    100001,
+		VendorId:  1001,
+		Amount:    999,
+		MaxAmount: 1500,
+		Frequency: "MONTHLY",
+		EndDate:   "2020-12-31",
+	}
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/mandate`,
+			HTTPMethod:   `POST`,
+		},
+		Body: utils.JsonStringify(body),
+	}
+
+	expected := body
+	expected.Id = 1001
+	expected.Currency = "GBP"
+	expected.Description = "Recurring payment to Gym"
+	expected.NextRunAt = "2019-01-24 01:00:10"
+	expected.Status = "ACTIVE"
+
+	mockDbi.EXPECT().AddOrUpdateMandate(gomock.Any(), body).Return(expected, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from AddOrUpdateMandate", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from AddOrUpdateMandate", 200, response.StatusCode)
+}
+
+func TestGetMandateRoute(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/mandate/{id}`,
+			HTTPMethod:   `GET`,
+		},
+		PathParameters: map[string]string{
+			"id": "1001",
+		},
+	}
+
+	expected := models.Mandate{
+		Id:        1001,
+		CardId:    100001,
+		VendorId:  1001,
+		Amount:    999,
+		MaxAmount: 999,
+		Currency:  "GBP",
+		Frequency: "MONTHLY",
+		NextRunAt: "2019-02-24 01:00:10",
+		Status:    "ACTIVE",
+		Runs: []models.MandateRun{
+			{Id: 1001, MandateId: 1001, AuthorisationId: 1011, Amount: 999, Status: "SUCCEEDED"},
+		},
+	}
+
+	mockDbi.EXPECT().GetMandate(gomock.Any(), 1001).Return(expected, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from GetMandate", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from GetMandate", 200, response.StatusCode)
+}
+
+func TestSetMandateStatusRoute(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/mandate/{id}/status`,
+			HTTPMethod:   `POST`,
+		},
+		PathParameters: map[string]string{
+			"id": "1001",
+		},
+		Body: `{"status":"CANCELLED"}`,
+	}
+
+	expected := models.Mandate{Id: 1001, Status: "CANCELLED"}
+
+	mockDbi.EXPECT().SetMandateStatus(gomock.Any(), 1001, "CANCELLED").Return(expected, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from SetMandateStatus", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from SetMandateStatus", 200, response.StatusCode)
+}
+
+func TestSetMandateStatusRouteBadId(t *testing.T) {
+
+	testFront := makeFront(t)
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/mandate/{id}/status`,
+			HTTPMethod:   `POST`,
+		},
+		PathParameters: map[string]string{
+			"id": "abc",
+		},
+		Body: "{}",
+	}
+
+	expected := models.ConstructApiError(400, "SetMandateStatus: malformed id: abc")
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from SetMandateStatus", utils.JsonStringify(expected.ErrorBody()), response.Body)
+	utils.AssertEquals(t, "Http code from SetMandateStatus", 400, response.StatusCode)
+}
+
+func TestRunMandatesRoute(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			ResourcePath: `/admin/mandates`,
+			HTTPMethod:   `POST`,
+		},
+	}
+
+	expected := models.MandateReport{
+		Runs: []models.MandateRun{
+			{Id: 1001, MandateId: 1001, AuthorisationId: 1011, Amount: 999, Status: "SUCCEEDED"},
+		},
+		Succeeded: 1,
+	}
+
+	mockDbi.EXPECT().RunMandates(gomock.Any()).Return(expected, nil).Times(1)
+
+	response, _ := testFront.Handler(context.Background(), request)
+
+	utils.AssertEquals(t, "Data from RunMandates", utils.JsonStringify(expected), response.Body)
+	utils.AssertEquals(t, "Http code from RunMandates", 200, response.StatusCode)
+	utils.AssertEquals(t, "Cache-Control from RunMandates", "no-cache", response.Headers["Cache-Control"])
 }
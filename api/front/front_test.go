@@ -1,7 +1,10 @@
 package front
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/golang/mock/gomock"
@@ -27,7 +30,7 @@ func TestUnknownRoute(t *testing.T) {
 		}
 
 		Convey("Then it should return a bad request status code", func() {
-			response, err := testFront.Handler(request)
+			response, err := testFront.Handler(context.Background(), request)
 			So(response.Body, ShouldEqual, `{"message":"No such route as GET/unknownpath","code":404}`)
 			So(response.Headers["Access-Control-Allow-Origin"], ShouldEqual, "*")
 			So(response.StatusCode, ShouldEqual, 404)
@@ -41,7 +44,7 @@ func (front *Front) dummyDataRouter(route string) innerHandler {
 	return front.dummyDataHandler
 }
 
-func (front Front) dummyDataHandler(request events.APIGatewayProxyRequest) (result interface{}, apiError models.ApiError) {
+func (front Front) dummyDataHandler(ctx context.Context, request events.APIGatewayProxyRequest) (result interface{}, apiError models.ApiError) {
 
 	return struct {
 		Data string `json:"data"`
@@ -67,7 +70,7 @@ func TestFrontDummyData(t *testing.T) {
 		}
 
 		Convey("Then front should return a 200 request status code, and a JSON encoded string of the data", func() {
-			response, err := testFront.Handler(request)
+			response, err := testFront.Handler(context.Background(), request)
 			So(response.Body, ShouldEqual, `{"data":"Dummy"}`)
 			So(response.Headers["Access-Control-Allow-Origin"], ShouldEqual, "*")
 			So(response.Headers["Cache-Control"], ShouldEqual, "max-age=123")
@@ -82,7 +85,7 @@ func (front *Front) errorRouter(route string) innerHandler {
 	return front.errorHandler
 }
 
-func (front Front) errorHandler(request events.APIGatewayProxyRequest) (result interface{}, apiError models.ApiError) {
+func (front Front) errorHandler(ctx context.Context, request events.APIGatewayProxyRequest) (result interface{}, apiError models.ApiError) {
 
 	return nil, models.ConstructApiError(345, "A simulated error: %v", "error")
 }
@@ -106,7 +109,7 @@ func TestFrontErrorData(t *testing.T) {
 		}
 
 		Convey("Then front should return the ApiError code and a JSON encoded error body with the ApiError message", func() {
-			response, err := testFront.Handler(request)
+			response, err := testFront.Handler(context.Background(), request)
 			So(response.Body, ShouldEqual, `{"message":"A simulated error: error","code":345}`)
 			So(response.Headers["Access-Control-Allow-Origin"], ShouldEqual, "*")
 			So(response.StatusCode, ShouldEqual, 345)
@@ -120,7 +123,7 @@ func (front *Front) unmarshallableRouter(route string) innerHandler {
 	return front.unmarshallableHandler
 }
 
-func (front Front) unmarshallableHandler(request events.APIGatewayProxyRequest) (result interface{}, apiError models.ApiError) {
+func (front Front) unmarshallableHandler(ctx context.Context, request events.APIGatewayProxyRequest) (result interface{}, apiError models.ApiError) {
 
 	return func() {}, nil
 }
@@ -144,7 +147,7 @@ func TestFrontUnparseableData(t *testing.T) {
 		}
 
 		Convey("Then front should return 500 and a JSON encoded error body with an 'Unmarshallable data' message", func() {
-			response, err := testFront.Handler(request)
+			response, err := testFront.Handler(context.Background(), request)
 			So(response.Body, ShouldEqual, `{"message":"Unmarshallable data","code":500}`)
 			So(response.Headers["Access-Control-Allow-Origin"], ShouldEqual, "*")
 			So(response.StatusCode, ShouldEqual, 500)
@@ -158,10 +161,9 @@ func (front *Front) panickyRouter(route string) innerHandler {
 	return front.panickyHandler
 }
 
-func (front Front) panickyHandler(request events.APIGatewayProxyRequest) (result interface{}, apiError models.ApiError) {
+func (front Front) panickyHandler(ctx context.Context, request events.APIGatewayProxyRequest) (result interface{}, apiError models.ApiError) {
 
 	panic("Simulated panic")
-	return
 }
 
 func TestFrontPanicRecovery(t *testing.T) {
@@ -183,7 +185,7 @@ func TestFrontPanicRecovery(t *testing.T) {
 		}
 
 		Convey("Then front should return a 500 request status code and a JSON encoded error body with the panic message", func() {
-			response, err := testFront.Handler(request)
+			response, err := testFront.Handler(context.Background(), request)
 			So(response.Body, ShouldEqual, `{"message":"Panic: Simulated panic","code":500}`)
 			So(response.Headers["Access-Control-Allow-Origin"], ShouldEqual, "*")
 			So(response.StatusCode, ShouldEqual, 500)
@@ -191,3 +193,47 @@ func TestFrontPanicRecovery(t *testing.T) {
 		})
 	})
 }
+
+func (front *Front) slowRouter(route string) innerHandler {
+
+	return front.slowHandler
+}
+
+// Simulates a database call abandoned at the deadline, which the driver reports as a failure of its own
+func (front Front) slowHandler(ctx context.Context, request events.APIGatewayProxyRequest) (result interface{}, apiError models.ApiError) {
+
+	<-ctx.Done()
+
+	return nil, models.ErrorWrap(errors.New("canceling query due to user request"))
+}
+
+func TestFrontDeadlineExceeded(t *testing.T) {
+
+	mockController := gomock.NewController(t)
+	defer mockController.Finish()
+
+	testFront := makeFront(t)
+
+	testFront.router = testFront.slowRouter
+
+	Convey("When a handler overruns the deadline of the request", t, func() {
+
+		request := events.APIGatewayProxyRequest{
+			RequestContext: events.APIGatewayProxyRequestContext{
+				ResourcePath: `/whatever`,
+				HTTPMethod:   `POST`,
+			},
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), RESPONSE_MARGIN+50*time.Millisecond)
+		defer cancel()
+
+		Convey("Then front should return a 504 before the deadline, with a JSON encoded error body", func() {
+			response, err := testFront.Handler(ctx, request)
+			So(response.Body, ShouldEqual, `{"message":"Deadline exceeded: context deadline exceeded","code":504}`)
+			So(response.StatusCode, ShouldEqual, 504)
+			So(ctx.Err(), ShouldBeNil)
+			So(err, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,74 @@
+package front
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+// The detail-type of the CloudWatch events sent by a Lambda schedule
+const SCHEDULED_EVENT_DETAIL_TYPE = "Scheduled Event"
+
+// ScheduledHandler is the signature of Front.ScheduledHandler
+type ScheduledHandler func(ctx context.Context, event events.CloudWatchEvent) (interface{}, error)
+
+// Front.ScheduledHandler handles a scheduled CloudWatch event by sweeping expired authorisations, then charging the
+// mandates which are due, returning the report of each. Expiry runs first so that holds which have expired are
+// released before mandates are authorised against the card. An error fails the invocation so that it is visible in
+// the Lambda metrics.
+func (front Front) ScheduledHandler(ctx context.Context, event events.CloudWatchEvent) (interface{}, error) {
+
+	log.Printf("Handling a scheduled event from %v.", event.Source)
+
+	report := models.ScheduledReport{}
+
+	var apiErr models.ApiError
+
+	report.Expiry, apiErr = front.dbi.ExpireAuthorisations(ctx)
+
+	if apiErr != nil {
+		log.Printf("ERROR: Expiry sweep failed: %v", apiErr.Error())
+		return nil, apiErr
+	}
+
+	log.Printf("Expired %v authorisations, releasing %v", report.Expiry.AuthorisationsExpired, report.Expiry.AmountReleased)
+
+	report.Mandates, apiErr = front.dbi.RunMandates(ctx)
+
+	if apiErr != nil {
+		log.Printf("ERROR: Mandate run failed: %v", apiErr.Error())
+		return nil, apiErr
+	}
+
+	log.Printf("Ran %v mandates, %v failed and %v suspended", len(report.Mandates.Runs), report.Mandates.Failed, report.Mandates.Suspended)
+
+	return report, nil
+}
+
+// NewLambdaHandler returns a handler for lambda.Start which passes scheduled CloudWatch events to the scheduled
+// handler, and anything else to the proxy handler as an API Gateway proxy request, passing each the Lambda context
+func NewLambdaHandler(proxy LambdaHandler, scheduled ScheduledHandler) func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+
+	return func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+
+		var event events.CloudWatchEvent
+
+		if json.Unmarshal(payload, &event) == nil && event.DetailType == SCHEDULED_EVENT_DETAIL_TYPE {
+			return scheduled(ctx, event)
+		}
+
+		var request events.APIGatewayProxyRequest
+
+		err := json.Unmarshal(payload, &request)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return proxy(ctx, request)
+	}
+}
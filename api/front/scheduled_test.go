@@ -0,0 +1,107 @@
+package front
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/golang/mock/gomock"
+
+	"github.com/merlincox/cardapi/mocks"
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestLambdaHandlerScheduledEvent(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	expected := models.ScheduledReport{
+		Expiry: models.ExpiryReport{
+			AuthorisationsExpired: 1,
+			AmountReleased:        250,
+			Codes:                 []int{1011},
+		},
+		Mandates: models.MandateReport{
+			Failed: 1,
+			Runs: []models.MandateRun{
+				{Id: 1001, MandateId: 1001, AuthorisationId: 1012, Amount: 999, Status: "SUCCEEDED"},
+				{Id: 1002, MandateId: 1002, Amount: 500, Status: "FAILED", Reason: "Authorise: insufficient funds for amount 500"},
+			},
+			Succeeded: 1,
+		},
+	}
+
+	gomock.InOrder(
+		mockDbi.EXPECT().ExpireAuthorisations(gomock.Any()).Return(expected.Expiry, nil).Times(1),
+		mockDbi.EXPECT().RunMandates(gomock.Any()).Return(expected.Mandates, nil).Times(1),
+	)
+
+	handler := NewLambdaHandler(testFront.Handler, testFront.ScheduledHandler)
+
+	payload := json.RawMessage(`{"version":"0","id":"89d1a02d-5ec7-412e-82f5-13505f849b41","detail-type":"Scheduled Event",` +
+		`"source":"aws.events","time":"2019-01-24T01:00:10Z","region":"eu-west-1","resources":[],"detail":{}}`)
+
+	result, err := handler(context.Background(), payload)
+
+	utils.AssertNoError(t, "Calling the Lambda handler with a scheduled event", err)
+	utils.AssertEquals(t, "Result for a scheduled event", utils.JsonStringify(expected), utils.JsonStringify(result))
+}
+
+func TestLambdaHandlerScheduledEventError(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	mockDbi.EXPECT().ExpireAuthorisations(gomock.Any()).Return(models.ExpiryReport{}, models.ConstructApiError(500, "Bad thing")).Times(1)
+
+	_, err := testFront.ScheduledHandler(context.Background(), events.CloudWatchEvent{DetailType: SCHEDULED_EVENT_DETAIL_TYPE})
+
+	utils.AssertEquals(t, "Error for a failed scheduled event", "Bad thing", err.Error())
+}
+
+func TestLambdaHandlerScheduledEventMandatesError(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	mockDbi.EXPECT().ExpireAuthorisations(gomock.Any()).Return(models.ExpiryReport{}, nil).Times(1)
+	mockDbi.EXPECT().RunMandates(gomock.Any()).Return(models.MandateReport{}, models.ConstructApiError(500, "Bad thing")).Times(1)
+
+	_, err := testFront.ScheduledHandler(context.Background(), events.CloudWatchEvent{DetailType: SCHEDULED_EVENT_DETAIL_TYPE})
+
+	utils.AssertEquals(t, "Error for a scheduled event whose mandate run failed", "Bad thing", err.Error())
+}
+
+func TestLambdaHandlerProxyRequest(t *testing.T) {
+
+	testFront := makeFront(t)
+
+	handler := NewLambdaHandler(testFront.Handler, testFront.ScheduledHandler)
+
+	payload := json.RawMessage(`{"resource":"/status","path":"/status","httpMethod":"GET",` +
+		`"requestContext":{"resourcePath":"/status","httpMethod":"GET"}}`)
+
+	result, err := handler(context.Background(), payload)
+
+	utils.AssertNoError(t, "Calling the Lambda handler with a proxy request", err)
+
+	response, ok := result.(events.APIGatewayProxyResponse)
+
+	utils.AssertTrue(t, "Result for a proxy request is an APIGatewayProxyResponse", ok)
+	utils.AssertEquals(t, "Http code for a proxy request", 200, response.StatusCode)
+}
@@ -0,0 +1,155 @@
+package front
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// LambdaHandler is the signature of Front.Handler, as passed to lambda.Start
+type LambdaHandler func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+// NewHttpHandler wraps a LambdaHandler so that it can be served by a plain net/http server, for local use
+// without API Gateway.
+//
+// Each request is converted into an APIGatewayProxyRequest with its resource path and path parameters resolved
+// against the route templates, and the APIGatewayProxyResponse is written back. The request's context is passed on,
+// so that the handling of a request is abandoned if its client disconnects.
+func NewHttpHandler(handler LambdaHandler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		request, err := toProxyRequest(r)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		response, err := handler(r.Context(), request)
+
+		if err != nil {
+			log.Printf("ERROR: Handler returned error: %v", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeProxyResponse(w, response)
+	})
+}
+
+// Convert a net/http request into the form API Gateway would pass to the Lambda
+func toProxyRequest(r *http.Request) (events.APIGatewayProxyRequest, error) {
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		return events.APIGatewayProxyRequest{}, err
+	}
+
+	resourcePath, pathParameters := matchRoute(r.Method, r.URL.Path)
+
+	headers := make(map[string]string, len(r.Header))
+
+	for key, values := range r.Header {
+		headers[key] = values[0]
+	}
+
+	query := r.URL.Query()
+	queryParameters := make(map[string]string, len(query))
+
+	for key, values := range query {
+		queryParameters[key] = values[0]
+	}
+
+	return events.APIGatewayProxyRequest{
+		Resource:              resourcePath,
+		Path:                  r.URL.Path,
+		HTTPMethod:            r.Method,
+		Headers:               headers,
+		MultiValueHeaders:     r.Header,
+		QueryStringParameters: queryParameters,
+		PathParameters:        pathParameters,
+		Body:                  string(body),
+		RequestContext: events.APIGatewayProxyRequestContext{
+			HTTPMethod:   r.Method,
+			ResourcePath: resourcePath,
+		},
+	}, nil
+}
+
+func writeProxyResponse(w http.ResponseWriter, response events.APIGatewayProxyResponse) {
+
+	for key, value := range response.Headers {
+		w.Header().Set(key, value)
+	}
+
+	for key, values := range response.MultiValueHeaders {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	w.WriteHeader(response.StatusCode)
+	w.Write([]byte(response.Body))
+}
+
+// Find the route template matching a method and path, returning the resource path and the path parameters.
+// An unmatched path is returned unchanged as the resource path so that it is reported as an unknown route.
+func matchRoute(method, path string) (string, map[string]string) {
+
+	pathSegments := splitPath(path)
+
+	for _, template := range routeTemplates {
+
+		if !strings.HasPrefix(template, method+"/") {
+			continue
+		}
+
+		resourcePath := strings.TrimPrefix(template, method)
+
+		if pathParameters, ok := matchSegments(splitPath(resourcePath), pathSegments); ok {
+			return resourcePath, pathParameters
+		}
+	}
+
+	return path, nil
+}
+
+func matchSegments(templateSegments, pathSegments []string) (map[string]string, bool) {
+
+	if len(templateSegments) != len(pathSegments) {
+		return nil, false
+	}
+
+	pathParameters := make(map[string]string)
+
+	for i, segment := range templateSegments {
+
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+
+			if pathSegments[i] == "" {
+				return nil, false
+			}
+
+			pathParameters[segment[1:len(segment)-1]] = pathSegments[i]
+
+		} else if segment != pathSegments[i] {
+			return nil, false
+		}
+	}
+
+	return pathParameters, true
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
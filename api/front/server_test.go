@@ -0,0 +1,130 @@
+package front
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+
+	"github.com/merlincox/cardapi/mocks"
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestMatchRoute(t *testing.T) {
+
+	resourcePath, params := matchRoute("GET", "/card/100001")
+
+	utils.AssertEquals(t, "Resource path for GET /card/100001", "/card/{id}", resourcePath)
+	utils.AssertEquals(t, "Id parameter for GET /card/100001", "100001", params["id"])
+
+	resourcePath, params = matchRoute("GET", "/calc/add/")
+
+	utils.AssertEquals(t, "Resource path for GET /calc/add/", "/calc/{op}", resourcePath)
+	utils.AssertEquals(t, "Op parameter for GET /calc/add/", "add", params["op"])
+
+	resourcePath, _ = matchRoute("POST", "/top-up")
+
+	utils.AssertEquals(t, "Resource path for POST /top-up", "/top-up", resourcePath)
+
+	resourcePath, _ = matchRoute("GET", "/card")
+
+	utils.AssertEquals(t, "Resource path for GET /card", "/card", resourcePath)
+
+	resourcePath, params = matchRoute("POST", "/card/100001")
+
+	utils.AssertEquals(t, "Resource path for POST /card/100001", "/card/100001", resourcePath)
+	utils.AssertTrue(t, "Path parameters for an unmatched route are nil", params == nil)
+}
+
+func TestRouteTemplatesAreRouted(t *testing.T) {
+
+	testFront := makeFront(t)
+
+	unknown := reflect.ValueOf(testFront.getHandlerForRoute("GET/unknownpath")).Pointer()
+
+	for _, template := range routeTemplates {
+
+		handler := reflect.ValueOf(testFront.getHandlerForRoute(template)).Pointer()
+
+		utils.AssertFalse(t, "Route template "+template+" is routed to the unknown route handler", handler == unknown)
+	}
+}
+
+func serveHttp(handler http.Handler, method, target, body string) (*http.Response, string) {
+
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	request.Header.Set("Accept-Language", "en-GB")
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	response := recorder.Result()
+	raw, _ := ioutil.ReadAll(response.Body)
+
+	return response, string(raw)
+}
+
+func TestHttpHandlerGetCard(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	expected := models.Card{
+		Id:         100001,
+		CustomerId: 1001,
+		Balance:    1000,
+		Available:  900,
+	}
+
+	mockDbi.EXPECT().GetCard(gomock.Any(), 100001).Return(expected, nil).Times(1)
+
+	response, body := serveHttp(NewHttpHandler(testFront.Handler), "GET", "/card/100001", "")
+
+	utils.AssertEquals(t, "Data from GET /card/100001", utils.JsonStringify(expected), body)
+	utils.AssertEquals(t, "Http code from GET /card/100001", 200, response.StatusCode)
+	utils.AssertEquals(t, "Cache-Control header from GET /card/100001", "max-age=123", response.Header.Get("Cache-Control"))
+	utils.AssertEquals(t, "Content-Type header from GET /card/100001", "application/json", response.Header.Get("Content-Type"))
+}
+
+func TestHttpHandlerPostAndQuery(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockDbi := mocks.NewMockDbi(mockCtrl)
+
+	testFront := NewFront(mockDbi, models.Status{}, 123)
+
+	mockDbi.EXPECT().TopUp(gomock.Any(), 100001, 2000, "", "Transfer from Bank").Return(1009, nil).Times(1)
+
+	response, body := serveHttp(NewHttpHandler(testFront.Handler), "POST", "/top-up",
+		`{"cardId":100001,"amount":2000,"description":"Transfer from Bank"}`)
+
+	utils.AssertEquals(t, "Data from POST /top-up", `{"id":1009}`, body)
+	utils.AssertEquals(t, "Http code from POST /top-up", 200, response.StatusCode)
+	utils.AssertEquals(t, "Cache-Control header from POST /top-up", "no-cache", response.Header.Get("Cache-Control"))
+
+	response, body = serveHttp(NewHttpHandler(testFront.Handler), "GET", "/calc/add?val1=1.5&val2=2", "")
+
+	utils.AssertEquals(t, "Http code from GET /calc/add", 200, response.StatusCode)
+	utils.AssertTrue(t, "Result from GET /calc/add", strings.Contains(body, `"result":"3.5"`))
+}
+
+func TestHttpHandlerUnknownRoute(t *testing.T) {
+
+	testFront := makeFront(t)
+
+	response, body := serveHttp(NewHttpHandler(testFront.Handler), "GET", "/unknownpath", "")
+
+	utils.AssertEquals(t, "Data from GET /unknownpath", `{"message":"No such route as GET/unknownpath","code":404}`, body)
+	utils.AssertEquals(t, "Http code from GET /unknownpath", 404, response.StatusCode)
+}
@@ -2,6 +2,8 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
@@ -19,20 +21,50 @@ import (
 
 const cacheTtlSeconds = 60
 
-var handler func(request events.APIGatewayProxyRequest) (response events.APIGatewayProxyResponse, err error)
+var (
+	handler   front.LambdaHandler
+	scheduled front.ScheduledHandler
+)
 
 func main() {
 
+	httpAddr := flag.String("http", "", "serve the API over plain HTTP on this address, e.g. :8080, instead of as a Lambda")
+	memory := flag.Bool("memory", false, "use an empty in-memory database instead of MySQL")
+
+	flag.Parse()
+
 	log.Printf("Starting %v API using Go %v\n", os.Getenv("RELEASE"), runtime.Version())
 	log.Printf("Commit %v Timestamp %v\n", os.Getenv("COMMIT"), os.Getenv("TIMESTAMP"))
 
-	dbi, apiErr := db.NewDbi(os.Getenv("MYSQLDSN"), nil)
+	var (
+		dbi     db.Dbi
+		apiErr  models.ApiError
+		options []db.Option
+	)
+
+	// the exchange rates, such as EUR=1.17,USD=1.27, default to db.DEFAULT_FX_RATES
+	if list := os.Getenv("FXRATES"); list != "" {
+
+		rates, err := db.ParseFxRates(list)
+
+		if err != nil {
+			log.Fatalf("Fatal configuration error: FXRATES: %v", err)
+		}
+
+		options = append(options, db.WithFxRates(rates))
+	}
+
+	if *memory {
+		dbi = db.NewMemoryDbi(options...)
+	} else {
+		dbi, apiErr = db.NewDbi(os.Getenv("MYSQLDSN"), nil, append(options, db.WithReplica(os.Getenv("MYSQLREPLICADSN")))...)
+	}
 
 	if apiErr != nil {
 
 		log.Printf("Fatal database error: %v", apiErr.Error())
 
-		handler = func(request events.APIGatewayProxyRequest) (response events.APIGatewayProxyResponse, err error) {
+		handler = func(ctx context.Context, request events.APIGatewayProxyRequest) (response events.APIGatewayProxyResponse, err error) {
 
 			body := apiErr.ErrorBody()
 
@@ -44,6 +76,10 @@ func main() {
 			return
 		}
 
+		scheduled = func(ctx context.Context, event events.CloudWatchEvent) (interface{}, error) {
+			return nil, apiErr
+		}
+
 	} else {
 
 		status := models.Status{
@@ -54,8 +90,18 @@ func main() {
 			Timestamp: time.Now().Format(time.RFC3339Nano),
 		}
 
-		handler = front.NewFront(dbi, status, cacheTtlSeconds).Handler
+		f := front.NewFront(dbi, status, cacheTtlSeconds)
+
+		handler = f.Handler
+		scheduled = f.ScheduledHandler
+	}
+
+	if *httpAddr != "" {
+
+		log.Printf("Listening for HTTP requests on %v\n", *httpAddr)
+		log.Fatal(http.ListenAndServe(*httpAddr, front.NewHttpHandler(handler)))
 	}
 
-	lambda.Start(handler)
+	// the same function serves API Gateway requests and the scheduled expiry sweep
+	lambda.Start(front.NewLambdaHandler(handler, scheduled))
 }
@@ -0,0 +1,210 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	CARD_STATUS_ACTIVE  = "ACTIVE"
+	CARD_STATUS_FROZEN  = "FROZEN"
+	CARD_STATUS_BLOCKED = "BLOCKED"
+	CARD_STATUS_CLOSED  = "CLOSED"
+
+	// Guarded updates which only affect a card still in the status read before the change
+	QUERY_UPDATE_CARD_STATUS = `UPDATE cards SET status = ? WHERE id = ? AND status = ?`
+	QUERY_CLOSE_CARD         = `UPDATE cards SET status = ?, balance = 0, available = 0 WHERE id = ? AND status = ? AND balance = ? AND available = balance`
+
+	// The external destination of the balance paid out when a card is closed
+	LEDGER_ACCOUNT_PAYOUT = "payout"
+
+	MESSAGE_BAD_CARD_STATUS        = "%v: no card status %v"
+	MESSAGE_CARD_STATUS_TRANSITION = "%v: card %v cannot change from %v to %v"
+	MESSAGE_CARD_STATUS_CHANGED    = "%v: card %v was changed by another request"
+	MESSAGE_CARD_HAS_HOLDS         = "%v: card %v has %v held by open authorisations"
+	MESSAGE_CARD_IN_DEBIT          = "%v: card %v has a negative balance of %v"
+	MESSAGE_CARD_NOT_USABLE        = "%v: card %v is %v"
+
+	MESSAGE_PAYOUT = "Payout of balance on closing"
+)
+
+// The statuses a card may change to from each status. A frozen card is unfrozen by changing it back to ACTIVE, as is
+// a blocked card once cleared. CLOSED is final.
+var cardTransitions = map[string][]string{
+	CARD_STATUS_ACTIVE:  {CARD_STATUS_FROZEN, CARD_STATUS_BLOCKED, CARD_STATUS_CLOSED},
+	CARD_STATUS_FROZEN:  {CARD_STATUS_ACTIVE, CARD_STATUS_BLOCKED, CARD_STATUS_CLOSED},
+	CARD_STATUS_BLOCKED: {CARD_STATUS_ACTIVE, CARD_STATUS_CLOSED},
+	CARD_STATUS_CLOSED:  {},
+}
+
+// The statuses in which a card may be authorised against, topped up, re-debited by a lost dispute, or given a mandate
+var (
+	authorisableStatuses = []string{CARD_STATUS_ACTIVE}
+	topUpStatuses        = []string{CARD_STATUS_ACTIVE, CARD_STATUS_FROZEN}
+	redebitStatuses      = []string{CARD_STATUS_ACTIVE, CARD_STATUS_FROZEN, CARD_STATUS_BLOCKED}
+	mandateStatuses      = []string{CARD_STATUS_ACTIVE, CARD_STATUS_FROZEN, CARD_STATUS_BLOCKED}
+)
+
+func contains(statuses []string, status string) bool {
+
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check that a card may change from its current status to the requested one, and that a card being closed has no
+// open holds, since their funds could no longer be released, and does not owe a negative balance, which could no
+// longer be repaid
+func checkCardTransition(c models.Card, status string) models.ApiError {
+
+	if _, ok := cardTransitions[status]; !ok {
+		return models.ConstructApiError(400, MESSAGE_BAD_CARD_STATUS, "SetCardStatus", status)
+	}
+
+	if !contains(cardTransitions[c.Status], status) {
+		return models.ConstructApiError(409, MESSAGE_CARD_STATUS_TRANSITION, "SetCardStatus", c.Id, c.Status, status)
+	}
+
+	if status == CARD_STATUS_CLOSED && c.Available != c.Balance {
+		return models.ConstructApiError(409, MESSAGE_CARD_HAS_HOLDS, "SetCardStatus", c.Id, models.Money{Amount: c.Balance - c.Available, Currency: c.Currency})
+	}
+
+	if status == CARD_STATUS_CLOSED && c.Balance < 0 {
+		return models.ConstructApiError(409, MESSAGE_CARD_IN_DEBIT, "SetCardStatus", c.Id, models.Money{Amount: c.Balance, Currency: c.Currency})
+	}
+
+	return nil
+}
+
+// Check that a card is in one of the statuses allowed for an operation
+func checkCardUsable(c models.Card, statuses []string, context string) models.ApiError {
+
+	if !contains(statuses, c.Status) {
+		return models.ConstructApiError(403, MESSAGE_CARD_NOT_USABLE, context, c.Id, c.Status)
+	}
+
+	return nil
+}
+
+// Returns the description of the STATUS movement which records a change of card status
+func statusDescription(from, to, description string) string {
+
+	if description == "" {
+		return fmt.Sprintf("Status changed from %v to %v", from, to)
+	}
+
+	return fmt.Sprintf("Status changed from %v to %v: %v", from, to, description)
+}
+
+// SetCardStatus changes the status of a card, recording the change in its movements. Closing a card pays out its
+// remaining balance and ends its mandates. Returns the updated card
+func (d *dbGate) SetCardStatus(ctx context.Context, cardId int, status, description string) (models.Card, models.ApiError) {
+
+	c, apiErr := d.getCard(ctx, cardId)
+
+	if apiErr != nil {
+		return c, apiErr
+	}
+
+	apiErr = checkCardTransition(c, status)
+
+	if apiErr != nil {
+		return c, apiErr
+	}
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
+
+	if err != nil {
+		return c, models.ErrorWrap(err)
+	}
+
+	defer tx.Rollback()
+
+	qry := QUERY_UPDATE_CARD_STATUS
+	args := []interface{}{status, cardId, c.Status}
+
+	if status == CARD_STATUS_CLOSED {
+		qry = QUERY_CLOSE_CARD
+		args = append(args, c.Balance)
+	}
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return c, models.ErrorWrap(err)
+	}
+
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, args...)
+
+	if res.apiErr != nil {
+		return c, res.apiErr
+	}
+
+	// the status, balance or holds have changed since the card was read
+	if res.numRowsAffected != 1 {
+		return c, models.ConstructApiError(409, MESSAGE_CARD_STATUS_CHANGED, "SetCardStatus", cardId)
+	}
+
+	qry = QUERY_ADD_MOVEMENT
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return c, models.ErrorWrap(err)
+	}
+
+	stmt := tx.StmtContext(ctx, d.stmt(qry))
+
+	res = d.exec(ctx, stmt, qry, cardId, 0, statusDescription(c.Status, status, description), "STATUS")
+
+	if res.apiErr != nil {
+		return c, res.apiErr
+	}
+
+	if status == CARD_STATUS_CLOSED && c.Balance > 0 {
+
+		res = d.exec(ctx, stmt, qry, cardId, -c.Balance, MESSAGE_PAYOUT, "PAYOUT")
+
+		if res.apiErr != nil {
+			return c, res.apiErr
+		}
+
+		apiErr = d.addLedgerEntry(ctx, tx, "PAYOUT", MESSAGE_PAYOUT, res.lastInsertedId, transfer(CardAvailableAccount(cardId), LEDGER_ACCOUNT_PAYOUT, c.Balance, c.Currency))
+
+		if apiErr != nil {
+			return c, apiErr
+		}
+	}
+
+	if status == CARD_STATUS_CLOSED {
+
+		qry = QUERY_END_CARD_MANDATES
+
+		err = d.prepareQry(ctx, qry)
+
+		if err != nil {
+			return c, models.ErrorWrap(err)
+		}
+
+		res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, cardId)
+
+		if res.apiErr != nil {
+			return c, res.apiErr
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return c, models.ErrorWrap(err)
+	}
+
+	// the card returned includes this change, which may not yet have reached a replica
+	return d.GetCard(WithReadYourWrites(ctx), cardId)
+}
@@ -0,0 +1,229 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestSetCardStatusFreeze(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 1000, 750, "ACTIVE", "2019-01-24 01:00:10", "GBP")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		expecter.ExpectBegin()
+
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD_STATUS))
+		// This duplication seems to be necessary for tx.Stmt(..)
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD_STATUS)).ExpectExec().WithArgs("FROZEN", 100001, "ACTIVE").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		expecter.ExpectPrepare(esc(QUERY_ADD_MOVEMENT))
+		expecter.ExpectPrepare(esc(QUERY_ADD_MOVEMENT)).ExpectExec().
+			WithArgs(100001, 0, "Status changed from ACTIVE to FROZEN: Lost in the park", "STATUS").WillReturnResult(sqlmock.NewResult(1009, 1))
+
+		expecter.ExpectCommit()
+
+		//  c.id, c.balance, c.available, c.customer_id, c.status, c.ts, m.id, m.amount, m.description, m.movement_type, m.ts
+		expected = sqlmock.NewRows([]string{"c.id", "c.balance", "c.available", "c.customer_id", "c.status", "c.tc", "m.id", "m.amount", "m.description", "m.movement_type", "m.ts", "m.related_movement_id", "c.currency"}).
+			AddRow(int64(100001), 1000, 750, 1001, "FROZEN", "2019-01-24 01:00:10", 1009, 0, "Status changed from ACTIVE to FROZEN: Lost in the park", "STATUS", "2019-01-24 01:00:10", nil, "GBP")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_CARD_ALL)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		c, apiErr := dbi.SetCardStatus(context.Background(), 100001, "FROZEN", "Lost in the park")
+
+		utils.AssertNoError(t, "Calling SetCardStatus", apiErr)
+		utils.AssertEquals(t, "Status for SetCardStatus result", "FROZEN", c.Status)
+		utils.AssertEquals(t, "len(Movements) for SetCardStatus result", 1, len(c.Movements))
+	})
+}
+
+func TestSetCardStatusClose(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 1000, 1000, "FROZEN", "2019-01-24 01:00:10", "GBP")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		expecter.ExpectBegin()
+
+		expecter.ExpectPrepare(esc(QUERY_CLOSE_CARD))
+		expecter.ExpectPrepare(esc(QUERY_CLOSE_CARD)).ExpectExec().WithArgs("CLOSED", 100001, "FROZEN", 1000).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		expecter.ExpectPrepare(esc(QUERY_ADD_MOVEMENT))
+		ep := expecter.ExpectPrepare(esc(QUERY_ADD_MOVEMENT))
+		ep.ExpectExec().WithArgs(100001, 0, "Status changed from FROZEN to CLOSED", "STATUS").WillReturnResult(sqlmock.NewResult(1009, 1))
+		ep.ExpectExec().WithArgs(100001, -1000, MESSAGE_PAYOUT, "PAYOUT").WillReturnResult(sqlmock.NewResult(1010, 1))
+
+		expectLedgerEntry(expecter, "PAYOUT", MESSAGE_PAYOUT, 1010, transfer(CardAvailableAccount(100001), LEDGER_ACCOUNT_PAYOUT, 1000, "GBP"))
+
+		expecter.ExpectPrepare(esc(QUERY_END_CARD_MANDATES))
+		expecter.ExpectPrepare(esc(QUERY_END_CARD_MANDATES)).ExpectExec().WithArgs(100001).WillReturnResult(sqlmock.NewResult(0, 2))
+
+		expecter.ExpectCommit()
+
+		expected = sqlmock.NewRows([]string{"c.id", "c.balance", "c.available", "c.customer_id", "c.status", "c.tc", "m.id", "m.amount", "m.description", "m.movement_type", "m.ts", "m.related_movement_id", "c.currency"}).
+			AddRow(int64(100001), 0, 0, 1001, "CLOSED", "2019-01-24 01:00:10", nil, nil, nil, nil, nil, nil, "GBP")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_CARD_ALL)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		c, apiErr := dbi.SetCardStatus(context.Background(), 100001, "CLOSED", "")
+
+		utils.AssertNoError(t, "Calling SetCardStatus to close", apiErr)
+		utils.AssertEquals(t, "Status for SetCardStatus result", "CLOSED", c.Status)
+		utils.AssertEquals(t, "Balance for SetCardStatus result", 0, c.Balance)
+	})
+}
+
+func TestSetCardStatusConcurrentChange(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 1000, 750, "ACTIVE", "2019-01-24 01:00:10", "GBP")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		expecter.ExpectBegin()
+
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD_STATUS))
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD_STATUS)).ExpectExec().WithArgs("BLOCKED", 100001, "ACTIVE").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		expecter.ExpectRollback()
+
+		_, apiErr := dbi.SetCardStatus(context.Background(), 100001, "BLOCKED", "Suspected fraud")
+
+		utils.AssertEquals(t, "Return status for calling SetCardStatus after a concurrent change", 409, apiErr.StatusCode())
+	})
+}
+
+func TestSetCardStatusBad(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 1000, 750, "ACTIVE", "2019-01-24 01:00:10", "GBP")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		_, apiErr := dbi.SetCardStatus(context.Background(), 100001, "LOST", "")
+
+		utils.AssertEquals(t, "Return status for calling SetCardStatus with an unknown status", 400, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling SetCardStatus with an unknown status",
+			fmt.Sprintf(MESSAGE_BAD_CARD_STATUS, "SetCardStatus", "LOST"), apiErr.Error())
+	})
+}
+
+func TestCheckCardTransition(t *testing.T) {
+
+	c := models.Card{Id: 100001, Balance: 1000, Available: 750, Status: CARD_STATUS_CLOSED, Currency: "GBP"}
+
+	utils.AssertEquals(t, "Return status for reopening a closed card", 409, checkCardTransition(c, CARD_STATUS_ACTIVE).StatusCode())
+
+	c.Status = CARD_STATUS_BLOCKED
+
+	utils.AssertEquals(t, "Return status for freezing a blocked card", 409, checkCardTransition(c, CARD_STATUS_FROZEN).StatusCode())
+	utils.AssertNoError(t, "Unblocking a blocked card", checkCardTransition(c, CARD_STATUS_ACTIVE))
+
+	apiErr := checkCardTransition(c, CARD_STATUS_CLOSED)
+
+	utils.AssertEquals(t, "Return status for closing a card with open holds", 409, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for closing a card with open holds",
+		fmt.Sprintf(MESSAGE_CARD_HAS_HOLDS, "SetCardStatus", 100001, "£2.50"), apiErr.Error())
+
+	c.Balance, c.Available = -250, -250
+
+	utils.AssertEquals(t, "Return status for closing a card with a negative balance", 409, checkCardTransition(c, CARD_STATUS_CLOSED).StatusCode())
+}
+
+func TestAuthoriseFrozenCard(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"}).
+			AddRow(int64(1001), "Coffee Shop", 999, "GBP", "", "")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_VENDOR)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
+
+		expected = sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 12676, 12089, "FROZEN", "2019-01-24 01:00:10", "GBP")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		_, apiErr := dbi.Authorise(context.Background(), 100001, 1001, 210, "", "Coffee")
+
+		utils.AssertEquals(t, "Return status for calling Authorise on a frozen card", 403, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling Authorise on a frozen card",
+			fmt.Sprintf(MESSAGE_CARD_NOT_USABLE, "Authorise", 100001, "FROZEN"), apiErr.Error())
+	})
+}
+
+func TestTopUpClosedCard(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 0, 0, "CLOSED", "2019-01-24 01:00:10", "GBP")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		_, apiErr := dbi.TopUp(context.Background(), 100001, 2000, "", "Transfer from Bank")
+
+		utils.AssertEquals(t, "Return status for calling TopUp on a closed card", 403, apiErr.StatusCode())
+	})
+}
+
+func TestMemoryCardStatus(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 1000)
+	defer dbi.Close()
+
+	utils.AssertEquals(t, "Status of a new card", CARD_STATUS_ACTIVE, c.Status)
+
+	_, apiErr := dbi.SetCardStatus(context.Background(), c.Id, CARD_STATUS_FROZEN, "Lost in the park")
+	utils.AssertNoError(t, "Calling SetCardStatus to freeze", apiErr)
+
+	_, apiErr = dbi.Authorise(context.Background(), c.Id, v.Id, 100, "", "Coffee")
+	utils.AssertEquals(t, "Return status for calling Authorise on a frozen card", 403, apiErr.StatusCode())
+
+	_, apiErr = dbi.TopUp(context.Background(), c.Id, 500, "", "Transfer from Bank")
+	utils.AssertNoError(t, "Calling TopUp on a frozen card", apiErr)
+
+	_, apiErr = dbi.SetCardStatus(context.Background(), c.Id, CARD_STATUS_ACTIVE, "Found")
+	utils.AssertNoError(t, "Calling SetCardStatus to unfreeze", apiErr)
+
+	aid, apiErr := dbi.Authorise(context.Background(), c.Id, v.Id, 100, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise on an unfrozen card", apiErr)
+
+	_, apiErr = dbi.SetCardStatus(context.Background(), c.Id, CARD_STATUS_CLOSED, "")
+	utils.AssertEquals(t, "Return status for closing a card with an open hold", 409, apiErr.StatusCode())
+
+	_, apiErr = dbi.Capture(context.Background(), aid, 100, "")
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	closed, apiErr := dbi.SetCardStatus(context.Background(), c.Id, CARD_STATUS_CLOSED, "Customer request")
+
+	utils.AssertNoError(t, "Calling SetCardStatus to close", apiErr)
+	utils.AssertEquals(t, "Status after closing", CARD_STATUS_CLOSED, closed.Status)
+	utils.AssertEquals(t, "Balance after closing", 0, closed.Balance)
+	utils.AssertEquals(t, "Available after closing", 0, closed.Available)
+	utils.AssertEquals(t, "MovementType of the last movement", "PAYOUT", closed.Movements[len(closed.Movements)-1].MovementType)
+	utils.AssertEquals(t, "Amount of the payout movement", -1400, closed.Movements[len(closed.Movements)-1].Amount)
+
+	payout, apiErr := dbi.GetAccountBalance(context.Background(), LEDGER_ACCOUNT_PAYOUT)
+
+	utils.AssertNoError(t, "Calling GetAccountBalance", apiErr)
+	utils.AssertEquals(t, "Balance of the payout account", 1400, payout)
+
+	_, apiErr = dbi.TopUp(context.Background(), c.Id, 500, "", "Transfer from Bank")
+	utils.AssertEquals(t, "Return status for calling TopUp on a closed card", 403, apiErr.StatusCode())
+
+	r, apiErr := dbi.Reconcile(context.Background())
+
+	utils.AssertNoError(t, "Calling Reconcile", apiErr)
+	utils.AssertTrue(t, "Ok for Reconcile after closing", r.Ok)
+}
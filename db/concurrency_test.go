@@ -0,0 +1,201 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+const (
+	HAMMER_GOROUTINES = 50
+	HAMMER_AMOUNT     = 30
+)
+
+// Run fn from HAMMER_GOROUTINES goroutines at once and return the number of calls which succeeded. A call may be
+// refused, with a 400 or by a spending limit, but not fail otherwise
+func hammer(t *testing.T, fn func() models.ApiError) int {
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded int
+	)
+
+	start := make(chan struct{})
+
+	for i := 0; i < HAMMER_GOROUTINES; i++ {
+
+		wg.Add(1)
+
+		go func() {
+
+			defer wg.Done()
+
+			<-start
+
+			apiErr := fn()
+
+			if apiErr != nil {
+
+				if apiErr.StatusCode() != 400 && apiErr.StatusCode() != LIMIT_EXCEEDED_STATUS {
+					t.Errorf("Unexpected error from concurrent call: %v", apiErr.Error())
+				}
+
+				return
+			}
+
+			mu.Lock()
+			succeeded++
+			mu.Unlock()
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+
+	return succeeded
+}
+
+// Authorise HAMMER_AMOUNT against the card from many goroutines at once, and check that the card is never overdrawn
+func testConcurrentAuthorise(t *testing.T, dbi Dbi, cardId, vendorId int) {
+
+	c, apiErr := dbi.GetCard(context.Background(), cardId)
+	utils.AssertNoError(t, "Calling GetCard", apiErr)
+
+	succeeded := hammer(t, func() models.ApiError {
+		_, apiErr := dbi.Authorise(context.Background(), cardId, vendorId, HAMMER_AMOUNT, "", "Coffee")
+		return apiErr
+	})
+
+	utils.AssertEquals(t, "Number of concurrent authorisations which succeeded", c.Available/HAMMER_AMOUNT, succeeded)
+
+	c, apiErr = dbi.GetCard(context.Background(), cardId)
+	utils.AssertNoError(t, "Calling GetCard", apiErr)
+
+	utils.AssertTrue(t, "Available for card after concurrent authorisations is not negative", c.Available >= 0)
+	utils.AssertTrue(t, "Available for card after concurrent authorisations is less than one authorisation", c.Available < HAMMER_AMOUNT)
+}
+
+// Authorise HAMMER_AMOUNT against a card with a daily spend cap of 10 authorisations from many goroutines at once, and
+// check that the cap is never passed
+func testConcurrentSpendCap(t *testing.T, dbi Dbi, cardId, vendorId int) {
+
+	_, apiErr := dbi.SetCardLimits(context.Background(), cardId, models.SpendingLimits{DailySpend: 10 * HAMMER_AMOUNT})
+	utils.AssertNoError(t, "Calling SetCardLimits", apiErr)
+
+	succeeded := hammer(t, func() models.ApiError {
+		_, apiErr := dbi.Authorise(context.Background(), cardId, vendorId, HAMMER_AMOUNT, "", "Coffee")
+		return apiErr
+	})
+
+	utils.AssertEquals(t, "Number of concurrent authorisations within the daily spend which succeeded", 10, succeeded)
+
+	c, apiErr := dbi.GetCard(context.Background(), cardId)
+	utils.AssertNoError(t, "Calling GetCard", apiErr)
+
+	utils.AssertEquals(t, "Available for card after concurrent authorisations up to the daily spend", c.Balance-10*HAMMER_AMOUNT, c.Available)
+}
+
+// Capture HAMMER_AMOUNT of an authorisation from many goroutines at once, and check that it is never over-captured
+func testConcurrentCapture(t *testing.T, dbi Dbi, cardId, vendorId int) {
+
+	authId, apiErr := dbi.Authorise(context.Background(), cardId, vendorId, 10*HAMMER_AMOUNT, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	succeeded := hammer(t, func() models.ApiError {
+		_, apiErr := dbi.Capture(context.Background(), authId, HAMMER_AMOUNT, "")
+		return apiErr
+	})
+
+	utils.AssertEquals(t, "Number of concurrent captures which succeeded", 10, succeeded)
+
+	auth, apiErr := dbi.GetAuthorisation(context.Background(), authId)
+	utils.AssertNoError(t, "Calling GetAuthorisation", apiErr)
+
+	utils.AssertEquals(t, "Captured for authorisation after concurrent captures", 10*HAMMER_AMOUNT, auth.Captured)
+
+	succeeded = hammer(t, func() models.ApiError {
+		_, apiErr := dbi.Refund(context.Background(), authId, HAMMER_AMOUNT, "", "Bad coffee")
+		return apiErr
+	})
+
+	utils.AssertEquals(t, "Number of concurrent refunds which succeeded", 10, succeeded)
+
+	auth, apiErr = dbi.GetAuthorisation(context.Background(), authId)
+	utils.AssertNoError(t, "Calling GetAuthorisation", apiErr)
+
+	utils.AssertEquals(t, "Refunded for authorisation after concurrent refunds", 10*HAMMER_AMOUNT, auth.Refunded)
+}
+
+// Capture and reverse HAMMER_AMOUNT of an authorisation from many goroutines at once, half of each, and check that
+// together they never take more than the authorisation, and that nothing is left held on the card
+func testConcurrentCaptureReverse(t *testing.T, dbi Dbi, cardId, vendorId int) {
+
+	authId, apiErr := dbi.Authorise(context.Background(), cardId, vendorId, 10*HAMMER_AMOUNT, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	var calls int32
+
+	succeeded := hammer(t, func() models.ApiError {
+
+		if atomic.AddInt32(&calls, 1)%2 == 0 {
+			_, apiErr := dbi.Capture(context.Background(), authId, HAMMER_AMOUNT, "")
+			return apiErr
+		}
+
+		_, apiErr := dbi.Reverse(context.Background(), authId, HAMMER_AMOUNT, "", "Cancelled")
+		return apiErr
+	})
+
+	utils.AssertEquals(t, "Number of concurrent captures and reversals which succeeded", 10, succeeded)
+
+	auth, apiErr := dbi.GetAuthorisation(context.Background(), authId)
+	utils.AssertNoError(t, "Calling GetAuthorisation", apiErr)
+
+	utils.AssertEquals(t, "Captured and reversed for authorisation after concurrent captures and reversals", 10*HAMMER_AMOUNT, auth.Captured+auth.Reversed)
+
+	c, apiErr := dbi.GetCard(context.Background(), cardId)
+	utils.AssertNoError(t, "Calling GetCard", apiErr)
+
+	utils.AssertEquals(t, "Available for card after concurrent captures and reversals, with nothing held", c.Balance, c.Available)
+}
+
+func TestMemoryConcurrentAuthorise(t *testing.T) {
+
+	// the burst of authorisations would otherwise be declined by the risk rules
+	dbi, c, v := memoryFixture(t, 1000, WithRiskEvaluator(ApproveAll))
+	defer dbi.Close()
+
+	testConcurrentAuthorise(t, dbi, c.Id, v.Id)
+}
+
+func TestMemoryConcurrentCapture(t *testing.T) {
+
+	// the burst of authorisations would otherwise be declined by the risk rules
+	dbi, c, v := memoryFixture(t, 1000, WithRiskEvaluator(ApproveAll))
+	defer dbi.Close()
+
+	testConcurrentCapture(t, dbi, c.Id, v.Id)
+}
+
+func TestMemoryConcurrentCaptureReverse(t *testing.T) {
+
+	// the burst of authorisations would otherwise be declined by the risk rules
+	dbi, c, v := memoryFixture(t, 1000, WithRiskEvaluator(ApproveAll))
+	defer dbi.Close()
+
+	testConcurrentCaptureReverse(t, dbi, c.Id, v.Id)
+}
+
+func TestMemoryConcurrentSpendCap(t *testing.T) {
+
+	// the burst of authorisations would otherwise be declined by the risk rules
+	dbi, c, v := memoryFixture(t, 1000, WithRiskEvaluator(ApproveAll))
+	defer dbi.Close()
+
+	testConcurrentSpendCap(t, dbi, c.Id, v.Id)
+}
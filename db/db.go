@@ -2,61 +2,70 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
-	"net/http"
 	"sync"
-
-	"github.com/go-sql-driver/mysql"
+	"time"
 
 	"github.com/merlincox/cardapi/models"
 )
 
 const (
-	QUERY_GET_CUSTOMERS = "SELECT id, fullname FROM customers"
-	QUERY_GET_VENDORS   = "SELECT id, vendor_name, balance FROM vendors"
+	QUERY_GET_CUSTOMERS = "SELECT id, fullname FROM customers ORDER BY id LIMIT ? OFFSET ?"
+	QUERY_GET_VENDORS   = "SELECT id, vendor_name, balance, currency, category, mcc FROM vendors ORDER BY id LIMIT ? OFFSET ?"
+
+	QUERY_COUNT_CUSTOMERS = "SELECT COUNT(*) FROM customers"
+	QUERY_COUNT_VENDORS   = "SELECT COUNT(*) FROM vendors"
 
-	QUERY_GET_VENDOR        = "SELECT id, vendor_name, balance FROM vendors WHERE id = ?"
-	QUERY_GET_CARD          = "SELECT id, balance, available, ts FROM cards WHERE id = ?"
-	QUERY_GET_AUTHORISATION = "SELECT id, amount, card_id, vendor_id, description, captured, reversed, refunded FROM authorisations WHERE id = ?"
+	QUERY_GET_VENDOR        = "SELECT id, vendor_name, balance, currency, category, mcc FROM vendors WHERE id = ?"
+	QUERY_GET_CARD          = "SELECT id, balance, available, status, ts, currency FROM cards WHERE id = ?"
+	QUERY_GET_AUTHORISATION = "SELECT id, amount, card_id, vendor_id, description, captured, reversed, refunded, expires_at, currency, card_currency, rate, status, disputed, dispute_status FROM authorisations WHERE id = ?"
 
-	QUERY_GET_CARD_ALL = `SELECT c.id, c.balance, c.available, c.customer_id, c.ts, m.id, m.amount, m.description, m.movement_type, m.ts
+	QUERY_GET_CARD_ALL = `SELECT c.id, c.balance, c.available, c.customer_id, c.status, c.ts, m.id, m.amount, m.description, m.movement_type, m.ts, m.related_movement_id, c.currency
                             FROM cards c
                             LEFT OUTER JOIN movements m ON (m.card_id = c.id)
                             WHERE c.id = ?
                             ORDER BY m.ts`
 
-	QUERY_GET_VENDOR_ALL = `SELECT v.id, v.vendor_name, v.balance, a.id, a.amount, a.card_id, a.description, a.captured, a.reversed, a.refunded, a.ts
+	QUERY_GET_VENDOR_ALL = `SELECT v.id, v.vendor_name, v.balance, a.id, a.amount, a.card_id, a.description, a.captured, a.reversed, a.refunded, a.ts, v.currency, a.currency, a.card_currency, a.rate, v.category, v.mcc
                             FROM vendors v
                             LEFT OUTER JOIN authorisations a ON (a.vendor_id = v.id)
                             WHERE v.id = ?
                             ORDER BY a.ts`
 
-	QUERY_GET_CUSTOMER_ALL = `SELECT cu.id, cu.fullname, c.id, c.balance, c.available, c.ts
+	QUERY_GET_CUSTOMER_ALL = `SELECT cu.id, cu.fullname, c.id, c.balance, c.available, c.status, c.ts, c.currency
                             FROM customers cu
                             LEFT OUTER JOIN cards c ON (c.customer_id = cu.id)
                             WHERE cu.id = ?
                             ORDER BY c.ts`
 
-	QUERY_GET_AUTHORISATION_ALL = `SELECT a.id, a.amount, a.card_id, a.vendor_id, a.description, a.captured, a.reversed, a.refunded, m.id, m.amount, m.description, m.movement_type, m.ts
+	QUERY_GET_AUTHORISATION_ALL = `SELECT a.id, a.amount, a.card_id, a.vendor_id, a.description, a.captured, a.reversed, a.refunded, a.expires_at, m.id, m.amount, m.description, m.movement_type, m.ts, a.currency, a.card_currency, a.rate, a.status, a.disputed, a.dispute_status, a.mcc
                             FROM authorisations a
                             LEFT OUTER JOIN auth_movements m ON (m.authorisation_id = a.id)
-                            WHERE cu.id = ?
-                            ORDER BY c.ts`
+                            WHERE a.id = ?
+                            ORDER BY m.ts`
 
-	QUERY_UPDATE_AUTH   = `UPDATE authorisations SET captured = captured + ?, refunded = refunded + ?, reversed = reversed + ? WHERE id = ?`
 	QUERY_UPDATE_CARD   = `UPDATE cards SET balance = balance + ?, available = available + ? WHERE id = ?`
 	QUERY_UPDATE_VENDOR = `UPDATE vendors SET balance = balance + ? WHERE id = ?`
 
-	QUERY_UPDATE_VENDOR_DETAILS   = `UPDATE vendors SET vendor_name = ? WHERE id = ?`
+	// Guarded updates which only affect a row if the funds they depend on are still there when the row is locked
+	QUERY_HOLD_CARD    = `UPDATE cards SET available = available - ? WHERE id = ? AND available >= ? AND status = 'ACTIVE'`
+	QUERY_TOP_UP_CARD  = `UPDATE cards SET balance = balance + ?, available = available + ? WHERE id = ? AND status IN ('ACTIVE', 'FROZEN')`
+	QUERY_CAPTURE_AUTH = `UPDATE authorisations SET captured = captured + ? WHERE id = ? AND amount - (captured + reversed) >= ?
+                          AND (expires_at IS NULL OR expires_at > ?)`
+	QUERY_REVERSE_AUTH = `UPDATE authorisations SET reversed = reversed + ? WHERE id = ? AND amount - (captured + reversed) >= ?`
+	QUERY_REFUND_AUTH  = `UPDATE authorisations SET refunded = refunded + ? WHERE id = ? AND captured - (refunded + disputed) >= ?`
+
+	QUERY_UPDATE_VENDOR_DETAILS   = `UPDATE vendors SET vendor_name = ?, category = ?, mcc = ? WHERE id = ?`
 	QUERY_UPDATE_CUSTOMER_DETAILS = `UPDATE customers SET fullname = ? WHERE id = ?`
 
-	QUERY_ADD_VENDOR   = "INSERT INTO vendors (vendor_name) VALUES (?)"
+	QUERY_ADD_VENDOR   = "INSERT INTO vendors (vendor_name, category, mcc, currency) VALUES (?, ?, ?, ?)"
 	QUERY_ADD_CUSTOMER = "INSERT INTO customers (fullname) VALUES (?)"
-	QUERY_ADD_CARD     = "INSERT INTO cards (customer_id) VALUES (?)"
+	QUERY_ADD_CARD     = "INSERT INTO cards (customer_id, currency) VALUES (?, ?)"
 
-	QUERY_ADD_AUTHORISATION = `INSERT INTO authorisations (card_id, vendor_id, amount, description) 
-                               VALUES (?, ?, ?, ?)`
+	// ts is given, as the time from which the authorisation counts towards the card's limits
+	QUERY_ADD_AUTHORISATION = `INSERT INTO authorisations (card_id, vendor_id, amount, description, expires_at, currency, card_currency, rate, status, mcc, ts) 
+                               VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
 	QUERY_ADD_MOVEMENT = `INSERT INTO movements (card_id, amount, description, movement_type) 
                                VALUES (?, ?, ?, ?)`
@@ -64,146 +73,341 @@ const (
 	QUERY_ADD_AUTH_MOVEMENT = `INSERT INTO auth_movements (authorisation_id, amount, description, movement_type) 
                                VALUES (?, ?, ?, ?)`
 
-	MYSQL_ERROR_FOREIGN_KEY = 1216
+	QUERY_ADD_IDEMPOTENCY_KEY      = "INSERT INTO idempotency_keys (idempotency_key, fingerprint, ts) VALUES (?, ?, ?)"
+	QUERY_GET_IDEMPOTENCY_KEY      = "SELECT idempotency_key, fingerprint, response_id FROM idempotency_keys WHERE idempotency_key = ?"
+	QUERY_COMPLETE_IDEMPOTENCY_KEY = "UPDATE idempotency_keys SET response_id = ? WHERE idempotency_key = ? AND response_id IS NULL"
+	QUERY_DELETE_IDEMPOTENCY_KEY   = "DELETE FROM idempotency_keys WHERE idempotency_key = ? AND response_id IS NULL"
+
+	// A guarded update which claims again a key abandoned by the request which claimed it, for the same request
+	QUERY_TAKE_OVER_IDEMPOTENCY_KEY = `UPDATE idempotency_keys SET ts = ? WHERE idempotency_key = ? AND fingerprint = ? AND response_id IS NULL
+                                       AND ts <= ?`
+
+	// A claimed idempotency key which has been neither completed nor released for this long has been abandoned by its
+	// request, which cannot run for longer than the 15 minute maximum of a Lambda function, and can be taken over
+	IDEMPOTENCY_CLAIM_TIMEOUT = 15 * time.Minute
 
 	MESSAGE_BAD_ID = "%v: no %v with id: %v"
 
-	MESSAGE_INSUFFICIENT_AVAILABLE     = "%v: insufficient funds: £%.2f exceeds available £%.2f"
-	MESSAGE_INSUFFICIENT_AVAILABLE_FOR = "%v: insufficient funds for amount £%.2f"
+	// The amounts in these messages are models.Money, so that they can be formatted in the language of the request
+	MESSAGE_INSUFFICIENT_AVAILABLE     = "%v: insufficient funds: %v exceeds available %v"
+	MESSAGE_INSUFFICIENT_AVAILABLE_FOR = "%v: insufficient funds for amount %v"
 
 	MESSAGE_INVALID_ROW_UPDATE = "%v: invalid row update"
+
+	MESSAGE_IDEMPOTENCY_KEY_IN_USE = "%v: idempotency key %v is in use by another request"
 )
 
-// Dbi interface for database operations
+// Dbi interface for database operations. Each operation takes the context of the request it serves, so that its
+// queries and transaction are abandoned when the request's deadline passes or it is cancelled
 type Dbi interface {
 
-	// GetCustomers returns an array of customers
-	GetCustomers() ([]models.Customer, models.ApiError)
-	// GetVendors returns an array of vendors
-	GetVendors() ([]models.Vendor, models.ApiError)
+	// GetCustomers returns a page of up to limit customers starting at offset, and the total number of customers
+	GetCustomers(ctx context.Context, offset, limit int) ([]models.Customer, int, models.ApiError)
+	// GetVendors returns a page of up to limit vendors starting at offset, and the total number of vendors
+	GetVendors(ctx context.Context, offset, limit int) ([]models.Vendor, int, models.ApiError)
 	// Adds a customer using a customer object, or if an id already exists updates an existing customer
 
 	// GetCustomer returns a customer object including associated cards
-	GetCustomer(id int) (models.Customer, models.ApiError)
+	GetCustomer(ctx context.Context, id int) (models.Customer, models.ApiError)
 	// GetVendor returns a vendor object, including associated authorisations
-	GetVendor(id int) (models.Vendor, models.ApiError)
+	GetVendor(ctx context.Context, id int) (models.Vendor, models.ApiError)
 	// GetCard returns a card object, including movements such as top-ups, payments, refunds
-	GetCard(id int) (models.Card, models.ApiError)
+	GetCard(ctx context.Context, id int) (models.Card, models.ApiError)
 	// GetAuthorisation returns an authorisation object, including associated movements such as captures, refunds, reversals etc
-	GetAuthorisation(id int) (models.Authorisation, models.ApiError)
+	GetAuthorisation(ctx context.Context, id int) (models.Authorisation, models.ApiError)
 
-	AddOrUpdateCustomer(models.Customer) (models.Customer, models.ApiError)
+	AddOrUpdateCustomer(ctx context.Context, c models.Customer) (models.Customer, models.ApiError)
 	// AddOrUpdateVendor adds a vendor taking a vendor object, or if an id already exists updates an existing vendor
-	AddOrUpdateVendor(models.Vendor) (models.Vendor, models.ApiError)
-	// AddCard adds a card to a customer, taking a customer id and returning a card object
-	AddCard(customerId int) (models.Card, models.ApiError)
+	AddOrUpdateVendor(ctx context.Context, v models.Vendor) (models.Vendor, models.ApiError)
+	// AddCard adds a card to a customer in a currency, taking a customer id and returning a card object
+	AddCard(ctx context.Context, customerId int, currency string) (models.Card, models.ApiError)
+	// SetCardStatus changes the status of a card, recording the change in its movements. Closing a card pays out its
+	// remaining balance. Returns the updated card
+	SetCardStatus(ctx context.Context, cardId int, status, description string) (models.Card, models.ApiError)
+
+	// The amounts of spending limits are in the minor unit of the currency of each card they apply to. A limit of 0
+	// is no limit
+
+	// GetCardLimits returns the effective spending limits of a card: each of its own limits, or where that is 0 the
+	// default of its customer
+	GetCardLimits(ctx context.Context, cardId int) (models.SpendingLimits, models.ApiError)
+	// SetCardLimits replaces the spending limits of a card, returning its effective limits
+	SetCardLimits(ctx context.Context, cardId int, limits models.SpendingLimits) (models.SpendingLimits, models.ApiError)
+	// SetCustomerLimits replaces the default spending limits of the cards of a customer, returning them
+	SetCustomerLimits(ctx context.Context, customerId int, limits models.SpendingLimits) (models.SpendingLimits, models.ApiError)
+	// GetVendorFees returns the effective fee schedule charged on the captures of a vendor: its own, or if it has none
+	// that of its category
+	GetVendorFees(ctx context.Context, vendorId int) (models.FeeSchedule, models.ApiError)
+	// SetVendorFees replaces the fee schedule of a vendor, which takes the place of that of its category, returning it
+	SetVendorFees(ctx context.Context, vendorId int, fees models.FeeSchedule) (models.FeeSchedule, models.ApiError)
+	// SetCategoryFees replaces the fee schedule of the vendors of a category without one of their own, returning it
+	SetCategoryFees(ctx context.Context, category string, fees models.FeeSchedule) (models.FeeSchedule, models.ApiError)
+	// GetCardMccControls returns the merchant category codes which a card allows and blocks
+	GetCardMccControls(ctx context.Context, cardId int) (models.MccControls, models.ApiError)
+	// SetCardMccControls replaces the merchant category codes which a card allows and blocks, returning them
+	SetCardMccControls(ctx context.Context, cardId int, controls models.MccControls) (models.MccControls, models.ApiError)
+
+	// The amounts of these operations are in the minor unit of a currency which, if not empty, must be that of the
+	// card, vendor or authorisation the amount applies to
 
 	// TopUp simulates a top-up to a card and returns a top-up code
-	TopUp(cardId, amount int, description string) (int, models.ApiError)
-	// Authorise requests authorisation of a payment and returns an authorisation code
-	Authorise(cardId, vendorId, amount int, description string) (int, models.ApiError)
-	// Capture requests the capture of all or part of an authorised payment and returns a capture code
-	Capture(authorisationId, amount int) (int, models.ApiError)
+	TopUp(ctx context.Context, cardId, amount int, currency, description string) (int, models.ApiError)
+	// Transfer moves funds from one card to another, returning the id of the TRANSFER-OUT movement
+	Transfer(ctx context.Context, fromCardId, toCardId, amount int, currency, description string) (int, models.ApiError)
+	// Authorise requests authorisation of a payment in the vendor's currency and returns an authorisation code. The
+	// hold on the card must be within its spending limits, and the payment is scored by the RiskEvaluator, which may
+	// decline it or hold it for review
+	Authorise(ctx context.Context, cardId, vendorId, amount int, currency, description string) (int, models.ApiError)
+	// Capture requests the capture of all or part of an authorised payment and returns a capture code. An
+	// authorisation held for review cannot be captured until it is cleared
+	Capture(ctx context.Context, authorisationId, amount int, currency string) (int, models.ApiError)
 	// Refund requests a refund all or part of a captured payment and returns a refund code
-	Refund(authorisationId, amount int, description string) (int, models.ApiError)
+	Refund(ctx context.Context, authorisationId, amount int, currency, description string) (int, models.ApiError)
 	// Reverse requests a reversal of all or part of a authorisation and returns a reversal code
-	Reverse(authorisationId, amount int, description string) (int, models.ApiError)
+	Reverse(ctx context.Context, authorisationId, amount int, currency, description string) (int, models.ApiError)
+	// ClearAuthorisation clears an authorisation held for review, so that it can be captured, recording the clearance
+	// in its movements. Returns the updated authorisation
+	ClearAuthorisation(ctx context.Context, authorisationId int, description string) (models.Authorisation, models.ApiError)
+	// OpenDispute opens a dispute against all or part of a captured payment, provisionally crediting the card with it.
+	// Returns the updated authorisation
+	OpenDispute(ctx context.Context, authorisationId, amount int, currency, description string) (models.Authorisation, models.ApiError)
+	// SetDisputeStatus moves the dispute on an authorisation to VENDOR_RESPONDED, WON or LOST. A dispute won is
+	// charged back to the vendor, and a dispute lost re-debits the card, which must not be closed. Returns the updated
+	// authorisation
+	SetDisputeStatus(ctx context.Context, authorisationId int, status, description string) (models.Authorisation, models.ApiError)
+
+	// ClaimIdempotencyKey records a new idempotency key with the fingerprint of the request using it, returning true.
+	// If the key has already been claimed it returns the existing record and false, unless it was claimed for the same
+	// request more than IDEMPOTENCY_CLAIM_TIMEOUT ago and never completed, when it is claimed again
+	ClaimIdempotencyKey(ctx context.Context, key, fingerprint string) (models.IdempotencyKey, bool, models.ApiError)
+	// CompleteIdempotencyKey records the response id of the request which claimed an idempotency key
+	CompleteIdempotencyKey(ctx context.Context, key string, responseId int) models.ApiError
+	// ReleaseIdempotencyKey removes an idempotency key which has not been completed, so that its request can be retried
+	ReleaseIdempotencyKey(ctx context.Context, key string) models.ApiError
+
+	// GetLedgerEntries returns a page of up to limit ledger entries starting at offset, and the total number of entries
+	GetLedgerEntries(ctx context.Context, offset, limit int) ([]models.LedgerEntry, int, models.ApiError)
+	// GetAccountBalance returns the sum of the postings to a ledger account
+	GetAccountBalance(ctx context.Context, account string) (int, models.ApiError)
+
+	// Reconcile checks the balance invariants of every card, authorisation and vendor, and reports any breaks
+	Reconcile(ctx context.Context) (models.ReconciliationReport, models.ApiError)
+
+	// ExpireAuthorisations reverses the uncaptured remainder of every authorisation past its expiry time, releasing
+	// the hold on the card, and reports the authorisations expired
+	ExpireAuthorisations(ctx context.Context) (models.ExpiryReport, models.ApiError)
+
+	// SettleVendors settles every vendor with captures, refunds or chargebacks since its last settlement, grouping them
+	// into a batch which is paid out net of fees, and reports the batches and their payout file
+	SettleVendors(ctx context.Context) (models.SettlementReport, models.ApiError)
+	// GetSettlements returns a page of up to limit settlement batches of a vendor starting at offset, oldest first, and
+	// the total number of its batches
+	GetSettlements(ctx context.Context, vendorId, offset, limit int) ([]models.Settlement, int, models.ApiError)
+
+	// AddOrUpdateMandate adds a mandate for a vendor to charge a card up to a ceiling each period until an end date,
+	// or if an id already exists updates its amount, description and end date. Returns the mandate
+	AddOrUpdateMandate(ctx context.Context, mandate models.Mandate) (models.Mandate, models.ApiError)
+	// GetMandate returns a mandate, including its runs
+	GetMandate(ctx context.Context, id int) (models.Mandate, models.ApiError)
+	// SetMandateStatus suspends, resumes or cancels a mandate, returning it
+	SetMandateStatus(ctx context.Context, id int, status string) (models.Mandate, models.ApiError)
+	// RunMandates charges each mandate which is due through Authorise and Capture, recording a run of each. A run
+	// refused for insufficient funds is retried after a backoff, and a mandate is suspended after repeated failures
+	RunMandates(ctx context.Context) (models.MandateReport, models.ApiError)
 
 	// Close closes prepared statements and the database connection
 	Close()
 }
 
-// A private empty struct type to attach interface methods to
-type dbGate struct{}
+// The SQL implementation of Dbi, for MySQL or Postgres. It owns its connections, so that several instances, such as one per database or
+// one per test, can be used independently in one process. Writes and the reads they depend on use the embedded
+// primary connection, while the read methods use the replica connection when there is one
+type dbGate struct {
+	*dbConn
+	replica *dbConn
+	fx      FxRates
+	risk    RiskEvaluator
+	fee     models.FeeSchedule
+}
 
-var (
-	dbd   *dbGate
-	dbx   *sql.DB
-	stmts = make(map[string]*sql.Stmt, 10)
-	mutex sync.Mutex
-)
+// A connection pool with its cache of prepared statements, and the dialect of its database
+type dbConn struct {
+	dbx     *sql.DB
+	dialect *dialect
+	mutex   sync.Mutex
+	stmts   map[string]*sql.Stmt
+}
 
-// Returns a new Dbi singleton instance, retrieves the existing instance, or returns an injected instance (for testing)
-func NewDbi(mysqlDsn string, injected *sql.DB) (Dbi, models.ApiError) {
+// Returns a new Dbi instance connected to a DSN, or using an injected connection (for testing), configured by any
+// options. The DSN is a PostgreSQL connection URL (postgres://...) or otherwise a MySQL DSN. A new connection is
+// refused if the schema version is behind LatestSchemaVersion
+func NewDbi(dsn string, injected *sql.DB, options ...Option) (Dbi, models.ApiError) {
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	var o dbOptions
 
-	if dbx == nil {
+	for _, option := range options {
+		option(&o)
+	}
 
-		if injected == nil {
+	primary := injected
 
-			db, err := sql.Open("mysql", mysqlDsn)
+	if primary == nil {
 
-			// Open with a bad DSN does not error, hence ping to check the connection
-			if err == nil {
-				err = db.Ping()
-			}
+		db, apiErr := Open(dsn)
 
-			if err != nil {
-				return nil, models.ConstructApiError(http.StatusServiceUnavailable, "Fatal database error: %v", err.Error())
-			}
+		if apiErr != nil {
+			return nil, apiErr
+		}
+
+		// refuse to start against a schema which has not been migrated up to the version this code requires
+		apiErr = CheckSchemaVersion(db)
+
+		if apiErr != nil {
+			db.Close()
+			return nil, apiErr
+		}
+
+		primary = db
+	}
+
+	d := &dbGate{
+		dbConn: newDbConn(primary, dialectOf(primary)),
+		fx:     o.rates(),
+		risk:   o.risk(),
+		fee:    o.settlementFee,
+	}
 
-			dbx = db
+	replica := o.replica
 
-		} else {
-			dbx = injected
+	if replica == nil && o.replicaDsn != "" {
+
+		// the replica's schema is replicated from the primary, so is not checked separately
+		db, apiErr := Open(o.replicaDsn)
+
+		if apiErr != nil {
+			d.Close()
+			return nil, apiErr
 		}
 
-		dbd = &dbGate{}
+		replica = db
+	}
+
+	if replica != nil {
+		d.replica = newDbConn(replica, dialectOf(replica))
 	}
 
-	return dbd, nil
+	return d, nil
 }
 
-// Close close prepared statements and the database connection
+func newDbConn(db *sql.DB, dl *dialect) *dbConn {
+
+	return &dbConn{
+		dbx:     db,
+		dialect: dl,
+		stmts:   make(map[string]*sql.Stmt, 10),
+	}
+}
+
+// Close closes the prepared statements and the database connections of this instance only
 func (d *dbGate) Close() {
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	d.dbConn.close()
 
-	for _, stmt := range stmts {
-		stmt.Close()
+	if d.replica != nil {
+		d.replica.close()
 	}
+}
 
-	if dbx != nil {
-		dbx.Close()
+func (c *dbConn) close() {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, stmt := range c.stmts {
+		stmt.Close()
 	}
 
-	stmts = make(map[string]*sql.Stmt)
-	dbx = nil
+	c.dbx.Close()
+
+	c.stmts = make(map[string]*sql.Stmt)
 }
 
-// Retreive prepared query if it exists, or prepare the query and store it
-func prepareQry(qry string) (err error) {
+// Retreive prepared query if it exists, or prepare the query, rewritten for the dialect, and store it
+func (c *dbConn) prepareQry(ctx context.Context, qry string) (err error) {
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	_, prepared := stmts[qry]
+	_, prepared := c.stmts[qry]
 
 	if !prepared {
 
-		stmts[qry], err = dbx.Prepare(qry)
+		var stmt *sql.Stmt
+
+		stmt, err = c.dbx.PrepareContext(ctx, c.dialect.rewrite(qry))
+
+		if err == nil {
+			c.stmts[qry] = stmt
+		}
 	}
 
 	return
 }
 
+// Returns a query prepared by prepareQry
+func (c *dbConn) stmt(qry string) *sql.Stmt {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.stmts[qry]
+}
+
 type execResult struct {
 	numRowsAffected int
 	lastInsertedId  int
 	apiErr          models.ApiError
-	mysqlCode       uint16
+	violation       string
+}
+
+// Execute a prepared query, which may be a transaction's copy of it. An insert returning the id of the new row is
+// queried for it instead
+func (c *dbConn) exec(ctx context.Context, stmt *sql.Stmt, qry string, args ...interface{}) execResult {
+
+	if c.dialect.returningId && insertsReturningId[qry] {
+
+		var id int
+
+		err := stmt.QueryRowContext(ctx, args...).Scan(&id)
+
+		if err != nil {
+			return c.errorResult(err)
+		}
+
+		return execResult{
+			numRowsAffected: 1,
+			lastInsertedId:  id,
+		}
+	}
+
+	return c.handleResults(stmt.ExecContext(ctx, args...))
 }
 
 // Reduce boiler plate by handling execution results in one place
-func handleResults(result sql.Result, err error) execResult {
+func (c *dbConn) handleResults(result sql.Result, err error) execResult {
 
 	if err == nil {
 
 		affected, err := result.RowsAffected()
 
+		// a dialect which returns ids from the insert does not support LastInsertId
+		if err == nil && c.dialect.returningId {
+
+			return execResult{
+				numRowsAffected: int(affected),
+			}
+		}
+
 		if err == nil {
 
 			lastId, err := result.LastInsertId()
@@ -218,19 +422,42 @@ func handleResults(result sql.Result, err error) execResult {
 		}
 	}
 
-	res := execResult{
-		apiErr: models.ErrorWrap(err),
+	return c.errorResult(err)
+}
+
+func (c *dbConn) errorResult(err error) execResult {
+
+	return execResult{
+		apiErr:    models.ErrorWrap(err),
+		violation: c.dialect.violation(err),
 	}
+}
+
+// Count the rows returned by a COUNT(*) query
+func (c *dbConn) count(ctx context.Context, qry string, args ...interface{}) (int, models.ApiError) {
+
+	var (
+		total int
+		err   error
+	)
+
+	err = c.prepareQry(ctx, qry)
 
-	if mysqlError, ok := err.(*mysql.MySQLError); ok {
-		res.mysqlCode = mysqlError.Number
+	if err != nil {
+		return 0, models.ErrorWrap(err)
 	}
 
-	return res
+	err = c.stmt(qry).QueryRowContext(ctx, args...).Scan(&total)
+
+	if err != nil {
+		return 0, models.ErrorWrap(err)
+	}
+
+	return total, nil
 }
 
-// GetVendors returns an array of vendors
-func (d *dbGate) GetVendors() ([]models.Vendor, models.ApiError) {
+// GetVendors returns a page of up to limit vendors starting at offset, and the total number of vendors
+func (d *dbGate) GetVendors(ctx context.Context, offset, limit int) ([]models.Vendor, int, models.ApiError) {
 
 	var (
 		vs  []models.Vendor
@@ -238,28 +465,36 @@ func (d *dbGate) GetVendors() ([]models.Vendor, models.ApiError) {
 		err error
 	)
 
+	conn := d.reader(ctx)
+
+	total, apiErr := conn.count(ctx, QUERY_COUNT_VENDORS)
+
+	if apiErr != nil {
+		return vs, 0, apiErr
+	}
+
 	qry := QUERY_GET_VENDORS
 
-	err = prepareQry(qry)
+	err = conn.prepareQry(ctx, qry)
 
 	if err != nil {
-		return vs, models.ErrorWrap(err)
+		return vs, 0, models.ErrorWrap(err)
 	}
 
-	rows, err := stmts[qry].Query()
+	rows, err := conn.stmt(qry).QueryContext(ctx, limit, offset)
 
 	if err != nil {
-		return vs, models.ErrorWrap(err)
+		return vs, 0, models.ErrorWrap(err)
 	}
 
 	defer rows.Close()
 
 	for rows.Next() {
 
-		err := rows.Scan(&v.Id, &v.VendorName, &v.Balance)
+		err := rows.Scan(&v.Id, &v.VendorName, &v.Balance, &v.Currency, &v.Category, &v.Mcc)
 
 		if err != nil {
-			return vs, models.ErrorWrap(err)
+			return vs, 0, models.ErrorWrap(err)
 		}
 
 		vs = append(vs, v)
@@ -268,14 +503,14 @@ func (d *dbGate) GetVendors() ([]models.Vendor, models.ApiError) {
 	err = rows.Err()
 
 	if err != nil {
-		return vs, models.ErrorWrap(err)
+		return vs, 0, models.ErrorWrap(err)
 	}
 
-	return vs, nil
+	return vs, total, nil
 }
 
-// GetCustomers returns an array of customers
-func (d *dbGate) GetCustomers() ([]models.Customer, models.ApiError) {
+// GetCustomers returns a page of up to limit customers starting at offset, and the total number of customers
+func (d *dbGate) GetCustomers(ctx context.Context, offset, limit int) ([]models.Customer, int, models.ApiError) {
 
 	var (
 		cs  []models.Customer
@@ -283,18 +518,26 @@ func (d *dbGate) GetCustomers() ([]models.Customer, models.ApiError) {
 		err error
 	)
 
+	conn := d.reader(ctx)
+
+	total, apiErr := conn.count(ctx, QUERY_COUNT_CUSTOMERS)
+
+	if apiErr != nil {
+		return cs, 0, apiErr
+	}
+
 	qry := QUERY_GET_CUSTOMERS
 
-	err = prepareQry(qry)
+	err = conn.prepareQry(ctx, qry)
 
 	if err != nil {
-		return cs, models.ErrorWrap(err)
+		return cs, 0, models.ErrorWrap(err)
 	}
 
-	rows, err := stmts[qry].Query()
+	rows, err := conn.stmt(qry).QueryContext(ctx, limit, offset)
 
 	if err != nil {
-		return cs, models.ErrorWrap(err)
+		return cs, 0, models.ErrorWrap(err)
 	}
 
 	defer rows.Close()
@@ -304,7 +547,7 @@ func (d *dbGate) GetCustomers() ([]models.Customer, models.ApiError) {
 		err := rows.Scan(&c.Id, &c.Fullname)
 
 		if err != nil {
-			return cs, models.ErrorWrap(err)
+			return cs, 0, models.ErrorWrap(err)
 		}
 
 		cs = append(cs, c)
@@ -313,14 +556,14 @@ func (d *dbGate) GetCustomers() ([]models.Customer, models.ApiError) {
 	err = rows.Err()
 
 	if err != nil {
-		return cs, models.ErrorWrap(err)
+		return cs, 0, models.ErrorWrap(err)
 	}
 
-	return cs, nil
+	return cs, total, nil
 }
 
 // GetCustomer returns a customer object including associated cards
-func (d *dbGate) GetCustomer(id int) (models.Customer, models.ApiError) {
+func (d *dbGate) GetCustomer(ctx context.Context, id int) (models.Customer, models.ApiError) {
 
 	var (
 		cu  models.Customer
@@ -328,15 +571,17 @@ func (d *dbGate) GetCustomer(id int) (models.Customer, models.ApiError) {
 		err error
 	)
 
+	conn := d.reader(ctx)
+
 	qry := QUERY_GET_CUSTOMER_ALL
 
-	err = prepareQry(qry)
+	err = conn.prepareQry(ctx, qry)
 
 	if err != nil {
 		return cu, models.ErrorWrap(err)
 	}
 
-	rows, err := stmts[qry].Query(id)
+	rows, err := conn.stmt(qry).QueryContext(ctx, id)
 
 	if err != nil {
 		return cu, models.ErrorWrap(err)
@@ -346,8 +591,8 @@ func (d *dbGate) GetCustomer(id int) (models.Customer, models.ApiError) {
 
 	for rows.Next() {
 
-		//cu.id, cu.fullname, c.id, c.balance, c.available, c.ts
-		err := rows.Scan(&cu.Id, &cu.Fullname, &c.Id, &c.Balance, &c.Available, &c.Ts)
+		//cu.id, cu.fullname, c.id, c.balance, c.available, c.status, c.ts, c.currency
+		err := rows.Scan(&cu.Id, &cu.Fullname, &c.Id, &c.Balance, &c.Available, &c.Status, scanNullDatetime(&c.Ts), &c.Currency)
 
 		if err != nil {
 			return cu, models.ErrorWrap(err)
@@ -373,7 +618,7 @@ func (d *dbGate) GetCustomer(id int) (models.Customer, models.ApiError) {
 }
 
 // GetVendor returns a vendor object, including associated authorisations
-func (d *dbGate) GetVendor(id int) (models.Vendor, models.ApiError) {
+func (d *dbGate) GetVendor(ctx context.Context, id int) (models.Vendor, models.ApiError) {
 
 	var (
 		v   models.Vendor
@@ -381,15 +626,17 @@ func (d *dbGate) GetVendor(id int) (models.Vendor, models.ApiError) {
 		err error
 	)
 
+	conn := d.reader(ctx)
+
 	qry := QUERY_GET_VENDOR_ALL
 
-	err = prepareQry(qry)
+	err = conn.prepareQry(ctx, qry)
 
 	if err != nil {
 		return v, models.ErrorWrap(err)
 	}
 
-	rows, err := stmts[qry].Query(id)
+	rows, err := conn.stmt(qry).QueryContext(ctx, id)
 
 	if err != nil {
 		return v, models.ErrorWrap(err)
@@ -399,8 +646,8 @@ func (d *dbGate) GetVendor(id int) (models.Vendor, models.ApiError) {
 
 	for rows.Next() {
 
-		//v.id, v.vendor_name, v.balance, a.id, a.amount, a.card_id, a.description, a.captured, a.reversed, a.refunded, a.ts
-		err := rows.Scan(&v.Id, &v.VendorName, &v.Balance, &a.Amount, &a.Id, &a.CardId, &a.Description, &a.Captured, &a.Reversed, &a.Refunded, &a.Ts)
+		//v.id, v.vendor_name, v.balance, a.id, a.amount, a.card_id, a.description, a.captured, a.reversed, a.refunded, a.ts, v.currency, a.currency, a.card_currency, a.rate, v.category, v.mcc
+		err := rows.Scan(&v.Id, &v.VendorName, &v.Balance, &a.Id, &a.Amount, &a.CardId, &a.Description, &a.Captured, &a.Reversed, &a.Refunded, scanNullDatetime(&a.Ts), &v.Currency, &a.Currency, &a.CardCurrency, &a.Rate, &v.Category, &v.Mcc)
 
 		if err != nil {
 			return v, models.ErrorWrap(err)
@@ -425,7 +672,7 @@ func (d *dbGate) GetVendor(id int) (models.Vendor, models.ApiError) {
 	return v, nil
 }
 
-func (d *dbGate) getVendor(id int) (models.Vendor, models.ApiError) {
+func (c *dbConn) getVendor(ctx context.Context, id int) (models.Vendor, models.ApiError) {
 
 	var (
 		v   models.Vendor
@@ -434,13 +681,13 @@ func (d *dbGate) getVendor(id int) (models.Vendor, models.ApiError) {
 
 	qry := QUERY_GET_VENDOR
 
-	err = prepareQry(qry)
+	err = c.prepareQry(ctx, qry)
 
 	if err != nil {
 		return v, models.ErrorWrap(err)
 	}
 
-	err = stmts[qry].QueryRow(id).Scan(&v.Id, &v.VendorName, &v.Balance)
+	err = c.stmt(qry).QueryRowContext(ctx, id).Scan(&v.Id, &v.VendorName, &v.Balance, &v.Currency, &v.Category, &v.Mcc)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -452,22 +699,34 @@ func (d *dbGate) getVendor(id int) (models.Vendor, models.ApiError) {
 	return v, nil
 }
 
-func (d *dbGate) getAuthorisation(id int) (models.Authorisation, models.ApiError) {
+// Scan the row of QUERY_GET_AUTHORISATION
+func scanAuthorisation(row *sql.Row) (models.Authorisation, error) {
 	var (
-		a   models.Authorisation
-		err error
+		a             models.Authorisation
+		expiresAt     sql.NullString
+		disputeStatus sql.NullString
 	)
 
+	// id, amount, card_id, vendor_id, description, captured, reversed, refunded, expires_at, currency, card_currency, rate, status, disputed, dispute_status
+	err := row.Scan(&a.Id, &a.Amount, &a.CardId, &a.VendorId, &a.Description, &a.Captured, &a.Reversed, &a.Refunded, scanNullDatetime(&expiresAt), &a.Currency, &a.CardCurrency, &a.Rate, &a.Status, &a.Disputed, &disputeStatus)
+
+	a.ExpiresAt = expiresAt.String
+	a.DisputeStatus = disputeStatus.String
+
+	return a, err
+}
+
+func (d *dbGate) getAuthorisation(ctx context.Context, id int) (models.Authorisation, models.ApiError) {
+
 	qry := QUERY_GET_AUTHORISATION
 
-	err = prepareQry(qry)
+	err := d.prepareQry(ctx, qry)
 
 	if err != nil {
-		return a, models.ErrorWrap(err)
+		return models.Authorisation{}, models.ErrorWrap(err)
 	}
 
-	// id, amount, card_id, vendor_id, description, captured, reversed, refunded
-	err = stmts[qry].QueryRow(id).Scan(&a.Id, &a.Amount, &a.CardId, &a.VendorId, &a.Description, &a.Captured, &a.Reversed, &a.Refunded)
+	a, err := scanAuthorisation(d.stmt(qry).QueryRowContext(ctx, id))
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -479,35 +738,72 @@ func (d *dbGate) getAuthorisation(id int) (models.Authorisation, models.ApiError
 	return a, nil
 }
 
+// Returns an authorisation as updated by the guarded update of a transaction, for the running totals from which the
+// change on the card is converted. In a single currency the change on the card is the amount itself, so the
+// authorisation as read before the transaction serves.
+func (d *dbGate) guardedAuthorisation(ctx context.Context, tx *sql.Tx, auth models.Authorisation) (models.Authorisation, models.ApiError) {
+
+	if auth.Currency == auth.CardCurrency {
+		return auth, nil
+	}
+
+	qry := QUERY_GET_AUTHORISATION
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	a, err := scanAuthorisation(tx.StmtContext(ctx, d.stmt(qry)).QueryRowContext(ctx, auth.Id))
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	return a, nil
+}
+
 // GetAuthorisation returns an authorisation object, including associated movements such as capture etc
-func (d *dbGate) GetAuthorisation(id int) (models.Authorisation, models.ApiError) {
+func (d *dbGate) GetAuthorisation(ctx context.Context, id int) (models.Authorisation, models.ApiError) {
 	var (
-		a   models.Authorisation
-		m   models.NullableMovement
-		err error
+		a             models.Authorisation
+		m             models.NullableMovement
+		expiresAt     sql.NullString
+		disputeStatus sql.NullString
+		err           error
 	)
 
+	conn := d.reader(ctx)
+
 	qry := QUERY_GET_AUTHORISATION_ALL
 
-	err = prepareQry(qry)
+	err = conn.prepareQry(ctx, qry)
 
 	if err != nil {
 		return a, models.ErrorWrap(err)
 	}
 
-	rows, err := stmts[qry].Query(id)
+	rows, err := conn.stmt(qry).QueryContext(ctx, id)
+
+	if err != nil {
+		return a, models.ErrorWrap(err)
+	}
 
 	defer rows.Close()
 
 	for rows.Next() {
 
-		//a.id, a.amount, a.card_id, a.vendor_id, a.description, a.captured, a.reversed, a.refunded, m.amount, m.description, m.movement_type, m.ts
-		err := rows.Scan(&a.Id, &a.Amount, &a.CardId, &a.VendorId, &a.Description, &a.Captured, &a.Reversed, &a.Refunded, &m.Id, &m.Amount, &m.Description, &m.MovementType, &m.Ts)
+		//a.id, a.amount, a.card_id, a.vendor_id, a.description, a.captured, a.reversed, a.refunded, a.expires_at, m.id, m.amount, m.description, m.movement_type, m.ts, a.currency, a.card_currency, a.rate, a.status, a.disputed, a.dispute_status, a.mcc
+		err := rows.Scan(&a.Id, &a.Amount, &a.CardId, &a.VendorId, &a.Description, &a.Captured, &a.Reversed, &a.Refunded, scanNullDatetime(&expiresAt), &m.Id, &m.Amount, &m.Description, &m.MovementType, scanNullDatetime(&m.Ts), &a.Currency, &a.CardCurrency, &a.Rate, &a.Status, &a.Disputed, &disputeStatus, &a.Mcc)
 
 		if err != nil {
 			return a, models.ErrorWrap(err)
 		}
 
+		a.ExpiresAt = expiresAt.String
+		a.DisputeStatus = disputeStatus.String
+
 		if m.Valid() {
 			m.ParentId.Int64 = int64(id)
 			a.Movements = append(a.Movements, m.AuthMovement())
@@ -527,7 +823,7 @@ func (d *dbGate) GetAuthorisation(id int) (models.Authorisation, models.ApiError
 	return a, nil
 }
 
-func (d *dbGate) getCard(id int) (models.Card, models.ApiError) {
+func (d *dbGate) getCard(ctx context.Context, id int) (models.Card, models.ApiError) {
 
 	var (
 		c   models.Card
@@ -536,13 +832,13 @@ func (d *dbGate) getCard(id int) (models.Card, models.ApiError) {
 
 	qry := QUERY_GET_CARD
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return c, models.ErrorWrap(err)
 	}
 
-	err = stmts[qry].QueryRow(id).Scan(&c.Id, &c.Balance, &c.Available, &c.Ts)
+	err = d.stmt(qry).QueryRowContext(ctx, id).Scan(&c.Id, &c.Balance, &c.Available, &c.Status, scanDatetime(&c.Ts), &c.Currency)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -555,7 +851,7 @@ func (d *dbGate) getCard(id int) (models.Card, models.ApiError) {
 }
 
 // GetCard  returns a card object, including movements such as top-ups, payments, refunds
-func (d *dbGate) GetCard(id int) (models.Card, models.ApiError) {
+func (d *dbGate) GetCard(ctx context.Context, id int) (models.Card, models.ApiError) {
 
 	var (
 		c   models.Card
@@ -563,22 +859,28 @@ func (d *dbGate) GetCard(id int) (models.Card, models.ApiError) {
 		err error
 	)
 
+	conn := d.reader(ctx)
+
 	qry := QUERY_GET_CARD_ALL
 
-	err = prepareQry(qry)
+	err = conn.prepareQry(ctx, qry)
 
 	if err != nil {
 		return c, models.ErrorWrap(err)
 	}
 
-	rows, err := stmts[qry].Query(id)
+	rows, err := conn.stmt(qry).QueryContext(ctx, id)
+
+	if err != nil {
+		return c, models.ErrorWrap(err)
+	}
 
 	defer rows.Close()
 
 	for rows.Next() {
 
-		//c.id, c.balance, c.available, c.customer_id, c.ts, m.id, m.amount, m.description, m.movement_type, m.ts
-		err := rows.Scan(&c.Id, &c.Balance, &c.Available, &c.CustomerId, &c.Ts, &m.Id, &m.Amount, &m.Description, &m.MovementType, &m.Ts)
+		//c.id, c.balance, c.available, c.customer_id, c.status, c.ts, m.id, m.amount, m.description, m.movement_type, m.ts, m.related_movement_id, c.currency
+		err := rows.Scan(&c.Id, &c.Balance, &c.Available, &c.CustomerId, &c.Status, scanDatetime(&c.Ts), &m.Id, &m.Amount, &m.Description, &m.MovementType, scanNullDatetime(&m.Ts), &m.RelatedId, &c.Currency)
 
 		if err != nil {
 			return c, models.ErrorWrap(err)
@@ -604,25 +906,50 @@ func (d *dbGate) GetCard(id int) (models.Card, models.ApiError) {
 }
 
 // AddOrUpdateVendor adds a vendor taking a vendor object, or if an id already exists updates an existing vendor
-func (d *dbGate) AddOrUpdateVendor(v models.Vendor) (models.Vendor, models.ApiError) {
+func (d *dbGate) AddOrUpdateVendor(ctx context.Context, v models.Vendor) (models.Vendor, models.ApiError) {
 
 	var (
 		err error
 	)
 
+	apiErr := checkCategory(v.Category, "AddOrUpdateVendor")
+
+	if apiErr != nil {
+		return models.Vendor{}, apiErr
+	}
+
+	apiErr = checkMcc(v.Mcc, "AddOrUpdateVendor")
+
+	if apiErr != nil {
+		return models.Vendor{}, apiErr
+	}
+
 	qry := QUERY_ADD_VENDOR
+	args := []interface{}{v.VendorName, v.Category, v.Mcc}
 
+	// the currency of an existing vendor cannot change, as its balance and authorisations are in it
 	if v.Id > 0 {
 		qry = QUERY_UPDATE_VENDOR_DETAILS
+		args = append(args, v.Id)
+	} else {
+
+		currency, apiErr := d.fx.checkCurrency(v.Currency, "AddOrUpdateVendor")
+
+		if apiErr != nil {
+			return models.Vendor{}, apiErr
+		}
+
+		v.Currency = currency
+		args = append(args, currency)
 	}
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return models.Vendor{}, models.ErrorWrap(err)
 	}
 
-	res := handleResults(stmts[qry].Exec(v.VendorName))
+	res := d.exec(ctx, d.stmt(qry), qry, args...)
 
 	if res.apiErr != nil {
 		return models.Vendor{}, res.apiErr
@@ -644,25 +971,27 @@ func (d *dbGate) AddOrUpdateVendor(v models.Vendor) (models.Vendor, models.ApiEr
 }
 
 // AddOrUpdateCustomer adds a customer taking a customer object, or if an id already exists updates an existing customer
-func (d *dbGate) AddOrUpdateCustomer(c models.Customer) (models.Customer, models.ApiError) {
+func (d *dbGate) AddOrUpdateCustomer(ctx context.Context, c models.Customer) (models.Customer, models.ApiError) {
 
 	var (
 		err error
 	)
 
 	qry := QUERY_ADD_CUSTOMER
+	args := []interface{}{c.Fullname}
 
 	if c.Id > 0 {
 		qry = QUERY_UPDATE_CUSTOMER_DETAILS
+		args = append(args, c.Id)
 	}
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return models.Customer{}, models.ErrorWrap(err)
 	}
 
-	res := handleResults(stmts[qry].Exec(c.Fullname))
+	res := d.exec(ctx, d.stmt(qry), qry, args...)
 
 	if res.apiErr != nil {
 		return models.Customer{}, res.apiErr
@@ -679,27 +1008,33 @@ func (d *dbGate) AddOrUpdateCustomer(c models.Customer) (models.Customer, models
 	return c, nil
 }
 
-// AddCard adds a card to a customer, taking a customer id and returning a card object
-func (d *dbGate) AddCard(customerId int) (models.Card, models.ApiError) {
+// AddCard adds a card to a customer in a currency, taking a customer id and returning a card object
+func (d *dbGate) AddCard(ctx context.Context, customerId int, currency string) (models.Card, models.ApiError) {
 
 	var (
 		c   models.Card
 		err error
 	)
 
+	currency, apiErr := d.fx.checkCurrency(currency, "AddCard")
+
+	if apiErr != nil {
+		return c, apiErr
+	}
+
 	qry := QUERY_ADD_CARD
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return c, models.ErrorWrap(err)
 	}
 
-	res := handleResults(stmts[qry].Exec(customerId))
+	res := d.exec(ctx, d.stmt(qry), qry, customerId, currency)
 
 	if res.apiErr != nil {
 
-		if res.mysqlCode == MYSQL_ERROR_FOREIGN_KEY {
+		if res.violation == VIOLATION_FOREIGN_KEY {
 			return c, models.ConstructApiError(400, MESSAGE_BAD_ID, "AddCard", "customer", customerId)
 		}
 
@@ -709,15 +1044,19 @@ func (d *dbGate) AddCard(customerId int) (models.Card, models.ApiError) {
 	c = models.Card{
 		CustomerId: customerId,
 		Id:         res.lastInsertedId,
+		Status:     CARD_STATUS_ACTIVE,
+		Currency:   currency,
 	}
 
 	return c, nil
 }
 
-// Authorise requests authorisation of a payment and returns an authorisation code
-func (d *dbGate) Authorise(cardId, vendorId, amount int, description string) (int, models.ApiError) {
+// Authorise requests authorisation of a payment in the vendor's currency and returns an authorisation code. The hold
+// on a card in another currency is the amount converted at the current rate, which is locked for the authorisation.
+// The hold must be within the spending limits of the card, and the payment is scored by the RiskEvaluator
+func (d *dbGate) Authorise(ctx context.Context, cardId, vendorId, amount int, currency, description string) (int, models.ApiError) {
 
-	_, apiErr := d.getVendor(vendorId)
+	v, apiErr := d.getVendor(ctx, vendorId)
 
 	if apiErr != nil {
 
@@ -728,7 +1067,7 @@ func (d *dbGate) Authorise(cardId, vendorId, amount int, description string) (in
 		return -1, models.ConstructApiError(400, MESSAGE_BAD_ID, "Authorise", "vendor", vendorId)
 	}
 
-	c, apiErr := d.getCard(cardId)
+	c, apiErr := d.getCard(ctx, cardId)
 
 	if apiErr != nil {
 
@@ -739,11 +1078,80 @@ func (d *dbGate) Authorise(cardId, vendorId, amount int, description string) (in
 		return -1, models.ConstructApiError(400, MESSAGE_BAD_ID, "Authorise", "card", cardId)
 	}
 
-	if c.Available < amount {
-		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "Authorise", float32(amount)/100, float32(c.Available)/100)
+	apiErr = checkCardUsable(c, authorisableStatuses, "Authorise")
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	currency, apiErr = checkAmountCurrency(currency, v.Currency, "vendor", vendorId, "Authorise")
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	rate, apiErr := d.fx.rate(currency, c.Currency, "Authorise")
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	hold := convert(amount, rate, currency, c.Currency)
+
+	if c.Available < hold {
+		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "Authorise", models.Money{Amount: hold, Currency: c.Currency}, models.Money{Amount: c.Available, Currency: c.Currency})
 	}
 
-	tx, err := dbx.Begin()
+	limits, apiErr := d.getLimits(ctx, QUERY_GET_CARD_LIMITS, c.Id, "card", "Authorise")
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	controls, apiErr := d.getMccControls(ctx, c.Id, "Authorise")
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	now := clock()
+
+	history, apiErr := d.getRecentAuthorisations(ctx, cardId, now.Add(-RISK_HISTORY))
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	// the limits are checked first against the history read for the risk evaluation, so that an authorisation over
+	// them is refused without a transaction, then again once the hold is placed
+	apiErr = checkLimits(limits, c, vendorId, hold, history, now)
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	apiErr = checkMccControls(controls, c, v)
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	status, reason, apiErr := evaluateRisk(ctx, d.risk, RiskRequest{
+		Card:        c,
+		Vendor:      v,
+		Amount:      amount,
+		Currency:    currency,
+		Hold:        hold,
+		Description: description,
+		History:     history,
+		Now:         now,
+	})
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
@@ -751,53 +1159,86 @@ func (d *dbGate) Authorise(cardId, vendorId, amount int, description string) (in
 
 	defer tx.Rollback()
 
-	qry := QUERY_UPDATE_CARD
+	qry := QUERY_HOLD_CARD
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	res := handleResults(tx.Stmt(stmts[qry]).Exec(0, -amount, cardId))
+	// the hold is conditional on the available funds so that concurrent authorisations cannot overdraw the card, and on
+	// the status so that it cannot race a change of status
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, hold, cardId, hold)
 
 	if res.apiErr != nil {
 		return -1, res.apiErr
 	}
 
-	//double check that exactly one row was updated
-
 	if res.numRowsAffected != 1 {
-		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE_FOR, "Authorise", float32(amount)/100)
+		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE_FOR, "Authorise", models.Money{Amount: hold, Currency: c.Currency})
+	}
+
+	// the hold locks the card's row until the transaction ends, so concurrent authorisations of the card are checked
+	// here one at a time, each against those committed before it, and cannot together pass a cap
+	apiErr = d.checkLimitsHeld(ctx, tx, limits, c, vendorId, hold, now)
+
+	if apiErr != nil {
+		return -1, apiErr
 	}
 
 	qry = QUERY_ADD_AUTHORISATION
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	res = handleResults(tx.Stmt(stmts[qry]).Exec(cardId, vendorId, amount, description))
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, cardId, vendorId, amount, description, expiryTime(now), currency, c.Currency, rate, status, v.Mcc, datetime(now))
 
-	if err != nil {
+	if res.apiErr != nil {
 		return -1, res.apiErr
 	}
 
+	id := res.lastInsertedId
+
+	apiErr = d.addLedgerEntry(ctx, tx, "AUTHORISATION", description, id, transfer(CardAvailableAccount(cardId), CardHeldAccount(cardId), hold, c.Currency))
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	if status == AUTHORISATION_STATUS_REVIEW {
+
+		qry = QUERY_ADD_AUTH_MOVEMENT
+
+		err = d.prepareQry(ctx, qry)
+
+		if err != nil {
+			return -1, models.ErrorWrap(err)
+		}
+
+		res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, id, 0, reason, "REVIEW")
+
+		if res.apiErr != nil {
+			return -1, res.apiErr
+		}
+	}
+
 	err = tx.Commit()
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	return res.lastInsertedId, nil
+	return id, nil
 }
 
 // TopUp simulates a top-up to a card and returns a top-up code
-func (d *dbGate) TopUp(cardId, amount int, description string) (int, models.ApiError) {
+func (d *dbGate) TopUp(ctx context.Context, cardId, amount int, currency, description string) (int, models.ApiError) {
 
-	_, apiErr := d.getCard(cardId)
+	c, apiErr := d.getCard(ctx, cardId)
 
 	if apiErr != nil {
 
@@ -808,7 +1249,19 @@ func (d *dbGate) TopUp(cardId, amount int, description string) (int, models.ApiE
 		return -1, models.ConstructApiError(400, MESSAGE_BAD_ID, "TopUp", "card", cardId)
 	}
 
-	tx, err := dbx.Begin()
+	apiErr = checkCardUsable(c, topUpStatuses, "TopUp")
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	_, apiErr = checkAmountCurrency(currency, c.Currency, "card", cardId, "TopUp")
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
@@ -816,40 +1269,45 @@ func (d *dbGate) TopUp(cardId, amount int, description string) (int, models.ApiE
 
 	defer tx.Rollback()
 
-	qry := QUERY_UPDATE_CARD
+	qry := QUERY_TOP_UP_CARD
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	res := handleResults(tx.Stmt(stmts[qry]).Exec(amount, amount, cardId))
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, amount, amount, cardId)
 
-	if err != nil {
+	if res.apiErr != nil {
 		return -1, res.apiErr
 	}
 
-	//double check that exactly one row was updated
-
+	// the status has changed since the card was read
 	if res.numRowsAffected != 1 {
-		return -1, models.ConstructApiError(500, MESSAGE_INVALID_ROW_UPDATE, "TopUp")
+		return -1, models.ConstructApiError(409, MESSAGE_CARD_STATUS_CHANGED, "TopUp", cardId)
 	}
 
 	qry = QUERY_ADD_MOVEMENT
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	res = handleResults(tx.Stmt(stmts[qry]).Exec(cardId, amount, description, "TOP-UP"))
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, cardId, amount, description, "TOP-UP")
 
 	if res.apiErr != nil {
 		return -1, res.apiErr
 	}
 
+	apiErr = d.addLedgerEntry(ctx, tx, "TOP-UP", description, res.lastInsertedId, transfer(LEDGER_ACCOUNT_FUNDING, CardAvailableAccount(cardId), amount, c.Currency))
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
 	err = tx.Commit()
 
 	if err != nil {
@@ -859,10 +1317,37 @@ func (d *dbGate) TopUp(cardId, amount int, description string) (int, models.ApiE
 	return res.lastInsertedId, nil
 }
 
+// Apply a guarded update to an authorisation within a transaction, as the first statement of the transaction so that
+// the row lock it takes serialises concurrent captures, refunds and reversals of the same authorisation.
+// The update only succeeds if the guard (amount remaining to be captured or refunded) still covers the amount.
+// Any further guard arguments, such as the time for the capture expiry guard, follow the standard ones.
+func (d *dbGate) guardAuthorisation(ctx context.Context, tx *sql.Tx, qry string, auth models.Authorisation, amount int, context string, guardArgs ...interface{}) models.ApiError {
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	args := append([]interface{}{amount, auth.Id, amount}, guardArgs...)
+
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, args...)
+
+	if res.apiErr != nil {
+		return res.apiErr
+	}
+
+	if res.numRowsAffected != 1 {
+		return models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE_FOR, context, models.Money{Amount: amount, Currency: auth.Currency})
+	}
+
+	return nil
+}
+
 // Capture requests the capture of all or part of an authorised payment and returns a capture code
-func (d *dbGate) Capture(authorisationId, amount int) (int, models.ApiError) {
+func (d *dbGate) Capture(ctx context.Context, authorisationId, amount int, currency string) (int, models.ApiError) {
 
-	auth, apiErr := d.getAuthorisation(authorisationId)
+	auth, apiErr := d.getAuthorisation(ctx, authorisationId)
 
 	if apiErr != nil {
 
@@ -873,48 +1358,68 @@ func (d *dbGate) Capture(authorisationId, amount int) (int, models.ApiError) {
 		return -1, models.ConstructApiError(400, MESSAGE_BAD_ID, "Capture", "authorisation", authorisationId)
 	}
 
-	if amount > auth.Capturable() {
-		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "Capture", float32(amount)/100, float32(auth.Capturable())/100)
+	_, apiErr = checkAmountCurrency(currency, auth.Currency, "authorisation", auth.Id, "Capture")
+
+	if apiErr != nil {
+		return -1, apiErr
 	}
 
-	tx, err := dbx.Begin()
+	now := clock()
 
-	if err != nil {
-		return -1, models.ErrorWrap(err)
+	if expired(auth, now) {
+		return -1, models.ConstructApiError(400, MESSAGE_AUTHORISATION_EXPIRED, "Capture", auth.Id, auth.ExpiresAt)
 	}
 
-	defer tx.Rollback()
+	if auth.Status == AUTHORISATION_STATUS_REVIEW {
+		return -1, models.ConstructApiError(409, MESSAGE_AUTHORISATION_IN_REVIEW, "Capture", auth.Id)
+	}
 
-	qry := QUERY_UPDATE_CARD
+	if amount > auth.Capturable() {
+		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "Capture", models.Money{Amount: amount, Currency: auth.Currency}, models.Money{Amount: auth.Capturable(), Currency: auth.Currency})
+	}
+
+	fees, apiErr := d.getVendorFees(ctx, auth.VendorId, "Capture")
 
-	err = prepareQry(qry)
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	fee := fees.Fee(amount)
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	res := handleResults(tx.Stmt(stmts[qry]).Exec(-amount, 0, auth.CardId))
+	defer tx.Rollback()
 
-	if res.apiErr != nil {
-		return -1, res.apiErr
+	// the expiry is guarded too, so that a capture cannot race the expiry sweep
+	apiErr = d.guardAuthorisation(ctx, tx, QUERY_CAPTURE_AUTH, auth, amount, "Capture", datetime(now))
+
+	if apiErr != nil {
+		return -1, apiErr
 	}
 
-	//double check that exactly one row was updated
+	guarded, apiErr := d.guardedAuthorisation(ctx, tx, auth)
 
-	if res.numRowsAffected != 1 {
-		return -1, models.ConstructApiError(500, MESSAGE_INVALID_ROW_UPDATE, "Capture")
+	if apiErr != nil {
+		return -1, apiErr
 	}
 
-	qry = QUERY_UPDATE_AUTH
+	// the capture takes its share of the hold, which is released as the captured and reversed amounts total up
+	released := guarded.Captured + guarded.Reversed
+	cardAmount := cardChange(guarded, released-amount, released)
+
+	qry := QUERY_UPDATE_CARD
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	//captured = captured + ?, refunded = refunded + ?, reversed = reversed + ?
-	res = handleResults(tx.Stmt(stmts[qry]).Exec(amount, 0, 0, auth.Id))
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, -cardAmount, 0, auth.CardId)
 
 	if res.apiErr != nil {
 		return -1, res.apiErr
@@ -926,16 +1431,17 @@ func (d *dbGate) Capture(authorisationId, amount int) (int, models.ApiError) {
 		return -1, models.ConstructApiError(500, MESSAGE_INVALID_ROW_UPDATE, "Capture")
 	}
 
-	// this is only done in this simulation so that the effect of capturing is easily visible through a UI
+	// this is only done in this simulation so that the effect of capturing is easily visible through a UI. The vendor is
+	// credited net of the fee
 	qry = QUERY_UPDATE_VENDOR
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	res = handleResults(tx.Stmt(stmts[qry]).Exec(amount, auth.VendorId))
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, amount-fee, auth.VendorId)
 
 	if res.apiErr != nil {
 		return -1, res.apiErr
@@ -949,13 +1455,13 @@ func (d *dbGate) Capture(authorisationId, amount int) (int, models.ApiError) {
 
 	qry = QUERY_ADD_MOVEMENT
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	res = handleResults(tx.Stmt(stmts[qry]).Exec(auth.CardId, -amount, auth.Description, "PURCHASE")) //? add original purchase date from auth.Ts
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, auth.CardId, -cardAmount, auth.Description, "PURCHASE") //? add original purchase date from auth.Ts
 
 	if res.apiErr != nil {
 		return -1, res.apiErr
@@ -963,31 +1469,49 @@ func (d *dbGate) Capture(authorisationId, amount int) (int, models.ApiError) {
 
 	qry = QUERY_ADD_AUTH_MOVEMENT
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	res = handleResults(tx.Stmt(stmts[qry]).Exec(auth.Id, amount, fmt.Sprintf("Capture of £%.2f", float32(amount)/100), "CAPTURE"))
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, auth.Id, amount, "Capture of "+models.FormatAmount(amount, auth.Currency), "CAPTURE")
 
 	if res.apiErr != nil {
 		return -1, res.apiErr
 	}
 
+	id := res.lastInsertedId
+
+	apiErr = d.addLedgerEntry(ctx, tx, "CAPTURE", auth.Description, id,
+		exchange(CardHeldAccount(auth.CardId), cardAmount, auth.CardCurrency, VendorAccount(auth.VendorId), amount, auth.Currency))
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	if fee > 0 {
+
+		apiErr = d.chargeCaptureFee(ctx, tx, auth, amount, fee)
+
+		if apiErr != nil {
+			return -1, apiErr
+		}
+	}
+
 	err = tx.Commit()
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	return res.lastInsertedId, nil
+	return id, nil
 }
 
 // Refund requests a refund all or part of a captured payment and returns a refund code
-func (d *dbGate) Refund(authorisationId, amount int, description string) (int, models.ApiError) {
+func (d *dbGate) Refund(ctx context.Context, authorisationId, amount int, currency, description string) (int, models.ApiError) {
 
-	auth, apiErr := d.getAuthorisation(authorisationId)
+	auth, apiErr := d.getAuthorisation(ctx, authorisationId)
 
 	if apiErr != nil {
 
@@ -998,11 +1522,17 @@ func (d *dbGate) Refund(authorisationId, amount int, description string) (int, m
 		return -1, models.ConstructApiError(400, MESSAGE_BAD_ID, "Refund", "authorisation", authorisationId)
 	}
 
+	_, apiErr = checkAmountCurrency(currency, auth.Currency, "authorisation", auth.Id, "Refund")
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
 	if amount > auth.Refundable() {
-		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "Refund", float32(amount)/100, float32(auth.Refundable())/100)
+		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "Refund", models.Money{Amount: amount, Currency: auth.Currency}, models.Money{Amount: auth.Refundable(), Currency: auth.Currency})
 	}
 
-	tx, err := dbx.Begin()
+	tx, err := d.dbx.BeginTx(ctx, nil)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
@@ -1010,36 +1540,30 @@ func (d *dbGate) Refund(authorisationId, amount int, description string) (int, m
 
 	defer tx.Rollback()
 
-	qry := QUERY_UPDATE_CARD
-
-	err = prepareQry(qry)
+	apiErr = d.guardAuthorisation(ctx, tx, QUERY_REFUND_AUTH, auth, amount, "Refund")
 
-	if err != nil {
-		return -1, models.ErrorWrap(err)
+	if apiErr != nil {
+		return -1, apiErr
 	}
 
-	res := handleResults(tx.Stmt(stmts[qry]).Exec(amount, amount, auth.CardId))
+	guarded, apiErr := d.guardedAuthorisation(ctx, tx, auth)
 
-	if res.apiErr != nil {
-		return -1, res.apiErr
+	if apiErr != nil {
+		return -1, apiErr
 	}
 
-	//double check that exactly one row was updated
-
-	if res.numRowsAffected != 1 {
-		return -1, models.ConstructApiError(500, MESSAGE_INVALID_ROW_UPDATE, "Refund")
-	}
+	// refunded at the rate locked when the payment was authorised
+	cardAmount := cardChange(guarded, guarded.Refunded-amount, guarded.Refunded)
 
-	qry = QUERY_UPDATE_AUTH
+	qry := QUERY_UPDATE_CARD
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	//captured = captured + ?, refunded = refunded + ?, reversed = reversed + ?
-	res = handleResults(tx.Stmt(stmts[qry]).Exec(0, amount, 0, auth.Id))
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, cardAmount, cardAmount, auth.CardId)
 
 	if res.apiErr != nil {
 		return -1, res.apiErr
@@ -1048,19 +1572,19 @@ func (d *dbGate) Refund(authorisationId, amount int, description string) (int, m
 	//double check that exactly one row was updated
 
 	if res.numRowsAffected != 1 {
-		return -1, models.ConstructApiError(500, MESSAGE_INVALID_ROW_UPDATE, "Capture")
+		return -1, models.ConstructApiError(500, MESSAGE_INVALID_ROW_UPDATE, "Refund")
 	}
 
 	// this is only done in this simulation so that the effect of capturing is easily visible through a UI
 	qry = QUERY_UPDATE_VENDOR
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	res = handleResults(tx.Stmt(stmts[qry]).Exec(-amount, auth.VendorId))
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, -amount, auth.VendorId)
 
 	if res.apiErr != nil {
 		return -1, res.apiErr
@@ -1074,13 +1598,13 @@ func (d *dbGate) Refund(authorisationId, amount int, description string) (int, m
 
 	qry = QUERY_ADD_MOVEMENT
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	res = handleResults(tx.Stmt(stmts[qry]).Exec(auth.CardId, amount, description, "REFUND"))
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, auth.CardId, cardAmount, description, "REFUND")
 
 	if res.apiErr != nil {
 		return -1, res.apiErr
@@ -1088,18 +1612,25 @@ func (d *dbGate) Refund(authorisationId, amount int, description string) (int, m
 
 	qry = QUERY_ADD_AUTH_MOVEMENT
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	res = handleResults(tx.Stmt(stmts[qry]).Exec(auth.Id, -amount, description, "REFUND"))
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, auth.Id, -amount, description, "REFUND")
 
 	if res.apiErr != nil {
 		return -1, res.apiErr
 	}
 
+	apiErr = d.addLedgerEntry(ctx, tx, "REFUND", description, res.lastInsertedId,
+		exchange(VendorAccount(auth.VendorId), amount, auth.Currency, CardAvailableAccount(auth.CardId), cardAmount, auth.CardCurrency))
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
 	err = tx.Commit()
 
 	if err != nil {
@@ -1110,9 +1641,9 @@ func (d *dbGate) Refund(authorisationId, amount int, description string) (int, m
 }
 
 // Reverse requests a reversal of all or part of a authorisation and returns a reversal code
-func (d *dbGate) Reverse(authorisationId, amount int, description string) (int, models.ApiError) {
+func (d *dbGate) Reverse(ctx context.Context, authorisationId, amount int, currency, description string) (int, models.ApiError) {
 
-	auth, apiErr := d.getAuthorisation(authorisationId)
+	auth, apiErr := d.getAuthorisation(ctx, authorisationId)
 
 	if apiErr != nil {
 
@@ -1123,11 +1654,24 @@ func (d *dbGate) Reverse(authorisationId, amount int, description string) (int,
 		return -1, models.ConstructApiError(400, MESSAGE_BAD_ID, "Reverse", "authorisation", authorisationId)
 	}
 
+	_, apiErr = checkAmountCurrency(currency, auth.Currency, "authorisation", auth.Id, "Reverse")
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
 	if amount > auth.Capturable() {
-		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "Reverse", float32(amount)/100, float32(auth.Capturable())/100)
+		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "Reverse", models.Money{Amount: amount, Currency: auth.Currency}, models.Money{Amount: auth.Capturable(), Currency: auth.Currency})
 	}
 
-	tx, err := dbx.Begin()
+	return d.releaseHold(ctx, auth, amount, description, "REVERSAL", "Reverse")
+}
+
+// Reverse all or part of the uncaptured amount of an authorisation, releasing it from hold on the card, recording
+// the reversal as an authorisation movement and ledger entry of the given type, and returning its code
+func (d *dbGate) releaseHold(ctx context.Context, auth models.Authorisation, amount int, description, movementType, context string) (int, models.ApiError) {
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
@@ -1135,15 +1679,30 @@ func (d *dbGate) Reverse(authorisationId, amount int, description string) (int,
 
 	defer tx.Rollback()
 
+	apiErr := d.guardAuthorisation(ctx, tx, QUERY_REVERSE_AUTH, auth, amount, context)
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	guarded, apiErr := d.guardedAuthorisation(ctx, tx, auth)
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	released := guarded.Captured + guarded.Reversed
+	cardAmount := cardChange(guarded, released-amount, released)
+
 	qry := QUERY_UPDATE_CARD
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	res := handleResults(tx.Stmt(stmts[qry]).Exec(0, amount, auth.CardId))
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, 0, cardAmount, auth.CardId)
 
 	if res.apiErr != nil {
 		return -1, res.apiErr
@@ -1152,49 +1711,161 @@ func (d *dbGate) Reverse(authorisationId, amount int, description string) (int,
 	//double check that exactly one row was updated
 
 	if res.numRowsAffected != 1 {
-		return -1, models.ConstructApiError(500, MESSAGE_INVALID_ROW_UPDATE, "Reverse")
+		return -1, models.ConstructApiError(500, MESSAGE_INVALID_ROW_UPDATE, context)
 	}
 
-	qry = QUERY_UPDATE_AUTH
+	qry = QUERY_ADD_AUTH_MOVEMENT
 
-	err = prepareQry(qry)
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	//captured = captured + ?, refunded = refunded + ?, reversed = reversed + ?
-	res = handleResults(tx.Stmt(stmts[qry]).Exec(0, 0, amount, auth.Id))
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, auth.Id, -amount, description, movementType)
 
 	if res.apiErr != nil {
 		return -1, res.apiErr
 	}
 
-	//double check that exactly one row was updated
+	apiErr = d.addLedgerEntry(ctx, tx, movementType, description, res.lastInsertedId, transfer(CardHeldAccount(auth.CardId), CardAvailableAccount(auth.CardId), cardAmount, auth.CardCurrency))
 
-	if res.numRowsAffected != 1 {
-		return -1, models.ConstructApiError(500, MESSAGE_INVALID_ROW_UPDATE, "Reverse")
+	if apiErr != nil {
+		return -1, apiErr
 	}
 
-	qry = QUERY_ADD_AUTH_MOVEMENT
-
-	err = prepareQry(qry)
+	err = tx.Commit()
 
 	if err != nil {
 		return -1, models.ErrorWrap(err)
 	}
 
-	res = handleResults(tx.Stmt(stmts[qry]).Exec(auth.Id, -amount, description, "REVERSAL"))
+	return res.lastInsertedId, nil
+}
+
+// ClaimIdempotencyKey records a new idempotency key with the fingerprint of the request using it, returning true.
+// If the key has already been claimed it returns the existing record and false, unless it was claimed for the same
+// request more than IDEMPOTENCY_CLAIM_TIMEOUT ago and never completed, when it is claimed again
+func (d *dbGate) ClaimIdempotencyKey(ctx context.Context, key, fingerprint string) (models.IdempotencyKey, bool, models.ApiError) {
+
+	var (
+		k          models.IdempotencyKey
+		responseId sql.NullInt64
+		err        error
+	)
+
+	now := clock()
+
+	qry := QUERY_ADD_IDEMPOTENCY_KEY
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return k, false, models.ErrorWrap(err)
+	}
+
+	res := d.exec(ctx, d.stmt(qry), qry, key, fingerprint, datetime(now))
+
+	if res.apiErr == nil {
+
+		k = models.IdempotencyKey{
+			Key:         key,
+			Fingerprint: fingerprint,
+		}
+
+		return k, true, nil
+	}
+
+	if res.violation != VIOLATION_DUPLICATE_KEY {
+		return k, false, res.apiErr
+	}
+
+	qry = QUERY_TAKE_OVER_IDEMPOTENCY_KEY
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return k, false, models.ErrorWrap(err)
+	}
+
+	res = d.exec(ctx, d.stmt(qry), qry, datetime(now), key, fingerprint, datetime(now.Add(-IDEMPOTENCY_CLAIM_TIMEOUT)))
 
 	if res.apiErr != nil {
-		return -1, res.apiErr
+		return k, false, res.apiErr
 	}
 
-	err = tx.Commit()
+	if res.numRowsAffected == 1 {
+
+		k = models.IdempotencyKey{
+			Key:         key,
+			Fingerprint: fingerprint,
+		}
+
+		return k, true, nil
+	}
+
+	qry = QUERY_GET_IDEMPOTENCY_KEY
+
+	err = d.prepareQry(ctx, qry)
 
 	if err != nil {
-		return -1, models.ErrorWrap(err)
+		return k, false, models.ErrorWrap(err)
 	}
 
-	return res.lastInsertedId, nil
+	err = d.stmt(qry).QueryRowContext(ctx, key).Scan(&k.Key, &k.Fingerprint, &responseId)
+
+	if err != nil {
+
+		// the key was released by the request which claimed it between the insert and the select
+		if err == sql.ErrNoRows {
+			return k, false, models.ConstructApiError(409, MESSAGE_IDEMPOTENCY_KEY_IN_USE, "ClaimIdempotencyKey", key)
+		}
+
+		return k, false, models.ErrorWrap(err)
+	}
+
+	k.ResponseId = int(responseId.Int64)
+	k.Completed = responseId.Valid
+
+	return k, false, nil
+}
+
+// CompleteIdempotencyKey records the response id of the request which claimed an idempotency key
+func (d *dbGate) CompleteIdempotencyKey(ctx context.Context, key string, responseId int) models.ApiError {
+
+	qry := QUERY_COMPLETE_IDEMPOTENCY_KEY
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	res := d.exec(ctx, d.stmt(qry), qry, responseId, key)
+
+	if res.apiErr != nil {
+		return res.apiErr
+	}
+
+	//double check that exactly one row was updated
+
+	if res.numRowsAffected != 1 {
+		return models.ConstructApiError(500, MESSAGE_INVALID_ROW_UPDATE, "CompleteIdempotencyKey")
+	}
+
+	return nil
+}
+
+// ReleaseIdempotencyKey removes an idempotency key which has not been completed, so that its request can be retried
+func (d *dbGate) ReleaseIdempotencyKey(ctx context.Context, key string) models.ApiError {
+
+	qry := QUERY_DELETE_IDEMPOTENCY_KEY
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	return d.exec(ctx, d.stmt(qry), qry, key).apiErr
 }
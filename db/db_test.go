@@ -1,9 +1,11 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"gopkg.in/DATA-DOG/go-sqlmock.v1"
@@ -20,6 +22,8 @@ var (
 		"(",
 		")",
 		"+",
+		"*",
+		"$",
 	}
 )
 
@@ -37,8 +41,22 @@ func esc(src string) string {
 	return src
 }
 
+// The time at which the clock is fixed during tests
+var testNow = time.Date(2019, 1, 24, 1, 0, 10, 0, time.UTC)
+
+// Fix the clock used for expiry at a given time, returning a function which restores it
+func fixClock(at time.Time) func() {
+
+	saved := clock
+	clock = func() time.Time { return at }
+
+	return func() { clock = saved }
+}
+
 func testWrapper(t *testing.T, callback func(*testing.T, sqlmock.Sqlmock, Dbi)) {
 
+	defer fixClock(testNow)()
+
 	mockDb, expecter, _ := sqlmock.New()
 	dbi, _ := NewDbi("", mockDb)
 	defer dbi.Close()
@@ -48,19 +66,112 @@ func testWrapper(t *testing.T, callback func(*testing.T, sqlmock.Sqlmock, Dbi))
 	utils.AssertNoError(t, "Calling ExpectationsWereMet", expecter.ExpectationsWereMet())
 }
 
+// Expect a ledger entry to be written within a transaction
+func expectLedgerEntry(expecter sqlmock.Sqlmock, entryType, description string, reference int, postings []models.LedgerPosting) {
+
+	expecter.ExpectPrepare(esc(QUERY_ADD_LEDGER_ENTRY))
+	expecter.ExpectPrepare(esc(QUERY_ADD_LEDGER_ENTRY)).ExpectExec().WithArgs(entryType, description, reference).WillReturnResult(sqlmock.NewResult(1001, 1))
+
+	expecter.ExpectPrepare(esc(QUERY_ADD_LEDGER_POSTING))
+	ep := expecter.ExpectPrepare(esc(QUERY_ADD_LEDGER_POSTING))
+
+	for i, p := range postings {
+		ep.ExpectExec().WithArgs(1001, p.Account, p.Amount, p.Currency).WillReturnResult(sqlmock.NewResult(int64(1001+i), 1))
+	}
+}
+
+// Expect the limits of a card to be read before a hold is placed on it, returning them
+func expectLimits(expecter sqlmock.Sqlmock, cardId int, limits models.SpendingLimits) {
+
+	expected := sqlmock.NewRows([]string{"max_transaction", "daily_spend", "monthly_spend", "hourly_authorisations", "vendor_daily_spend"}).
+		AddRow(limits.MaxTransaction, limits.DailySpend, limits.MonthlySpend, limits.HourlyAuthorisations, limits.VendorDailySpend)
+
+	expecter.ExpectPrepare(esc(QUERY_GET_CARD_LIMITS)).ExpectQuery().WithArgs(cardId).WillReturnRows(expected)
+}
+
+// Expect the merchant category controls of a card to be read before an authorisation, returning none
+func expectMccControls(expecter sqlmock.Sqlmock, cardId int) {
+
+	expected := sqlmock.NewRows([]string{"id", "mcc", "control"}).AddRow(cardId, nil, nil)
+
+	expecter.ExpectPrepare(esc(QUERY_GET_CARD_MCC_CONTROLS)).ExpectQuery().WithArgs(cardId).WillReturnRows(expected)
+}
+
+// Expect the fee schedule of a vendor to be read before a capture, returning it
+func expectFees(expecter sqlmock.Sqlmock, vendorId int, fees models.FeeSchedule) {
+
+	expected := sqlmock.NewRows([]string{"basis_points", "fixed_amount"}).AddRow(fees.BasisPoints, fees.Fixed)
+
+	expecter.ExpectPrepare(esc(QUERY_GET_VENDOR_FEES)).ExpectQuery().WithArgs(vendorId).WillReturnRows(expected)
+}
+
+// Expect the authorisation history of a card to be read by Authorise, returning none
+func expectHistory(expecter sqlmock.Sqlmock, cardId int) {
+
+	expected := sqlmock.NewRows([]string{"id", "vendor_id", "amount", "reversed", "expires_at", "currency", "card_currency", "rate", "ts"})
+
+	expecter.ExpectPrepare(esc(QUERY_GET_RECENT_AUTHORISATIONS)).ExpectQuery().WithArgs(cardId, datetime(testNow.Add(-RISK_HISTORY))).WillReturnRows(expected)
+}
+
+// Expect the authorisation history of a card to be read again by Authorise in the transaction of its hold, through
+// the statement already prepared, returning none
+func expectHeldHistory(expecter sqlmock.Sqlmock, cardId int) {
+
+	expected := sqlmock.NewRows([]string{"id", "vendor_id", "amount", "reversed", "expires_at", "currency", "card_currency", "rate", "ts"})
+
+	expecter.ExpectQuery(esc(QUERY_GET_RECENT_AUTHORISATIONS)).WithArgs(cardId, datetime(testNow.Add(-RISK_HISTORY))).WillReturnRows(expected)
+}
+
+func TestIndependentInstances(t *testing.T) {
+
+	mockDb1, expecter1, _ := sqlmock.New()
+	mockDb2, expecter2, _ := sqlmock.New()
+
+	dbi1, _ := NewDbi("", mockDb1)
+	dbi2, _ := NewDbi("", mockDb2)
+	defer dbi2.Close()
+
+	// each instance prepares the query on its own connection
+	expecter1.ExpectPrepare(esc(QUERY_GET_VENDOR)).ExpectQuery().WithArgs(1001).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"}).AddRow(int64(1001), "Coffee Shop", 999, "GBP", "", ""))
+	expecter1.ExpectClose()
+
+	expecter2.ExpectPrepare(esc(QUERY_GET_VENDOR)).ExpectQuery().WithArgs(1002).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"}).AddRow(int64(1002), "Tea Shop", 0, "GBP", "", ""))
+
+	v, apiErr := dbi1.(*dbGate).getVendor(context.Background(), 1001)
+
+	utils.AssertNoError(t, "Calling getVendor on the first instance", apiErr)
+	utils.AssertEquals(t, "VendorName from the first instance", "Coffee Shop", v.VendorName)
+
+	dbi1.Close()
+
+	v, apiErr = dbi2.(*dbGate).getVendor(context.Background(), 1002)
+
+	utils.AssertNoError(t, "Calling getVendor on the second instance after closing the first", apiErr)
+	utils.AssertEquals(t, "VendorName from the second instance", "Tea Shop", v.VendorName)
+
+	utils.AssertNoError(t, "Calling ExpectationsWereMet for the first instance", expecter1.ExpectationsWereMet())
+	utils.AssertNoError(t, "Calling ExpectationsWereMet for the second instance", expecter2.ExpectationsWereMet())
+}
+
 func TestGetVendors(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance"}).
-			AddRow(int64(1001), "a shop", 1234).
-			AddRow(int64(2002), "a pub", 999)
+		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"}).
+			AddRow(int64(1001), "a shop", 1234, "GBP", "", "").
+			AddRow(int64(2002), "a pub", 999, "GBP", "", "")
+
+		counted := sqlmock.NewRows([]string{"count"}).AddRow(22)
 
-		expecter.ExpectPrepare(esc(QUERY_GET_VENDORS)).ExpectQuery().WillReturnRows(expected)
+		expecter.ExpectPrepare(esc(QUERY_COUNT_VENDORS)).ExpectQuery().WillReturnRows(counted)
+		expecter.ExpectPrepare(esc(QUERY_GET_VENDORS)).ExpectQuery().WithArgs(2, 20).WillReturnRows(expected)
 
-		vs, apiErr := dbi.GetVendors()
+		vs, total, apiErr := dbi.GetVendors(context.Background(), 20, 2)
 
 		utils.AssertNoError(t, "Calling GetVendors", apiErr)
 		utils.AssertEquals(t, "Size of GetVendors result", 2, len(vs))
+		utils.AssertEquals(t, "Total for GetVendors result", 22, total)
 		utils.AssertEquals(t, "VendorName for GetVendors result[0]", "a shop", vs[0].VendorName)
 		utils.AssertEquals(t, "Id for GetVendors result[0]", 1001, vs[0].Id)
 		utils.AssertEquals(t, "Balance for GetVendors result[0]", 1234, vs[0].Balance)
@@ -74,12 +185,16 @@ func TestGetCustomers(t *testing.T) {
 			AddRow(int64(1001), "Fred Bloggs").
 			AddRow(int64(2002), "Jane Doe")
 
-		expecter.ExpectPrepare(esc(QUERY_GET_CUSTOMERS)).ExpectQuery().WillReturnRows(expected)
+		counted := sqlmock.NewRows([]string{"count"}).AddRow(2)
 
-		vs, apiErr := dbi.GetCustomers()
+		expecter.ExpectPrepare(esc(QUERY_COUNT_CUSTOMERS)).ExpectQuery().WillReturnRows(counted)
+		expecter.ExpectPrepare(esc(QUERY_GET_CUSTOMERS)).ExpectQuery().WithArgs(100, 0).WillReturnRows(expected)
+
+		vs, total, apiErr := dbi.GetCustomers(context.Background(), 0, 100)
 
 		utils.AssertNoError(t, "Calling GetCustomers", apiErr)
 		utils.AssertEquals(t, "Size of GetCustomers result", 2, len(vs))
+		utils.AssertEquals(t, "Total for GetCustomers result", 2, total)
 		utils.AssertEquals(t, "VendorName for GetCustomers result[0]", "Fred Bloggs", vs[0].Fullname)
 		utils.AssertEquals(t, "Id for GetCustomers result[0]", 1001, vs[0].Id)
 	})
@@ -88,13 +203,13 @@ func TestGetCustomers(t *testing.T) {
 func TestGetCustomer(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		//cu.id, cu.fullname, c.id, c.balance, c.available, c.ts
-		expected := sqlmock.NewRows([]string{"cu.id", "cu.fullname", "c.id", "c.balance", "c.available", "c.ts"}).
-			AddRow(int64(1001), "Fred Bloggs", 1001, 456, 0, "2019-01-24 01:00:10")
+		//cu.id, cu.fullname, c.id, c.balance, c.available, c.status, c.ts
+		expected := sqlmock.NewRows([]string{"cu.id", "cu.fullname", "c.id", "c.balance", "c.available", "c.status", "c.ts", "c.currency"}).
+			AddRow(int64(1001), "Fred Bloggs", 1001, 456, 0, "ACTIVE", "2019-01-24 01:00:10", "GBP")
 
 		expecter.ExpectPrepare(esc(QUERY_GET_CUSTOMER_ALL)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
 
-		c, apiErr := dbi.GetCustomer(1001)
+		c, apiErr := dbi.GetCustomer(context.Background(), 1001)
 
 		utils.AssertNoError(t, "Calling GetCustomer", apiErr)
 		utils.AssertEquals(t, "Fullname for GetCustomer result", "Fred Bloggs", c.Fullname)
@@ -106,11 +221,11 @@ func TestGetCustomer(t *testing.T) {
 func TestGetCustomerNotFound(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		expected := sqlmock.NewRows([]string{"cu.id", "cu.fullname", "c.id", "c.balance", "c.available", "c.ts"})
+		expected := sqlmock.NewRows([]string{"cu.id", "cu.fullname", "c.id", "c.balance", "c.available", "c.status", "c.ts", "c.currency"})
 
 		expecter.ExpectPrepare(esc(QUERY_GET_CUSTOMER_ALL)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
 
-		_, apiErr := dbi.GetCustomer(1001)
+		_, apiErr := dbi.GetCustomer(context.Background(), 1001)
 
 		utils.AssertEquals(t, "Return status for calling GetCustomer with a bad id", 404, apiErr.StatusCode())
 		utils.AssertEquals(t, "Return message for calling GetCustomer with bad id 1001", badIdMessage("GetCustomer", "customer", 1001), apiErr.Error())
@@ -120,13 +235,13 @@ func TestGetCustomerNotFound(t *testing.T) {
 func TestGetAuthorisation(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		//a.id, a.amount, a.card_id, a.vendor_id, a.description, a.captured, a.reversed, a.refunded, m.amount, m.description, m.movement_type, m.ts
-		expected := sqlmock.NewRows([]string{"a.id", "a.amount", "a.card_id", "a.vendor_id", "a.description", "a.captured", "a.reversed", "a.refunded", "m.id", "m.amount", "m.description", "m.movement_type", "m.ts"}).
-			AddRow(int64(1001), 250, 100001, 1002, "cake", 0, 250, 0, 1009, 250, "cake bad", "REVERSAL", "2019-01-24 01:00:10")
+		//a.id, a.amount, a.card_id, a.vendor_id, a.description, a.captured, a.reversed, a.refunded, a.expires_at, m.id, m.amount, m.description, m.movement_type, m.ts
+		expected := sqlmock.NewRows([]string{"a.id", "a.amount", "a.card_id", "a.vendor_id", "a.description", "a.captured", "a.reversed", "a.refunded", "a.expires_at", "m.id", "m.amount", "m.description", "m.movement_type", "m.ts", "a.currency", "a.card_currency", "a.rate", "a.status", "a.disputed", "a.dispute_status", "a.mcc"}).
+			AddRow(int64(1001), 250, 100001, 1002, "cake", 0, 250, 0, "2019-01-31 01:00:10", 1009, 250, "cake bad", "REVERSAL", "2019-01-24 01:00:10", "GBP", "GBP", 1.0, "APPROVED", 0, nil, "")
 
 		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION_ALL)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
 
-		a, apiErr := dbi.GetAuthorisation(1001)
+		a, apiErr := dbi.GetAuthorisation(context.Background(), 1001)
 
 		utils.AssertNoError(t, "Calling GetAuthorisation", apiErr)
 		utils.AssertEquals(t, "Amount for GetAuthorisation result", 250, a.Amount)
@@ -138,11 +253,11 @@ func TestGetAuthorisation(t *testing.T) {
 func TestGetAuthorisationNotFound(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		expected := sqlmock.NewRows([]string{"a.id", "a.amount", "a.card_id", "a.vendor_id", "a.description", "a.captured", "a.reversed", "a.refunded", "m.id", "m.amount", "m.description", "m.movement_type", "m.ts"})
+		expected := sqlmock.NewRows([]string{"a.id", "a.amount", "a.card_id", "a.vendor_id", "a.description", "a.captured", "a.reversed", "a.refunded", "a.expires_at", "m.id", "m.amount", "m.description", "m.movement_type", "m.ts", "a.currency", "a.card_currency", "a.rate", "a.status", "a.disputed", "a.dispute_status", "a.mcc"})
 
 		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION_ALL)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
 
-		_, apiErr := dbi.GetAuthorisation(1001)
+		_, apiErr := dbi.GetAuthorisation(context.Background(), 1001)
 
 		utils.AssertEquals(t, "Return status for calling GetAuthorisation with a bad id", 404, apiErr.StatusCode())
 		utils.AssertEquals(t, "Return message for calling GetAuthorisation with bad id 1001", badIdMessage("GetAuthorisation", "authorisation", 1001), apiErr.Error())
@@ -153,19 +268,21 @@ func TestGetVendor(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
 		//v.id, v.vendor_name, v.balance, a.id, a.amount, a.card_id, a.description, a.captured, a.reversed, a.refunded, a.ts
-		expected := sqlmock.NewRows([]string{"v.id", "v.vendor_name", "v.balance", "a.id", "a.amount", "a.card_id", "a.description", "a.captured", "a.reversed", "a.refunded", "a.ts"}).
-			AddRow(int64(1001), "Coffee Shop", 0, 99, 210, 10001, "Cake", 0, 0, 0, "2019-01-24 01:00:10").
-			AddRow(int64(1001), "Coffee Shop", 0, 99, 150, 10001, "Coffee", 0, 0, 0, "2019-01-24 01:00:10")
+		expected := sqlmock.NewRows([]string{"v.id", "v.vendor_name", "v.balance", "a.id", "a.amount", "a.card_id", "a.description", "a.captured", "a.reversed", "a.refunded", "a.ts", "v.currency", "a.currency", "a.card_currency", "a.rate", "v.category", "v.mcc"}).
+			AddRow(int64(1001), "Coffee Shop", 0, 99, 210, 10001, "Cake", 0, 0, 0, "2019-01-24 01:00:10", "GBP", "GBP", "GBP", 1.0, "", "").
+			AddRow(int64(1001), "Coffee Shop", 0, 99, 150, 10001, "Coffee", 0, 0, 0, "2019-01-24 01:00:10", "GBP", "GBP", "GBP", 1.0, "", "")
 
 		expecter.ExpectPrepare(esc(QUERY_GET_VENDOR_ALL)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
 
-		v, apiErr := dbi.GetVendor(1001)
+		v, apiErr := dbi.GetVendor(context.Background(), 1001)
 
 		utils.AssertNoError(t, "Calling GetVendor", apiErr)
 		utils.AssertEquals(t, "VendorName for GetVendor result", "Coffee Shop", v.VendorName)
 		utils.AssertEquals(t, "Id for GetVendor result", 1001, v.Id)
 		utils.AssertEquals(t, "len(Authorisations) for GetVendor result", 2, len(v.Authorisations))
 		utils.AssertEquals(t, "Authorisations[0].Description for GetVendor result", "Cake", v.Authorisations[0].Description)
+		utils.AssertEquals(t, "Authorisations[0].Id for GetVendor result", 99, v.Authorisations[0].Id)
+		utils.AssertEquals(t, "Authorisations[0].Amount for GetVendor result", 210, v.Authorisations[0].Amount)
 	})
 }
 
@@ -176,7 +293,7 @@ func TestGetVendorNotFound(t *testing.T) {
 
 		expecter.ExpectPrepare(esc(QUERY_GET_VENDOR_ALL)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
 
-		_, apiErr := dbi.GetVendor(1001)
+		_, apiErr := dbi.GetVendor(context.Background(), 1001)
 
 		utils.AssertEquals(t, "Return status for calling GetVendor with a bad id", 404, apiErr.StatusCode())
 		utils.AssertEquals(t, "Return message for calling GetVendor with bad id 1001", badIdMessage("GetVendor", "vendor", 1001), apiErr.Error())
@@ -186,13 +303,13 @@ func TestGetVendorNotFound(t *testing.T) {
 func TestGetCard(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		//  c.id, c.balance, c.available, c.ts, m.amount, m.description, m.movement_type, m.ts
-		expected := sqlmock.NewRows([]string{"c.id", "c.balance", "c.available", "c.customer_id", "c.tc", "m.id", "m.amount", "m.description", "m.movement_type", "m.ts"}).
-			AddRow(int64(1001), 12676, 12089, 1001, "2019-01-24 01:00:10", 1001, 95, "Cake", "PURCHASE", "2019-01-24 01:00:10")
+		//  c.id, c.balance, c.available, c.customer_id, c.status, c.ts, m.id, m.amount, m.description, m.movement_type, m.ts
+		expected := sqlmock.NewRows([]string{"c.id", "c.balance", "c.available", "c.customer_id", "c.status", "c.tc", "m.id", "m.amount", "m.description", "m.movement_type", "m.ts", "m.related_movement_id", "c.currency"}).
+			AddRow(int64(1001), 12676, 12089, 1001, "ACTIVE", "2019-01-24 01:00:10", 1001, 95, "Cake", "PURCHASE", "2019-01-24 01:00:10", nil, "GBP")
 
 		expecter.ExpectPrepare(esc(QUERY_GET_CARD_ALL)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
 
-		v, apiErr := dbi.GetCard(1001)
+		v, apiErr := dbi.GetCard(context.Background(), 1001)
 
 		utils.AssertNoError(t, "Calling GetCard", apiErr)
 		utils.AssertEquals(t, "Balance for GetCard result", 12676, v.Balance)
@@ -205,17 +322,29 @@ func TestGetCard(t *testing.T) {
 func TestGetCardNotFound(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		expected := sqlmock.NewRows([]string{"c.id", "c.balance", "c.available", "c.tc", "m.amount", "m.description", "m.movement_type", "m.ts"})
+		expected := sqlmock.NewRows([]string{"c.id", "c.balance", "c.available", "c.status", "c.tc", "m.amount", "m.description", "m.movement_type", "m.ts", "m.related_movement_id"})
 
 		expecter.ExpectPrepare(esc(QUERY_GET_CARD_ALL)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
 
-		_, apiErr := dbi.GetCard(1001)
+		_, apiErr := dbi.GetCard(context.Background(), 1001)
 
 		utils.AssertEquals(t, "Return status for calling GetCard with a bad id", 404, apiErr.StatusCode())
 		utils.AssertEquals(t, "Return message for calling GetCard with bad id 1001", badIdMessage("GetCard", "card", 1001), apiErr.Error())
 	})
 }
 
+func TestGetCardDeadlineExceeded(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+
+		_, apiErr := dbi.GetCard(ctx, 1001)
+
+		utils.AssertEquals(t, "Return status for calling GetCard after the deadline", 504, apiErr.StatusCode())
+	})
+}
+
 func TestAddVendor(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
@@ -225,9 +354,9 @@ func TestAddVendor(t *testing.T) {
 
 		expected := sqlmock.NewResult(1001, 1)
 
-		expecter.ExpectPrepare(esc(QUERY_ADD_VENDOR)).ExpectExec().WithArgs("coffee shop").WillReturnResult(expected)
+		expecter.ExpectPrepare(esc(QUERY_ADD_VENDOR)).ExpectExec().WithArgs("coffee shop", "", "", "GBP").WillReturnResult(expected)
 
-		v, apiErr := dbi.AddOrUpdateVendor(v)
+		v, apiErr := dbi.AddOrUpdateVendor(context.Background(), v)
 
 		utils.AssertNoError(t, "Calling AddOrUpdateVendor without an id", apiErr)
 		utils.AssertEquals(t, "VendorName for AddOrUpdateVendor without an id", "coffee shop", v.VendorName)
@@ -245,9 +374,9 @@ func TestUpdateVendor(t *testing.T) {
 
 		expected := sqlmock.NewResult(0, 1)
 
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_VENDOR_DETAILS)).ExpectExec().WithArgs("coffee shop").WillReturnResult(expected)
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_VENDOR_DETAILS)).ExpectExec().WithArgs("coffee shop", "", "", 1002).WillReturnResult(expected)
 
-		v, apiErr := dbi.AddOrUpdateVendor(v)
+		v, apiErr := dbi.AddOrUpdateVendor(context.Background(), v)
 
 		utils.AssertNoError(t, "Calling AddOrUpdateVendor with an id", apiErr)
 		utils.AssertEquals(t, "VendorName for AddOrUpdateVendor with an id", "coffee shop", v.VendorName)
@@ -266,7 +395,7 @@ func TestAddCustomer(t *testing.T) {
 
 		expecter.ExpectPrepare(esc(QUERY_ADD_CUSTOMER)).ExpectExec().WithArgs("Fred Bloggs").WillReturnResult(expected)
 
-		c, apiErr := dbi.AddOrUpdateCustomer(c)
+		c, apiErr := dbi.AddOrUpdateCustomer(context.Background(), c)
 
 		utils.AssertNoError(t, "Calling AddOrUpdateCustomer without an id", apiErr)
 		utils.AssertEquals(t, "VendorName for AddOrUpdateCustomer without an id", "Fred Bloggs", c.Fullname)
@@ -284,9 +413,9 @@ func TestUpdateCustomer(t *testing.T) {
 
 		expected := sqlmock.NewResult(0, 1)
 
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_CUSTOMER_DETAILS)).ExpectExec().WithArgs("Fred Bloggs").WillReturnResult(expected)
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CUSTOMER_DETAILS)).ExpectExec().WithArgs("Fred Bloggs", 1001).WillReturnResult(expected)
 
-		c, apiErr := dbi.AddOrUpdateCustomer(c)
+		c, apiErr := dbi.AddOrUpdateCustomer(context.Background(), c)
 
 		utils.AssertNoError(t, "Calling AddOrUpdateCustomer with an id", apiErr)
 		utils.AssertEquals(t, "VendorName for AddOrUpdateCustomer with an id", "Fred Bloggs", c.Fullname)
@@ -299,9 +428,9 @@ func TestAddCardOK(t *testing.T) {
 
 		expected := sqlmock.NewResult(1001, 1)
 
-		expecter.ExpectPrepare(esc(QUERY_ADD_CARD)).ExpectExec().WithArgs(1099).WillReturnResult(expected)
+		expecter.ExpectPrepare(esc(QUERY_ADD_CARD)).ExpectExec().WithArgs(1099, "GBP").WillReturnResult(expected)
 
-		c, apiErr := dbi.AddCard(1099)
+		c, apiErr := dbi.AddCard(context.Background(), 1099, "")
 
 		utils.AssertNoError(t, "Calling AddCard", apiErr)
 		utils.AssertEquals(t, "CustomerId for AddCard result", 1099, c.CustomerId)
@@ -317,9 +446,9 @@ func TestAddCardNotFound(t *testing.T) {
 			Message: "(Foreign key violation)",
 		}
 
-		expecter.ExpectPrepare(esc(QUERY_ADD_CARD)).ExpectExec().WithArgs(1099).WillReturnError(err)
+		expecter.ExpectPrepare(esc(QUERY_ADD_CARD)).ExpectExec().WithArgs(1099, "GBP").WillReturnError(err)
 
-		_, apiErr := dbi.AddCard(1099)
+		_, apiErr := dbi.AddCard(context.Background(), 1099, "")
 
 		utils.AssertEquals(t, "Return status for calling AddCard with a bad customerId", 400, apiErr.StatusCode())
 		utils.AssertEquals(t, "Return message for calling AddCard with bad customerId 1099", badIdMessage("AddCard", "customer", 1099), apiErr.Error())
@@ -329,32 +458,40 @@ func TestAddCardNotFound(t *testing.T) {
 func TestAuthoriseOK(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance"}).
-			AddRow(int64(1001), "Coffee Shop", 999)
+		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"}).
+			AddRow(int64(1001), "Coffee Shop", 999, "GBP", "", "")
 
 		expecter.ExpectPrepare(esc(QUERY_GET_VENDOR)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
 
-		expected = sqlmock.NewRows([]string{"id", "balance", "available", "tc"}).
-			AddRow(int64(100001), 12676, 12089, "2019-01-24 01:00:10")
+		expected = sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 12676, 12089, "ACTIVE", "2019-01-24 01:00:10", "GBP")
 
 		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
 
+		expectLimits(expecter, 100001, models.SpendingLimits{})
+		expectMccControls(expecter, 100001)
+		expectHistory(expecter, 100001)
+
 		expecter.ExpectBegin()
 
 		expectedR := sqlmock.NewResult(0, 1)
 
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD))
+		expecter.ExpectPrepare(esc(QUERY_HOLD_CARD))
 		// This duplication seems to be necessary for tx.Stmt(..)
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD)).ExpectExec().WithArgs(0, -210, 100001).WillReturnResult(expectedR)
+		expecter.ExpectPrepare(esc(QUERY_HOLD_CARD)).ExpectExec().WithArgs(210, 100001, 210).WillReturnResult(expectedR)
+
+		expectHeldHistory(expecter, 100001)
 
 		expectedR = sqlmock.NewResult(1009, 1)
 
 		expecter.ExpectPrepare(esc(QUERY_ADD_AUTHORISATION))
-		expecter.ExpectPrepare(esc(QUERY_ADD_AUTHORISATION)).ExpectExec().WithArgs(100001, 1001, 210, "Coffee").WillReturnResult(expectedR)
+		expecter.ExpectPrepare(esc(QUERY_ADD_AUTHORISATION)).ExpectExec().WithArgs(100001, 1001, 210, "Coffee", expiryTime(testNow), "GBP", "GBP", 1.0, AUTHORISATION_STATUS_APPROVED, "", datetime(testNow)).WillReturnResult(expectedR)
+
+		expectLedgerEntry(expecter, "AUTHORISATION", "Coffee", 1009, transfer(CardAvailableAccount(100001), CardHeldAccount(100001), 210, "GBP"))
 
 		expecter.ExpectCommit()
 
-		aid, apiErr := dbi.Authorise(100001, 1001, 210, "Coffee")
+		aid, apiErr := dbi.Authorise(context.Background(), 100001, 1001, 210, "", "Coffee")
 
 		utils.AssertNoError(t, "Calling Authorise", apiErr)
 
@@ -365,11 +502,11 @@ func TestAuthoriseOK(t *testing.T) {
 func TestAuthoriseBadVendor(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance"})
+		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"})
 
 		expecter.ExpectPrepare(esc(QUERY_GET_VENDOR)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
 
-		aid, apiErr := dbi.Authorise(100001, 1001, 210, "Coffee")
+		aid, apiErr := dbi.Authorise(context.Background(), 100001, 1001, 210, "", "Coffee")
 
 		utils.AssertEquals(t, "Return status for calling Authorise with a bad vendorId", 400, apiErr.StatusCode())
 		utils.AssertEquals(t, "Return message for calling Authorise with a bad vendorId 1001", badIdMessage("Authorise", "vendor", 1001), apiErr.Error())
@@ -380,16 +517,16 @@ func TestAuthoriseBadVendor(t *testing.T) {
 func TestAuthoriseBadCard(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance"}).
-			AddRow(int64(1001), "Coffee Shop", 999)
+		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"}).
+			AddRow(int64(1001), "Coffee Shop", 999, "GBP", "", "")
 
 		expecter.ExpectPrepare(esc(QUERY_GET_VENDOR)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
 
-		expected = sqlmock.NewRows([]string{"id", "balance", "available", "tc"})
+		expected = sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"})
 
 		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
 
-		aid, apiErr := dbi.Authorise(100001, 1001, 210, "Coffee")
+		aid, apiErr := dbi.Authorise(context.Background(), 100001, 1001, 210, "", "Coffee")
 
 		utils.AssertEquals(t, "Return status for calling Authorise with a bad cardId", 400, apiErr.StatusCode())
 		utils.AssertEquals(t, "Return message for calling Authorise with a bad cardId 100001", badIdMessage("Authorise", "card", 100001), apiErr.Error())
@@ -400,20 +537,20 @@ func TestAuthoriseBadCard(t *testing.T) {
 func TestAuthoriseInsufficientFunds(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance"}).
-			AddRow(int64(1001), "Coffee Shop", 999)
+		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"}).
+			AddRow(int64(1001), "Coffee Shop", 999, "GBP", "", "")
 
 		expecter.ExpectPrepare(esc(QUERY_GET_VENDOR)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
 
-		expected = sqlmock.NewRows([]string{"id", "balance", "available", "tc"}).
-			AddRow(int64(100001), 12676, 0, "2019-01-24 01:00:10")
+		expected = sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 12676, 0, "ACTIVE", "2019-01-24 01:00:10", "GBP")
 
 		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
 
-		aid, apiErr := dbi.Authorise(100001, 1001, 210, "Coffee")
+		aid, apiErr := dbi.Authorise(context.Background(), 100001, 1001, 210, "", "Coffee")
 
 		utils.AssertEquals(t, "Return status for calling Authorise with insufficient funds", 400, apiErr.StatusCode())
-		utils.AssertEquals(t, "Return message for calling Authorise with insufficient funds 100001", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE, "Authorise", 2.1, 0.0), apiErr.Error())
+		utils.AssertEquals(t, "Return message for calling Authorise with insufficient funds 100001", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE, "Authorise", "£2.10", "£0.00"), apiErr.Error())
 		utils.AssertEquals(t, "Return status for calling Authorise with insufficient funds", -1, aid)
 	})
 }
@@ -422,30 +559,34 @@ func TestAuthoriseInsufficientFunds(t *testing.T) {
 func TestAuthoriseInsufficientFunds2(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance"}).
-			AddRow(int64(1001), "Coffee Shop", 999)
+		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"}).
+			AddRow(int64(1001), "Coffee Shop", 999, "GBP", "", "")
 
 		expecter.ExpectPrepare(esc(QUERY_GET_VENDOR)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
 
-		expected = sqlmock.NewRows([]string{"id", "balance", "available", "tc"}).
-			AddRow(int64(100001), 12676, 211, "2019-01-24 01:00:10")
+		expected = sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 12676, 211, "ACTIVE", "2019-01-24 01:00:10", "GBP")
 
 		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
 
+		expectLimits(expecter, 100001, models.SpendingLimits{})
+		expectMccControls(expecter, 100001)
+		expectHistory(expecter, 100001)
+
 		expecter.ExpectBegin()
 
 		expectedR := sqlmock.NewResult(0, 0)
 
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD))
+		expecter.ExpectPrepare(esc(QUERY_HOLD_CARD))
 		// This duplication seems to be necessary for tx.Stmt(..)
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD)).ExpectExec().WithArgs(0, -210, 100001).WillReturnResult(expectedR)
+		expecter.ExpectPrepare(esc(QUERY_HOLD_CARD)).ExpectExec().WithArgs(210, 100001, 210).WillReturnResult(expectedR)
 
 		expecter.ExpectRollback()
 
-		aid, apiErr := dbi.Authorise(100001, 1001, 210, "Coffee")
+		aid, apiErr := dbi.Authorise(context.Background(), 100001, 1001, 210, "", "Coffee")
 
 		utils.AssertEquals(t, "Return status for calling Authorise with insufficient funds", 400, apiErr.StatusCode())
-		utils.AssertEquals(t, "Return message for calling Authorise with insufficient funds for £2.10", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE_FOR, "Authorise", 2.1), apiErr.Error())
+		utils.AssertEquals(t, "Return message for calling Authorise with insufficient funds for £2.10", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE_FOR, "Authorise", "£2.10"), apiErr.Error())
 		utils.AssertEquals(t, "Return status for calling Authorise with insufficient funds", -1, aid)
 	})
 }
@@ -453,8 +594,8 @@ func TestAuthoriseInsufficientFunds2(t *testing.T) {
 func TestTopUpOK(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		expected := sqlmock.NewRows([]string{"id", "balance", "available", "tc"}).
-			AddRow(int64(100001), 12676, 12089, "2019-01-24 01:00:10")
+		expected := sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 12676, 12089, "ACTIVE", "2019-01-24 01:00:10", "GBP")
 
 		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
 
@@ -462,18 +603,20 @@ func TestTopUpOK(t *testing.T) {
 
 		expectedR := sqlmock.NewResult(0, 1)
 
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD))
+		expecter.ExpectPrepare(esc(QUERY_TOP_UP_CARD))
 		// This duplication seems to be necessary for tx.Stmt(..)
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD)).ExpectExec().WithArgs(2000, 2000, 100001).WillReturnResult(expectedR)
+		expecter.ExpectPrepare(esc(QUERY_TOP_UP_CARD)).ExpectExec().WithArgs(2000, 2000, 100001).WillReturnResult(expectedR)
 
 		expectedR = sqlmock.NewResult(1009, 1)
 
 		expecter.ExpectPrepare(esc(QUERY_ADD_MOVEMENT))
 		expecter.ExpectPrepare(esc(QUERY_ADD_MOVEMENT)).ExpectExec().WithArgs(100001, 2000, "Transfer from Bank", "TOP-UP").WillReturnResult(expectedR)
 
+		expectLedgerEntry(expecter, "TOP-UP", "Transfer from Bank", 1009, transfer(LEDGER_ACCOUNT_FUNDING, CardAvailableAccount(100001), 2000, "GBP"))
+
 		expecter.ExpectCommit()
 
-		aid, apiErr := dbi.TopUp(100001, 2000, "Transfer from Bank")
+		aid, apiErr := dbi.TopUp(context.Background(), 100001, 2000, "", "Transfer from Bank")
 
 		utils.AssertNoError(t, "Calling TopUp", apiErr)
 
@@ -481,14 +624,40 @@ func TestTopUpOK(t *testing.T) {
 	})
 }
 
+func TestTopUpDeadlineExceeded(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		expected := sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 12676, 12089, "ACTIVE", "2019-01-24 01:00:10", "GBP")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		expecter.ExpectBegin()
+
+		expecter.ExpectPrepare(esc(QUERY_TOP_UP_CARD))
+		expecter.ExpectPrepare(esc(QUERY_TOP_UP_CARD)).ExpectExec().WithArgs(2000, 2000, 100001).
+			WillDelayFor(time.Second).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		// the transaction is rolled back by database/sql when the deadline passes, asynchronously, so is not expected
+
+		_, apiErr := dbi.TopUp(ctx, 100001, 2000, "", "Transfer from Bank")
+
+		utils.AssertTrue(t, "Calling TopUp past the deadline returns an error", apiErr != nil)
+		utils.AssertEquals(t, "Context error after calling TopUp past the deadline", context.DeadlineExceeded, ctx.Err())
+	})
+}
+
 func TestTopUpBadCard(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		expected := sqlmock.NewRows([]string{"id", "balance", "available", "tc"})
+		expected := sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"})
 
 		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
 
-		aid, apiErr := dbi.TopUp(100001, 2000, "Transfer from Bank")
+		aid, apiErr := dbi.TopUp(context.Background(), 100001, 2000, "", "Transfer from Bank")
 
 		utils.AssertEquals(t, "Return status for calling TopUp with a invalid card", 400, apiErr.StatusCode())
 		utils.AssertEquals(t, "Return message for calling TopUp with an invalid card 100001", badIdMessage("TopUp", "card", 100001), apiErr.Error())
@@ -499,24 +668,26 @@ func TestTopUpBadCard(t *testing.T) {
 func TestCaptureOK(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		//id, amount, card_id, vendor_id, description, captured, reversed, refunded
-		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded"}).
-			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 0, 0, 0)
+		//id, amount, card_id, vendor_id, description, captured, reversed, refunded, expires_at
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 0, 0, 0, nil, "GBP", "GBP", 1.0, "APPROVED", 0, nil)
 
 		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
 
+		expectFees(expecter, 1002, models.FeeSchedule{})
+
 		expecter.ExpectBegin()
 
 		expectedR := sqlmock.NewResult(0, 1)
 
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD))
+		expecter.ExpectPrepare(esc(QUERY_CAPTURE_AUTH))
 		// This duplication seems to be necessary for tx.Stmt(..)
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD)).ExpectExec().WithArgs(-250, 0, 100001).WillReturnResult(expectedR)
+		expecter.ExpectPrepare(esc(QUERY_CAPTURE_AUTH)).ExpectExec().WithArgs(250, 1005, 250, datetime(testNow)).WillReturnResult(expectedR)
 
 		expectedR = sqlmock.NewResult(0, 1)
 
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_AUTH))
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_AUTH)).ExpectExec().WithArgs(250, 0, 0, 1005).WillReturnResult(expectedR)
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD))
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD)).ExpectExec().WithArgs(-250, 0, 100001).WillReturnResult(expectedR)
 
 		expectedR = sqlmock.NewResult(0, 1)
 
@@ -534,9 +705,11 @@ func TestCaptureOK(t *testing.T) {
 		expecter.ExpectPrepare(esc(QUERY_ADD_AUTH_MOVEMENT))
 		expecter.ExpectPrepare(esc(QUERY_ADD_AUTH_MOVEMENT)).ExpectExec().WithArgs(1005, 250, "Capture of £2.50", "CAPTURE").WillReturnResult(expectedR)
 
+		expectLedgerEntry(expecter, "CAPTURE", "Coffee", 1009, transfer(CardHeldAccount(100001), VendorAccount(1002), 250, "GBP"))
+
 		expecter.ExpectCommit()
 
-		aid, apiErr := dbi.Capture(1005, 250)
+		aid, apiErr := dbi.Capture(context.Background(), 1005, 250, "")
 
 		utils.AssertNoError(t, "Calling Capture", apiErr)
 
@@ -547,12 +720,12 @@ func TestCaptureOK(t *testing.T) {
 func TestCaptureBadId(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		//id, amount, card_id, vendor_id, description, captured, reversed, refunded
-		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded"})
+		//id, amount, card_id, vendor_id, description, captured, reversed, refunded, expires_at
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"})
 
 		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
 
-		aid, apiErr := dbi.Capture(1005, 250)
+		aid, apiErr := dbi.Capture(context.Background(), 1005, 250, "")
 
 		utils.AssertEquals(t, "Return status for calling Capture with bad id", 400, apiErr.StatusCode())
 		utils.AssertEquals(t, "Return message for calling Capture with bad id", fmt.Sprintf(MESSAGE_BAD_ID, "Capture", "authorisation", 1005), apiErr.Error())
@@ -563,26 +736,56 @@ func TestCaptureBadId(t *testing.T) {
 func TestCaptureInsufficient(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
-		//id, amount, card_id, vendor_id, description, captured, reversed, refunded
-		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded"}).
-			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 250, 0, 0)
+		//id, amount, card_id, vendor_id, description, captured, reversed, refunded, expires_at
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 250, 0, 0, nil, "GBP", "GBP", 1.0, "APPROVED", 0, nil)
 
 		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
 
-		aid, apiErr := dbi.Capture(1005, 250)
+		aid, apiErr := dbi.Capture(context.Background(), 1005, 250, "")
 
 		utils.AssertEquals(t, "Return status for calling Capture with insufficient uncaptured funds", 400, apiErr.StatusCode())
-		utils.AssertEquals(t, "Return message for calling Capture with insufficient uncaptured funds for £2.50", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE, "Capture", 2.5, 0.0), apiErr.Error())
+		utils.AssertEquals(t, "Return message for calling Capture with insufficient uncaptured funds for £2.50", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE, "Capture", "£2.50", "£0.00"), apiErr.Error())
 		utils.AssertEquals(t, "Return status for calling Capture with insufficient uncaptured funds", -1, aid)
 	})
 }
 
+// The pre-check passes but a concurrent capture has used up the funds by the time the row is locked
+func TestCaptureInsufficient2(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		//id, amount, card_id, vendor_id, description, captured, reversed, refunded, expires_at
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 0, 0, 0, nil, "GBP", "GBP", 1.0, "APPROVED", 0, nil)
+
+		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
+
+		expectFees(expecter, 1002, models.FeeSchedule{})
+
+		expecter.ExpectBegin()
+
+		expectedR := sqlmock.NewResult(0, 0)
+
+		expecter.ExpectPrepare(esc(QUERY_CAPTURE_AUTH))
+		// This duplication seems to be necessary for tx.Stmt(..)
+		expecter.ExpectPrepare(esc(QUERY_CAPTURE_AUTH)).ExpectExec().WithArgs(250, 1005, 250, datetime(testNow)).WillReturnResult(expectedR)
+
+		expecter.ExpectRollback()
+
+		aid, apiErr := dbi.Capture(context.Background(), 1005, 250, "")
+
+		utils.AssertEquals(t, "Return status for calling Capture after a concurrent capture", 400, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling Capture after a concurrent capture for £2.50", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE_FOR, "Capture", "£2.50"), apiErr.Error())
+		utils.AssertEquals(t, "Return status for calling Capture after a concurrent capture", -1, aid)
+	})
+}
+
 func TestRefundOK(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
 		//id, amount, card_id, vendor_id, description, refundd, reversed, refunded
-		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded"}).
-			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 250, 0, 0)
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 250, 0, 0, nil, "GBP", "GBP", 1.0, "APPROVED", 0, nil)
 
 		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
 
@@ -590,14 +793,14 @@ func TestRefundOK(t *testing.T) {
 
 		expectedR := sqlmock.NewResult(0, 1)
 
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD))
+		expecter.ExpectPrepare(esc(QUERY_REFUND_AUTH))
 		// This duplication seems to be necessary for tx.Stmt(..)
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD)).ExpectExec().WithArgs(250, 250, 100001).WillReturnResult(expectedR)
+		expecter.ExpectPrepare(esc(QUERY_REFUND_AUTH)).ExpectExec().WithArgs(250, 1005, 250).WillReturnResult(expectedR)
 
 		expectedR = sqlmock.NewResult(0, 1)
 
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_AUTH))
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_AUTH)).ExpectExec().WithArgs(0, 250, 0, 1005).WillReturnResult(expectedR)
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD))
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD)).ExpectExec().WithArgs(250, 250, 100001).WillReturnResult(expectedR)
 
 		expectedR = sqlmock.NewResult(0, 1)
 
@@ -615,9 +818,11 @@ func TestRefundOK(t *testing.T) {
 		expecter.ExpectPrepare(esc(QUERY_ADD_AUTH_MOVEMENT))
 		expecter.ExpectPrepare(esc(QUERY_ADD_AUTH_MOVEMENT)).ExpectExec().WithArgs(1005, -250, "Bad coffee", "REFUND").WillReturnResult(expectedR)
 
+		expectLedgerEntry(expecter, "REFUND", "Bad coffee", 1009, transfer(VendorAccount(1002), CardAvailableAccount(100001), 250, "GBP"))
+
 		expecter.ExpectCommit()
 
-		aid, apiErr := dbi.Refund(1005, 250, "Bad coffee")
+		aid, apiErr := dbi.Refund(context.Background(), 1005, 250, "", "Bad coffee")
 
 		utils.AssertNoError(t, "Calling Refund", apiErr)
 
@@ -629,11 +834,11 @@ func TestRefundBadId(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
 		//id, amount, card_id, vendor_id, description, refundd, reversed, refunded
-		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded"})
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"})
 
 		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
 
-		aid, apiErr := dbi.Refund(1005, 250, "Bad coffee")
+		aid, apiErr := dbi.Refund(context.Background(), 1005, 250, "", "Bad coffee")
 
 		utils.AssertEquals(t, "Return status for calling Refund with bad id", 400, apiErr.StatusCode())
 		utils.AssertEquals(t, "Return message for calling Refund with bad id", fmt.Sprintf(MESSAGE_BAD_ID, "Refund", "authorisation", 1005), apiErr.Error())
@@ -645,25 +850,53 @@ func TestRefundInsufficient(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
 		//id, amount, card_id, vendor_id, description, refundd, reversed, refunded
-		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded"}).
-			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 0, 0, 0)
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 0, 0, 0, nil, "GBP", "GBP", 1.0, "APPROVED", 0, nil)
 
 		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
 
-		aid, apiErr := dbi.Refund(1005, 250, "Bad coffee")
+		aid, apiErr := dbi.Refund(context.Background(), 1005, 250, "", "Bad coffee")
 
 		utils.AssertEquals(t, "Return status for calling Refund with insufficient unrefundd funds", 400, apiErr.StatusCode())
-		utils.AssertEquals(t, "Return message for calling Refund with insufficient captured funds for £2.50", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE, "Refund", 2.5, 0.0), apiErr.Error())
+		utils.AssertEquals(t, "Return message for calling Refund with insufficient captured funds for £2.50", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE, "Refund", "£2.50", "£0.00"), apiErr.Error())
 		utils.AssertEquals(t, "Return status for calling Refund with insufficient captured funds", -1, aid)
 	})
 }
 
+// The pre-check passes but a concurrent refund has used up the funds by the time the row is locked
+func TestRefundInsufficient2(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		//id, amount, card_id, vendor_id, description, captured, reversed, refunded, expires_at
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 250, 0, 0, nil, "GBP", "GBP", 1.0, "APPROVED", 0, nil)
+
+		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
+
+		expecter.ExpectBegin()
+
+		expectedR := sqlmock.NewResult(0, 0)
+
+		expecter.ExpectPrepare(esc(QUERY_REFUND_AUTH))
+		// This duplication seems to be necessary for tx.Stmt(..)
+		expecter.ExpectPrepare(esc(QUERY_REFUND_AUTH)).ExpectExec().WithArgs(250, 1005, 250).WillReturnResult(expectedR)
+
+		expecter.ExpectRollback()
+
+		aid, apiErr := dbi.Refund(context.Background(), 1005, 250, "", "Bad coffee")
+
+		utils.AssertEquals(t, "Return status for calling Refund after a concurrent refund", 400, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling Refund after a concurrent refund for £2.50", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE_FOR, "Refund", "£2.50"), apiErr.Error())
+		utils.AssertEquals(t, "Return status for calling Refund after a concurrent refund", -1, aid)
+	})
+}
+
 func TestReverseOK(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
 		//id, amount, card_id, vendor_id, description, reversed, reversed, refunded
-		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded"}).
-			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 0, 0, 0)
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 0, 0, 0, nil, "GBP", "GBP", 1.0, "APPROVED", 0, nil)
 
 		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
 
@@ -671,14 +904,14 @@ func TestReverseOK(t *testing.T) {
 
 		expectedR := sqlmock.NewResult(0, 1)
 
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD))
+		expecter.ExpectPrepare(esc(QUERY_REVERSE_AUTH))
 		// This duplication seems to be necessary for tx.Stmt(..)
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD)).ExpectExec().WithArgs(0, 250, 100001).WillReturnResult(expectedR)
+		expecter.ExpectPrepare(esc(QUERY_REVERSE_AUTH)).ExpectExec().WithArgs(250, 1005, 250).WillReturnResult(expectedR)
 
 		expectedR = sqlmock.NewResult(0, 1)
 
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_AUTH))
-		expecter.ExpectPrepare(esc(QUERY_UPDATE_AUTH)).ExpectExec().WithArgs(0, 0, 250, 1005).WillReturnResult(expectedR)
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD))
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD)).ExpectExec().WithArgs(0, 250, 100001).WillReturnResult(expectedR)
 
 		expectedR = sqlmock.NewResult(1009, 1)
 		//auth.Id, -amount, description, "REVERSAL"
@@ -686,9 +919,11 @@ func TestReverseOK(t *testing.T) {
 		expecter.ExpectPrepare(esc(QUERY_ADD_AUTH_MOVEMENT))
 		expecter.ExpectPrepare(esc(QUERY_ADD_AUTH_MOVEMENT)).ExpectExec().WithArgs(1005, -250, "Bad coffee", "REVERSAL").WillReturnResult(expectedR)
 
+		expectLedgerEntry(expecter, "REVERSAL", "Bad coffee", 1009, transfer(CardHeldAccount(100001), CardAvailableAccount(100001), 250, "GBP"))
+
 		expecter.ExpectCommit()
 
-		aid, apiErr := dbi.Reverse(1005, 250, "Bad coffee")
+		aid, apiErr := dbi.Reverse(context.Background(), 1005, 250, "", "Bad coffee")
 
 		utils.AssertNoError(t, "Calling Reverse", apiErr)
 
@@ -700,11 +935,11 @@ func TestReverseBadId(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
 		//id, amount, card_id, vendor_id, description, reversed, reversed, refunded
-		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded"})
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"})
 
 		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
 
-		aid, apiErr := dbi.Reverse(1005, 250, "Bad coffee")
+		aid, apiErr := dbi.Reverse(context.Background(), 1005, 250, "", "Bad coffee")
 
 		utils.AssertEquals(t, "Return status for calling Reverse with bad id", 400, apiErr.StatusCode())
 		utils.AssertEquals(t, "Return message for calling Reverse with bad id", fmt.Sprintf(MESSAGE_BAD_ID, "Reverse", "authorisation", 1005), apiErr.Error())
@@ -716,15 +951,156 @@ func TestReverseInsufficient(t *testing.T) {
 	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
 
 		//id, amount, card_id, vendor_id, description, reversed, reversed, refunded
-		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded"}).
-			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 250, 0, 0)
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 250, 0, 0, nil, "GBP", "GBP", 1.0, "APPROVED", 0, nil)
 
 		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
 
-		aid, apiErr := dbi.Reverse(1005, 250, "Bad coffee")
+		aid, apiErr := dbi.Reverse(context.Background(), 1005, 250, "", "Bad coffee")
 
 		utils.AssertEquals(t, "Return status for calling Reverse with insufficient unreversed funds", 400, apiErr.StatusCode())
-		utils.AssertEquals(t, "Return message for calling Reverse with insufficient captured funds for £2.50", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE, "Reverse", 2.5, 0.0), apiErr.Error())
+		utils.AssertEquals(t, "Return message for calling Reverse with insufficient captured funds for £2.50", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE, "Reverse", "£2.50", "£0.00"), apiErr.Error())
 		utils.AssertEquals(t, "Return status for calling Reverse with insufficient captured funds", -1, aid)
 	})
 }
+
+// The pre-check passes but a concurrent reversal has used up the funds by the time the row is locked
+func TestReverseInsufficient2(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		//id, amount, card_id, vendor_id, description, captured, reversed, refunded, expires_at
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 0, 0, 0, nil, "GBP", "GBP", 1.0, "APPROVED", 0, nil)
+
+		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
+
+		expecter.ExpectBegin()
+
+		expectedR := sqlmock.NewResult(0, 0)
+
+		expecter.ExpectPrepare(esc(QUERY_REVERSE_AUTH))
+		// This duplication seems to be necessary for tx.Stmt(..)
+		expecter.ExpectPrepare(esc(QUERY_REVERSE_AUTH)).ExpectExec().WithArgs(250, 1005, 250).WillReturnResult(expectedR)
+
+		expecter.ExpectRollback()
+
+		aid, apiErr := dbi.Reverse(context.Background(), 1005, 250, "", "Bad coffee")
+
+		utils.AssertEquals(t, "Return status for calling Reverse after a concurrent reversal", 400, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling Reverse after a concurrent reversal for £2.50", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE_FOR, "Reverse", "£2.50"), apiErr.Error())
+		utils.AssertEquals(t, "Return status for calling Reverse after a concurrent reversal", -1, aid)
+	})
+}
+
+func TestClaimIdempotencyKeyNew(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewResult(0, 1)
+
+		expecter.ExpectPrepare(esc(QUERY_ADD_IDEMPOTENCY_KEY)).ExpectExec().WithArgs("key-1", "abc123", sqlmock.AnyArg()).WillReturnResult(expected)
+
+		k, claimed, apiErr := dbi.ClaimIdempotencyKey(context.Background(), "key-1", "abc123")
+
+		utils.AssertNoError(t, "Calling ClaimIdempotencyKey", apiErr)
+		utils.AssertTrue(t, "Claimed for ClaimIdempotencyKey with a new key", claimed)
+		utils.AssertEquals(t, "Fingerprint for ClaimIdempotencyKey result", "abc123", k.Fingerprint)
+	})
+}
+
+func TestClaimIdempotencyKeyExisting(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		err := &mysql.MySQLError{
+			Number:  MYSQL_ERROR_DUPLICATE_KEY,
+			Message: "(Duplicate entry)",
+		}
+
+		expecter.ExpectPrepare(esc(QUERY_ADD_IDEMPOTENCY_KEY)).ExpectExec().WithArgs("key-1", "abc123", sqlmock.AnyArg()).WillReturnError(err)
+		expecter.ExpectPrepare(esc(QUERY_TAKE_OVER_IDEMPOTENCY_KEY)).ExpectExec().WithArgs(sqlmock.AnyArg(), "key-1", "abc123", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		expected := sqlmock.NewRows([]string{"idempotency_key", "fingerprint", "response_id"}).
+			AddRow("key-1", "abc123", 1009)
+
+		expecter.ExpectPrepare(esc(QUERY_GET_IDEMPOTENCY_KEY)).ExpectQuery().WithArgs("key-1").WillReturnRows(expected)
+
+		k, claimed, apiErr := dbi.ClaimIdempotencyKey(context.Background(), "key-1", "abc123")
+
+		utils.AssertNoError(t, "Calling ClaimIdempotencyKey", apiErr)
+		utils.AssertFalse(t, "Claimed for ClaimIdempotencyKey with an existing key", claimed)
+		utils.AssertTrue(t, "Completed for ClaimIdempotencyKey result", k.Completed)
+		utils.AssertEquals(t, "ResponseId for ClaimIdempotencyKey result", 1009, k.ResponseId)
+	})
+}
+
+func TestClaimIdempotencyKeyInProgress(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		err := &mysql.MySQLError{
+			Number:  MYSQL_ERROR_DUPLICATE_KEY,
+			Message: "(Duplicate entry)",
+		}
+
+		expecter.ExpectPrepare(esc(QUERY_ADD_IDEMPOTENCY_KEY)).ExpectExec().WithArgs("key-1", "abc123", sqlmock.AnyArg()).WillReturnError(err)
+		expecter.ExpectPrepare(esc(QUERY_TAKE_OVER_IDEMPOTENCY_KEY)).ExpectExec().WithArgs(sqlmock.AnyArg(), "key-1", "abc123", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		expected := sqlmock.NewRows([]string{"idempotency_key", "fingerprint", "response_id"}).
+			AddRow("key-1", "abc123", nil)
+
+		expecter.ExpectPrepare(esc(QUERY_GET_IDEMPOTENCY_KEY)).ExpectQuery().WithArgs("key-1").WillReturnRows(expected)
+
+		k, claimed, apiErr := dbi.ClaimIdempotencyKey(context.Background(), "key-1", "abc123")
+
+		utils.AssertNoError(t, "Calling ClaimIdempotencyKey", apiErr)
+		utils.AssertFalse(t, "Claimed for ClaimIdempotencyKey with an existing key", claimed)
+		utils.AssertFalse(t, "Completed for ClaimIdempotencyKey result", k.Completed)
+	})
+}
+
+func TestClaimIdempotencyKeyAbandoned(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		err := &mysql.MySQLError{
+			Number:  MYSQL_ERROR_DUPLICATE_KEY,
+			Message: "(Duplicate entry)",
+		}
+
+		expecter.ExpectPrepare(esc(QUERY_ADD_IDEMPOTENCY_KEY)).ExpectExec().WithArgs("key-1", "abc123", datetime(testNow)).WillReturnError(err)
+		expecter.ExpectPrepare(esc(QUERY_TAKE_OVER_IDEMPOTENCY_KEY)).ExpectExec().
+			WithArgs(datetime(testNow), "key-1", "abc123", datetime(testNow.Add(-IDEMPOTENCY_CLAIM_TIMEOUT))).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		k, claimed, apiErr := dbi.ClaimIdempotencyKey(context.Background(), "key-1", "abc123")
+
+		utils.AssertNoError(t, "Calling ClaimIdempotencyKey", apiErr)
+		utils.AssertTrue(t, "Claimed for ClaimIdempotencyKey with an abandoned key", claimed)
+		utils.AssertFalse(t, "Completed for ClaimIdempotencyKey result", k.Completed)
+	})
+}
+
+func TestCompleteIdempotencyKey(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewResult(0, 1)
+
+		expecter.ExpectPrepare(esc(QUERY_COMPLETE_IDEMPOTENCY_KEY)).ExpectExec().WithArgs(1009, "key-1").WillReturnResult(expected)
+
+		apiErr := dbi.CompleteIdempotencyKey(context.Background(), "key-1", 1009)
+
+		utils.AssertNoError(t, "Calling CompleteIdempotencyKey", apiErr)
+	})
+}
+
+func TestReleaseIdempotencyKey(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewResult(0, 1)
+
+		expecter.ExpectPrepare(esc(QUERY_DELETE_IDEMPOTENCY_KEY)).ExpectExec().WithArgs("key-1").WillReturnResult(expected)
+
+		apiErr := dbi.ReleaseIdempotencyKey(context.Background(), "key-1")
+
+		utils.AssertNoError(t, "Calling ReleaseIdempotencyKey", apiErr)
+	})
+}
@@ -0,0 +1,246 @@
+package db
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	MYSQL_ERROR_DUPLICATE_KEY = 1062
+	MYSQL_ERROR_FOREIGN_KEY   = 1216
+	MYSQL_ERROR_NO_SUCH_TABLE = 1146
+
+	POSTGRES_ERROR_DUPLICATE_KEY = "23505"
+	POSTGRES_ERROR_FOREIGN_KEY   = "23503"
+	POSTGRES_ERROR_NO_SUCH_TABLE = "42P01"
+
+	// The kinds of constraint violation which the Dbi methods handle, whichever the database
+	VIOLATION_DUPLICATE_KEY = "DUPLICATE_KEY"
+	VIOLATION_FOREIGN_KEY   = "FOREIGN_KEY"
+)
+
+// The differences between the databases supported. The queries are written for MySQL, and rewritten by a dialect
+// when they are prepared
+type dialect struct {
+	driver string
+
+	// the schema migrations, with the same versions and descriptions as the MySQL migrations
+	migrations []Migration
+
+	createSchemaMigrations string
+
+	// rewrites a MySQL query for this database
+	rewrite func(qry string) string
+
+	// whether inserts return the id of the new row from the query rather than from LastInsertId
+	returningId bool
+
+	// returns the VIOLATION_ kind of a database error, or "" if it is not a handled constraint violation
+	violation func(err error) string
+
+	noSuchTable func(err error) bool
+
+	// options added to the query string of a DSN
+	dsnOptions string
+}
+
+var mysqlDialect = &dialect{
+	driver:                 "mysql",
+	migrations:             migrations,
+	createSchemaMigrations: QUERY_CREATE_SCHEMA_MIGRATIONS,
+
+	rewrite: func(qry string) string {
+		return qry
+	},
+
+	violation: func(err error) string {
+
+		if mysqlError, ok := err.(*mysql.MySQLError); ok {
+
+			switch mysqlError.Number {
+			case MYSQL_ERROR_DUPLICATE_KEY:
+				return VIOLATION_DUPLICATE_KEY
+			case MYSQL_ERROR_FOREIGN_KEY:
+				return VIOLATION_FOREIGN_KEY
+			}
+		}
+
+		return ""
+	},
+
+	noSuchTable: func(err error) bool {
+
+		mysqlError, ok := err.(*mysql.MySQLError)
+
+		return ok && mysqlError.Number == MYSQL_ERROR_NO_SUCH_TABLE
+	},
+}
+
+var postgresDialect = &dialect{
+	driver:                 "postgres",
+	migrations:             postgresMigrations,
+	createSchemaMigrations: POSTGRES_CREATE_SCHEMA_MIGRATIONS,
+	rewrite:                postgresQuery,
+	returningId:            true,
+
+	violation: func(err error) string {
+
+		if pqError, ok := err.(*pq.Error); ok {
+
+			switch pqError.Code {
+			case POSTGRES_ERROR_DUPLICATE_KEY:
+				return VIOLATION_DUPLICATE_KEY
+			case POSTGRES_ERROR_FOREIGN_KEY:
+				return VIOLATION_FOREIGN_KEY
+			}
+		}
+
+		return ""
+	},
+
+	noSuchTable: func(err error) bool {
+
+		pqError, ok := err.(*pq.Error)
+
+		return ok && pqError.Code == POSTGRES_ERROR_NO_SUCH_TABLE
+	},
+}
+
+var sqliteDialect = &dialect{
+	driver:                 "sqlite",
+	migrations:             sqliteMigrations,
+	createSchemaMigrations: SQLITE_CREATE_SCHEMA_MIGRATIONS,
+	rewrite:                sqliteQuery,
+	dsnOptions:             SQLITE_DSN_OPTIONS,
+
+	violation: func(err error) string {
+
+		if sqliteError, ok := err.(*sqlite.Error); ok {
+
+			switch sqliteError.Code() {
+			case SQLITE_ERROR_DUPLICATE_KEY, SQLITE_ERROR_UNIQUE:
+				return VIOLATION_DUPLICATE_KEY
+			case SQLITE_ERROR_FOREIGN_KEY:
+				return VIOLATION_FOREIGN_KEY
+			}
+		}
+
+		return ""
+	},
+
+	// SQLite reports a missing table only by its message
+	noSuchTable: func(err error) bool {
+
+		_, ok := err.(*sqlite.Error)
+
+		return ok && strings.Contains(err.Error(), "no such table")
+	},
+}
+
+// Returns the dialect of a DSN: Postgres for a postgres:// or postgresql:// URL, SQLite for a file: URI, otherwise
+// MySQL
+func dsnDialect(dsn string) *dialect {
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgresDialect
+	}
+
+	if strings.HasPrefix(dsn, "file:") {
+		return sqliteDialect
+	}
+
+	return mysqlDialect
+}
+
+// Returns the dialect of an open connection from its driver. go-sqlmock connections are treated as MySQL
+func dialectOf(db *sql.DB) *dialect {
+
+	switch db.Driver().(type) {
+	case *pq.Driver:
+		return postgresDialect
+	case *sqlite.Driver:
+		return sqliteDialect
+	}
+
+	return mysqlDialect
+}
+
+// Open connects to a database DSN, which is a PostgreSQL connection URL (postgres://...), an SQLite file URI
+// (file:cardapi.db) or otherwise a MySQL DSN
+func Open(dsn string) (*sql.DB, models.ApiError) {
+
+	dl := dsnDialect(dsn)
+
+	if dl.dsnOptions != "" {
+
+		separator := "?"
+
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+
+		dsn += separator + dl.dsnOptions
+	}
+
+	db, err := sql.Open(dl.driver, dsn)
+
+	// Open with a bad DSN does not error, hence ping to check the connection
+	if err == nil {
+		err = db.Ping()
+	}
+
+	if err != nil {
+		return nil, models.ConstructApiError(http.StatusServiceUnavailable, "Fatal database error: %v", err.Error())
+	}
+
+	return db, nil
+}
+
+// A scan destination for a timestamp column, which keeps it in DATETIME_FORMAT whether the driver returns text, as
+// the MySQL driver does, or a time.Time, as the Postgres and SQLite drivers do
+type datetimeScanner struct {
+	dest *sql.NullString
+}
+
+func (s datetimeScanner) Scan(value interface{}) error {
+
+	if t, ok := value.(time.Time); ok {
+		value = datetime(t)
+	}
+
+	return s.dest.Scan(value)
+}
+
+// As datetimeScanner, for a column which is never NULL
+type notNullDatetimeScanner struct {
+	dest *string
+}
+
+func (s notNullDatetimeScanner) Scan(value interface{}) error {
+
+	var ns sql.NullString
+
+	err := datetimeScanner{&ns}.Scan(value)
+
+	*s.dest = ns.String
+
+	return err
+}
+
+// Returns a scan destination for a nullable timestamp column
+func scanNullDatetime(dest *sql.NullString) sql.Scanner {
+	return datetimeScanner{dest}
+}
+
+// Returns a scan destination for a timestamp column
+func scanDatetime(dest *string) sql.Scanner {
+	return notNullDatetimeScanner{dest}
+}
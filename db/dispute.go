@@ -0,0 +1,508 @@
+package db
+
+import (
+	"context"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	DISPUTE_STATUS_OPEN             = "OPEN"
+	DISPUTE_STATUS_VENDOR_RESPONDED = "VENDOR_RESPONDED"
+	DISPUTE_STATUS_WON              = "WON"
+	DISPUTE_STATUS_LOST             = "LOST"
+
+	// Guarded updates which only affect an authorisation with enough captured and not yet refunded or disputed to
+	// cover the dispute, or whose dispute is still in the status read before the change
+	QUERY_OPEN_DISPUTE = `UPDATE authorisations SET disputed = disputed + ?, dispute_status = 'OPEN' WHERE id = ? AND captured - (refunded + disputed) >= ?
+                          AND dispute_status IS NULL`
+	QUERY_UPDATE_DISPUTE_STATUS = `UPDATE authorisations SET dispute_status = ? WHERE id = ? AND dispute_status = ?`
+	QUERY_LOSE_DISPUTE          = `UPDATE authorisations SET dispute_status = ?, disputed = 0 WHERE id = ? AND dispute_status = ?`
+
+	// A guarded update which only re-debits a card not closed since it was read
+	QUERY_REDEBIT_CARD = `UPDATE cards SET balance = balance + ?, available = available + ? WHERE id = ? AND status <> 'CLOSED'`
+
+	// The account which funds the provisional credit of a dispute until it is charged back to the vendor or re-debited
+	LEDGER_ACCOUNT_DISPUTES = "disputes"
+
+	MESSAGE_BAD_DISPUTE_AMOUNT        = "%v: amount %v must be positive"
+	MESSAGE_BAD_DISPUTE_STATUS        = "%v: no dispute status %v"
+	MESSAGE_DISPUTE_EXISTS            = "%v: authorisation %v already has a dispute, %v"
+	MESSAGE_NO_DISPUTE                = "%v: authorisation %v has no dispute"
+	MESSAGE_DISPUTE_STATUS_TRANSITION = "%v: dispute on authorisation %v cannot change from %v to %v"
+	MESSAGE_DISPUTE_CHANGED           = "%v: dispute on authorisation %v was changed by another request"
+)
+
+// The statuses a dispute may change to from each status. A dispute which the vendor does not answer may be decided
+// without a response. WON and LOST are final.
+var disputeTransitions = map[string][]string{
+	DISPUTE_STATUS_OPEN:             {DISPUTE_STATUS_VENDOR_RESPONDED, DISPUTE_STATUS_WON, DISPUTE_STATUS_LOST},
+	DISPUTE_STATUS_VENDOR_RESPONDED: {DISPUTE_STATUS_WON, DISPUTE_STATUS_LOST},
+	DISPUTE_STATUS_WON:              {},
+	DISPUTE_STATUS_LOST:             {},
+}
+
+// The auth movement type recording the change of a dispute to each status
+var disputeMovementTypes = map[string]string{
+	DISPUTE_STATUS_OPEN:             "DISPUTE-OPENED",
+	DISPUTE_STATUS_VENDOR_RESPONDED: "DISPUTE-RESPONDED",
+	DISPUTE_STATUS_WON:              "CHARGEBACK",
+	DISPUTE_STATUS_LOST:             "DISPUTE-LOST",
+}
+
+// The descriptions of the movements of a dispute when none is given
+var disputeDescriptions = map[string]string{
+	DISPUTE_STATUS_OPEN:             "Dispute opened",
+	DISPUTE_STATUS_VENDOR_RESPONDED: "Vendor responded to dispute",
+	DISPUTE_STATUS_WON:              "Chargeback of disputed payment",
+	DISPUTE_STATUS_LOST:             "Re-debit of disputed payment",
+}
+
+// Returns the description of a movement of a dispute changing to a status
+func disputeDescription(status, description string) string {
+
+	if description == "" {
+		return disputeDescriptions[status]
+	}
+
+	return description
+}
+
+// Check that an amount of an authorisation may be disputed
+func checkDisputable(auth models.Authorisation, amount int) models.ApiError {
+
+	if amount < 1 {
+		return models.ConstructApiError(400, MESSAGE_BAD_DISPUTE_AMOUNT, "OpenDispute", amount)
+	}
+
+	if auth.DisputeStatus != "" {
+		return models.ConstructApiError(409, MESSAGE_DISPUTE_EXISTS, "OpenDispute", auth.Id, auth.DisputeStatus)
+	}
+
+	if amount > auth.Refundable() {
+		return models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "OpenDispute", models.Money{Amount: amount, Currency: auth.Currency}, models.Money{Amount: auth.Refundable(), Currency: auth.Currency})
+	}
+
+	return nil
+}
+
+// Check that the dispute on an authorisation may change from its current status to the requested one
+func checkDisputeTransition(auth models.Authorisation, status string) models.ApiError {
+
+	if _, ok := disputeTransitions[status]; !ok || status == DISPUTE_STATUS_OPEN {
+		return models.ConstructApiError(400, MESSAGE_BAD_DISPUTE_STATUS, "SetDisputeStatus", status)
+	}
+
+	if auth.DisputeStatus == "" {
+		return models.ConstructApiError(409, MESSAGE_NO_DISPUTE, "SetDisputeStatus", auth.Id)
+	}
+
+	if !contains(disputeTransitions[auth.DisputeStatus], status) {
+		return models.ConstructApiError(409, MESSAGE_DISPUTE_STATUS_TRANSITION, "SetDisputeStatus", auth.Id, auth.DisputeStatus, status)
+	}
+
+	return nil
+}
+
+// Returns the authorisation of a dispute, as a 404 if there is none with the id
+func (d *dbGate) getDisputedAuthorisation(ctx context.Context, authorisationId int, context string) (models.Authorisation, models.ApiError) {
+
+	auth, apiErr := d.getAuthorisation(ctx, authorisationId)
+
+	if apiErr != nil && apiErr.StatusCode() != 500 {
+		return auth, models.ConstructApiError(404, MESSAGE_BAD_ID, context, "authorisation", authorisationId)
+	}
+
+	return auth, apiErr
+}
+
+// OpenDispute opens a dispute against all or part of a captured payment, provisionally crediting the card with it.
+// Returns the updated authorisation
+func (d *dbGate) OpenDispute(ctx context.Context, authorisationId, amount int, currency, description string) (models.Authorisation, models.ApiError) {
+
+	auth, apiErr := d.getDisputedAuthorisation(ctx, authorisationId, "OpenDispute")
+
+	if apiErr != nil {
+		return auth, apiErr
+	}
+
+	_, apiErr = checkAmountCurrency(currency, auth.Currency, "authorisation", auth.Id, "OpenDispute")
+
+	if apiErr != nil {
+		return auth, apiErr
+	}
+
+	apiErr = checkDisputable(auth, amount)
+
+	if apiErr != nil {
+		return auth, apiErr
+	}
+
+	c, apiErr := d.getCard(ctx, auth.CardId)
+
+	if apiErr != nil {
+		return auth, apiErr
+	}
+
+	apiErr = checkCardUsable(c, topUpStatuses, "OpenDispute")
+
+	if apiErr != nil {
+		return auth, apiErr
+	}
+
+	description = disputeDescription(DISPUTE_STATUS_OPEN, description)
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	defer tx.Rollback()
+
+	apiErr = d.guardAuthorisation(ctx, tx, QUERY_OPEN_DISPUTE, auth, amount, "OpenDispute")
+
+	if apiErr != nil {
+		return auth, apiErr
+	}
+
+	// the whole disputed amount is converted at the rate locked when the payment was authorised, so that a lost
+	// dispute re-debits exactly what was credited
+	credit := cardAmount(auth, amount)
+
+	qry := QUERY_UPDATE_CARD
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, credit, credit, auth.CardId)
+
+	if res.apiErr != nil {
+		return auth, res.apiErr
+	}
+
+	//double check that exactly one row was updated
+
+	if res.numRowsAffected != 1 {
+		return auth, models.ConstructApiError(500, MESSAGE_INVALID_ROW_UPDATE, "OpenDispute")
+	}
+
+	qry = QUERY_ADD_MOVEMENT
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, auth.CardId, credit, description, "DISPUTE-CREDIT")
+
+	if res.apiErr != nil {
+		return auth, res.apiErr
+	}
+
+	qry = QUERY_ADD_AUTH_MOVEMENT
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, auth.Id, -amount, description, disputeMovementTypes[DISPUTE_STATUS_OPEN])
+
+	if res.apiErr != nil {
+		return auth, res.apiErr
+	}
+
+	apiErr = d.addLedgerEntry(ctx, tx, "DISPUTE-OPENED", description, res.lastInsertedId, transfer(LEDGER_ACCOUNT_DISPUTES, CardAvailableAccount(auth.CardId), credit, auth.CardCurrency))
+
+	if apiErr != nil {
+		return auth, apiErr
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	return d.GetAuthorisation(WithReadYourWrites(ctx), auth.Id)
+}
+
+// SetDisputeStatus moves the dispute on an authorisation to VENDOR_RESPONDED, WON or LOST, recording the change in its
+// movements. A dispute won is charged back to the vendor, and a dispute lost re-debits the card, which must not be
+// closed. Returns the updated authorisation
+func (d *dbGate) SetDisputeStatus(ctx context.Context, authorisationId int, status, description string) (models.Authorisation, models.ApiError) {
+
+	auth, apiErr := d.getDisputedAuthorisation(ctx, authorisationId, "SetDisputeStatus")
+
+	if apiErr != nil {
+		return auth, apiErr
+	}
+
+	apiErr = checkDisputeTransition(auth, status)
+
+	if apiErr != nil {
+		return auth, apiErr
+	}
+
+	if status == DISPUTE_STATUS_LOST {
+
+		c, apiErr := d.getCard(ctx, auth.CardId)
+
+		if apiErr != nil {
+			return auth, apiErr
+		}
+
+		apiErr = checkCardUsable(c, redebitStatuses, "SetDisputeStatus")
+
+		if apiErr != nil {
+			return auth, apiErr
+		}
+	}
+
+	description = disputeDescription(status, description)
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	defer tx.Rollback()
+
+	qry := QUERY_UPDATE_DISPUTE_STATUS
+
+	if status == DISPUTE_STATUS_LOST {
+		qry = QUERY_LOSE_DISPUTE
+	}
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, status, auth.Id, auth.DisputeStatus)
+
+	if res.apiErr != nil {
+		return auth, res.apiErr
+	}
+
+	// the dispute has changed since the authorisation was read
+	if res.numRowsAffected != 1 {
+		return auth, models.ConstructApiError(409, MESSAGE_DISPUTE_CHANGED, "SetDisputeStatus", auth.Id)
+	}
+
+	credit := cardAmount(auth, auth.Disputed)
+
+	var (
+		movementAmount int
+		postings       []models.LedgerPosting
+	)
+
+	switch status {
+
+	case DISPUTE_STATUS_WON:
+
+		movementAmount = -auth.Disputed
+		postings = exchange(VendorAccount(auth.VendorId), auth.Disputed, auth.Currency, LEDGER_ACCOUNT_DISPUTES, credit, auth.CardCurrency)
+
+		qry = QUERY_UPDATE_VENDOR
+
+		err = d.prepareQry(ctx, qry)
+
+		if err != nil {
+			return auth, models.ErrorWrap(err)
+		}
+
+		res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, -auth.Disputed, auth.VendorId)
+
+		if res.apiErr != nil {
+			return auth, res.apiErr
+		}
+
+		//double check that exactly one row was updated
+
+		if res.numRowsAffected != 1 {
+			return auth, models.ConstructApiError(500, MESSAGE_INVALID_ROW_UPDATE, "SetDisputeStatus")
+		}
+
+	case DISPUTE_STATUS_LOST:
+
+		movementAmount = auth.Disputed
+		postings = transfer(CardAvailableAccount(auth.CardId), LEDGER_ACCOUNT_DISPUTES, credit, auth.CardCurrency)
+
+		// the re-debit is not conditional on the funds available, which it may leave negative
+		qry = QUERY_REDEBIT_CARD
+
+		err = d.prepareQry(ctx, qry)
+
+		if err != nil {
+			return auth, models.ErrorWrap(err)
+		}
+
+		res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, -credit, -credit, auth.CardId)
+
+		if res.apiErr != nil {
+			return auth, res.apiErr
+		}
+
+		// the card has been closed since it was read
+		if res.numRowsAffected != 1 {
+			return auth, models.ConstructApiError(409, MESSAGE_CARD_STATUS_CHANGED, "SetDisputeStatus", auth.CardId)
+		}
+
+		qry = QUERY_ADD_MOVEMENT
+
+		err = d.prepareQry(ctx, qry)
+
+		if err != nil {
+			return auth, models.ErrorWrap(err)
+		}
+
+		res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, auth.CardId, -credit, description, "DISPUTE-REDEBIT")
+
+		if res.apiErr != nil {
+			return auth, res.apiErr
+		}
+	}
+
+	qry = QUERY_ADD_AUTH_MOVEMENT
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, auth.Id, movementAmount, description, disputeMovementTypes[status])
+
+	if res.apiErr != nil {
+		return auth, res.apiErr
+	}
+
+	if postings != nil {
+
+		apiErr = d.addLedgerEntry(ctx, tx, disputeMovementTypes[status], description, res.lastInsertedId, postings)
+
+		if apiErr != nil {
+			return auth, apiErr
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	return d.GetAuthorisation(WithReadYourWrites(ctx), auth.Id)
+}
+
+// OpenDispute opens a dispute against all or part of a captured payment, provisionally crediting the card with it.
+// Returns the updated authorisation
+func (m *memGate) OpenDispute(ctx context.Context, authorisationId, amount int, currency, description string) (models.Authorisation, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	auth, ok := m.authorisations[authorisationId]
+
+	if !ok {
+		return auth, models.ConstructApiError(404, MESSAGE_BAD_ID, "OpenDispute", "authorisation", authorisationId)
+	}
+
+	if _, apiErr := checkAmountCurrency(currency, auth.Currency, "authorisation", auth.Id, "OpenDispute"); apiErr != nil {
+		return auth, apiErr
+	}
+
+	if apiErr := checkDisputable(auth, amount); apiErr != nil {
+		return auth, apiErr
+	}
+
+	if apiErr := checkCardUsable(m.cards[auth.CardId], topUpStatuses, "OpenDispute"); apiErr != nil {
+		return auth, apiErr
+	}
+
+	description = disputeDescription(DISPUTE_STATUS_OPEN, description)
+	credit := cardAmount(auth, amount)
+
+	auth.Disputed += amount
+	auth.DisputeStatus = DISPUTE_STATUS_OPEN
+	m.authorisations[auth.Id] = auth
+
+	m.updateCard(auth.CardId, credit, credit)
+	m.addMovement(auth.CardId, credit, description, "DISPUTE-CREDIT")
+
+	id := m.addAuthMovement(auth.Id, -amount, description, disputeMovementTypes[DISPUTE_STATUS_OPEN])
+
+	m.addLedgerEntry("DISPUTE-OPENED", description, id, transfer(LEDGER_ACCOUNT_DISPUTES, CardAvailableAccount(auth.CardId), credit, auth.CardCurrency))
+
+	return m.authorisationWithMovements(auth.Id), nil
+}
+
+// SetDisputeStatus moves the dispute on an authorisation to VENDOR_RESPONDED, WON or LOST, recording the change in its
+// movements. A dispute won is charged back to the vendor, and a dispute lost re-debits the card, which must not be
+// closed. Returns the updated authorisation
+func (m *memGate) SetDisputeStatus(ctx context.Context, authorisationId int, status, description string) (models.Authorisation, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	auth, ok := m.authorisations[authorisationId]
+
+	if !ok {
+		return auth, models.ConstructApiError(404, MESSAGE_BAD_ID, "SetDisputeStatus", "authorisation", authorisationId)
+	}
+
+	if apiErr := checkDisputeTransition(auth, status); apiErr != nil {
+		return auth, apiErr
+	}
+
+	if status == DISPUTE_STATUS_LOST {
+		if apiErr := checkCardUsable(m.cards[auth.CardId], redebitStatuses, "SetDisputeStatus"); apiErr != nil {
+			return auth, apiErr
+		}
+	}
+
+	description = disputeDescription(status, description)
+	disputed := auth.Disputed
+	credit := cardAmount(auth, disputed)
+
+	auth.DisputeStatus = status
+
+	if status == DISPUTE_STATUS_LOST {
+		auth.Disputed = 0
+	}
+
+	m.authorisations[auth.Id] = auth
+
+	switch status {
+
+	case DISPUTE_STATUS_VENDOR_RESPONDED:
+		m.addAuthMovement(auth.Id, 0, description, disputeMovementTypes[status])
+
+	case DISPUTE_STATUS_WON:
+		m.updateVendor(auth.VendorId, -disputed)
+
+		id := m.addAuthMovement(auth.Id, -disputed, description, disputeMovementTypes[status])
+
+		m.addLedgerEntry(disputeMovementTypes[status], description, id,
+			exchange(VendorAccount(auth.VendorId), disputed, auth.Currency, LEDGER_ACCOUNT_DISPUTES, credit, auth.CardCurrency))
+
+	case DISPUTE_STATUS_LOST:
+		m.updateCard(auth.CardId, -credit, -credit)
+		m.addMovement(auth.CardId, -credit, description, "DISPUTE-REDEBIT")
+
+		id := m.addAuthMovement(auth.Id, disputed, description, disputeMovementTypes[status])
+
+		m.addLedgerEntry(disputeMovementTypes[status], description, id, transfer(CardAvailableAccount(auth.CardId), LEDGER_ACCOUNT_DISPUTES, credit, auth.CardCurrency))
+	}
+
+	return m.authorisationWithMovements(auth.Id), nil
+}
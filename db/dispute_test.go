@@ -0,0 +1,238 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestOpenDisputeExists(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 250, 0, 0, nil, "GBP", "GBP", 1.0, "APPROVED", 100, "OPEN")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
+
+		_, apiErr := dbi.OpenDispute(context.Background(), 1005, 100, "", "")
+
+		utils.AssertEquals(t, "Return status for calling OpenDispute on an authorisation already disputed", 409, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling OpenDispute on an authorisation already disputed",
+			fmt.Sprintf(MESSAGE_DISPUTE_EXISTS, "OpenDispute", 1005, "OPEN"), apiErr.Error())
+	})
+}
+
+// Disputes most of a captured payment, which the vendor answers and the card holder wins, and the whole of another,
+// which the card holder loses, checking the card, the vendor and the disputes ledger account at each step
+func testDisputes(t *testing.T, dbi Dbi, c models.Card, v models.Vendor) {
+
+	ctx := context.Background()
+
+	aid, apiErr := dbi.Authorise(ctx, c.Id, v.Id, 2500, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	_, apiErr = dbi.Capture(ctx, aid, 2500, "")
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	other, apiErr := dbi.Authorise(ctx, c.Id, v.Id, 1000, "", "Cake")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	_, apiErr = dbi.OpenDispute(ctx, 9999, 500, "", "")
+	utils.AssertEquals(t, "Return status for calling OpenDispute with an invalid id", 404, apiErr.StatusCode())
+
+	_, apiErr = dbi.OpenDispute(ctx, other, 500, "", "")
+	utils.AssertEquals(t, "Return status for calling OpenDispute on an authorisation not captured", 400, apiErr.StatusCode())
+
+	_, apiErr = dbi.OpenDispute(ctx, aid, 3000, "", "")
+	utils.AssertEquals(t, "Return status for calling OpenDispute for more than captured", 400, apiErr.StatusCode())
+
+	for _, amount := range []int{0, -5000} {
+
+		_, apiErr = dbi.OpenDispute(ctx, aid, amount, "", "")
+
+		utils.AssertEquals(t, fmt.Sprintf("Return status for calling OpenDispute for %v", amount), 400, apiErr.StatusCode())
+		utils.AssertEquals(t, fmt.Sprintf("Return message for calling OpenDispute for %v", amount),
+			fmt.Sprintf(MESSAGE_BAD_DISPUTE_AMOUNT, "OpenDispute", amount), apiErr.Error())
+	}
+
+	card, _ := dbi.GetCard(ctx, c.Id)
+	utils.AssertEquals(t, "Balance after refused disputes", 10000-2500, card.Balance)
+
+	a, apiErr := dbi.OpenDispute(ctx, aid, 2000, "", "Not delivered")
+
+	utils.AssertNoError(t, "Calling OpenDispute", apiErr)
+	utils.AssertEquals(t, "Disputed after OpenDispute", 2000, a.Disputed)
+	utils.AssertEquals(t, "Dispute status after OpenDispute", DISPUTE_STATUS_OPEN, a.DisputeStatus)
+	utils.AssertEquals(t, "Refundable while disputed", 500, a.Refundable())
+	utils.AssertEquals(t, "Movement type of the opened dispute", "DISPUTE-OPENED", a.Movements[len(a.Movements)-1].MovementType)
+	utils.AssertEquals(t, "Amount of the opened dispute", -2000, a.Movements[len(a.Movements)-1].Amount)
+
+	card, _ = dbi.GetCard(ctx, c.Id)
+
+	utils.AssertEquals(t, "Balance after the provisional credit", 10000-2500+2000, card.Balance)
+	utils.AssertEquals(t, "Available after the provisional credit", 10000-2500-1000+2000, card.Available)
+	utils.AssertEquals(t, "Movement type of the provisional credit", "DISPUTE-CREDIT", card.Movements[len(card.Movements)-1].MovementType)
+
+	_, apiErr = dbi.OpenDispute(ctx, aid, 500, "", "")
+
+	utils.AssertEquals(t, "Return status for calling OpenDispute twice", 409, apiErr.StatusCode())
+
+	_, apiErr = dbi.Refund(ctx, aid, 1000, "", "Stale")
+
+	utils.AssertEquals(t, "Return status for calling Refund of the disputed amount", 400, apiErr.StatusCode())
+
+	_, apiErr = dbi.SetDisputeStatus(ctx, aid, "MAYBE", "")
+
+	utils.AssertEquals(t, "Return status for calling SetDisputeStatus with an unknown status", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling SetDisputeStatus with an unknown status",
+		fmt.Sprintf(MESSAGE_BAD_DISPUTE_STATUS, "SetDisputeStatus", "MAYBE"), apiErr.Error())
+
+	_, apiErr = dbi.SetDisputeStatus(ctx, other, DISPUTE_STATUS_WON, "")
+
+	utils.AssertEquals(t, "Return status for calling SetDisputeStatus without a dispute", 409, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling SetDisputeStatus without a dispute",
+		fmt.Sprintf(MESSAGE_NO_DISPUTE, "SetDisputeStatus", other), apiErr.Error())
+
+	a, apiErr = dbi.SetDisputeStatus(ctx, aid, DISPUTE_STATUS_VENDOR_RESPONDED, "")
+
+	utils.AssertNoError(t, "Calling SetDisputeStatus with VENDOR_RESPONDED", apiErr)
+	utils.AssertEquals(t, "Dispute status after the vendor responded", DISPUTE_STATUS_VENDOR_RESPONDED, a.DisputeStatus)
+	utils.AssertEquals(t, "Movement type of the response", "DISPUTE-RESPONDED", a.Movements[len(a.Movements)-1].MovementType)
+	utils.AssertEquals(t, "Description of the response", "Vendor responded to dispute", a.Movements[len(a.Movements)-1].Description)
+
+	_, apiErr = dbi.SetDisputeStatus(ctx, aid, DISPUTE_STATUS_VENDOR_RESPONDED, "")
+
+	utils.AssertEquals(t, "Return status for calling SetDisputeStatus with VENDOR_RESPONDED twice", 409, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling SetDisputeStatus with VENDOR_RESPONDED twice",
+		fmt.Sprintf(MESSAGE_DISPUTE_STATUS_TRANSITION, "SetDisputeStatus", aid, DISPUTE_STATUS_VENDOR_RESPONDED, DISPUTE_STATUS_VENDOR_RESPONDED), apiErr.Error())
+
+	a, apiErr = dbi.SetDisputeStatus(ctx, aid, DISPUTE_STATUS_WON, "")
+
+	utils.AssertNoError(t, "Calling SetDisputeStatus with WON", apiErr)
+	utils.AssertEquals(t, "Dispute status after the dispute was won", DISPUTE_STATUS_WON, a.DisputeStatus)
+	utils.AssertEquals(t, "Disputed after the dispute was won", 2000, a.Disputed)
+	utils.AssertEquals(t, "Movement type of the chargeback", "CHARGEBACK", a.Movements[len(a.Movements)-1].MovementType)
+	utils.AssertEquals(t, "Amount of the chargeback", -2000, a.Movements[len(a.Movements)-1].Amount)
+
+	v, _ = dbi.GetVendor(ctx, v.Id)
+	utils.AssertEquals(t, "Vendor balance after the chargeback", 2500-2000, v.Balance)
+
+	_, apiErr = dbi.SetDisputeStatus(ctx, aid, DISPUTE_STATUS_LOST, "")
+
+	utils.AssertEquals(t, "Return status for calling SetDisputeStatus on a dispute won", 409, apiErr.StatusCode())
+
+	_, apiErr = dbi.Capture(ctx, other, 1000, "")
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	_, apiErr = dbi.OpenDispute(ctx, other, 1000, "", "")
+	utils.AssertNoError(t, "Calling OpenDispute", apiErr)
+
+	a, apiErr = dbi.SetDisputeStatus(ctx, other, DISPUTE_STATUS_LOST, "")
+
+	utils.AssertNoError(t, "Calling SetDisputeStatus with LOST", apiErr)
+	utils.AssertEquals(t, "Dispute status after the dispute was lost", DISPUTE_STATUS_LOST, a.DisputeStatus)
+	utils.AssertEquals(t, "Refundable after the dispute was lost", 1000, a.Refundable())
+	utils.AssertEquals(t, "Movement type of the lost dispute", "DISPUTE-LOST", a.Movements[len(a.Movements)-1].MovementType)
+	utils.AssertEquals(t, "Amount of the lost dispute", 1000, a.Movements[len(a.Movements)-1].Amount)
+
+	card, _ = dbi.GetCard(ctx, c.Id)
+
+	utils.AssertEquals(t, "Balance after the re-debit", 10000-2500+2000-1000, card.Balance)
+	utils.AssertEquals(t, "Available after the re-debit", 10000-2500+2000-1000, card.Available)
+	utils.AssertEquals(t, "Movement type of the re-debit", "DISPUTE-REDEBIT", card.Movements[len(card.Movements)-1].MovementType)
+	utils.AssertEquals(t, "Description of the re-debit", "Re-debit of disputed payment", card.Movements[len(card.Movements)-1].Description)
+
+	v, _ = dbi.GetVendor(ctx, v.Id)
+	utils.AssertEquals(t, "Vendor balance after the lost dispute", 2500-2000+1000, v.Balance)
+
+	disputes, _ := dbi.GetAccountBalance(ctx, LEDGER_ACCOUNT_DISPUTES)
+	utils.AssertEquals(t, "Balance of the disputes account once every dispute is settled", 0, disputes)
+
+	r, apiErr := dbi.Reconcile(ctx)
+
+	utils.AssertNoError(t, "Calling Reconcile", apiErr)
+	utils.AssertTrue(t, "Ok for Reconcile after disputes", r.Ok)
+}
+
+func TestMemoryDisputes(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 10000)
+	defer dbi.Close()
+
+	testDisputes(t, dbi, c, v)
+}
+
+// Loses a dispute whose provisional credit was spent, leaving the card owing, which cannot then be closed, and
+// checks that a dispute on a card closed while it was open cannot be lost
+func testDisputeClosedCard(t *testing.T, dbi Dbi, c models.Card, v models.Vendor) {
+
+	ctx := context.Background()
+
+	aid, apiErr := dbi.Authorise(ctx, c.Id, v.Id, 10000, "", "Sofa")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	_, apiErr = dbi.Capture(ctx, aid, 10000, "")
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	_, apiErr = dbi.OpenDispute(ctx, aid, 10000, "", "Not delivered")
+	utils.AssertNoError(t, "Calling OpenDispute", apiErr)
+
+	spent, apiErr := dbi.Authorise(ctx, c.Id, v.Id, 10000, "", "Chair")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	_, apiErr = dbi.Capture(ctx, spent, 10000, "")
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	_, apiErr = dbi.SetDisputeStatus(ctx, aid, DISPUTE_STATUS_LOST, "")
+	utils.AssertNoError(t, "Calling SetDisputeStatus to lose the dispute", apiErr)
+
+	card, _ := dbi.GetCard(ctx, c.Id)
+	utils.AssertEquals(t, "Balance after losing a spent dispute", -10000, card.Balance)
+
+	_, apiErr = dbi.SetCardStatus(ctx, c.Id, CARD_STATUS_CLOSED, "")
+
+	utils.AssertEquals(t, "Return status for closing a card owing a balance", 409, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for closing a card owing a balance",
+		fmt.Sprintf(MESSAGE_CARD_IN_DEBIT, "SetCardStatus", c.Id, "-£100.00"), apiErr.Error())
+
+	_, apiErr = dbi.TopUp(ctx, c.Id, 12500, "", "Transfer from Bank")
+	utils.AssertNoError(t, "Calling TopUp", apiErr)
+
+	_, apiErr = dbi.OpenDispute(ctx, spent, 2500, "", "Broken")
+	utils.AssertNoError(t, "Calling OpenDispute", apiErr)
+
+	card, apiErr = dbi.SetCardStatus(ctx, c.Id, CARD_STATUS_CLOSED, "")
+
+	utils.AssertNoError(t, "Calling SetCardStatus to close the card", apiErr)
+	utils.AssertEquals(t, "Balance after closing", 0, card.Balance)
+	utils.AssertEquals(t, "Payout on closing", -5000, card.Movements[len(card.Movements)-1].Amount)
+
+	_, apiErr = dbi.SetDisputeStatus(ctx, spent, DISPUTE_STATUS_LOST, "")
+
+	utils.AssertEquals(t, "Return status for losing a dispute on a closed card", 403, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for losing a dispute on a closed card",
+		fmt.Sprintf(MESSAGE_CARD_NOT_USABLE, "SetDisputeStatus", c.Id, CARD_STATUS_CLOSED), apiErr.Error())
+
+	a, apiErr := dbi.SetDisputeStatus(ctx, spent, DISPUTE_STATUS_WON, "")
+
+	utils.AssertNoError(t, "Calling SetDisputeStatus to win a dispute on a closed card", apiErr)
+	utils.AssertEquals(t, "Dispute status after winning on a closed card", DISPUTE_STATUS_WON, a.DisputeStatus)
+
+	r, apiErr := dbi.Reconcile(ctx)
+
+	utils.AssertNoError(t, "Calling Reconcile", apiErr)
+	utils.AssertTrue(t, "Ok for Reconcile after closing a card with disputes", r.Ok)
+}
+
+func TestMemoryDisputeClosedCard(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 10000)
+	defer dbi.Close()
+
+	testDisputeClosedCard(t, dbi, c, v)
+}
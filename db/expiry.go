@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	QUERY_GET_EXPIRED_AUTHORISATIONS = `SELECT id FROM authorisations
+                            WHERE expires_at <= ? AND amount - (captured + reversed) > 0
+                            ORDER BY id`
+
+	// How long an authorisation may be captured for before the sweep releases its hold
+	AUTHORISATION_EXPIRY = 7 * 24 * time.Hour
+
+	// The format of MySQL DATETIME values, in which expiry times are stored and compared, always in UTC
+	DATETIME_FORMAT = "2006-01-02 15:04:05"
+
+	MESSAGE_AUTHORISATION_EXPIRED = "%v: authorisation %v expired at %v"
+)
+
+// The source of the current time for expiry, replaceable in tests
+var clock = time.Now
+
+// Returns a time as a UTC DATETIME value
+func datetime(t time.Time) string {
+	return t.UTC().Format(DATETIME_FORMAT)
+}
+
+// Returns the expiry time of an authorisation made at the given time
+func expiryTime(now time.Time) string {
+	return datetime(now.Add(AUTHORISATION_EXPIRY))
+}
+
+// True if an authorisation has an expiry time which has passed at the given time. Authorisations made before expiry
+// times were introduced have none, so never expire.
+func expired(auth models.Authorisation, now time.Time) bool {
+	return auth.ExpiresAt != "" && auth.ExpiresAt <= datetime(now)
+}
+
+// Returns the description of the EXPIRY movement which releases the hold of an expired authorisation
+func expiryDescription(amount int, currency string) string {
+	return "Expiry of " + models.FormatAmount(amount, currency)
+}
+
+// ExpireAuthorisations reverses the uncaptured remainder of every authorisation past its expiry time, releasing the
+// hold on the card, and reports the authorisations expired
+func (d *dbGate) ExpireAuthorisations(ctx context.Context) (models.ExpiryReport, models.ApiError) {
+
+	var (
+		ids []int
+		err error
+	)
+
+	report := models.ExpiryReport{
+		AmountsReleased: map[string]int{},
+		Codes:           []int{},
+	}
+
+	qry := QUERY_GET_EXPIRED_AUTHORISATIONS
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return report, models.ErrorWrap(err)
+	}
+
+	rows, err := d.stmt(qry).QueryContext(ctx, datetime(clock()))
+
+	if err != nil {
+		return report, models.ErrorWrap(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var id int
+
+		err := rows.Scan(&id)
+
+		if err != nil {
+			return report, models.ErrorWrap(err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return report, models.ErrorWrap(err)
+	}
+
+	for _, id := range ids {
+
+		auth, apiErr := d.getAuthorisation(ctx, id)
+
+		if apiErr != nil {
+			return report, apiErr
+		}
+
+		amount := auth.Capturable()
+
+		if amount <= 0 {
+			continue
+		}
+
+		code, apiErr := d.releaseHold(ctx, auth, amount, expiryDescription(amount, auth.Currency), "EXPIRY", "ExpireAuthorisations")
+
+		if apiErr != nil {
+
+			// a reversal since the authorisation was read has failed the guard: the next sweep will pick up the rest
+			if apiErr.StatusCode() == 400 {
+				continue
+			}
+
+			return report, apiErr
+		}
+
+		report.AuthorisationsExpired++
+		report.AmountReleased += amount
+		report.AmountsReleased[auth.Currency] += amount
+		report.Codes = append(report.Codes, code)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestExpireAuthorisations(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id"}).
+			AddRow(1005).
+			AddRow(1006)
+
+		expecter.ExpectPrepare(esc(QUERY_GET_EXPIRED_AUTHORISATIONS)).ExpectQuery().WithArgs(datetime(testNow)).WillReturnRows(expected)
+
+		//id, amount, card_id, vendor_id, description, captured, reversed, refunded, expires_at
+		expected = sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 100, 0, 0, "2019-01-24 01:00:00", "GBP", "GBP", 1.0, "APPROVED", 0, nil)
+
+		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
+
+		expecter.ExpectBegin()
+
+		expecter.ExpectPrepare(esc(QUERY_REVERSE_AUTH))
+		// This duplication seems to be necessary for tx.Stmt(..)
+		expecter.ExpectPrepare(esc(QUERY_REVERSE_AUTH)).ExpectExec().WithArgs(150, 1005, 150).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD))
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD)).ExpectExec().WithArgs(0, 150, 100001).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		expecter.ExpectPrepare(esc(QUERY_ADD_AUTH_MOVEMENT))
+		expecter.ExpectPrepare(esc(QUERY_ADD_AUTH_MOVEMENT)).ExpectExec().WithArgs(1005, -150, "Expiry of £1.50", "EXPIRY").WillReturnResult(sqlmock.NewResult(1011, 1))
+
+		expectLedgerEntry(expecter, "EXPIRY", "Expiry of £1.50", 1011, transfer(CardHeldAccount(100001), CardAvailableAccount(100001), 150, "GBP"))
+
+		expecter.ExpectCommit()
+
+		// the second authorisation has been reversed concurrently since it was selected, so fails the guard
+		expected = sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1006), 300, 100001, 1002, "Cake", 0, 0, 0, "2019-01-24 01:00:00", "GBP", "GBP", 1.0, "APPROVED", 0, nil)
+
+		// the statements are already prepared on the connection, so are not prepared again
+		expecter.ExpectQuery(esc(QUERY_GET_AUTHORISATION)).WithArgs(1006).WillReturnRows(expected)
+
+		expecter.ExpectBegin()
+
+		expecter.ExpectExec(esc(QUERY_REVERSE_AUTH)).WithArgs(300, 1006, 300).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		expecter.ExpectRollback()
+
+		report, apiErr := dbi.ExpireAuthorisations(context.Background())
+
+		utils.AssertNoError(t, "Calling ExpireAuthorisations", apiErr)
+		utils.AssertEquals(t, "AuthorisationsExpired for ExpireAuthorisations result", 1, report.AuthorisationsExpired)
+		utils.AssertEquals(t, "AmountReleased for ExpireAuthorisations result", 150, report.AmountReleased)
+		utils.AssertEquals(t, "Codes for ExpireAuthorisations result", fmt.Sprint([]int{1011}), fmt.Sprint(report.Codes))
+	})
+}
+
+func TestCaptureExpired(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		//id, amount, card_id, vendor_id, description, captured, reversed, refunded, expires_at
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 0, 0, 0, "2019-01-24 01:00:10", "GBP", "GBP", 1.0, "APPROVED", 0, nil)
+
+		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
+
+		_, apiErr := dbi.Capture(context.Background(), 1005, 250, "")
+
+		utils.AssertEquals(t, "Return status for calling Capture on an expired authorisation", 400, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling Capture on an expired authorisation",
+			fmt.Sprintf(MESSAGE_AUTHORISATION_EXPIRED, "Capture", 1005, "2019-01-24 01:00:10"), apiErr.Error())
+	})
+}
+
+func TestExpired(t *testing.T) {
+
+	auth := models.Authorisation{ExpiresAt: datetime(testNow)}
+
+	utils.AssertFalse(t, "Authorisation expired before its expiry time", expired(auth, testNow.Add(-time.Second)))
+	utils.AssertTrue(t, "Authorisation expired at its expiry time", expired(auth, testNow))
+	utils.AssertFalse(t, "Authorisation without an expiry time expired", expired(models.Authorisation{}, testNow))
+}
+
+func TestMemoryExpireAuthorisations(t *testing.T) {
+
+	defer fixClock(testNow)()
+
+	dbi, c, v := memoryFixture(t, 1000)
+	defer dbi.Close()
+
+	aid, apiErr := dbi.Authorise(context.Background(), c.Id, v.Id, 400, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	_, apiErr = dbi.Capture(context.Background(), aid, 150, "")
+	utils.AssertNoError(t, "Calling Capture before expiry", apiErr)
+
+	report, apiErr := dbi.ExpireAuthorisations(context.Background())
+
+	utils.AssertNoError(t, "Calling ExpireAuthorisations before expiry", apiErr)
+	utils.AssertEquals(t, "AuthorisationsExpired before expiry", 0, report.AuthorisationsExpired)
+
+	fixClock(testNow.Add(AUTHORISATION_EXPIRY))
+
+	_, apiErr = dbi.Capture(context.Background(), aid, 50, "")
+
+	utils.AssertEquals(t, "Return status for calling Capture after expiry", 400, apiErr.StatusCode())
+
+	report, apiErr = dbi.ExpireAuthorisations(context.Background())
+
+	utils.AssertNoError(t, "Calling ExpireAuthorisations after expiry", apiErr)
+	utils.AssertEquals(t, "AuthorisationsExpired after expiry", 1, report.AuthorisationsExpired)
+	utils.AssertEquals(t, "AmountReleased after expiry", 250, report.AmountReleased)
+	utils.AssertEquals(t, "AmountsReleased after expiry", fmt.Sprint(map[string]int{"GBP": 250}), fmt.Sprint(report.AmountsReleased))
+
+	a, apiErr := dbi.GetAuthorisation(context.Background(), aid)
+
+	utils.AssertNoError(t, "Calling GetAuthorisation", apiErr)
+	utils.AssertEquals(t, "Capturable after expiry", 0, a.Capturable())
+	utils.AssertEquals(t, "MovementType of the last movement", "EXPIRY", a.Movements[len(a.Movements)-1].MovementType)
+
+	card, apiErr := dbi.GetCard(context.Background(), c.Id)
+
+	utils.AssertNoError(t, "Calling GetCard", apiErr)
+	utils.AssertEquals(t, "Available after expiry", 850, card.Available)
+	utils.AssertEquals(t, "Balance after expiry", 850, card.Balance)
+
+	report, apiErr = dbi.ExpireAuthorisations(context.Background())
+
+	utils.AssertNoError(t, "Calling ExpireAuthorisations again", apiErr)
+	utils.AssertEquals(t, "AuthorisationsExpired by a repeated sweep", 0, report.AuthorisationsExpired)
+
+	r, apiErr := dbi.Reconcile(context.Background())
+
+	utils.AssertNoError(t, "Calling Reconcile", apiErr)
+	utils.AssertTrue(t, "Ok for Reconcile after expiry", r.Ok)
+}
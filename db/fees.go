@@ -0,0 +1,282 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	// The effective fee schedule of a vendor: its own, or if it has none that of its category, or none
+	QUERY_GET_VENDOR_FEES = `SELECT COALESCE(f.basis_points, cf.basis_points, 0), COALESCE(f.fixed_amount, cf.fixed_amount, 0)
+                            FROM vendors v
+                            LEFT OUTER JOIN vendor_fees f ON (f.vendor_id = v.id)
+                            LEFT OUTER JOIN category_fees cf ON (cf.category = v.category)
+                            WHERE v.id = ?`
+
+	// Fee schedules are replaced whole, deleting then inserting, as limits are
+	QUERY_DELETE_VENDOR_FEES = "DELETE FROM vendor_fees WHERE vendor_id = ?"
+	QUERY_ADD_VENDOR_FEES    = "INSERT INTO vendor_fees (vendor_id, basis_points, fixed_amount) VALUES (?, ?, ?)"
+
+	QUERY_DELETE_CATEGORY_FEES = "DELETE FROM category_fees WHERE category = ?"
+	QUERY_ADD_CATEGORY_FEES    = "INSERT INTO category_fees (category, basis_points, fixed_amount) VALUES (?, ?, ?)"
+
+	// A fee of 10000 basis points is the whole amount
+	MAX_BASIS_POINTS    = 10000
+	MAX_CATEGORY_LENGTH = 32
+
+	MESSAGE_BAD_BASIS_POINTS = "%v: basisPoints must be between 0 and %v"
+	MESSAGE_BAD_FIXED_FEE    = "%v: fixed must not be negative"
+	MESSAGE_LONG_CATEGORY    = "%v: category %v is longer than %v characters"
+	MESSAGE_NO_CATEGORY      = "%v: no category given"
+	MESSAGE_CAPTURE_FEE      = "Fee on capture of %v"
+)
+
+// Check that a fee schedule charges between none and all of an amount, plus a fixed amount which is not negative
+func checkFeesValid(fees models.FeeSchedule, context string) models.ApiError {
+
+	if fees.BasisPoints < 0 || fees.BasisPoints > MAX_BASIS_POINTS {
+		return models.ConstructApiError(400, MESSAGE_BAD_BASIS_POINTS, context, MAX_BASIS_POINTS)
+	}
+
+	if fees.Fixed < 0 {
+		return models.ConstructApiError(400, MESSAGE_BAD_FIXED_FEE, context)
+	}
+
+	return nil
+}
+
+// Check that a vendor category fits its column. A vendor need not have a category
+func checkCategory(category, context string) models.ApiError {
+
+	if len(category) > MAX_CATEGORY_LENGTH {
+		return models.ConstructApiError(400, MESSAGE_LONG_CATEGORY, context, category, MAX_CATEGORY_LENGTH)
+	}
+
+	return nil
+}
+
+// Check that a category to set a fee schedule for is given and fits its column
+func checkFeeCategory(category, context string) models.ApiError {
+
+	if category == "" {
+		return models.ConstructApiError(400, MESSAGE_NO_CATEGORY, context)
+	}
+
+	return checkCategory(category, context)
+}
+
+// Returns the description of the fee charged on a capture
+func captureFeeDescription(amount int, currency string) string {
+	return fmt.Sprintf(MESSAGE_CAPTURE_FEE, models.FormatAmount(amount, currency))
+}
+
+// Read the effective fee schedule of a vendor with QUERY_GET_VENDOR_FEES
+func (c *dbConn) getVendorFees(ctx context.Context, vendorId int, context string) (models.FeeSchedule, models.ApiError) {
+
+	var f models.FeeSchedule
+
+	qry := QUERY_GET_VENDOR_FEES
+
+	err := c.prepareQry(ctx, qry)
+
+	if err != nil {
+		return f, models.ErrorWrap(err)
+	}
+
+	err = c.stmt(qry).QueryRowContext(ctx, vendorId).Scan(&f.BasisPoints, &f.Fixed)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return f, models.ConstructApiError(404, MESSAGE_BAD_ID, context, "vendor", vendorId)
+		}
+		return f, models.ErrorWrap(err)
+	}
+
+	return f, nil
+}
+
+// Replace the fee schedule of a vendor or category in a transaction
+func (d *dbGate) setFees(ctx context.Context, deleteQry, addQry string, key interface{}, fees models.FeeSchedule) models.ApiError {
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	defer tx.Rollback()
+
+	for _, qry := range []string{deleteQry, addQry} {
+
+		err = d.prepareQry(ctx, qry)
+
+		if err != nil {
+			return models.ErrorWrap(err)
+		}
+	}
+
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(deleteQry)), deleteQry, key)
+
+	if res.apiErr != nil {
+		return res.apiErr
+	}
+
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(addQry)), addQry, key, fees.BasisPoints, fees.Fixed)
+
+	if res.apiErr != nil {
+		return res.apiErr
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	return nil
+}
+
+// Charge the fee on a capture within its transaction, taking it from the vendor's account into the fees account with
+// a FEE auth movement. The vendor's balance has already been credited net of the fee
+func (d *dbGate) chargeCaptureFee(ctx context.Context, tx *sql.Tx, auth models.Authorisation, amount, fee int) models.ApiError {
+
+	description := captureFeeDescription(amount, auth.Currency)
+
+	qry := QUERY_ADD_AUTH_MOVEMENT
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, auth.Id, -fee, description, "FEE")
+
+	if res.apiErr != nil {
+		return res.apiErr
+	}
+
+	return d.addLedgerEntry(ctx, tx, "FEE", description, res.lastInsertedId, transfer(VendorAccount(auth.VendorId), LEDGER_ACCOUNT_FEES, fee, auth.Currency))
+}
+
+// GetVendorFees returns the effective fee schedule charged on the captures of a vendor: its own, or if it has none
+// that of its category
+func (d *dbGate) GetVendorFees(ctx context.Context, vendorId int) (models.FeeSchedule, models.ApiError) {
+	return d.reader(ctx).getVendorFees(ctx, vendorId, "GetVendorFees")
+}
+
+// SetVendorFees replaces the fee schedule of a vendor, which takes the place of that of its category, returning it
+func (d *dbGate) SetVendorFees(ctx context.Context, vendorId int, fees models.FeeSchedule) (models.FeeSchedule, models.ApiError) {
+
+	apiErr := checkFeesValid(fees, "SetVendorFees")
+
+	if apiErr != nil {
+		return models.FeeSchedule{}, apiErr
+	}
+
+	// check that the vendor exists, as a foreign key violation is not reported alike by every database
+	_, apiErr = d.getVendorFees(ctx, vendorId, "SetVendorFees")
+
+	if apiErr != nil {
+		return models.FeeSchedule{}, apiErr
+	}
+
+	apiErr = d.setFees(ctx, QUERY_DELETE_VENDOR_FEES, QUERY_ADD_VENDOR_FEES, vendorId, fees)
+
+	if apiErr != nil {
+		return models.FeeSchedule{}, apiErr
+	}
+
+	return d.getVendorFees(ctx, vendorId, "SetVendorFees")
+}
+
+// SetCategoryFees replaces the fee schedule of the vendors of a category without one of their own, returning it
+func (d *dbGate) SetCategoryFees(ctx context.Context, category string, fees models.FeeSchedule) (models.FeeSchedule, models.ApiError) {
+
+	apiErr := checkFeesValid(fees, "SetCategoryFees")
+
+	if apiErr != nil {
+		return models.FeeSchedule{}, apiErr
+	}
+
+	apiErr = checkFeeCategory(category, "SetCategoryFees")
+
+	if apiErr != nil {
+		return models.FeeSchedule{}, apiErr
+	}
+
+	apiErr = d.setFees(ctx, QUERY_DELETE_CATEGORY_FEES, QUERY_ADD_CATEGORY_FEES, category, fees)
+
+	if apiErr != nil {
+		return models.FeeSchedule{}, apiErr
+	}
+
+	return fees, nil
+}
+
+// Returns the effective fee schedule of a vendor in memory
+func (m *memGate) effectiveFees(v models.Vendor) models.FeeSchedule {
+
+	if fees, ok := m.vendorFees[v.Id]; ok {
+		return fees
+	}
+
+	return m.categoryFees[v.Category]
+}
+
+// GetVendorFees returns the effective fee schedule charged on the captures of a vendor: its own, or if it has none
+// that of its category
+func (m *memGate) GetVendorFees(ctx context.Context, vendorId int) (models.FeeSchedule, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	v, ok := m.vendors[vendorId]
+
+	if !ok {
+		return models.FeeSchedule{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "GetVendorFees", "vendor", vendorId)
+	}
+
+	return m.effectiveFees(v), nil
+}
+
+// SetVendorFees replaces the fee schedule of a vendor, which takes the place of that of its category, returning it
+func (m *memGate) SetVendorFees(ctx context.Context, vendorId int, fees models.FeeSchedule) (models.FeeSchedule, models.ApiError) {
+
+	if apiErr := checkFeesValid(fees, "SetVendorFees"); apiErr != nil {
+		return models.FeeSchedule{}, apiErr
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.vendors[vendorId]; !ok {
+		return models.FeeSchedule{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "SetVendorFees", "vendor", vendorId)
+	}
+
+	m.vendorFees[vendorId] = fees
+
+	return fees, nil
+}
+
+// SetCategoryFees replaces the fee schedule of the vendors of a category without one of their own, returning it
+func (m *memGate) SetCategoryFees(ctx context.Context, category string, fees models.FeeSchedule) (models.FeeSchedule, models.ApiError) {
+
+	if apiErr := checkFeesValid(fees, "SetCategoryFees"); apiErr != nil {
+		return models.FeeSchedule{}, apiErr
+	}
+
+	if apiErr := checkFeeCategory(category, "SetCategoryFees"); apiErr != nil {
+		return models.FeeSchedule{}, apiErr
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.categoryFees[category] = fees
+
+	return fees, nil
+}
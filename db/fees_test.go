@@ -0,0 +1,161 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestCaptureWithFee(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 0, 0, 0, nil, "GBP", "GBP", 1.0, "APPROVED", 0, nil)
+
+		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
+
+		expectFees(expecter, 1002, models.FeeSchedule{BasisPoints: 100, Fixed: 5})
+
+		expecter.ExpectBegin()
+
+		expecter.ExpectPrepare(esc(QUERY_CAPTURE_AUTH))
+		// This duplication seems to be necessary for tx.Stmt(..)
+		expecter.ExpectPrepare(esc(QUERY_CAPTURE_AUTH)).ExpectExec().WithArgs(250, 1005, 250, datetime(testNow)).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD))
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_CARD)).ExpectExec().WithArgs(-250, 0, 100001).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		// 1% of 2.50 rounded up, plus 0.05
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_VENDOR))
+		expecter.ExpectPrepare(esc(QUERY_UPDATE_VENDOR)).ExpectExec().WithArgs(250-8, 1002).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		expecter.ExpectPrepare(esc(QUERY_ADD_MOVEMENT))
+		expecter.ExpectPrepare(esc(QUERY_ADD_MOVEMENT)).ExpectExec().WithArgs(100001, -250, "Coffee", "PURCHASE").WillReturnResult(sqlmock.NewResult(1009, 1))
+
+		expecter.ExpectPrepare(esc(QUERY_ADD_AUTH_MOVEMENT))
+		expecter.ExpectPrepare(esc(QUERY_ADD_AUTH_MOVEMENT)).ExpectExec().WithArgs(1005, 250, "Capture of £2.50", "CAPTURE").WillReturnResult(sqlmock.NewResult(1009, 1))
+
+		expectLedgerEntry(expecter, "CAPTURE", "Coffee", 1009, transfer(CardHeldAccount(100001), VendorAccount(1002), 250, "GBP"))
+
+		// the statements of the fee have already been prepared for the transaction by the capture
+		expecter.ExpectExec(esc(QUERY_ADD_AUTH_MOVEMENT)).WithArgs(1005, -8, "Fee on capture of £2.50", "FEE").WillReturnResult(sqlmock.NewResult(1010, 1))
+
+		expecter.ExpectExec(esc(QUERY_ADD_LEDGER_ENTRY)).WithArgs("FEE", "Fee on capture of £2.50", 1010).WillReturnResult(sqlmock.NewResult(1002, 1))
+		expecter.ExpectExec(esc(QUERY_ADD_LEDGER_POSTING)).WithArgs(1002, VendorAccount(1002), -8, "GBP").WillReturnResult(sqlmock.NewResult(1003, 1))
+		expecter.ExpectExec(esc(QUERY_ADD_LEDGER_POSTING)).WithArgs(1002, LEDGER_ACCOUNT_FEES, 8, "GBP").WillReturnResult(sqlmock.NewResult(1004, 1))
+
+		expecter.ExpectCommit()
+
+		aid, apiErr := dbi.Capture(context.Background(), 1005, 250, "")
+
+		utils.AssertNoError(t, "Calling Capture", apiErr)
+		utils.AssertEquals(t, "Capture id, which is that of the capture rather than its fee", 1009, aid)
+	})
+}
+
+// Charges the fee of a vendor's category on a capture, then the vendor's own schedule in its place, and settles the
+// captures net of their fees, checking the vendor, the authorisation and the fees ledger account
+func testFees(t *testing.T, dbi Dbi, c models.Card, v models.Vendor) {
+
+	ctx := context.Background()
+
+	_, apiErr := dbi.SetCategoryFees(ctx, "cafe", models.FeeSchedule{BasisPoints: 10001})
+
+	utils.AssertEquals(t, "Return status for calling SetCategoryFees with more than 10000 basis points", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling SetCategoryFees with more than 10000 basis points",
+		fmt.Sprintf(MESSAGE_BAD_BASIS_POINTS, "SetCategoryFees", MAX_BASIS_POINTS), apiErr.Error())
+
+	_, apiErr = dbi.SetCategoryFees(ctx, "", models.FeeSchedule{BasisPoints: 100})
+	utils.AssertEquals(t, "Return status for calling SetCategoryFees without a category", 400, apiErr.StatusCode())
+
+	_, apiErr = dbi.SetVendorFees(ctx, v.Id, models.FeeSchedule{Fixed: -1})
+	utils.AssertEquals(t, "Return status for calling SetVendorFees with a negative fixed fee", 400, apiErr.StatusCode())
+
+	_, apiErr = dbi.SetVendorFees(ctx, 9999, models.FeeSchedule{})
+	utils.AssertEquals(t, "Return status for calling SetVendorFees with an invalid id", 404, apiErr.StatusCode())
+
+	_, apiErr = dbi.GetVendorFees(ctx, 9999)
+	utils.AssertEquals(t, "Return status for calling GetVendorFees with an invalid id", 404, apiErr.StatusCode())
+
+	_, apiErr = dbi.AddOrUpdateVendor(ctx, models.Vendor{Id: v.Id, VendorName: v.VendorName, Category: "a category much longer than allowed"})
+	utils.AssertEquals(t, "Return status for calling AddOrUpdateVendor with a category too long", 400, apiErr.StatusCode())
+
+	_, apiErr = dbi.AddOrUpdateVendor(ctx, models.Vendor{Id: v.Id, VendorName: v.VendorName, Category: "cafe"})
+	utils.AssertNoError(t, "Calling AddOrUpdateVendor with a category", apiErr)
+
+	fees, apiErr := dbi.GetVendorFees(ctx, v.Id)
+
+	utils.AssertNoError(t, "Calling GetVendorFees", apiErr)
+	utils.AssertEquals(t, "Fee schedule of a vendor before any is set", models.FeeSchedule{}, fees)
+
+	_, apiErr = dbi.SetCategoryFees(ctx, "cafe", models.FeeSchedule{BasisPoints: 100, Fixed: 5})
+	utils.AssertNoError(t, "Calling SetCategoryFees", apiErr)
+
+	fees, _ = dbi.GetVendorFees(ctx, v.Id)
+	utils.AssertEquals(t, "Fee schedule of a vendor from its category", models.FeeSchedule{BasisPoints: 100, Fixed: 5}, fees)
+
+	aid, apiErr := dbi.Authorise(ctx, c.Id, v.Id, 2000, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	_, apiErr = dbi.Capture(ctx, aid, 2000, "")
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	a, _ := dbi.GetAuthorisation(ctx, aid)
+
+	utils.AssertEquals(t, "Captured, which is not net of the fee", 2000, a.Captured)
+	utils.AssertEquals(t, "Movement type of the fee", "FEE", a.Movements[len(a.Movements)-1].MovementType)
+	utils.AssertEquals(t, "Amount of the fee", -25, a.Movements[len(a.Movements)-1].Amount)
+	utils.AssertEquals(t, "Description of the fee", "Fee on capture of £20.00", a.Movements[len(a.Movements)-1].Description)
+
+	v, _ = dbi.GetVendor(ctx, v.Id)
+	utils.AssertEquals(t, "Vendor balance after a capture, net of its fee", 2000-25, v.Balance)
+	utils.AssertEquals(t, "Vendor category", "cafe", v.Category)
+
+	fees, apiErr = dbi.SetVendorFees(ctx, v.Id, models.FeeSchedule{})
+
+	utils.AssertNoError(t, "Calling SetVendorFees", apiErr)
+	utils.AssertEquals(t, "Fee schedule of a vendor with its own, in place of its category's", models.FeeSchedule{}, fees)
+
+	aid, _ = dbi.Authorise(ctx, c.Id, v.Id, 500, "", "Cake")
+
+	_, apiErr = dbi.Capture(ctx, aid, 500, "")
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	_, apiErr = dbi.Refund(ctx, aid, 100, "", "Stale")
+	utils.AssertNoError(t, "Calling Refund", apiErr)
+
+	v, _ = dbi.GetVendor(ctx, v.Id)
+	utils.AssertEquals(t, "Vendor balance after a capture without a fee and a refund, which returns no fee", 2000-25+500-100, v.Balance)
+
+	fee, _ := dbi.GetAccountBalance(ctx, LEDGER_ACCOUNT_FEES)
+	utils.AssertEquals(t, "Balance of the fees account", 25, fee)
+
+	report, apiErr := dbi.SettleVendors(ctx)
+
+	utils.AssertNoError(t, "Calling SettleVendors", apiErr)
+	utils.AssertEquals(t, "Number of batches", 1, len(report.Settlements))
+	utils.AssertEquals(t, "Captured in the batch", 2500, report.Settlements[0].Captured)
+	utils.AssertEquals(t, "Capture fees of the batch", 25, report.Settlements[0].CaptureFees)
+	utils.AssertEquals(t, "Net of the batch", 2500-25-100, report.Settlements[0].Net)
+
+	v, _ = dbi.GetVendor(ctx, v.Id)
+	utils.AssertEquals(t, "Vendor balance after settlement", 0, v.Balance)
+
+	r, apiErr := dbi.Reconcile(ctx)
+
+	utils.AssertNoError(t, "Calling Reconcile", apiErr)
+	utils.AssertTrue(t, "Ok for Reconcile after fees", r.Ok)
+}
+
+func TestMemoryFees(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 10000)
+	defer dbi.Close()
+
+	testFees(t, dbi, c, v)
+}
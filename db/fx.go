@@ -0,0 +1,172 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	// The rate table used unless another is configured, in units of each currency to the pound
+	DEFAULT_FX_RATES = "EUR=1.17,USD=1.27,CAD=1.73,AUD=1.93,CHF=1.12,SEK=13.4,JPY=188"
+
+	MESSAGE_BAD_CURRENCY      = "%v: unsupported currency %v"
+	MESSAGE_CURRENCY_MISMATCH = "%v: amount in %v, but %v %v is in %v"
+	MESSAGE_NO_FX_RATE        = "%v: no exchange rate from %v to %v"
+)
+
+// FxRates is a table of exchange rates, in units of each currency to one unit of models.DEFAULT_CURRENCY. A currency
+// is supported if it is in the table
+type FxRates map[string]float64
+
+// ParseFxRates parses a rate table from a list of the units of each currency to the pound, such as EUR=1.17,USD=1.27.
+// The pound is always in the table, at 1
+func ParseFxRates(list string) (FxRates, error) {
+
+	rates := FxRates{
+		models.DEFAULT_CURRENCY: 1,
+	}
+
+	for _, item := range strings.Split(list, ",") {
+
+		item = strings.TrimSpace(item)
+
+		if item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad exchange rate %q: expected CODE=rate", item)
+		}
+
+		code := strings.ToUpper(strings.TrimSpace(parts[0]))
+
+		if _, ok := models.LookupCurrency(code); !ok {
+			return nil, fmt.Errorf("bad exchange rate %q: unsupported currency %v", item, code)
+		}
+
+		rate, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("bad exchange rate %q: rate must be a positive number", item)
+		}
+
+		rates[code] = rate
+	}
+
+	return rates, nil
+}
+
+var defaultFxRates, _ = ParseFxRates(DEFAULT_FX_RATES)
+
+// WithFxRates sets the rate table of a Dbi, in place of the DEFAULT_FX_RATES
+func WithFxRates(rates FxRates) Option {
+
+	return func(o *dbOptions) {
+		o.fxRates = rates
+	}
+}
+
+// Returns the rate table of the options, or the default
+func (o dbOptions) rates() FxRates {
+
+	if o.fxRates == nil {
+		return defaultFxRates
+	}
+
+	return o.fxRates
+}
+
+// Check that a currency is supported, returning the default for an empty one
+func (r FxRates) checkCurrency(currency, context string) (string, models.ApiError) {
+
+	if currency == "" {
+		return models.DEFAULT_CURRENCY, nil
+	}
+
+	if _, ok := r[currency]; !ok {
+		return currency, models.ConstructApiError(400, MESSAGE_BAD_CURRENCY, context, currency)
+	}
+
+	return currency, nil
+}
+
+// Returns the rate from one currency to another, in units of to per unit of from
+func (r FxRates) rate(from, to, context string) (float64, models.ApiError) {
+
+	if from == to {
+		return 1, nil
+	}
+
+	fromRate, fromOk := r[from]
+	toRate, toOk := r[to]
+
+	if !fromOk || !toOk {
+		return 0, models.ConstructApiError(400, MESSAGE_NO_FX_RATE, context, from, to)
+	}
+
+	return toRate / fromRate, nil
+}
+
+// Check that the currency of the amount of a request, if given, is that of the object it applies to, such as the
+// card topped up. Returns the currency of the amount
+func checkAmountCurrency(currency, objectCurrency, objectType string, id int, context string) (string, models.ApiError) {
+
+	if currency != "" && currency != objectCurrency {
+		return currency, models.ConstructApiError(400, MESSAGE_CURRENCY_MISMATCH, context, currency, objectType, id, objectCurrency)
+	}
+
+	return objectCurrency, nil
+}
+
+// Converts an amount in the minor unit of one currency into the minor unit of another at a rate between their major
+// units, rounding to the nearest
+func convert(amount int, rate float64, from, to string) int {
+
+	if from == to {
+		return amount
+	}
+
+	fromCurrency, _ := models.LookupCurrency(from)
+	toCurrency, _ := models.LookupCurrency(to)
+
+	return int(math.Round(float64(amount) * rate * math.Pow10(toCurrency.Digits-fromCurrency.Digits)))
+}
+
+// Returns the amount on the card of an amount of an authorisation, at the rate locked when it was made
+func cardAmount(auth models.Authorisation, amount int) int {
+	return convert(amount, auth.Rate, auth.Currency, auth.CardCurrency)
+}
+
+// Returns the change on the card when a running total of an authorisation, such as the amount captured, goes from
+// before to after. Converting the totals rather than each change means that the parts of a hold which are captured
+// or released always sum to the hold, whatever the rounding.
+func cardChange(auth models.Authorisation, before, after int) int {
+	return cardAmount(auth, after) - cardAmount(auth, before)
+}
+
+// FxAccount returns the ledger account through which amounts in a currency are exchanged into other currencies
+func FxAccount(currency string) string {
+	return fmt.Sprintf("fx:%v", currency)
+}
+
+// Returns the postings of an amount from one account to another in a different currency, through the fx accounts of
+// the two currencies, so that the postings in each currency balance. In the same currency it is a plain transfer
+func exchange(from string, fromAmount int, fromCurrency string, to string, toAmount int, toCurrency string) []models.LedgerPosting {
+
+	if fromCurrency == toCurrency {
+		return transfer(from, to, fromAmount, fromCurrency)
+	}
+
+	return []models.LedgerPosting{
+		{Account: from, Amount: -fromAmount, Currency: fromCurrency},
+		{Account: FxAccount(fromCurrency), Amount: fromAmount, Currency: fromCurrency},
+		{Account: FxAccount(toCurrency), Amount: -toAmount, Currency: toCurrency},
+		{Account: to, Amount: toAmount, Currency: toCurrency},
+	}
+}
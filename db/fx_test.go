@@ -0,0 +1,235 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestParseFxRates(t *testing.T) {
+
+	rates, err := ParseFxRates(" EUR=1.17, usd=1.27 ")
+
+	utils.AssertNoError(t, "Calling ParseFxRates", err)
+	utils.AssertEquals(t, "Number of rates", 3, len(rates))
+	utils.AssertEquals(t, "Rate of the pound", 1.0, rates["GBP"])
+	utils.AssertEquals(t, "Rate of the euro", 1.17, rates["EUR"])
+	utils.AssertEquals(t, "Rate of a lower-case code", 1.27, rates["USD"])
+
+	for _, list := range []string{"EUR", "XTS=2", "EUR=abc", "EUR=0", "EUR=-1.17"} {
+		_, err = ParseFxRates(list)
+		utils.AssertTrue(t, fmt.Sprintf("Error for ParseFxRates of %q", list), err != nil)
+	}
+
+	utils.AssertEquals(t, "Number of default rates", 8, len(defaultFxRates))
+}
+
+func TestConvert(t *testing.T) {
+
+	rate, apiErr := defaultFxRates.rate("EUR", "GBP", "Authorise")
+
+	utils.AssertNoError(t, "Rate from euros to pounds", apiErr)
+	utils.AssertEquals(t, "€10.00 in pounds", 855, convert(1000, rate, "EUR", "GBP"))
+
+	rate, _ = defaultFxRates.rate("GBP", "JPY", "Authorise")
+
+	utils.AssertEquals(t, "£10.00 in yen, which has no minor unit", 1880, convert(1000, rate, "GBP", "JPY"))
+	utils.AssertEquals(t, "£10.00 in pounds", 1000, convert(1000, 1, "GBP", "GBP"))
+
+	_, apiErr = FxRates{"GBP": 1}.rate("EUR", "GBP", "Authorise")
+
+	utils.AssertEquals(t, "Return status for a rate which is not in the table", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for a rate which is not in the table",
+		fmt.Sprintf(MESSAGE_NO_FX_RATE, "Authorise", "EUR", "GBP"), apiErr.Error())
+
+	// the parts of a hold always sum to the hold, though each is rounded
+	auth := models.Authorisation{Amount: 1000, Currency: "EUR", CardCurrency: "GBP", Rate: 1 / 1.17}
+
+	utils.AssertEquals(t, "Card change for the first part", 285, cardChange(auth, 0, 333))
+	utils.AssertEquals(t, "Card change for the rest", 570, cardChange(auth, 333, 1000))
+}
+
+func TestExchange(t *testing.T) {
+
+	postings := exchange(CardHeldAccount(100001), 855, "GBP", VendorAccount(1001), 1000, "EUR")
+
+	utils.AssertEquals(t, "Number of postings", 4, len(postings))
+	utils.AssertEquals(t, "Posting to the fx account of the card currency", utils.JsonStringify(models.LedgerPosting{Account: "fx:GBP", Amount: 855, Currency: "GBP"}), utils.JsonStringify(postings[1]))
+	utils.AssertEquals(t, "Posting to the fx account of the vendor currency", utils.JsonStringify(models.LedgerPosting{Account: "fx:EUR", Amount: -1000, Currency: "EUR"}), utils.JsonStringify(postings[2]))
+
+	utils.AssertEquals(t, "Number of postings in a single currency", 2, len(exchange(CardHeldAccount(100001), 855, "GBP", VendorAccount(1001), 855, "GBP")))
+}
+
+func TestAuthoriseFx(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"}).
+			AddRow(int64(1001), "Café de Paris", 0, "EUR", "", "")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_VENDOR)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
+
+		expected = sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 12676, 12089, "ACTIVE", "2019-01-24 01:00:10", "GBP")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		expectLimits(expecter, 100001, models.SpendingLimits{})
+		expectMccControls(expecter, 100001)
+		expectHistory(expecter, 100001)
+
+		expecter.ExpectBegin()
+
+		// €10.00 is held on the card as £8.55
+		expecter.ExpectPrepare(esc(QUERY_HOLD_CARD))
+		expecter.ExpectPrepare(esc(QUERY_HOLD_CARD)).ExpectExec().WithArgs(855, 100001, 855).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		expectHeldHistory(expecter, 100001)
+
+		rate := defaultFxRates["GBP"] / defaultFxRates["EUR"]
+
+		expecter.ExpectPrepare(esc(QUERY_ADD_AUTHORISATION))
+		expecter.ExpectPrepare(esc(QUERY_ADD_AUTHORISATION)).ExpectExec().WithArgs(100001, 1001, 1000, "Croissants", expiryTime(testNow), "EUR", "GBP", rate, AUTHORISATION_STATUS_APPROVED, "", datetime(testNow)).
+			WillReturnResult(sqlmock.NewResult(1009, 1))
+
+		expectLedgerEntry(expecter, "AUTHORISATION", "Croissants", 1009, transfer(CardAvailableAccount(100001), CardHeldAccount(100001), 855, "GBP"))
+
+		expecter.ExpectCommit()
+
+		aid, apiErr := dbi.Authorise(context.Background(), 100001, 1001, 1000, "EUR", "Croissants")
+
+		utils.AssertNoError(t, "Calling Authorise in the vendor's currency", apiErr)
+		utils.AssertEquals(t, "Authorisation id", 1009, aid)
+	})
+}
+
+func TestAuthoriseCurrencyMismatch(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"}).
+			AddRow(int64(1001), "Café de Paris", 0, "EUR", "", "")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_VENDOR)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
+
+		expected = sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 12676, 12089, "ACTIVE", "2019-01-24 01:00:10", "GBP")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		_, apiErr := dbi.Authorise(context.Background(), 100001, 1001, 1000, "GBP", "Croissants")
+
+		utils.AssertEquals(t, "Return status for calling Authorise in the card's currency", 400, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling Authorise in the card's currency",
+			fmt.Sprintf(MESSAGE_CURRENCY_MISMATCH, "Authorise", "GBP", "vendor", 1001, "EUR"), apiErr.Error())
+	})
+}
+
+// Authorises, captures, refunds and reverses a payment to a vendor in euros from a topped-up card in pounds, checking
+// the amounts on the card, the fx ledger accounts and that the result reconciles
+func testFx(t *testing.T, dbi Dbi, c models.Card) {
+
+	ctx := context.Background()
+
+	_, apiErr := dbi.AddOrUpdateVendor(ctx, models.Vendor{VendorName: "Café de Paris", Currency: "XTS"})
+	utils.AssertEquals(t, "Return status for calling AddOrUpdateVendor in an unsupported currency", 400, apiErr.StatusCode())
+
+	v, apiErr := dbi.AddOrUpdateVendor(ctx, models.Vendor{VendorName: "Café de Paris", Currency: "EUR"})
+	utils.AssertNoError(t, "Calling AddOrUpdateVendor in euros", apiErr)
+
+	_, apiErr = dbi.TopUp(ctx, c.Id, 100, "EUR", "Transfer from Bank")
+	utils.AssertEquals(t, "Return status for calling TopUp in another currency", 400, apiErr.StatusCode())
+
+	aid, apiErr := dbi.Authorise(ctx, c.Id, v.Id, 1000, "", "Croissants")
+	utils.AssertNoError(t, "Calling Authorise in euros", apiErr)
+
+	card, _ := dbi.GetCard(ctx, c.Id)
+	utils.AssertEquals(t, "Available after Authorise of €10.00", 2000-855, card.Available)
+
+	_, apiErr = dbi.Capture(ctx, aid, 333, "GBP")
+	utils.AssertEquals(t, "Return status for calling Capture in the card's currency", 400, apiErr.StatusCode())
+
+	_, apiErr = dbi.Capture(ctx, aid, 333, "EUR")
+	utils.AssertNoError(t, "Calling Capture in euros", apiErr)
+
+	card, _ = dbi.GetCard(ctx, c.Id)
+	utils.AssertEquals(t, "Balance after Capture of €3.33", 2000-285, card.Balance)
+	utils.AssertEquals(t, "Amount of the PURCHASE movement", -285, card.Movements[len(card.Movements)-1].Amount)
+
+	fxGbp, _ := dbi.GetAccountBalance(ctx, FxAccount("GBP"))
+	fxEur, _ := dbi.GetAccountBalance(ctx, FxAccount("EUR"))
+
+	utils.AssertEquals(t, "Balance of the pound fx account after Capture", 285, fxGbp)
+	utils.AssertEquals(t, "Balance of the euro fx account after Capture", -333, fxEur)
+
+	es, _, apiErr := dbi.GetLedgerEntries(ctx, 0, 100)
+	utils.AssertNoError(t, "Calling GetLedgerEntries", apiErr)
+
+	var currencies []string
+
+	for _, e := range es {
+		if e.EntryType == "CAPTURE" {
+			for _, p := range e.Postings {
+				currencies = append(currencies, p.Currency)
+			}
+		}
+	}
+
+	utils.AssertEquals(t, "Currencies of the postings of the Capture", fmt.Sprint([]string{"GBP", "GBP", "EUR", "EUR"}), fmt.Sprint(currencies))
+
+	_, apiErr = dbi.Refund(ctx, aid, 333, "", "Stale")
+	utils.AssertNoError(t, "Calling Refund in euros", apiErr)
+
+	_, apiErr = dbi.Reverse(ctx, aid, 667, "EUR", "Not wanted")
+	utils.AssertNoError(t, "Calling Reverse in euros", apiErr)
+
+	card, _ = dbi.GetCard(ctx, c.Id)
+	utils.AssertEquals(t, "Balance after the refund", 2000, card.Balance)
+	utils.AssertEquals(t, "Available after the whole hold is released", 2000, card.Available)
+
+	a, _ := dbi.GetAuthorisation(ctx, aid)
+	utils.AssertEquals(t, "Currency of the authorisation", "EUR", a.Currency)
+	utils.AssertEquals(t, "CardCurrency of the authorisation", "GBP", a.CardCurrency)
+	utils.AssertEquals(t, "Description of the CAPTURE movement", "Capture of €3.33", a.Movements[0].Description)
+
+	v, _ = dbi.GetVendor(ctx, v.Id)
+	utils.AssertEquals(t, "Currency of the vendor", "EUR", v.Currency)
+
+	r, apiErr := dbi.Reconcile(ctx)
+
+	utils.AssertNoError(t, "Calling Reconcile", apiErr)
+	utils.AssertTrue(t, "Ok for Reconcile after payments in another currency", r.Ok)
+}
+
+func TestMemoryFx(t *testing.T) {
+
+	dbi, c, _ := memoryFixture(t, 2000)
+	defer dbi.Close()
+
+	testFx(t, dbi, c)
+}
+
+func TestMemoryAddCardCurrency(t *testing.T) {
+
+	dbi, c, _ := memoryFixture(t, 0)
+	defer dbi.Close()
+
+	_, apiErr := dbi.AddCard(context.Background(), c.CustomerId, "XTS")
+
+	utils.AssertEquals(t, "Return status for calling AddCard in an unsupported currency", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling AddCard in an unsupported currency",
+		fmt.Sprintf(MESSAGE_BAD_CURRENCY, "AddCard", "XTS"), apiErr.Error())
+
+	usd, apiErr := dbi.AddCard(context.Background(), c.CustomerId, "USD")
+	utils.AssertNoError(t, "Calling AddCard in dollars", apiErr)
+	utils.AssertEquals(t, "Currency of the default card", models.DEFAULT_CURRENCY, c.Currency)
+
+	_, apiErr = dbi.Transfer(context.Background(), c.Id, usd.Id, 100, "", "Share of dinner")
+
+	utils.AssertEquals(t, "Return status for calling Transfer between currencies", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling Transfer between currencies",
+		fmt.Sprintf(MESSAGE_TRANSFER_CURRENCIES, "Transfer", c.Id, "GBP", usd.Id, "USD"), apiErr.Error())
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	QUERY_ADD_LEDGER_ENTRY   = "INSERT INTO ledger_entries (entry_type, description, reference_id) VALUES (?, ?, ?)"
+	QUERY_ADD_LEDGER_POSTING = "INSERT INTO ledger_postings (entry_id, account, amount, currency) VALUES (?, ?, ?, ?)"
+
+	QUERY_COUNT_LEDGER_ENTRIES = "SELECT COUNT(*) FROM ledger_entries"
+
+	QUERY_GET_LEDGER_ENTRIES = `SELECT e.id, e.entry_type, e.description, e.reference_id, e.ts, p.id, p.account, p.amount, p.currency
+                            FROM (SELECT id, entry_type, description, reference_id, ts FROM ledger_entries ORDER BY id LIMIT ? OFFSET ?) e
+                            JOIN ledger_postings p ON (p.entry_id = e.id)
+                            ORDER BY e.id, p.id`
+
+	QUERY_GET_ACCOUNT_BALANCE = "SELECT COALESCE(SUM(amount), 0) FROM ledger_postings WHERE account = ?"
+
+	// The external source of top-up funds
+	LEDGER_ACCOUNT_FUNDING = "funding"
+
+	MESSAGE_UNBALANCED_LEDGER_ENTRY = "%v: unbalanced ledger entry: postings sum to %v"
+)
+
+// CardAvailableAccount returns the ledger account of the funds on a card which are available to spend
+func CardAvailableAccount(cardId int) string {
+	return fmt.Sprintf("card-available:%v", cardId)
+}
+
+// CardHeldAccount returns the ledger account of the funds on a card which are held by authorisations
+func CardHeldAccount(cardId int) string {
+	return fmt.Sprintf("card-held:%v", cardId)
+}
+
+// VendorAccount returns the ledger account of the funds captured by a vendor
+func VendorAccount(vendorId int) string {
+	return fmt.Sprintf("vendor:%v", vendorId)
+}
+
+// Returns a posting of amount in a currency from one account to another
+func transfer(from, to string, amount int, currency string) []models.LedgerPosting {
+	return []models.LedgerPosting{
+		{Account: from, Amount: -amount, Currency: currency},
+		{Account: to, Amount: amount, Currency: currency},
+	}
+}
+
+// Check that the postings of a ledger entry sum to zero
+func checkBalanced(entryType string, postings []models.LedgerPosting) models.ApiError {
+
+	sum := 0
+
+	for _, p := range postings {
+		sum += p.Amount
+	}
+
+	if sum != 0 {
+		return models.ConstructApiError(500, MESSAGE_UNBALANCED_LEDGER_ENTRY, entryType, sum)
+	}
+
+	return nil
+}
+
+// Write a balanced ledger entry and its postings within a transaction
+func (d *dbGate) addLedgerEntry(ctx context.Context, tx *sql.Tx, entryType, description string, reference int, postings []models.LedgerPosting) models.ApiError {
+
+	apiErr := checkBalanced(entryType, postings)
+
+	if apiErr != nil {
+		return apiErr
+	}
+
+	qry := QUERY_ADD_LEDGER_ENTRY
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, entryType, description, reference)
+
+	if res.apiErr != nil {
+		return res.apiErr
+	}
+
+	entryId := res.lastInsertedId
+
+	qry = QUERY_ADD_LEDGER_POSTING
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	stmt := tx.StmtContext(ctx, d.stmt(qry))
+
+	for _, p := range postings {
+
+		res = d.exec(ctx, stmt, qry, entryId, p.Account, p.Amount, p.Currency)
+
+		if res.apiErr != nil {
+			return res.apiErr
+		}
+	}
+
+	return nil
+}
+
+// GetLedgerEntries returns a page of up to limit ledger entries starting at offset, and the total number of entries
+func (d *dbGate) GetLedgerEntries(ctx context.Context, offset, limit int) ([]models.LedgerEntry, int, models.ApiError) {
+
+	var (
+		es  []models.LedgerEntry
+		err error
+	)
+
+	total, apiErr := d.count(ctx, QUERY_COUNT_LEDGER_ENTRIES)
+
+	if apiErr != nil {
+		return es, 0, apiErr
+	}
+
+	qry := QUERY_GET_LEDGER_ENTRIES
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return es, 0, models.ErrorWrap(err)
+	}
+
+	rows, err := d.stmt(qry).QueryContext(ctx, limit, offset)
+
+	if err != nil {
+		return es, 0, models.ErrorWrap(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			e models.LedgerEntry
+			p models.LedgerPosting
+		)
+
+		//e.id, e.entry_type, e.description, e.reference_id, e.ts, p.id, p.account, p.amount, p.currency
+		err := rows.Scan(&e.Id, &e.EntryType, &e.Description, &e.Reference, scanDatetime(&e.Ts), &p.Id, &p.Account, &p.Amount, &p.Currency)
+
+		if err != nil {
+			return es, 0, models.ErrorWrap(err)
+		}
+
+		p.EntryId = e.Id
+
+		if len(es) == 0 || es[len(es)-1].Id != e.Id {
+			es = append(es, e)
+		}
+
+		es[len(es)-1].Postings = append(es[len(es)-1].Postings, p)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return es, 0, models.ErrorWrap(err)
+	}
+
+	return es, total, nil
+}
+
+// GetAccountBalance returns the sum of the postings to a ledger account
+func (d *dbGate) GetAccountBalance(ctx context.Context, account string) (int, models.ApiError) {
+
+	var balance int
+
+	qry := QUERY_GET_ACCOUNT_BALANCE
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return 0, models.ErrorWrap(err)
+	}
+
+	err = d.stmt(qry).QueryRowContext(ctx, account).Scan(&balance)
+
+	if err != nil {
+		return 0, models.ErrorWrap(err)
+	}
+
+	return balance, nil
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestCheckBalanced(t *testing.T) {
+
+	utils.AssertNoError(t, "Calling checkBalanced with a transfer", checkBalanced("TOP-UP", transfer(LEDGER_ACCOUNT_FUNDING, CardAvailableAccount(100001), 2000, "GBP")))
+
+	postings := []models.LedgerPosting{
+		{Account: LEDGER_ACCOUNT_FUNDING, Amount: -2000},
+		{Account: CardAvailableAccount(100001), Amount: 1999},
+	}
+
+	apiErr := checkBalanced("TOP-UP", postings)
+
+	utils.AssertEquals(t, "Return status for calling checkBalanced with unbalanced postings", 500, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling checkBalanced with unbalanced postings", fmt.Sprintf(MESSAGE_UNBALANCED_LEDGER_ENTRY, "TOP-UP", -1), apiErr.Error())
+}
+
+func TestGetLedgerEntries(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(12)
+
+		expecter.ExpectPrepare(esc(QUERY_COUNT_LEDGER_ENTRIES)).ExpectQuery().WillReturnRows(expected)
+
+		expected = sqlmock.NewRows([]string{"id", "entry_type", "description", "reference_id", "ts", "id", "account", "amount", "currency"}).
+			AddRow(1011, "TOP-UP", "Transfer from Bank", 1005, "2019-01-24 01:00:10", 1021, "funding", -2000, "GBP").
+			AddRow(1011, "TOP-UP", "Transfer from Bank", 1005, "2019-01-24 01:00:10", 1022, "card-available:100001", 2000, "GBP").
+			AddRow(1012, "AUTHORISATION", "Coffee", 1001, "2019-01-24 01:00:11", 1023, "card-available:100001", -250, "GBP").
+			AddRow(1012, "AUTHORISATION", "Coffee", 1001, "2019-01-24 01:00:11", 1024, "card-held:100001", 250, "")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_LEDGER_ENTRIES)).ExpectQuery().WithArgs(2, 10).WillReturnRows(expected)
+
+		es, total, apiErr := dbi.GetLedgerEntries(context.Background(), 10, 2)
+
+		utils.AssertNoError(t, "Calling GetLedgerEntries", apiErr)
+		utils.AssertEquals(t, "Total for GetLedgerEntries result", 12, total)
+		utils.AssertEquals(t, "Size of GetLedgerEntries result", 2, len(es))
+		utils.AssertEquals(t, "EntryType for GetLedgerEntries result[1]", "AUTHORISATION", es[1].EntryType)
+		utils.AssertEquals(t, "Size of Postings for GetLedgerEntries result[1]", 2, len(es[1].Postings))
+		utils.AssertEquals(t, "EntryId for GetLedgerEntries result[1].Postings[1]", 1012, es[1].Postings[1].EntryId)
+		utils.AssertEquals(t, "Account for GetLedgerEntries result[1].Postings[1]", "card-held:100001", es[1].Postings[1].Account)
+		utils.AssertEquals(t, "Currency for GetLedgerEntries result[1].Postings[0]", "GBP", es[1].Postings[0].Currency)
+		utils.AssertEquals(t, "Currency for GetLedgerEntries result[1].Postings[1] made before posting currencies", "", es[1].Postings[1].Currency)
+	})
+}
+
+func TestGetAccountBalance(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"balance"}).AddRow(1750)
+
+		expecter.ExpectPrepare(esc(QUERY_GET_ACCOUNT_BALANCE)).ExpectQuery().WithArgs("card-available:100001").WillReturnRows(expected)
+
+		balance, apiErr := dbi.GetAccountBalance(context.Background(), CardAvailableAccount(100001))
+
+		utils.AssertNoError(t, "Calling GetAccountBalance", apiErr)
+		utils.AssertEquals(t, "Result of GetAccountBalance", 1750, balance)
+	})
+}
+
+// The card and vendor balances of the memory implementation should agree with the ledger after a complete flow
+func TestMemoryLedgerMatchesBalances(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 1000)
+	defer dbi.Close()
+
+	aid, apiErr := dbi.Authorise(context.Background(), c.Id, v.Id, 400, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	_, apiErr = dbi.Capture(context.Background(), aid, 300, "")
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	_, apiErr = dbi.Reverse(context.Background(), aid, 100, "", "Smaller coffee")
+	utils.AssertNoError(t, "Calling Reverse", apiErr)
+
+	_, apiErr = dbi.Refund(context.Background(), aid, 50, "", "Cold coffee")
+	utils.AssertNoError(t, "Calling Refund", apiErr)
+
+	es, total, apiErr := dbi.GetLedgerEntries(context.Background(), 0, 100)
+
+	utils.AssertNoError(t, "Calling GetLedgerEntries", apiErr)
+	utils.AssertEquals(t, "Total for GetLedgerEntries", 5, total)
+
+	for _, e := range es {
+		utils.AssertNoError(t, "Postings of ledger entry "+e.EntryType+" balance", checkBalanced(e.EntryType, e.Postings))
+	}
+
+	c, apiErr = dbi.GetCard(context.Background(), c.Id)
+	utils.AssertNoError(t, "Calling GetCard", apiErr)
+
+	v, apiErr = dbi.GetVendor(context.Background(), v.Id)
+	utils.AssertNoError(t, "Calling GetVendor", apiErr)
+
+	available, _ := dbi.GetAccountBalance(context.Background(), CardAvailableAccount(c.Id))
+	held, _ := dbi.GetAccountBalance(context.Background(), CardHeldAccount(c.Id))
+	vendor, _ := dbi.GetAccountBalance(context.Background(), VendorAccount(v.Id))
+	funding, _ := dbi.GetAccountBalance(context.Background(), LEDGER_ACCOUNT_FUNDING)
+
+	utils.AssertEquals(t, "Card available against the ledger", c.Available, available)
+	utils.AssertEquals(t, "Card balance against the ledger", c.Balance, available+held)
+	utils.AssertEquals(t, "Vendor balance against the ledger", v.Balance, vendor)
+	utils.AssertEquals(t, "Funding against the ledger", -1000, funding)
+}
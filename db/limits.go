@@ -0,0 +1,428 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	// The effective limits of a card: each of its own limits, or where that is 0 the default of its customer
+	QUERY_GET_CARD_LIMITS = `SELECT COALESCE(NULLIF(l.max_transaction, 0), d.max_transaction, 0),
+                              COALESCE(NULLIF(l.daily_spend, 0), d.daily_spend, 0),
+                              COALESCE(NULLIF(l.monthly_spend, 0), d.monthly_spend, 0),
+                              COALESCE(NULLIF(l.hourly_authorisations, 0), d.hourly_authorisations, 0),
+                              COALESCE(NULLIF(l.vendor_daily_spend, 0), d.vendor_daily_spend, 0)
+                            FROM cards c
+                            LEFT OUTER JOIN card_limits l ON (l.card_id = c.id)
+                            LEFT OUTER JOIN customer_limits d ON (d.customer_id = c.customer_id)
+                            WHERE c.id = ?`
+
+	QUERY_GET_CUSTOMER_LIMITS = `SELECT COALESCE(d.max_transaction, 0), COALESCE(d.daily_spend, 0), COALESCE(d.monthly_spend, 0),
+                              COALESCE(d.hourly_authorisations, 0), COALESCE(d.vendor_daily_spend, 0)
+                            FROM customers cu
+                            LEFT OUTER JOIN customer_limits d ON (d.customer_id = cu.id)
+                            WHERE cu.id = ?`
+
+	// Limits are replaced whole, deleting then inserting, which every database supports alike
+	QUERY_DELETE_CARD_LIMITS = "DELETE FROM card_limits WHERE card_id = ?"
+	QUERY_ADD_CARD_LIMITS    = `INSERT INTO card_limits (card_id, max_transaction, daily_spend, monthly_spend, hourly_authorisations, vendor_daily_spend)
+                               VALUES (?, ?, ?, ?, ?, ?)`
+
+	QUERY_DELETE_CUSTOMER_LIMITS = "DELETE FROM customer_limits WHERE customer_id = ?"
+	QUERY_ADD_CUSTOMER_LIMITS    = `INSERT INTO customer_limits (customer_id, max_transaction, daily_spend, monthly_spend, hourly_authorisations, vendor_daily_spend)
+                               VALUES (?, ?, ?, ?, ?, ?)`
+
+	// The authorisations of a card made since a time
+	QUERY_GET_RECENT_AUTHORISATIONS = `SELECT id, vendor_id, amount, reversed, expires_at, currency, card_currency, rate, ts
+                            FROM authorisations
+                            WHERE card_id = ? AND ts >= ?
+                            ORDER BY id`
+
+	// The status of an authorisation refused by a spending limit, distinct from the 400 of insufficient funds
+	LIMIT_EXCEEDED_STATUS = http.StatusPaymentRequired
+
+	MESSAGE_BAD_LIMIT = "%v: %v must not be negative"
+
+	// Each message names the limit which refused the authorisation
+	MESSAGE_LIMIT_MAX_TRANSACTION       = "%v: card %v limit maxTransaction exceeded: %v is over the maximum of %v"
+	MESSAGE_LIMIT_HOURLY_AUTHORISATIONS = "%v: card %v limit hourlyAuthorisations exceeded: %v authorisations in the last hour"
+	MESSAGE_LIMIT_VENDOR_DAILY_SPEND    = "%v: card %v limit vendorDailySpend exceeded: %v would bring the spend today with vendor %v to %v, over the cap of %v"
+	MESSAGE_LIMIT_DAILY_SPEND           = "%v: card %v limit dailySpend exceeded: %v would bring the spend today to %v, over the cap of %v"
+	MESSAGE_LIMIT_MONTHLY_SPEND         = "%v: card %v limit monthlySpend exceeded: %v would bring the spend this month to %v, over the cap of %v"
+)
+
+// Check that none of a set of limits is negative
+func checkLimitsValid(limits models.SpendingLimits, context string) models.ApiError {
+
+	for _, l := range []struct {
+		name  string
+		value int
+	}{
+		{"maxTransaction", limits.MaxTransaction},
+		{"dailySpend", limits.DailySpend},
+		{"monthlySpend", limits.MonthlySpend},
+		{"hourlyAuthorisations", limits.HourlyAuthorisations},
+		{"vendorDailySpend", limits.VendorDailySpend},
+	} {
+		if l.value < 0 {
+			return models.ConstructApiError(400, MESSAGE_BAD_LIMIT, context, l.name)
+		}
+	}
+
+	return nil
+}
+
+// Returns the effective limits of a card: each of its own limits, or where that is 0 the default of its customer
+func withDefaults(card, customer models.SpendingLimits) models.SpendingLimits {
+
+	orDefault := func(limit, def int) int {
+		if limit == 0 {
+			return def
+		}
+		return limit
+	}
+
+	return models.SpendingLimits{
+		MaxTransaction:       orDefault(card.MaxTransaction, customer.MaxTransaction),
+		DailySpend:           orDefault(card.DailySpend, customer.DailySpend),
+		MonthlySpend:         orDefault(card.MonthlySpend, customer.MonthlySpend),
+		HourlyAuthorisations: orDefault(card.HourlyAuthorisations, customer.HourlyAuthorisations),
+		VendorDailySpend:     orDefault(card.VendorDailySpend, customer.VendorDailySpend),
+	}
+}
+
+// Returns the start of the day and of the month, in UTC, and the time an hour before a time. The spend caps run from
+// the start of the day and month, and hourlyAuthorisations over the last hour
+func limitWindows(now time.Time) (day, month, hour time.Time) {
+
+	now = now.UTC()
+
+	day = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	hour = now.Add(-time.Hour)
+
+	return
+}
+
+// True if an authorisation was made at or after a time
+func authorisedSince(auth models.Authorisation, since time.Time) bool {
+	return auth.Ts >= datetime(since)
+}
+
+// Check that a hold on a card for a payment to a vendor is within the card's limits, given the authorisations made on
+// it within the RISK_HISTORY. The spend of an authorisation is its amount on the card less any reversed, including by expiry
+func checkLimits(limits models.SpendingLimits, c models.Card, vendorId, hold int, recent []models.Authorisation, now time.Time) models.ApiError {
+
+	money := func(amount int) models.Money {
+		return models.Money{Amount: amount, Currency: c.Currency}
+	}
+
+	if limits.MaxTransaction > 0 && hold > limits.MaxTransaction {
+		return models.ConstructApiError(LIMIT_EXCEEDED_STATUS, MESSAGE_LIMIT_MAX_TRANSACTION, "Authorise", c.Id, money(hold), money(limits.MaxTransaction))
+	}
+
+	day, month, hour := limitWindows(now)
+
+	var daily, monthly, vendorDaily, hourly int
+
+	for _, a := range recent {
+
+		spend := cardChange(a, a.Reversed, a.Amount)
+
+		if authorisedSince(a, month) {
+			monthly += spend
+		}
+
+		if authorisedSince(a, day) {
+
+			daily += spend
+
+			if a.VendorId == vendorId {
+				vendorDaily += spend
+			}
+		}
+
+		if authorisedSince(a, hour) {
+			hourly++
+		}
+	}
+
+	if limits.HourlyAuthorisations > 0 && hourly >= limits.HourlyAuthorisations {
+		return models.ConstructApiError(LIMIT_EXCEEDED_STATUS, MESSAGE_LIMIT_HOURLY_AUTHORISATIONS, "Authorise", c.Id, hourly)
+	}
+
+	if limits.VendorDailySpend > 0 && vendorDaily+hold > limits.VendorDailySpend {
+		return models.ConstructApiError(LIMIT_EXCEEDED_STATUS, MESSAGE_LIMIT_VENDOR_DAILY_SPEND, "Authorise", c.Id, money(hold), vendorId, money(vendorDaily+hold), money(limits.VendorDailySpend))
+	}
+
+	if limits.DailySpend > 0 && daily+hold > limits.DailySpend {
+		return models.ConstructApiError(LIMIT_EXCEEDED_STATUS, MESSAGE_LIMIT_DAILY_SPEND, "Authorise", c.Id, money(hold), money(daily+hold), money(limits.DailySpend))
+	}
+
+	if limits.MonthlySpend > 0 && monthly+hold > limits.MonthlySpend {
+		return models.ConstructApiError(LIMIT_EXCEEDED_STATUS, MESSAGE_LIMIT_MONTHLY_SPEND, "Authorise", c.Id, money(hold), money(monthly+hold), money(limits.MonthlySpend))
+	}
+
+	return nil
+}
+
+// Read the limits of a card or customer with QUERY_GET_CARD_LIMITS or QUERY_GET_CUSTOMER_LIMITS
+func (c *dbConn) getLimits(ctx context.Context, qry string, id int, objectType, context string) (models.SpendingLimits, models.ApiError) {
+
+	var l models.SpendingLimits
+
+	err := c.prepareQry(ctx, qry)
+
+	if err != nil {
+		return l, models.ErrorWrap(err)
+	}
+
+	err = c.stmt(qry).QueryRowContext(ctx, id).Scan(&l.MaxTransaction, &l.DailySpend, &l.MonthlySpend, &l.HourlyAuthorisations, &l.VendorDailySpend)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return l, models.ConstructApiError(404, MESSAGE_BAD_ID, context, objectType, id)
+		}
+		return l, models.ErrorWrap(err)
+	}
+
+	return l, nil
+}
+
+// Replace the limits of a card or customer in a transaction
+func (d *dbGate) setLimits(ctx context.Context, deleteQry, addQry string, id int, limits models.SpendingLimits) models.ApiError {
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	defer tx.Rollback()
+
+	for _, qry := range []string{deleteQry, addQry} {
+
+		err = d.prepareQry(ctx, qry)
+
+		if err != nil {
+			return models.ErrorWrap(err)
+		}
+	}
+
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(deleteQry)), deleteQry, id)
+
+	if res.apiErr != nil {
+		return res.apiErr
+	}
+
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(addQry)), addQry, id, limits.MaxTransaction, limits.DailySpend, limits.MonthlySpend, limits.HourlyAuthorisations, limits.VendorDailySpend)
+
+	if res.apiErr != nil {
+		return res.apiErr
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	return nil
+}
+
+// Returns the authorisations made on a card since a time, in the order they were made
+func (d *dbGate) getRecentAuthorisations(ctx context.Context, cardId int, since time.Time) ([]models.Authorisation, models.ApiError) {
+
+	qry := QUERY_GET_RECENT_AUTHORISATIONS
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return nil, models.ErrorWrap(err)
+	}
+
+	return scanRecentAuthorisations(ctx, d.stmt(qry), cardId, since)
+}
+
+// Check that a hold on a card is within its limits, given the authorisations made on it as read in the transaction
+// which has placed the hold with QUERY_HOLD_CARD, and so holds the card's row
+func (d *dbGate) checkLimitsHeld(ctx context.Context, tx *sql.Tx, limits models.SpendingLimits, c models.Card, vendorId, hold int, now time.Time) models.ApiError {
+
+	qry := QUERY_GET_RECENT_AUTHORISATIONS
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	recent, apiErr := scanRecentAuthorisations(ctx, tx.StmtContext(ctx, d.stmt(qry)), c.Id, now.Add(-RISK_HISTORY))
+
+	if apiErr != nil {
+		return apiErr
+	}
+
+	return checkLimits(limits, c, vendorId, hold, recent, now)
+}
+
+// Returns the authorisations made on a card since a time through a QUERY_GET_RECENT_AUTHORISATIONS statement
+func scanRecentAuthorisations(ctx context.Context, stmt *sql.Stmt, cardId int, since time.Time) ([]models.Authorisation, models.ApiError) {
+
+	var recent []models.Authorisation
+
+	rows, err := stmt.QueryContext(ctx, cardId, datetime(since))
+
+	if err != nil {
+		return recent, models.ErrorWrap(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			a         models.Authorisation
+			expiresAt sql.NullString
+		)
+
+		// id, vendor_id, amount, reversed, expires_at, currency, card_currency, rate, ts
+		err = rows.Scan(&a.Id, &a.VendorId, &a.Amount, &a.Reversed, scanNullDatetime(&expiresAt), &a.Currency, &a.CardCurrency, &a.Rate, scanDatetime(&a.Ts))
+
+		if err != nil {
+			return recent, models.ErrorWrap(err)
+		}
+
+		a.CardId = cardId
+		a.ExpiresAt = expiresAt.String
+
+		recent = append(recent, a)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return recent, models.ErrorWrap(err)
+	}
+
+	return recent, nil
+}
+
+// GetCardLimits returns the effective spending limits of a card: each of its own limits, or where that is 0 the
+// default of its customer. A limit of 0 is no limit
+func (d *dbGate) GetCardLimits(ctx context.Context, cardId int) (models.SpendingLimits, models.ApiError) {
+	return d.reader(ctx).getLimits(ctx, QUERY_GET_CARD_LIMITS, cardId, "card", "GetCardLimits")
+}
+
+// SetCardLimits replaces the spending limits of a card, returning its effective limits
+func (d *dbGate) SetCardLimits(ctx context.Context, cardId int, limits models.SpendingLimits) (models.SpendingLimits, models.ApiError) {
+
+	apiErr := checkLimitsValid(limits, "SetCardLimits")
+
+	if apiErr != nil {
+		return models.SpendingLimits{}, apiErr
+	}
+
+	// check that the card exists, as a foreign key violation is not reported alike by every database
+	_, apiErr = d.getLimits(ctx, QUERY_GET_CARD_LIMITS, cardId, "card", "SetCardLimits")
+
+	if apiErr != nil {
+		return models.SpendingLimits{}, apiErr
+	}
+
+	apiErr = d.setLimits(ctx, QUERY_DELETE_CARD_LIMITS, QUERY_ADD_CARD_LIMITS, cardId, limits)
+
+	if apiErr != nil {
+		return models.SpendingLimits{}, apiErr
+	}
+
+	return d.getLimits(ctx, QUERY_GET_CARD_LIMITS, cardId, "card", "SetCardLimits")
+}
+
+// SetCustomerLimits replaces the default spending limits of the cards of a customer, returning them
+func (d *dbGate) SetCustomerLimits(ctx context.Context, customerId int, limits models.SpendingLimits) (models.SpendingLimits, models.ApiError) {
+
+	apiErr := checkLimitsValid(limits, "SetCustomerLimits")
+
+	if apiErr != nil {
+		return models.SpendingLimits{}, apiErr
+	}
+
+	_, apiErr = d.getLimits(ctx, QUERY_GET_CUSTOMER_LIMITS, customerId, "customer", "SetCustomerLimits")
+
+	if apiErr != nil {
+		return models.SpendingLimits{}, apiErr
+	}
+
+	apiErr = d.setLimits(ctx, QUERY_DELETE_CUSTOMER_LIMITS, QUERY_ADD_CUSTOMER_LIMITS, customerId, limits)
+
+	if apiErr != nil {
+		return models.SpendingLimits{}, apiErr
+	}
+
+	return limits, nil
+}
+
+// Returns the effective limits of a card in memory
+func (m *memGate) effectiveLimits(c models.Card) models.SpendingLimits {
+	return withDefaults(m.cardLimits[c.Id], m.customerLimits[c.CustomerId])
+}
+
+// GetCardLimits returns the effective spending limits of a card: each of its own limits, or where that is 0 the
+// default of its customer. A limit of 0 is no limit
+func (m *memGate) GetCardLimits(ctx context.Context, cardId int) (models.SpendingLimits, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c, ok := m.cards[cardId]
+
+	if !ok {
+		return models.SpendingLimits{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "GetCardLimits", "card", cardId)
+	}
+
+	return m.effectiveLimits(c), nil
+}
+
+// SetCardLimits replaces the spending limits of a card, returning its effective limits
+func (m *memGate) SetCardLimits(ctx context.Context, cardId int, limits models.SpendingLimits) (models.SpendingLimits, models.ApiError) {
+
+	if apiErr := checkLimitsValid(limits, "SetCardLimits"); apiErr != nil {
+		return models.SpendingLimits{}, apiErr
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c, ok := m.cards[cardId]
+
+	if !ok {
+		return models.SpendingLimits{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "SetCardLimits", "card", cardId)
+	}
+
+	m.cardLimits[cardId] = limits
+
+	return m.effectiveLimits(c), nil
+}
+
+// SetCustomerLimits replaces the default spending limits of the cards of a customer, returning them
+func (m *memGate) SetCustomerLimits(ctx context.Context, customerId int, limits models.SpendingLimits) (models.SpendingLimits, models.ApiError) {
+
+	if apiErr := checkLimitsValid(limits, "SetCustomerLimits"); apiErr != nil {
+		return models.SpendingLimits{}, apiErr
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.customers[customerId]; !ok {
+		return models.SpendingLimits{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "SetCustomerLimits", "customer", customerId)
+	}
+
+	m.customerLimits[customerId] = limits
+
+	return limits, nil
+}
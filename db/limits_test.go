@@ -0,0 +1,211 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestCheckLimits(t *testing.T) {
+
+	c := models.Card{Id: 100001, Currency: "GBP"}
+
+	recent := []models.Authorisation{
+		// half an hour ago, partly reversed
+		{VendorId: 1001, Amount: 1200, Reversed: 200, Currency: "GBP", CardCurrency: "GBP", Rate: 1, Ts: datetime(testNow.Add(-30 * time.Minute))},
+		// yesterday, earlier this month
+		{VendorId: 1002, Amount: 2000, Currency: "GBP", CardCurrency: "GBP", Rate: 1, Ts: datetime(testNow.Add(-12 * time.Hour))},
+		// last month
+		{VendorId: 1001, Amount: 5000, Currency: "GBP", CardCurrency: "GBP", Rate: 1, Ts: datetime(testNow.AddDate(0, -1, 0))},
+	}
+
+	apiErr := checkLimits(models.SpendingLimits{MaxTransaction: 500}, c, 1001, 600, nil, testNow)
+
+	utils.AssertEquals(t, "Return status for a hold over maxTransaction", LIMIT_EXCEEDED_STATUS, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for a hold over maxTransaction",
+		fmt.Sprintf(MESSAGE_LIMIT_MAX_TRANSACTION, "Authorise", 100001, "£6.00", "£5.00"), apiErr.Error())
+
+	apiErr = checkLimits(models.SpendingLimits{VendorDailySpend: 1500}, c, 1001, 600, recent, testNow)
+
+	utils.AssertEquals(t, "Return message for a hold over vendorDailySpend",
+		fmt.Sprintf(MESSAGE_LIMIT_VENDOR_DAILY_SPEND, "Authorise", 100001, "£6.00", 1001, "£16.00", "£15.00"), apiErr.Error())
+
+	apiErr = checkLimits(models.SpendingLimits{VendorDailySpend: 1500}, c, 1002, 600, recent, testNow)
+
+	utils.AssertNoError(t, "Checking a hold with a vendor last paid yesterday against vendorDailySpend", apiErr)
+
+	apiErr = checkLimits(models.SpendingLimits{DailySpend: 1500}, c, 1002, 600, recent, testNow)
+
+	utils.AssertEquals(t, "Return message for a hold over dailySpend",
+		fmt.Sprintf(MESSAGE_LIMIT_DAILY_SPEND, "Authorise", 100001, "£6.00", "£16.00", "£15.00"), apiErr.Error())
+
+	apiErr = checkLimits(models.SpendingLimits{MonthlySpend: 3500}, c, 1002, 600, recent, testNow)
+
+	utils.AssertEquals(t, "Return message for a hold over monthlySpend",
+		fmt.Sprintf(MESSAGE_LIMIT_MONTHLY_SPEND, "Authorise", 100001, "£6.00", "£36.00", "£35.00"), apiErr.Error())
+
+	apiErr = checkLimits(models.SpendingLimits{HourlyAuthorisations: 1}, c, 1002, 600, recent, testNow)
+
+	utils.AssertEquals(t, "Return message for a hold over hourlyAuthorisations",
+		fmt.Sprintf(MESSAGE_LIMIT_HOURLY_AUTHORISATIONS, "Authorise", 100001, 1), apiErr.Error())
+
+	apiErr = checkLimits(models.SpendingLimits{MaxTransaction: 600, DailySpend: 1600, MonthlySpend: 3600, HourlyAuthorisations: 2, VendorDailySpend: 1600}, c, 1001, 600, recent, testNow)
+
+	utils.AssertNoError(t, "Checking a hold at every limit", apiErr)
+}
+
+func TestWithDefaults(t *testing.T) {
+
+	limits := withDefaults(models.SpendingLimits{MaxTransaction: 2000}, models.SpendingLimits{MaxTransaction: 5000, DailySpend: 10000})
+
+	utils.AssertEquals(t, "Effective limits", models.SpendingLimits{MaxTransaction: 2000, DailySpend: 10000}, limits)
+}
+
+func TestAuthoriseLimitExceeded(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"}).
+			AddRow(int64(1001), "Coffee Shop", 999, "GBP", "", "")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_VENDOR)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
+
+		expected = sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 12676, 12089, "ACTIVE", "2019-01-24 01:00:10", "GBP")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		expectLimits(expecter, 100001, models.SpendingLimits{DailySpend: 1000})
+		expectMccControls(expecter, 100001)
+
+		expected = sqlmock.NewRows([]string{"id", "vendor_id", "amount", "reversed", "expires_at", "currency", "card_currency", "rate", "ts"}).
+			AddRow(int64(1005), int64(1001), 900, 0, expiryTime(testNow), "GBP", "GBP", 1.0, datetime(testNow))
+
+		expecter.ExpectPrepare(esc(QUERY_GET_RECENT_AUTHORISATIONS)).ExpectQuery().WithArgs(100001, datetime(testNow.Add(-RISK_HISTORY))).WillReturnRows(expected)
+
+		aid, apiErr := dbi.Authorise(context.Background(), 100001, 1001, 210, "", "Coffee")
+
+		utils.AssertEquals(t, "Return status for calling Authorise over the daily spend", LIMIT_EXCEEDED_STATUS, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling Authorise over the daily spend",
+			fmt.Sprintf(MESSAGE_LIMIT_DAILY_SPEND, "Authorise", 100001, "£2.10", "£11.10", "£10.00"), apiErr.Error())
+		utils.AssertEquals(t, "Authorisation id", -1, aid)
+	})
+}
+
+func TestAuthoriseLimitExceededHeld(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"}).
+			AddRow(int64(1001), "Coffee Shop", 999, "GBP", "", "")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_VENDOR)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
+
+		expected = sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 12676, 12089, "ACTIVE", "2019-01-24 01:00:10", "GBP")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_CARD)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		expectLimits(expecter, 100001, models.SpendingLimits{DailySpend: 1000})
+		expectMccControls(expecter, 100001)
+		expectHistory(expecter, 100001)
+
+		expecter.ExpectBegin()
+
+		expecter.ExpectPrepare(esc(QUERY_HOLD_CARD))
+		expecter.ExpectPrepare(esc(QUERY_HOLD_CARD)).ExpectExec().WithArgs(210, 100001, 210).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		// an authorisation committed by a concurrent request while this one waited on the card's row
+		expected = sqlmock.NewRows([]string{"id", "vendor_id", "amount", "reversed", "expires_at", "currency", "card_currency", "rate", "ts"}).
+			AddRow(int64(1005), int64(1001), 900, 0, expiryTime(testNow), "GBP", "GBP", 1.0, datetime(testNow))
+
+		expecter.ExpectQuery(esc(QUERY_GET_RECENT_AUTHORISATIONS)).WithArgs(100001, datetime(testNow.Add(-RISK_HISTORY))).WillReturnRows(expected)
+
+		expecter.ExpectRollback()
+
+		aid, apiErr := dbi.Authorise(context.Background(), 100001, 1001, 210, "", "Coffee")
+
+		utils.AssertEquals(t, "Return status for calling Authorise over the daily spend once held", LIMIT_EXCEEDED_STATUS, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling Authorise over the daily spend once held",
+			fmt.Sprintf(MESSAGE_LIMIT_DAILY_SPEND, "Authorise", 100001, "£2.10", "£11.10", "£10.00"), apiErr.Error())
+		utils.AssertEquals(t, "Authorisation id", -1, aid)
+	})
+}
+
+// Sets the default limits of the card's customer and the card's own, then authorises payments up to them, checking
+// the limits which refuse each payment over them
+func testLimits(t *testing.T, dbi Dbi, c models.Card, v models.Vendor) {
+
+	defer fixClock(testNow)()
+
+	ctx := context.Background()
+
+	limits, apiErr := dbi.GetCardLimits(ctx, c.Id)
+
+	utils.AssertNoError(t, "Calling GetCardLimits", apiErr)
+	utils.AssertEquals(t, "Limits of a card without any", models.SpendingLimits{}, limits)
+
+	_, apiErr = dbi.SetCardLimits(ctx, c.Id, models.SpendingLimits{DailySpend: -1})
+
+	utils.AssertEquals(t, "Return status for calling SetCardLimits with a negative limit", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling SetCardLimits with a negative limit",
+		fmt.Sprintf(MESSAGE_BAD_LIMIT, "SetCardLimits", "dailySpend"), apiErr.Error())
+
+	_, apiErr = dbi.SetCardLimits(ctx, 9999, models.SpendingLimits{})
+	utils.AssertEquals(t, "Return status for calling SetCardLimits with an invalid id", 404, apiErr.StatusCode())
+
+	_, apiErr = dbi.SetCustomerLimits(ctx, 9999, models.SpendingLimits{})
+	utils.AssertEquals(t, "Return status for calling SetCustomerLimits with an invalid id", 404, apiErr.StatusCode())
+
+	_, apiErr = dbi.SetCustomerLimits(ctx, c.CustomerId, models.SpendingLimits{MaxTransaction: 5000, DailySpend: 3000})
+	utils.AssertNoError(t, "Calling SetCustomerLimits", apiErr)
+
+	limits, apiErr = dbi.SetCardLimits(ctx, c.Id, models.SpendingLimits{MaxTransaction: 2000, HourlyAuthorisations: 3})
+
+	utils.AssertNoError(t, "Calling SetCardLimits", apiErr)
+	utils.AssertEquals(t, "Effective limits of the card", models.SpendingLimits{MaxTransaction: 2000, DailySpend: 3000, HourlyAuthorisations: 3}, limits)
+
+	_, apiErr = dbi.Authorise(ctx, c.Id, v.Id, 2500, "", "Coffee")
+
+	utils.AssertEquals(t, "Return status for calling Authorise over maxTransaction", LIMIT_EXCEEDED_STATUS, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling Authorise over maxTransaction",
+		fmt.Sprintf(MESSAGE_LIMIT_MAX_TRANSACTION, "Authorise", c.Id, "£25.00", "£20.00"), apiErr.Error())
+
+	aid, apiErr := dbi.Authorise(ctx, c.Id, v.Id, 1500, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise within the limits", apiErr)
+
+	_, apiErr = dbi.Authorise(ctx, c.Id, v.Id, 1500, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise up to the daily spend", apiErr)
+
+	_, apiErr = dbi.Authorise(ctx, c.Id, v.Id, 100, "", "Coffee")
+
+	utils.AssertEquals(t, "Return message for calling Authorise over the customer's dailySpend",
+		fmt.Sprintf(MESSAGE_LIMIT_DAILY_SPEND, "Authorise", c.Id, "£1.00", "£31.00", "£30.00"), apiErr.Error())
+
+	// a reversal no longer counts towards the spend
+	_, apiErr = dbi.Reverse(ctx, aid, 1000, "", "Not wanted")
+	utils.AssertNoError(t, "Calling Reverse", apiErr)
+
+	_, apiErr = dbi.Authorise(ctx, c.Id, v.Id, 500, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise after a reversal", apiErr)
+
+	_, apiErr = dbi.Authorise(ctx, c.Id, v.Id, 100, "", "Coffee")
+
+	utils.AssertEquals(t, "Return message for calling Authorise over hourlyAuthorisations",
+		fmt.Sprintf(MESSAGE_LIMIT_HOURLY_AUTHORISATIONS, "Authorise", c.Id, 3), apiErr.Error())
+
+	card, _ := dbi.GetCard(ctx, c.Id)
+	utils.AssertEquals(t, "Available after the authorisations within the limits", 10000-2500, card.Available)
+}
+
+func TestMemoryLimits(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 10000)
+	defer dbi.Close()
+
+	testLimits(t, dbi, c, v)
+}
@@ -0,0 +1,1062 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	MANDATE_STATUS_ACTIVE    = "ACTIVE"
+	MANDATE_STATUS_SUSPENDED = "SUSPENDED"
+	MANDATE_STATUS_CANCELLED = "CANCELLED"
+	MANDATE_STATUS_ENDED     = "ENDED"
+
+	MANDATE_FREQUENCY_DAILY   = "DAILY"
+	MANDATE_FREQUENCY_WEEKLY  = "WEEKLY"
+	MANDATE_FREQUENCY_MONTHLY = "MONTHLY"
+
+	MANDATE_RUN_SUCCEEDED = "SUCCEEDED"
+	MANDATE_RUN_FAILED    = "FAILED"
+
+	// The wait before retrying a run refused for insufficient funds, doubled for each consecutive failure before it
+	MANDATE_RETRY_BACKOFF = time.Hour
+
+	// The consecutive failed runs after which a mandate is suspended
+	MANDATE_MAX_FAILURES = 3
+
+	// The format of the end date of a mandate, the last day on which a period may start
+	DATE_FORMAT = "2006-01-02"
+
+	// The length of the reason column of a mandate run
+	MAX_MANDATE_REASON_LENGTH = 255
+
+	// The prefix of the idempotency keys under which the scheduler authorises mandates, which requests may not use
+	MANDATE_IDEMPOTENCY_KEY_PREFIX = "mandate-"
+
+	QUERY_GET_MANDATE = `SELECT id, card_id, vendor_id, amount, max_amount, currency, frequency, description, end_date, anchor_day, next_run_at, retry_at, failures, status, ts
+                            FROM mandates WHERE id = ?`
+
+	// The active mandates whose period has started, or whose retry is due if a run for it has been refused
+	QUERY_GET_DUE_MANDATES = `SELECT id, card_id, vendor_id, amount, max_amount, currency, frequency, description, end_date, anchor_day, next_run_at, retry_at, failures, status, ts
+                            FROM mandates WHERE status = 'ACTIVE' AND COALESCE(retry_at, next_run_at) <= ?
+                            ORDER BY id`
+
+	QUERY_GET_MANDATE_RUNS = `SELECT id, mandate_id, authorisation_id, amount, status, reason, ts FROM mandate_runs WHERE mandate_id = ? ORDER BY id`
+
+	QUERY_ADD_MANDATE = `INSERT INTO mandates (card_id, vendor_id, amount, max_amount, currency, frequency, description, end_date, anchor_day, next_run_at)
+                               VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	QUERY_ADD_MANDATE_RUN = `INSERT INTO mandate_runs (mandate_id, authorisation_id, amount, status, reason, ts)
+                               VALUES (?, ?, ?, ?, ?, ?)`
+
+	QUERY_UPDATE_MANDATE_DETAILS = `UPDATE mandates SET amount = ?, description = ?, end_date = ? WHERE id = ? AND status IN ('ACTIVE', 'SUSPENDED')`
+
+	// The mandates of a card which is closed, which could no longer be charged
+	QUERY_END_CARD_MANDATES = `UPDATE mandates SET status = 'ENDED', retry_at = NULL WHERE card_id = ? AND status IN ('ACTIVE', 'SUSPENDED')`
+
+	// A guarded update which only affects a mandate still in the state read before the change
+	QUERY_UPDATE_MANDATE_STATE = `UPDATE mandates SET status = ?, next_run_at = ?, retry_at = ?, failures = ?
+                               WHERE id = ? AND status = ? AND next_run_at = ? AND failures = ?`
+
+	MESSAGE_MANDATE_DESCRIPTION = "Recurring payment to %v"
+
+	MESSAGE_BAD_MANDATE_FREQUENCY  = "%v: no mandate frequency %v"
+	MESSAGE_BAD_MANDATE_AMOUNT     = "%v: amount must be positive"
+	MESSAGE_MANDATE_OVER_CEILING   = "%v: amount %v exceeds the ceiling of %v"
+	MESSAGE_BAD_MANDATE_END_DATE   = "%v: endDate %v is not a date of the form YYYY-MM-DD"
+	MESSAGE_MANDATE_END_DATE_PAST  = "%v: endDate %v has passed"
+	MESSAGE_BAD_MANDATE_STATUS     = "%v: no mandate status %v"
+	MESSAGE_MANDATE_TRANSITION     = "%v: mandate %v cannot change from %v to %v"
+	MESSAGE_MANDATE_CLOSED         = "%v: mandate %v is %v"
+	MESSAGE_MANDATE_CHANGED        = "%v: mandate %v was changed by another request"
+	MESSAGE_MANDATE_IN_PROGRESS    = "%v: mandate %v is being charged for %v by another run"
+	MESSAGE_MANDATE_KEY_MISMATCH   = "%v: idempotency key %v of mandate %v was used for another request"
+	MESSAGE_MANDATE_NOT_ITS_AUTH   = "%v: authorisation %v is not of the card and vendor of mandate %v"
+	MESSAGE_MANDATE_NOT_CAPTURED   = "%v: authorisation %v of mandate %v was released without being captured"
+	MESSAGE_MANDATE_CAPTURE_FAILED = "Capture refused: %v"
+	MESSAGE_BAD_MANDATE_NEXT_RUN   = "%v: mandate %v has an invalid nextRunAt %v"
+)
+
+// The statuses a mandate may be changed to through SetMandateStatus from each status. A mandate is suspended by the
+// scheduler after MANDATE_MAX_FAILURES failed runs, or may be suspended to pause it, and resumes when changed back
+// to ACTIVE. It is ENDED by the scheduler once its next period would start after its end date. CANCELLED and ENDED
+// are final.
+var mandateTransitions = map[string][]string{
+	MANDATE_STATUS_ACTIVE:    {MANDATE_STATUS_SUSPENDED, MANDATE_STATUS_CANCELLED},
+	MANDATE_STATUS_SUSPENDED: {MANDATE_STATUS_ACTIVE, MANDATE_STATUS_CANCELLED},
+	MANDATE_STATUS_CANCELLED: {},
+	MANDATE_STATUS_ENDED:     {},
+}
+
+var mandateFrequencies = []string{MANDATE_FREQUENCY_DAILY, MANDATE_FREQUENCY_WEEKLY, MANDATE_FREQUENCY_MONTHLY}
+
+// The operations through which the scheduler finds and records the runs of mandates, besides the Dbi operations
+// through which it charges them
+type mandateStore interface {
+	Dbi
+
+	// Returns the mandates due to be charged at a time
+	dueMandates(ctx context.Context, now time.Time) ([]models.Mandate, models.ApiError)
+	// Records a run of a mandate and moves it from the state it was charged in to the next, returning the run
+	recordMandateRun(ctx context.Context, m, next models.Mandate, run models.MandateRun) (models.MandateRun, models.ApiError)
+}
+
+// Check the amount, ceiling and end date which may be given on adding or updating a mandate. A ceiling of 0 is the
+// amount
+func checkMandateTerms(m models.Mandate, now time.Time, context string) (models.Mandate, models.ApiError) {
+
+	if m.Amount <= 0 {
+		return m, models.ConstructApiError(400, MESSAGE_BAD_MANDATE_AMOUNT, context)
+	}
+
+	if m.MaxAmount == 0 {
+		m.MaxAmount = m.Amount
+	}
+
+	if m.Amount > m.MaxAmount {
+		return m, models.ConstructApiError(400, MESSAGE_MANDATE_OVER_CEILING, context, m.Amount, m.MaxAmount)
+	}
+
+	if m.EndDate != "" {
+
+		if _, err := time.Parse(DATE_FORMAT, m.EndDate); err != nil {
+			return m, models.ConstructApiError(400, MESSAGE_BAD_MANDATE_END_DATE, context, m.EndDate)
+		}
+
+		if m.EndDate < now.UTC().Format(DATE_FORMAT) {
+			return m, models.ConstructApiError(400, MESSAGE_MANDATE_END_DATE_PAST, context, m.EndDate)
+		}
+	}
+
+	return m, nil
+}
+
+// Check a new mandate, returning it as it is to be added: due now, in the vendor's currency, with a description
+func checkNewMandate(m models.Mandate, v models.Vendor, now time.Time) (models.Mandate, models.ApiError) {
+
+	if !contains(mandateFrequencies, m.Frequency) {
+		return m, models.ConstructApiError(400, MESSAGE_BAD_MANDATE_FREQUENCY, "AddOrUpdateMandate", m.Frequency)
+	}
+
+	m, apiErr := checkMandateTerms(m, now, "AddOrUpdateMandate")
+
+	if apiErr != nil {
+		return m, apiErr
+	}
+
+	m.Currency, apiErr = checkAmountCurrency(m.Currency, v.Currency, "vendor", v.Id, "AddOrUpdateMandate")
+
+	if apiErr != nil {
+		return m, apiErr
+	}
+
+	if m.Description == "" {
+		m.Description = fmt.Sprintf(MESSAGE_MANDATE_DESCRIPTION, v.VendorName)
+	}
+
+	m.AnchorDay = now.Day()
+	m.NextRunAt = datetime(now)
+	m.RetryAt = ""
+	m.Failures = 0
+	m.Status = MANDATE_STATUS_ACTIVE
+
+	return m, nil
+}
+
+// Check the update of an existing mandate, returning it with the amount, description and end date changed. The
+// card, vendor, frequency and ceiling agreed by the customer cannot change
+func checkMandateUpdate(existing, m models.Mandate, now time.Time) (models.Mandate, models.ApiError) {
+
+	if existing.Status != MANDATE_STATUS_ACTIVE && existing.Status != MANDATE_STATUS_SUSPENDED {
+		return existing, models.ConstructApiError(409, MESSAGE_MANDATE_CLOSED, "AddOrUpdateMandate", existing.Id, existing.Status)
+	}
+
+	m.MaxAmount = existing.MaxAmount
+
+	m, apiErr := checkMandateTerms(m, now, "AddOrUpdateMandate")
+
+	if apiErr != nil {
+		return existing, apiErr
+	}
+
+	existing.Amount = m.Amount
+	existing.EndDate = m.EndDate
+
+	if m.Description != "" {
+		existing.Description = m.Description
+	}
+
+	return existing, nil
+}
+
+// Returns the start of the period after the one starting at a DATETIME value. A monthly period starts on the anchor
+// day of its month, or on the last day of a month too short for it, so that periods do not drift after a short
+// month. An anchor day of 0 is the day of the period
+func nextPeriod(runAt, frequency string, anchorDay int) (string, error) {
+
+	t, err := time.Parse(DATETIME_FORMAT, runAt)
+
+	if err != nil {
+		return runAt, err
+	}
+
+	switch frequency {
+	case MANDATE_FREQUENCY_DAILY:
+		t = t.AddDate(0, 0, 1)
+	case MANDATE_FREQUENCY_WEEKLY:
+		t = t.AddDate(0, 0, 7)
+	default:
+
+		if anchorDay == 0 {
+			anchorDay = t.Day()
+		}
+
+		// day 0 of the month after next is the last day of next month
+		lastDay := time.Date(t.Year(), t.Month()+2, 0, 0, 0, 0, 0, time.UTC).Day()
+
+		if anchorDay > lastDay {
+			anchorDay = lastDay
+		}
+
+		t = time.Date(t.Year(), t.Month()+1, anchorDay, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	}
+
+	return datetime(t), nil
+}
+
+// Moves a mandate on to its next period, ending it if that would start after its end date
+func advanceMandate(m models.Mandate) (models.Mandate, models.ApiError) {
+
+	next, err := nextPeriod(m.NextRunAt, m.Frequency, m.AnchorDay)
+
+	if err != nil {
+		return m, models.ConstructApiError(500, MESSAGE_BAD_MANDATE_NEXT_RUN, "RunMandates", m.Id, m.NextRunAt)
+	}
+
+	m.NextRunAt = next
+	m.RetryAt = ""
+
+	if m.EndDate != "" && m.NextRunAt[:len(DATE_FORMAT)] > m.EndDate {
+		m.Status = MANDATE_STATUS_ENDED
+	}
+
+	return m, nil
+}
+
+// Returns the wait before retrying a mandate refused for insufficient funds after a number of consecutive failures
+func mandateBackoff(failures int) time.Duration {
+	return MANDATE_RETRY_BACKOFF << uint(failures-1)
+}
+
+// Returns the state of a mandate after a run. A successful run moves it on to its next period. A run refused for
+// insufficient funds is retried after a backoff within the same period, whereas any other refusal, such as by a
+// spending limit or a frozen card, skips the period. Either is a failure, and a mandate is suspended after
+// MANDATE_MAX_FAILURES consecutive failures
+func nextMandateState(m models.Mandate, run models.MandateRun, retry bool, now time.Time) (models.Mandate, models.ApiError) {
+
+	if run.Status == MANDATE_RUN_SUCCEEDED {
+		m.Failures = 0
+		return advanceMandate(m)
+	}
+
+	m.Failures++
+
+	if m.Failures >= MANDATE_MAX_FAILURES {
+		m.Status = MANDATE_STATUS_SUSPENDED
+		m.RetryAt = ""
+		return m, nil
+	}
+
+	if retry {
+		m.RetryAt = datetime(now.Add(mandateBackoff(m.Failures)))
+		return m, nil
+	}
+
+	return advanceMandate(m)
+}
+
+// Returns the state of a mandate after a change of status. A resumed mandate is charged for the latest period which
+// has started, without those which passed while it was suspended, and starts again without failures
+func changedMandateState(m models.Mandate, status string, now time.Time) (models.Mandate, models.ApiError) {
+
+	m.Status = status
+	m.RetryAt = ""
+
+	if status != MANDATE_STATUS_ACTIVE {
+		return m, nil
+	}
+
+	m.Failures = 0
+
+	next, err := nextPeriod(m.NextRunAt, m.Frequency, m.AnchorDay)
+
+	for ; err == nil && next <= datetime(now); next, err = nextPeriod(next, m.Frequency, m.AnchorDay) {
+		m.NextRunAt = next
+	}
+
+	// a value which cannot be parsed is not advanced from the zero time, period by period
+	if err != nil {
+		return m, models.ConstructApiError(500, MESSAGE_BAD_MANDATE_NEXT_RUN, "SetMandateStatus", m.Id, m.NextRunAt)
+	}
+
+	if m.EndDate != "" && m.NextRunAt[:len(DATE_FORMAT)] > m.EndDate {
+		m.Status = MANDATE_STATUS_ENDED
+	}
+
+	return m, nil
+}
+
+// Check that a mandate may change from its current status to the requested one
+func checkMandateTransition(m models.Mandate, status string) models.ApiError {
+
+	if _, ok := mandateTransitions[status]; !ok {
+		return models.ConstructApiError(400, MESSAGE_BAD_MANDATE_STATUS, "SetMandateStatus", status)
+	}
+
+	if !contains(mandateTransitions[m.Status], status) {
+		return models.ConstructApiError(409, MESSAGE_MANDATE_TRANSITION, "SetMandateStatus", m.Id, m.Status, status)
+	}
+
+	return nil
+}
+
+// Returns the reason recorded for a failed run, cut to the length of its column
+func mandateReason(reason string) string {
+
+	if len(reason) > MAX_MANDATE_REASON_LENGTH {
+		return reason[:MAX_MANDATE_REASON_LENGTH]
+	}
+
+	return reason
+}
+
+// True if an authorisation was refused for insufficient available funds on the card, the one refusal which is retried
+func insufficientFunds(apiErr models.ApiError) bool {
+	return models.HasFormat(apiErr, MESSAGE_INSUFFICIENT_AVAILABLE) || models.HasFormat(apiErr, MESSAGE_INSUFFICIENT_AVAILABLE_FOR)
+}
+
+// Charge a mandate for its current period through Authorise and Capture, returning the run and whether it is to be
+// retried. The authorisation of a period is made under an idempotency key, so that it is made once however many times
+// the period is run, and a run which finds it already made captures what remains of it. A refused authorisation
+// releases the key, so that a retry can make it. A period which another run is charging is a 409. A key claimed for
+// another request, or whose authorisation is not of the mandate's card and vendor, fails the run without capturing
+func chargeMandate(ctx context.Context, store mandateStore, m models.Mandate) (models.MandateRun, bool, models.ApiError) {
+
+	run := models.MandateRun{
+		MandateId: m.Id,
+		Amount:    m.Amount,
+		Currency:  m.Currency,
+	}
+
+	key := fmt.Sprintf("%v%v-%v", MANDATE_IDEMPOTENCY_KEY_PREFIX, m.Id, m.NextRunAt)
+
+	k, claimed, apiErr := store.ClaimIdempotencyKey(ctx, key, key)
+
+	if apiErr != nil {
+		return run, false, apiErr
+	}
+
+	if !claimed && k.Fingerprint != key {
+		return failedMandateRun(run, models.ConstructApiError(409, MESSAGE_MANDATE_KEY_MISMATCH, "RunMandates", key, m.Id))
+	}
+
+	if !claimed && !k.Completed {
+		return run, false, models.ConstructApiError(409, MESSAGE_MANDATE_IN_PROGRESS, "RunMandates", m.Id, m.NextRunAt)
+	}
+
+	aid := k.ResponseId
+
+	if claimed {
+
+		aid, apiErr = store.Authorise(ctx, m.CardId, m.VendorId, m.Amount, m.Currency, m.Description)
+
+		if apiErr != nil {
+
+			// released without the run's context, which has expired if the run failed by exceeding its deadline
+			if releaseErr := store.ReleaseIdempotencyKey(context.Background(), key); releaseErr != nil {
+				log.Printf("ERROR: Failed to release %v: %v", key, releaseErr.Error())
+			}
+
+			if apiErr.StatusCode() >= 500 {
+				return run, false, apiErr
+			}
+
+			run.Status = MANDATE_RUN_FAILED
+			run.Reason = mandateReason(apiErr.Error())
+
+			return run, insufficientFunds(apiErr), nil
+		}
+
+		// the authorisation has been made, so the run goes on to capture it even if the key cannot be completed, which
+		// is done without the run's context in case its deadline has passed. A key left claimed is taken over by a run
+		// of the period after IDEMPOTENCY_CLAIM_TIMEOUT
+		if completeErr := store.CompleteIdempotencyKey(context.Background(), key, aid); completeErr != nil {
+			log.Printf("ERROR: Failed to complete %v with %v: %v", key, aid, completeErr.Error())
+		}
+	}
+
+	run.AuthorisationId = aid
+
+	auth, apiErr := store.GetAuthorisation(WithReadYourWrites(ctx), aid)
+
+	if apiErr != nil {
+		return run, false, apiErr
+	}
+
+	if auth.CardId != m.CardId || auth.VendorId != m.VendorId {
+		return failedMandateRun(run, models.ConstructApiError(409, MESSAGE_MANDATE_NOT_ITS_AUTH, "RunMandates", aid, m.Id))
+	}
+
+	if capturable := auth.Capturable(); capturable > 0 {
+
+		_, apiErr = store.Capture(ctx, aid, capturable, auth.Currency)
+
+		if apiErr != nil {
+
+			if apiErr.StatusCode() >= 500 {
+				return run, false, apiErr
+			}
+
+			run.Status = MANDATE_RUN_FAILED
+			run.Reason = mandateReason(fmt.Sprintf(MESSAGE_MANDATE_CAPTURE_FAILED, apiErr.Error()))
+
+			// the hold of an authorisation which cannot be captured, such as one held for review, is not left on the card
+			_, apiErr = store.Reverse(ctx, aid, capturable, auth.Currency, run.Reason)
+
+			if apiErr != nil && apiErr.StatusCode() >= 500 {
+				return run, false, apiErr
+			}
+
+			return run, false, nil
+		}
+
+		auth.Captured += capturable
+	}
+
+	if auth.Captured == 0 {
+		run.Status = MANDATE_RUN_FAILED
+		run.Reason = fmt.Sprintf(MESSAGE_MANDATE_NOT_CAPTURED, "RunMandates", aid, m.Id)
+		return run, false, nil
+	}
+
+	run.Status = MANDATE_RUN_SUCCEEDED
+
+	return run, false, nil
+}
+
+// Returns a run failed by a conflict, recorded with its reason rather than skipped as a run in progress is, as it
+// would conflict again on every run of the period
+func failedMandateRun(run models.MandateRun, apiErr models.ApiError) (models.MandateRun, bool, models.ApiError) {
+
+	run.Status = MANDATE_RUN_FAILED
+	run.Reason = mandateReason(apiErr.Error())
+
+	return run, false, nil
+}
+
+// Charge each mandate which is due, recording its run, and report the runs. A mandate which another run is charging
+// is left to it
+func runMandates(ctx context.Context, store mandateStore) (models.MandateReport, models.ApiError) {
+
+	report := models.MandateReport{
+		Runs: []models.MandateRun{},
+	}
+
+	now := clock()
+
+	due, apiErr := store.dueMandates(ctx, now)
+
+	if apiErr != nil {
+		return report, apiErr
+	}
+
+	for _, m := range due {
+
+		run, retry, apiErr := chargeMandate(ctx, store, m)
+
+		if apiErr != nil {
+
+			if apiErr.StatusCode() == 409 {
+				log.Printf("Skipping mandate %v: %v", m.Id, apiErr.Error())
+				continue
+			}
+
+			return report, apiErr
+		}
+
+		next, apiErr := nextMandateState(m, run, retry, now)
+
+		if apiErr != nil {
+			return report, apiErr
+		}
+
+		run, apiErr = store.recordMandateRun(ctx, m, next, run)
+
+		if apiErr != nil {
+			return report, apiErr
+		}
+
+		if run.Status == MANDATE_RUN_SUCCEEDED {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+
+		if next.Status == MANDATE_STATUS_SUSPENDED {
+			report.Suspended++
+		}
+
+		report.Runs = append(report.Runs, run)
+	}
+
+	return report, nil
+}
+
+// Returns a value for a nullable column, NULL if empty
+func nullable(value interface{}) interface{} {
+
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+	case int:
+		if v == 0 {
+			return nil
+		}
+	}
+
+	return value
+}
+
+// Scan a row of QUERY_GET_MANDATE or QUERY_GET_DUE_MANDATES
+func scanMandate(scan func(dest ...interface{}) error) (models.Mandate, error) {
+
+	var (
+		m       models.Mandate
+		retryAt sql.NullString
+	)
+
+	err := scan(&m.Id, &m.CardId, &m.VendorId, &m.Amount, &m.MaxAmount, &m.Currency, &m.Frequency, &m.Description, &m.EndDate,
+		&m.AnchorDay, scanDatetime(&m.NextRunAt), scanNullDatetime(&retryAt), &m.Failures, &m.Status, scanDatetime(&m.Ts))
+
+	m.RetryAt = retryAt.String
+
+	return m, err
+}
+
+func (c *dbConn) getMandate(ctx context.Context, id int, context string) (models.Mandate, models.ApiError) {
+
+	qry := QUERY_GET_MANDATE
+
+	err := c.prepareQry(ctx, qry)
+
+	if err != nil {
+		return models.Mandate{}, models.ErrorWrap(err)
+	}
+
+	m, err := scanMandate(c.stmt(qry).QueryRowContext(ctx, id).Scan)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return m, models.ConstructApiError(404, MESSAGE_BAD_ID, context, "mandate", id)
+		}
+		return m, models.ErrorWrap(err)
+	}
+
+	return m, nil
+}
+
+// Returns the runs of a mandate, which are in its currency
+func (c *dbConn) getMandateRuns(ctx context.Context, mandateId int, currency string) ([]models.MandateRun, models.ApiError) {
+
+	var runs []models.MandateRun
+
+	qry := QUERY_GET_MANDATE_RUNS
+
+	err := c.prepareQry(ctx, qry)
+
+	if err != nil {
+		return runs, models.ErrorWrap(err)
+	}
+
+	rows, err := c.stmt(qry).QueryContext(ctx, mandateId)
+
+	if err != nil {
+		return runs, models.ErrorWrap(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			r               models.MandateRun
+			authorisationId sql.NullInt64
+		)
+
+		err = rows.Scan(&r.Id, &r.MandateId, &authorisationId, &r.Amount, &r.Status, &r.Reason, scanDatetime(&r.Ts))
+
+		if err != nil {
+			return runs, models.ErrorWrap(err)
+		}
+
+		r.AuthorisationId = int(authorisationId.Int64)
+		r.Currency = currency
+
+		runs = append(runs, r)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return runs, models.ErrorWrap(err)
+	}
+
+	return runs, nil
+}
+
+// Apply a change of state to a mandate within a transaction, guarded on the state it was read in
+func (d *dbGate) updateMandateState(ctx context.Context, tx *sql.Tx, m, next models.Mandate, context string) models.ApiError {
+
+	qry := QUERY_UPDATE_MANDATE_STATE
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, next.Status, next.NextRunAt, nullable(next.RetryAt), next.Failures, m.Id, m.Status, m.NextRunAt, m.Failures)
+
+	if res.apiErr != nil {
+		return res.apiErr
+	}
+
+	if res.numRowsAffected != 1 {
+		return models.ConstructApiError(409, MESSAGE_MANDATE_CHANGED, context, m.Id)
+	}
+
+	return nil
+}
+
+// GetMandate returns a mandate, including its runs
+func (d *dbGate) GetMandate(ctx context.Context, id int) (models.Mandate, models.ApiError) {
+
+	conn := d.reader(ctx)
+
+	m, apiErr := conn.getMandate(ctx, id, "GetMandate")
+
+	if apiErr != nil {
+		return m, apiErr
+	}
+
+	m.Runs, apiErr = conn.getMandateRuns(ctx, id, m.Currency)
+
+	return m, apiErr
+}
+
+// AddOrUpdateMandate adds a mandate for a vendor to charge a card each period, taking a mandate object, or if an id
+// already exists updates the amount, description and end date of an existing mandate
+func (d *dbGate) AddOrUpdateMandate(ctx context.Context, m models.Mandate) (models.Mandate, models.ApiError) {
+
+	now := clock()
+
+	if m.Id > 0 {
+
+		existing, apiErr := d.getMandate(ctx, m.Id, "AddOrUpdateMandate")
+
+		if apiErr != nil {
+			return models.Mandate{}, apiErr
+		}
+
+		m, apiErr = checkMandateUpdate(existing, m, now)
+
+		if apiErr != nil {
+			return models.Mandate{}, apiErr
+		}
+
+		qry := QUERY_UPDATE_MANDATE_DETAILS
+
+		err := d.prepareQry(ctx, qry)
+
+		if err != nil {
+			return models.Mandate{}, models.ErrorWrap(err)
+		}
+
+		res := d.exec(ctx, d.stmt(qry), qry, m.Amount, m.Description, m.EndDate, m.Id)
+
+		if res.apiErr != nil {
+			return models.Mandate{}, res.apiErr
+		}
+
+		if res.numRowsAffected != 1 {
+			return models.Mandate{}, models.ConstructApiError(409, MESSAGE_MANDATE_CHANGED, "AddOrUpdateMandate", m.Id)
+		}
+
+		return m, nil
+	}
+
+	v, apiErr := d.getVendor(ctx, m.VendorId)
+
+	if apiErr != nil {
+
+		if apiErr.StatusCode() == 500 {
+			return models.Mandate{}, apiErr
+		}
+
+		return models.Mandate{}, models.ConstructApiError(400, MESSAGE_BAD_ID, "AddOrUpdateMandate", "vendor", m.VendorId)
+	}
+
+	c, apiErr := d.getCard(ctx, m.CardId)
+
+	if apiErr != nil {
+
+		if apiErr.StatusCode() == 500 {
+			return models.Mandate{}, apiErr
+		}
+
+		return models.Mandate{}, models.ConstructApiError(400, MESSAGE_BAD_ID, "AddOrUpdateMandate", "card", m.CardId)
+	}
+
+	apiErr = checkCardUsable(c, mandateStatuses, "AddOrUpdateMandate")
+
+	if apiErr != nil {
+		return models.Mandate{}, apiErr
+	}
+
+	m, apiErr = checkNewMandate(m, v, now)
+
+	if apiErr != nil {
+		return models.Mandate{}, apiErr
+	}
+
+	qry := QUERY_ADD_MANDATE
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return models.Mandate{}, models.ErrorWrap(err)
+	}
+
+	res := d.exec(ctx, d.stmt(qry), qry, m.CardId, m.VendorId, m.Amount, m.MaxAmount, m.Currency, m.Frequency, m.Description, m.EndDate, m.AnchorDay, m.NextRunAt)
+
+	if res.apiErr != nil {
+		return models.Mandate{}, res.apiErr
+	}
+
+	m.Id = res.lastInsertedId
+
+	return m, nil
+}
+
+// SetMandateStatus suspends, resumes or cancels a mandate, returning it
+func (d *dbGate) SetMandateStatus(ctx context.Context, id int, status string) (models.Mandate, models.ApiError) {
+
+	m, apiErr := d.getMandate(ctx, id, "SetMandateStatus")
+
+	if apiErr != nil {
+		return m, apiErr
+	}
+
+	apiErr = checkMandateTransition(m, status)
+
+	if apiErr != nil {
+		return m, apiErr
+	}
+
+	next, apiErr := changedMandateState(m, status, clock())
+
+	if apiErr != nil {
+		return m, apiErr
+	}
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
+
+	if err != nil {
+		return m, models.ErrorWrap(err)
+	}
+
+	defer tx.Rollback()
+
+	apiErr = d.updateMandateState(ctx, tx, m, next, "SetMandateStatus")
+
+	if apiErr != nil {
+		return m, apiErr
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return m, models.ErrorWrap(err)
+	}
+
+	// the mandate returned includes this change, which may not yet have reached a replica
+	return d.GetMandate(WithReadYourWrites(ctx), id)
+}
+
+// RunMandates charges each active mandate whose period has started, or whose retry is due, through Authorise and
+// Capture, and reports the runs
+func (d *dbGate) RunMandates(ctx context.Context) (models.MandateReport, models.ApiError) {
+	return runMandates(ctx, d)
+}
+
+func (d *dbGate) dueMandates(ctx context.Context, now time.Time) ([]models.Mandate, models.ApiError) {
+
+	var due []models.Mandate
+
+	qry := QUERY_GET_DUE_MANDATES
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return due, models.ErrorWrap(err)
+	}
+
+	rows, err := d.stmt(qry).QueryContext(ctx, datetime(now))
+
+	if err != nil {
+		return due, models.ErrorWrap(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		m, err := scanMandate(rows.Scan)
+
+		if err != nil {
+			return due, models.ErrorWrap(err)
+		}
+
+		due = append(due, m)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return due, models.ErrorWrap(err)
+	}
+
+	return due, nil
+}
+
+// The run is recorded even if the mandate has been changed since it was read, such as by being cancelled, as the
+// payment has been taken, but the change is kept
+func (d *dbGate) recordMandateRun(ctx context.Context, m, next models.Mandate, run models.MandateRun) (models.MandateRun, models.ApiError) {
+
+	run.Ts = datetime(clock())
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
+
+	if err != nil {
+		return run, models.ErrorWrap(err)
+	}
+
+	defer tx.Rollback()
+
+	qry := QUERY_ADD_MANDATE_RUN
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return run, models.ErrorWrap(err)
+	}
+
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, run.MandateId, nullable(run.AuthorisationId), run.Amount, run.Status, run.Reason, run.Ts)
+
+	if res.apiErr != nil {
+		return run, res.apiErr
+	}
+
+	run.Id = res.lastInsertedId
+
+	apiErr := d.updateMandateState(ctx, tx, m, next, "RunMandates")
+
+	if apiErr != nil && apiErr.StatusCode() != 409 {
+		return run, apiErr
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return run, models.ErrorWrap(err)
+	}
+
+	return run, nil
+}
+
+// GetMandate returns a mandate, including its runs
+func (m *memGate) GetMandate(ctx context.Context, id int) (models.Mandate, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	md, ok := m.mandates[id]
+
+	if !ok {
+		return models.Mandate{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "GetMandate", "mandate", id)
+	}
+
+	for _, r := range m.mandateRuns {
+		if r.MandateId == id {
+			md.Runs = append(md.Runs, r)
+		}
+	}
+
+	return md, nil
+}
+
+// AddOrUpdateMandate adds a mandate for a vendor to charge a card each period, taking a mandate object, or if an id
+// already exists updates the amount, description and end date of an existing mandate
+func (m *memGate) AddOrUpdateMandate(ctx context.Context, md models.Mandate) (models.Mandate, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := clock()
+
+	if md.Id > 0 {
+
+		existing, ok := m.mandates[md.Id]
+
+		if !ok {
+			return models.Mandate{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "AddOrUpdateMandate", "mandate", md.Id)
+		}
+
+		md, apiErr := checkMandateUpdate(existing, md, now)
+
+		if apiErr != nil {
+			return models.Mandate{}, apiErr
+		}
+
+		m.mandates[md.Id] = md
+
+		return md, nil
+	}
+
+	v, ok := m.vendors[md.VendorId]
+
+	if !ok {
+		return models.Mandate{}, models.ConstructApiError(400, MESSAGE_BAD_ID, "AddOrUpdateMandate", "vendor", md.VendorId)
+	}
+
+	c, ok := m.cards[md.CardId]
+
+	if !ok {
+		return models.Mandate{}, models.ConstructApiError(400, MESSAGE_BAD_ID, "AddOrUpdateMandate", "card", md.CardId)
+	}
+
+	if apiErr := checkCardUsable(c, mandateStatuses, "AddOrUpdateMandate"); apiErr != nil {
+		return models.Mandate{}, apiErr
+	}
+
+	md, apiErr := checkNewMandate(md, v, now)
+
+	if apiErr != nil {
+		return models.Mandate{}, apiErr
+	}
+
+	md.Id = m.nextMandateId
+	md.Ts = memoryTs()
+	md.Runs = nil
+	m.nextMandateId++
+
+	m.mandates[md.Id] = md
+
+	return md, nil
+}
+
+// SetMandateStatus suspends, resumes or cancels a mandate, returning it
+func (m *memGate) SetMandateStatus(ctx context.Context, id int, status string) (models.Mandate, models.ApiError) {
+
+	m.mutex.Lock()
+
+	md, ok := m.mandates[id]
+
+	if !ok {
+		m.mutex.Unlock()
+		return models.Mandate{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "SetMandateStatus", "mandate", id)
+	}
+
+	if apiErr := checkMandateTransition(md, status); apiErr != nil {
+		m.mutex.Unlock()
+		return md, apiErr
+	}
+
+	next, apiErr := changedMandateState(md, status, clock())
+
+	if apiErr != nil {
+		m.mutex.Unlock()
+		return md, apiErr
+	}
+
+	m.mandates[id] = next
+
+	m.mutex.Unlock()
+
+	return m.GetMandate(ctx, id)
+}
+
+// RunMandates charges each active mandate whose period has started, or whose retry is due, through Authorise and
+// Capture, and reports the runs. The lock is not held while a mandate is charged, as Authorise and Capture take it
+func (m *memGate) RunMandates(ctx context.Context) (models.MandateReport, models.ApiError) {
+	return runMandates(ctx, m)
+}
+
+func (m *memGate) dueMandates(ctx context.Context, now time.Time) ([]models.Mandate, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var due []models.Mandate
+
+	for id := MEMORY_FIRST_MANDATE_ID; id < m.nextMandateId; id++ {
+
+		md := m.mandates[id]
+
+		attemptAt := md.NextRunAt
+
+		if md.RetryAt != "" {
+			attemptAt = md.RetryAt
+		}
+
+		if md.Status == MANDATE_STATUS_ACTIVE && attemptAt <= datetime(now) {
+			due = append(due, md)
+		}
+	}
+
+	return due, nil
+}
+
+// The run is recorded even if the mandate has been changed since it was read, such as by being cancelled, as the
+// payment has been taken, but the change is kept
+func (m *memGate) recordMandateRun(ctx context.Context, md, next models.Mandate, run models.MandateRun) (models.MandateRun, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	run.Id = m.nextMandateRunId
+	run.Ts = memoryTs()
+	m.nextMandateRunId++
+
+	m.mandateRuns = append(m.mandateRuns, run)
+
+	current := m.mandates[md.Id]
+
+	// equivalent of QUERY_UPDATE_MANDATE_STATE, which keeps any change to the amount, description or end date
+	if current.Status == md.Status && current.NextRunAt == md.NextRunAt && current.Failures == md.Failures {
+		current.Status = next.Status
+		current.NextRunAt = next.NextRunAt
+		current.RetryAt = next.RetryAt
+		current.Failures = next.Failures
+		m.mandates[md.Id] = current
+	}
+
+	return run, nil
+}
@@ -0,0 +1,656 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestNextPeriod(t *testing.T) {
+
+	period := func(runAt, frequency string, anchorDay int) string {
+
+		next, err := nextPeriod(runAt, frequency, anchorDay)
+
+		utils.AssertNoError(t, "Calling nextPeriod for "+runAt, err)
+
+		return next
+	}
+
+	utils.AssertEquals(t, "Next DAILY period", "2019-01-25 01:00:10", period("2019-01-24 01:00:10", MANDATE_FREQUENCY_DAILY, 24))
+	utils.AssertEquals(t, "Next WEEKLY period", "2019-01-31 01:00:10", period("2019-01-24 01:00:10", MANDATE_FREQUENCY_WEEKLY, 24))
+	utils.AssertEquals(t, "Next MONTHLY period", "2019-02-24 01:00:10", period("2019-01-24 01:00:10", MANDATE_FREQUENCY_MONTHLY, 24))
+	utils.AssertEquals(t, "Next MONTHLY period over a year end", "2020-01-15 00:00:00", period("2019-12-15 00:00:00", MANDATE_FREQUENCY_MONTHLY, 15))
+	utils.AssertEquals(t, "Next MONTHLY period without an anchor day", "2019-02-24 01:00:10", period("2019-01-24 01:00:10", MANDATE_FREQUENCY_MONTHLY, 0))
+
+	periods := []string{"2019-01-31 09:30:00"}
+
+	for i := 0; i < 3; i++ {
+		periods = append(periods, period(periods[i], MANDATE_FREQUENCY_MONTHLY, 31))
+	}
+
+	utils.AssertEquals(t, "MONTHLY periods anchored on the 31st",
+		utils.JsonStringify([]string{"2019-01-31 09:30:00", "2019-02-28 09:30:00", "2019-03-31 09:30:00", "2019-04-30 09:30:00"}),
+		utils.JsonStringify(periods))
+
+	utils.AssertEquals(t, "Next MONTHLY period anchored on the 30th in a leap year", "2020-02-29 00:00:00", period("2020-01-30 00:00:00", MANDATE_FREQUENCY_MONTHLY, 30))
+
+	_, err := nextPeriod("2019-01-24", MANDATE_FREQUENCY_MONTHLY, 24)
+
+	utils.AssertTrue(t, "Next period of a value which is not a DATETIME is an error", err != nil)
+}
+
+func TestNextMandateState(t *testing.T) {
+
+	m := models.Mandate{Frequency: MANDATE_FREQUENCY_MONTHLY, NextRunAt: datetime(testNow), Status: MANDATE_STATUS_ACTIVE}
+
+	succeeded := models.MandateRun{Status: MANDATE_RUN_SUCCEEDED}
+	failed := models.MandateRun{Status: MANDATE_RUN_FAILED}
+
+	state := func(m models.Mandate, run models.MandateRun, retry bool) models.Mandate {
+
+		next, apiErr := nextMandateState(m, run, retry, testNow)
+
+		utils.AssertNoError(t, "Calling nextMandateState", apiErr)
+
+		return next
+	}
+
+	next := state(m, failed, true)
+
+	utils.AssertEquals(t, "Failures after a refusal for insufficient funds", 1, next.Failures)
+	utils.AssertEquals(t, "NextRunAt after a refusal for insufficient funds", m.NextRunAt, next.NextRunAt)
+	utils.AssertEquals(t, "RetryAt after a refusal for insufficient funds", datetime(testNow.Add(MANDATE_RETRY_BACKOFF)), next.RetryAt)
+
+	next = state(next, failed, true)
+
+	utils.AssertEquals(t, "RetryAt after a second refusal, backed off", datetime(testNow.Add(2*MANDATE_RETRY_BACKOFF)), next.RetryAt)
+
+	next = state(next, failed, true)
+
+	utils.AssertEquals(t, "Status after MANDATE_MAX_FAILURES refusals", MANDATE_STATUS_SUSPENDED, next.Status)
+	utils.AssertEquals(t, "RetryAt of a suspended mandate", "", next.RetryAt)
+
+	next = state(m, failed, false)
+
+	utils.AssertEquals(t, "Failures after another refusal", 1, next.Failures)
+	utils.AssertEquals(t, "NextRunAt after another refusal, which skips the period", "2019-02-24 01:00:10", next.NextRunAt)
+	utils.AssertEquals(t, "RetryAt after another refusal", "", next.RetryAt)
+
+	next = state(next, succeeded, false)
+
+	utils.AssertEquals(t, "Failures after a success", 0, next.Failures)
+	utils.AssertEquals(t, "NextRunAt after a success", "2019-03-24 01:00:10", next.NextRunAt)
+	utils.AssertEquals(t, "Status after a success", MANDATE_STATUS_ACTIVE, next.Status)
+
+	m.EndDate = "2019-02-23"
+	next = state(m, succeeded, false)
+
+	utils.AssertEquals(t, "Status after a success when the next period starts after the end date", MANDATE_STATUS_ENDED, next.Status)
+
+	m.EndDate = "2019-02-24"
+	next = state(m, succeeded, false)
+
+	utils.AssertEquals(t, "Status after a success when the next period starts on the end date", MANDATE_STATUS_ACTIVE, next.Status)
+
+	m.NextRunAt = "2019-01-24"
+	_, apiErr := nextMandateState(m, succeeded, false, testNow)
+
+	utils.AssertEquals(t, "Status code of advancing a mandate whose nextRunAt is not a DATETIME", 500, apiErr.StatusCode())
+}
+
+func TestChangedMandateState(t *testing.T) {
+
+	m := models.Mandate{
+		Frequency: MANDATE_FREQUENCY_WEEKLY,
+		NextRunAt: datetime(testNow),
+		RetryAt:   datetime(testNow.Add(MANDATE_RETRY_BACKOFF)),
+		Failures:  MANDATE_MAX_FAILURES,
+		Status:    MANDATE_STATUS_SUSPENDED,
+	}
+
+	state := func(m models.Mandate, status string, now time.Time) models.Mandate {
+
+		next, apiErr := changedMandateState(m, status, now)
+
+		utils.AssertNoError(t, "Calling changedMandateState", apiErr)
+
+		return next
+	}
+
+	next := state(m, MANDATE_STATUS_ACTIVE, testNow.Add(time.Hour))
+
+	utils.AssertEquals(t, "NextRunAt of a mandate resumed within its period", m.NextRunAt, next.NextRunAt)
+	utils.AssertEquals(t, "Failures of a resumed mandate", 0, next.Failures)
+	utils.AssertEquals(t, "RetryAt of a resumed mandate", "", next.RetryAt)
+
+	next = state(m, MANDATE_STATUS_ACTIVE, testNow.AddDate(0, 0, 22))
+
+	utils.AssertEquals(t, "NextRunAt of a mandate resumed after three periods, charged for the latest", "2019-02-14 01:00:10", next.NextRunAt)
+	utils.AssertEquals(t, "Status of a mandate resumed within its end date", MANDATE_STATUS_ACTIVE, next.Status)
+
+	m.EndDate = "2019-02-10"
+	next = state(m, MANDATE_STATUS_ACTIVE, testNow.AddDate(0, 0, 22))
+
+	utils.AssertEquals(t, "Status of a mandate resumed after its end date", MANDATE_STATUS_ENDED, next.Status)
+
+	next = state(m, MANDATE_STATUS_CANCELLED, testNow.AddDate(0, 0, 22))
+
+	utils.AssertEquals(t, "Status of a cancelled mandate", MANDATE_STATUS_CANCELLED, next.Status)
+	utils.AssertEquals(t, "NextRunAt of a cancelled mandate", m.NextRunAt, next.NextRunAt)
+
+	m.NextRunAt = "2019-01-24"
+	_, apiErr := changedMandateState(m, MANDATE_STATUS_ACTIVE, testNow.AddDate(0, 0, 22))
+
+	utils.AssertEquals(t, "Status code of resuming a mandate whose nextRunAt is not a DATETIME", 500, apiErr.StatusCode())
+}
+
+func TestCheckMandateTransition(t *testing.T) {
+
+	for _, tc := range []struct {
+		from, to string
+		status   int
+	}{
+		{MANDATE_STATUS_ACTIVE, MANDATE_STATUS_SUSPENDED, 0},
+		{MANDATE_STATUS_ACTIVE, MANDATE_STATUS_CANCELLED, 0},
+		{MANDATE_STATUS_SUSPENDED, MANDATE_STATUS_ACTIVE, 0},
+		{MANDATE_STATUS_ACTIVE, MANDATE_STATUS_ACTIVE, 409},
+		{MANDATE_STATUS_ACTIVE, MANDATE_STATUS_ENDED, 409},
+		{MANDATE_STATUS_CANCELLED, MANDATE_STATUS_ACTIVE, 409},
+		{MANDATE_STATUS_ENDED, MANDATE_STATUS_ACTIVE, 409},
+		{MANDATE_STATUS_ACTIVE, "PAUSED", 400},
+	} {
+		apiErr := checkMandateTransition(models.Mandate{Status: tc.from}, tc.to)
+		context := fmt.Sprintf("Calling checkMandateTransition from %v to %v", tc.from, tc.to)
+
+		if tc.status == 0 {
+			utils.AssertNoError(t, context, apiErr)
+		} else {
+			utils.AssertEquals(t, "Return status for "+context, tc.status, apiErr.StatusCode())
+		}
+	}
+}
+
+// Adds a monthly mandate, checking its validation, then runs the scheduler as time passes: charging it, retrying it
+// with a backoff while the card has insufficient funds until it is suspended, resuming it and ending it. Then checks
+// that a cancelled mandate is not charged, and that an authorisation held for review is reversed and its period skipped
+func testMandates(t *testing.T, dbi Dbi, c models.Card, v models.Vendor) {
+
+	defer fixClock(testNow)()
+
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		mandate models.Mandate
+		status  int
+		message string
+	}{
+		{models.Mandate{CardId: c.Id, VendorId: v.Id, Amount: 400, Frequency: "YEARLY"}, 400,
+			fmt.Sprintf(MESSAGE_BAD_MANDATE_FREQUENCY, "AddOrUpdateMandate", "YEARLY")},
+		{models.Mandate{CardId: c.Id, VendorId: v.Id, Frequency: MANDATE_FREQUENCY_MONTHLY}, 400,
+			fmt.Sprintf(MESSAGE_BAD_MANDATE_AMOUNT, "AddOrUpdateMandate")},
+		{models.Mandate{CardId: c.Id, VendorId: v.Id, Amount: 400, MaxAmount: 300, Frequency: MANDATE_FREQUENCY_MONTHLY}, 400,
+			fmt.Sprintf(MESSAGE_MANDATE_OVER_CEILING, "AddOrUpdateMandate", 400, 300)},
+		{models.Mandate{CardId: c.Id, VendorId: v.Id, Amount: 400, Frequency: MANDATE_FREQUENCY_MONTHLY, EndDate: "31/03/2019"}, 400,
+			fmt.Sprintf(MESSAGE_BAD_MANDATE_END_DATE, "AddOrUpdateMandate", "31/03/2019")},
+		{models.Mandate{CardId: c.Id, VendorId: v.Id, Amount: 400, Frequency: MANDATE_FREQUENCY_MONTHLY, EndDate: "2019-01-23"}, 400,
+			fmt.Sprintf(MESSAGE_MANDATE_END_DATE_PAST, "AddOrUpdateMandate", "2019-01-23")},
+		{models.Mandate{CardId: 9999, VendorId: v.Id, Amount: 400, Frequency: MANDATE_FREQUENCY_MONTHLY}, 400,
+			fmt.Sprintf(MESSAGE_BAD_ID, "AddOrUpdateMandate", "card", 9999)},
+		{models.Mandate{CardId: c.Id, VendorId: 9999, Amount: 400, Frequency: MANDATE_FREQUENCY_MONTHLY}, 400,
+			fmt.Sprintf(MESSAGE_BAD_ID, "AddOrUpdateMandate", "vendor", 9999)},
+		{models.Mandate{CardId: c.Id, VendorId: v.Id, Amount: 400, Currency: "USD", Frequency: MANDATE_FREQUENCY_MONTHLY}, 400,
+			fmt.Sprintf(MESSAGE_CURRENCY_MISMATCH, "AddOrUpdateMandate", "USD", "vendor", v.Id, v.Currency)},
+	} {
+		_, apiErr := dbi.AddOrUpdateMandate(ctx, tc.mandate)
+
+		utils.AssertEquals(t, "Return status for calling AddOrUpdateMandate with "+tc.message, tc.status, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling AddOrUpdateMandate", tc.message, apiErr.Error())
+	}
+
+	m, apiErr := dbi.AddOrUpdateMandate(ctx, models.Mandate{CardId: c.Id, VendorId: v.Id, Amount: 400, MaxAmount: 500,
+		Frequency: MANDATE_FREQUENCY_MONTHLY, EndDate: "2019-03-31"})
+
+	utils.AssertNoError(t, "Calling AddOrUpdateMandate", apiErr)
+	utils.AssertTrue(t, "Id of a new mandate is set", m.Id > 0)
+	utils.AssertEquals(t, "Currency of a new mandate, that of its vendor", v.Currency, m.Currency)
+	utils.AssertEquals(t, "Description of a new mandate", "Recurring payment to Coffee Shop", m.Description)
+	utils.AssertEquals(t, "NextRunAt of a new mandate", datetime(testNow), m.NextRunAt)
+	utils.AssertEquals(t, "AnchorDay of a new mandate", 24, m.AnchorDay)
+	utils.AssertEquals(t, "Status of a new mandate", MANDATE_STATUS_ACTIVE, m.Status)
+
+	_, apiErr = dbi.GetMandate(ctx, 9999)
+	utils.AssertEquals(t, "Return status for calling GetMandate with an invalid id", 404, apiErr.StatusCode())
+
+	report, apiErr := dbi.RunMandates(ctx)
+
+	utils.AssertNoError(t, "Calling RunMandates", apiErr)
+	utils.AssertEquals(t, "Succeeded for the first run", 1, report.Succeeded)
+	utils.AssertEquals(t, "Runs for the first run", 1, len(report.Runs))
+	utils.AssertEquals(t, "Status of the first run", MANDATE_RUN_SUCCEEDED, report.Runs[0].Status)
+	utils.AssertEquals(t, "Currency of the first run", "GBP", report.Runs[0].Currency)
+
+	a, apiErr := dbi.GetAuthorisation(ctx, report.Runs[0].AuthorisationId)
+
+	utils.AssertNoError(t, "Calling GetAuthorisation for the first run", apiErr)
+	utils.AssertEquals(t, "Captured by the first run", 400, a.Captured)
+	utils.AssertEquals(t, "Description of the authorisation of the first run", m.Description, a.Description)
+
+	card, _ := dbi.GetCard(ctx, c.Id)
+	utils.AssertEquals(t, "Available after the first run", 600, card.Available)
+
+	report, apiErr = dbi.RunMandates(ctx)
+
+	utils.AssertNoError(t, "Calling RunMandates again within the period", apiErr)
+	utils.AssertEquals(t, "Report of a run with nothing due", `{"failed":0,"runs":[],"succeeded":0,"suspended":0}`, utils.JsonStringify(report))
+
+	_, apiErr = dbi.AddOrUpdateMandate(ctx, models.Mandate{Id: m.Id, Amount: 700})
+
+	utils.AssertEquals(t, "Return status for calling AddOrUpdateMandate over the ceiling", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling AddOrUpdateMandate over the ceiling",
+		fmt.Sprintf(MESSAGE_MANDATE_OVER_CEILING, "AddOrUpdateMandate", 700, 500), apiErr.Error())
+
+	_, apiErr = dbi.AddOrUpdateMandate(ctx, models.Mandate{Id: 9999, Amount: 500})
+	utils.AssertEquals(t, "Return status for calling AddOrUpdateMandate with an invalid id", 404, apiErr.StatusCode())
+
+	m, apiErr = dbi.AddOrUpdateMandate(ctx, models.Mandate{Id: m.Id, Amount: 500, EndDate: "2019-03-31"})
+
+	utils.AssertNoError(t, "Calling AddOrUpdateMandate with an id", apiErr)
+	utils.AssertEquals(t, "Amount of an updated mandate", 500, m.Amount)
+	utils.AssertEquals(t, "Description of an updated mandate, kept when not given", "Recurring payment to Coffee Shop", m.Description)
+	utils.AssertEquals(t, "NextRunAt of an updated mandate", "2019-02-24 01:00:10", m.NextRunAt)
+	utils.AssertEquals(t, "AnchorDay of an updated mandate, the day it was added", 24, m.AnchorDay)
+
+	now := testNow.AddDate(0, 1, 0)
+	fixClock(now)
+
+	report, apiErr = dbi.RunMandates(ctx)
+
+	utils.AssertNoError(t, "Calling RunMandates in the second period", apiErr)
+	utils.AssertEquals(t, "Succeeded in the second period", 1, report.Succeeded)
+
+	card, _ = dbi.GetCard(ctx, c.Id)
+	utils.AssertEquals(t, "Available after the second period", 100, card.Available)
+
+	now = testNow.AddDate(0, 2, 0)
+	fixClock(now)
+
+	for i, wait := range []time.Duration{0, MANDATE_RETRY_BACKOFF, 2 * MANDATE_RETRY_BACKOFF} {
+
+		now = now.Add(wait)
+		fixClock(now)
+
+		report, apiErr = dbi.RunMandates(ctx)
+
+		utils.AssertNoError(t, fmt.Sprintf("Calling RunMandates for attempt %v with insufficient funds", i+1), apiErr)
+		utils.AssertEquals(t, fmt.Sprintf("Failed for attempt %v", i+1), 1, report.Failed)
+		utils.AssertEquals(t, fmt.Sprintf("Reason for attempt %v", i+1),
+			fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE, "Authorise", models.Money{Amount: 500, Currency: card.Currency}, models.Money{Amount: 100, Currency: card.Currency}),
+			report.Runs[0].Reason)
+		utils.AssertEquals(t, fmt.Sprintf("AuthorisationId for attempt %v", i+1), 0, report.Runs[0].AuthorisationId)
+
+		m, _ = dbi.GetMandate(ctx, m.Id)
+
+		utils.AssertEquals(t, fmt.Sprintf("Failures after attempt %v", i+1), i+1, m.Failures)
+		utils.AssertEquals(t, fmt.Sprintf("NextRunAt after attempt %v", i+1), "2019-03-24 01:00:10", m.NextRunAt)
+
+		if i+1 < MANDATE_MAX_FAILURES {
+
+			utils.AssertEquals(t, fmt.Sprintf("RetryAt after attempt %v", i+1), datetime(now.Add(mandateBackoff(i+1))), m.RetryAt)
+
+			report, apiErr = dbi.RunMandates(ctx)
+
+			utils.AssertNoError(t, fmt.Sprintf("Calling RunMandates before the retry of attempt %v", i+1), apiErr)
+			utils.AssertEquals(t, fmt.Sprintf("Runs before the retry of attempt %v", i+1), 0, len(report.Runs))
+		}
+	}
+
+	utils.AssertEquals(t, "Suspended after the last attempt", 1, report.Suspended)
+	utils.AssertEquals(t, "Status after the last attempt", MANDATE_STATUS_SUSPENDED, m.Status)
+
+	now = now.Add(time.Hour)
+	fixClock(now)
+
+	report, _ = dbi.RunMandates(ctx)
+	utils.AssertEquals(t, "Runs of a suspended mandate", 0, len(report.Runs))
+
+	_, apiErr = dbi.SetMandateStatus(ctx, m.Id, "PAUSED")
+
+	utils.AssertEquals(t, "Return status for calling SetMandateStatus with a bad status", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling SetMandateStatus with a bad status",
+		fmt.Sprintf(MESSAGE_BAD_MANDATE_STATUS, "SetMandateStatus", "PAUSED"), apiErr.Error())
+
+	_, apiErr = dbi.SetMandateStatus(ctx, m.Id, MANDATE_STATUS_ENDED)
+	utils.AssertEquals(t, "Return status for calling SetMandateStatus to end a mandate", 409, apiErr.StatusCode())
+
+	_, apiErr = dbi.SetMandateStatus(ctx, 9999, MANDATE_STATUS_ACTIVE)
+	utils.AssertEquals(t, "Return status for calling SetMandateStatus with an invalid id", 404, apiErr.StatusCode())
+
+	_, apiErr = dbi.TopUp(ctx, c.Id, 1000, "", "Transfer from Bank")
+	utils.AssertNoError(t, "Calling TopUp", apiErr)
+
+	m, apiErr = dbi.SetMandateStatus(ctx, m.Id, MANDATE_STATUS_ACTIVE)
+
+	utils.AssertNoError(t, "Calling SetMandateStatus to resume a mandate", apiErr)
+	utils.AssertEquals(t, "Status of a resumed mandate", MANDATE_STATUS_ACTIVE, m.Status)
+	utils.AssertEquals(t, "Failures of a resumed mandate", 0, m.Failures)
+	utils.AssertEquals(t, "Runs of a resumed mandate", 5, len(m.Runs))
+
+	report, apiErr = dbi.RunMandates(ctx)
+
+	utils.AssertNoError(t, "Calling RunMandates after resuming", apiErr)
+	utils.AssertEquals(t, "Succeeded after resuming", 1, report.Succeeded)
+
+	m, _ = dbi.GetMandate(ctx, m.Id)
+
+	utils.AssertEquals(t, "Status of a mandate whose next period starts after its end date", MANDATE_STATUS_ENDED, m.Status)
+	utils.AssertEquals(t, "Statuses of the runs of a mandate", fmt.Sprintf(`["%v","%v","%v","%v","%v","%v"]`,
+		MANDATE_RUN_SUCCEEDED, MANDATE_RUN_SUCCEEDED, MANDATE_RUN_FAILED, MANDATE_RUN_FAILED, MANDATE_RUN_FAILED, MANDATE_RUN_SUCCEEDED),
+		utils.JsonStringify(runStatuses(m.Runs)))
+	utils.AssertEquals(t, "Currency of a stored run of a mandate", m.Currency, m.Runs[0].Currency)
+
+	_, apiErr = dbi.SetMandateStatus(ctx, m.Id, MANDATE_STATUS_ACTIVE)
+	utils.AssertEquals(t, "Return status for calling SetMandateStatus on an ended mandate", 409, apiErr.StatusCode())
+
+	_, apiErr = dbi.AddOrUpdateMandate(ctx, models.Mandate{Id: m.Id, Amount: 100})
+	utils.AssertEquals(t, "Return status for calling AddOrUpdateMandate on an ended mandate", 409, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling AddOrUpdateMandate on an ended mandate",
+		fmt.Sprintf(MESSAGE_MANDATE_CLOSED, "AddOrUpdateMandate", m.Id, MANDATE_STATUS_ENDED), apiErr.Error())
+
+	cancelled, apiErr := dbi.AddOrUpdateMandate(ctx, models.Mandate{CardId: c.Id, VendorId: v.Id, Amount: 100, Frequency: MANDATE_FREQUENCY_DAILY})
+	utils.AssertNoError(t, "Calling AddOrUpdateMandate for a mandate to cancel", apiErr)
+
+	cancelled, apiErr = dbi.SetMandateStatus(ctx, cancelled.Id, MANDATE_STATUS_CANCELLED)
+
+	utils.AssertNoError(t, "Calling SetMandateStatus to cancel a mandate", apiErr)
+	utils.AssertEquals(t, "Status of a cancelled mandate", MANDATE_STATUS_CANCELLED, cancelled.Status)
+
+	report, _ = dbi.RunMandates(ctx)
+	utils.AssertEquals(t, "Runs of a cancelled mandate", 0, len(report.Runs))
+
+	gym, apiErr := dbi.AddOrUpdateVendor(ctx, models.Vendor{VendorName: "Gym"})
+	utils.AssertNoError(t, "Calling AddOrUpdateVendor", apiErr)
+
+	_, apiErr = dbi.TopUp(ctx, c.Id, 30000, "", "Transfer from Bank")
+	utils.AssertNoError(t, "Calling TopUp", apiErr)
+
+	card, _ = dbi.GetCard(ctx, c.Id)
+
+	reviewed, apiErr := dbi.AddOrUpdateMandate(ctx, models.Mandate{CardId: c.Id, VendorId: gym.Id, Amount: 30000, Frequency: MANDATE_FREQUENCY_MONTHLY})
+	utils.AssertNoError(t, "Calling AddOrUpdateMandate for a payment held for review", apiErr)
+
+	report, apiErr = dbi.RunMandates(ctx)
+
+	utils.AssertNoError(t, "Calling RunMandates for a payment held for review", apiErr)
+	utils.AssertEquals(t, "Failed for a payment held for review", 1, report.Failed)
+	utils.AssertTrue(t, "AuthorisationId for a payment held for review is set", report.Runs[0].AuthorisationId > 0)
+
+	a, _ = dbi.GetAuthorisation(ctx, report.Runs[0].AuthorisationId)
+	utils.AssertEquals(t, "Capturable of a payment held for review, reversed", 0, a.Capturable())
+
+	after, _ := dbi.GetCard(ctx, c.Id)
+	utils.AssertEquals(t, "Available after a payment held for review is reversed", card.Available, after.Available)
+
+	reviewed, _ = dbi.GetMandate(ctx, reviewed.Id)
+
+	utils.AssertEquals(t, "Failures after a payment held for review", 1, reviewed.Failures)
+	utils.AssertEquals(t, "NextRunAt after a payment held for review, which skips the period", datetime(now.AddDate(0, 1, 0)), reviewed.NextRunAt)
+	utils.AssertEquals(t, "RetryAt after a payment held for review", "", reviewed.RetryAt)
+}
+
+func runStatuses(runs []models.MandateRun) []string {
+
+	statuses := []string{}
+
+	for _, r := range runs {
+		statuses = append(statuses, r.Status)
+	}
+
+	return statuses
+}
+
+// A mandateStore whose idempotency keys cannot be completed
+type failingCompleteStore struct {
+	mandateStore
+}
+
+func (s failingCompleteStore) CompleteIdempotencyKey(ctx context.Context, key string, responseId int) models.ApiError {
+	return models.ConstructApiError(500, "CompleteIdempotencyKey: connection lost")
+}
+
+// Runs a mandate whose idempotency key cannot be completed after its authorisation, which is captured all the same,
+// and checks that the mandate moves on to its next period rather than being skipped as in progress
+func testMandateCompleteFails(t *testing.T, dbi Dbi, c models.Card, v models.Vendor) {
+
+	defer fixClock(testNow)()
+
+	ctx := context.Background()
+
+	m, apiErr := dbi.AddOrUpdateMandate(ctx, models.Mandate{CardId: c.Id, VendorId: v.Id, Amount: 400, Frequency: MANDATE_FREQUENCY_MONTHLY})
+
+	utils.AssertNoError(t, "Calling AddOrUpdateMandate", apiErr)
+
+	report, apiErr := runMandates(ctx, failingCompleteStore{dbi.(mandateStore)})
+
+	utils.AssertNoError(t, "Calling runMandates when completing the key fails", apiErr)
+	utils.AssertEquals(t, "Statuses of the runs when completing the key fails", utils.JsonStringify([]string{MANDATE_RUN_SUCCEEDED}),
+		utils.JsonStringify(runStatuses(report.Runs)))
+
+	a, apiErr := dbi.GetAuthorisation(ctx, report.Runs[0].AuthorisationId)
+
+	utils.AssertNoError(t, "Calling GetAuthorisation for the run", apiErr)
+	utils.AssertEquals(t, "Captured by the run when completing the key fails", 400, a.Captured)
+	utils.AssertEquals(t, "Capturable after the run when completing the key fails", 0, a.Capturable())
+
+	m, _ = dbi.GetMandate(ctx, m.Id)
+
+	utils.AssertEquals(t, "NextRunAt after the run when completing the key fails", datetime(testNow.AddDate(0, 1, 0)), m.NextRunAt)
+
+	card, _ := dbi.GetCard(ctx, c.Id)
+	utils.AssertEquals(t, "Available after the run when completing the key fails", 600, card.Available)
+}
+
+// A mandateStore whose mandates are updated while they are being run, just before each run is recorded
+type changingStore struct {
+	mandateStore
+	update models.Mandate
+}
+
+func (s changingStore) recordMandateRun(ctx context.Context, m, next models.Mandate, run models.MandateRun) (models.MandateRun, models.ApiError) {
+
+	update := s.update
+	update.Id = m.Id
+
+	_, apiErr := s.AddOrUpdateMandate(ctx, update)
+
+	if apiErr != nil {
+		return run, apiErr
+	}
+
+	return s.mandateStore.recordMandateRun(ctx, m, next, run)
+}
+
+// Runs a mandate whose amount and description are changed during the run, and checks that the change is kept as the
+// mandate moves on to its next period
+func testMandateChangedDuringRun(t *testing.T, dbi Dbi, c models.Card, v models.Vendor) {
+
+	defer fixClock(testNow)()
+
+	ctx := context.Background()
+
+	m, apiErr := dbi.AddOrUpdateMandate(ctx, models.Mandate{CardId: c.Id, VendorId: v.Id, Amount: 400, MaxAmount: 500, Frequency: MANDATE_FREQUENCY_MONTHLY})
+
+	utils.AssertNoError(t, "Calling AddOrUpdateMandate", apiErr)
+
+	report, apiErr := runMandates(ctx, changingStore{dbi.(mandateStore), models.Mandate{Amount: 500, Description: "Gym membership"}})
+
+	utils.AssertNoError(t, "Calling runMandates while the mandate changes", apiErr)
+	utils.AssertEquals(t, "Statuses of the runs while the mandate changes", utils.JsonStringify([]string{MANDATE_RUN_SUCCEEDED}),
+		utils.JsonStringify(runStatuses(report.Runs)))
+	utils.AssertEquals(t, "Amount of the run made before the change", 400, report.Runs[0].Amount)
+
+	m, _ = dbi.GetMandate(ctx, m.Id)
+
+	utils.AssertEquals(t, "Amount changed during the run", 500, m.Amount)
+	utils.AssertEquals(t, "Description changed during the run", "Gym membership", m.Description)
+	utils.AssertEquals(t, "NextRunAt after the run", datetime(testNow.AddDate(0, 1, 0)), m.NextRunAt)
+}
+
+// Closes a card with mandates, which are ended unless already closed, and checks that no mandate can be added to it
+func testMandateClosedCard(t *testing.T, dbi Dbi, c models.Card, v models.Vendor) {
+
+	defer fixClock(testNow)()
+
+	ctx := context.Background()
+
+	ids := []int{}
+
+	for i := 0; i < 3; i++ {
+
+		m, apiErr := dbi.AddOrUpdateMandate(ctx, models.Mandate{CardId: c.Id, VendorId: v.Id, Amount: 400, Frequency: MANDATE_FREQUENCY_MONTHLY})
+
+		utils.AssertNoError(t, "Calling AddOrUpdateMandate", apiErr)
+
+		ids = append(ids, m.Id)
+	}
+
+	_, apiErr := dbi.SetMandateStatus(ctx, ids[1], MANDATE_STATUS_SUSPENDED)
+
+	utils.AssertNoError(t, "Calling SetMandateStatus to suspend", apiErr)
+
+	_, apiErr = dbi.SetMandateStatus(ctx, ids[2], MANDATE_STATUS_CANCELLED)
+
+	utils.AssertNoError(t, "Calling SetMandateStatus to cancel", apiErr)
+
+	_, apiErr = dbi.SetCardStatus(ctx, c.Id, CARD_STATUS_CLOSED, "")
+
+	utils.AssertNoError(t, "Calling SetCardStatus to close", apiErr)
+
+	statuses := []string{}
+
+	for _, id := range ids {
+
+		m, apiErr := dbi.GetMandate(ctx, id)
+
+		utils.AssertNoError(t, "Calling GetMandate", apiErr)
+
+		statuses = append(statuses, m.Status)
+	}
+
+	utils.AssertEquals(t, "Statuses of the mandates of a closed card",
+		utils.JsonStringify([]string{MANDATE_STATUS_ENDED, MANDATE_STATUS_ENDED, MANDATE_STATUS_CANCELLED}), utils.JsonStringify(statuses))
+
+	report, apiErr := dbi.RunMandates(ctx)
+
+	utils.AssertNoError(t, "Calling RunMandates after closing the card", apiErr)
+	utils.AssertEquals(t, "Runs after closing the card", 0, len(report.Runs))
+
+	_, apiErr = dbi.AddOrUpdateMandate(ctx, models.Mandate{CardId: c.Id, VendorId: v.Id, Amount: 400, Frequency: MANDATE_FREQUENCY_MONTHLY})
+
+	utils.AssertEquals(t, "Return status for adding a mandate to a closed card", 403, apiErr.StatusCode())
+
+	_, apiErr = dbi.AddOrUpdateMandate(ctx, models.Mandate{Id: ids[0], Amount: 300})
+
+	utils.AssertEquals(t, "Return status for updating a mandate of a closed card", 409, apiErr.StatusCode())
+}
+
+// Runs a mandate whose idempotency key has been taken by a request for another customer's authorisation, first under
+// a fingerprint of its own and then under the key itself, and checks that the run fails without capturing it
+func testMandateForeignKey(t *testing.T, dbi Dbi, c models.Card, v models.Vendor) {
+
+	defer fixClock(testNow)()
+
+	ctx := context.Background()
+
+	cu, apiErr := dbi.AddOrUpdateCustomer(ctx, models.Customer{Fullname: "Jane Doe"})
+	utils.AssertNoError(t, "Calling AddOrUpdateCustomer", apiErr)
+
+	other, apiErr := dbi.AddCard(ctx, cu.Id, "")
+	utils.AssertNoError(t, "Calling AddCard", apiErr)
+
+	_, apiErr = dbi.TopUp(ctx, other.Id, 1000, "", "Transfer from Bank")
+	utils.AssertNoError(t, "Calling TopUp", apiErr)
+
+	aid, apiErr := dbi.Authorise(ctx, other.Id, v.Id, 300, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	m, apiErr := dbi.AddOrUpdateMandate(ctx, models.Mandate{CardId: c.Id, VendorId: v.Id, Amount: 400, Frequency: MANDATE_FREQUENCY_MONTHLY})
+	utils.AssertNoError(t, "Calling AddOrUpdateMandate", apiErr)
+
+	for i, own := range []bool{false, true} {
+
+		next, _ := time.Parse(DATETIME_FORMAT, m.NextRunAt)
+		fixClock(next)
+
+		key := fmt.Sprintf("%v%v-%v", MANDATE_IDEMPOTENCY_KEY_PREFIX, m.Id, m.NextRunAt)
+		fingerprint := "abc123"
+		reason := fmt.Sprintf(MESSAGE_MANDATE_KEY_MISMATCH, "RunMandates", key, m.Id)
+
+		if own {
+			fingerprint = key
+			reason = fmt.Sprintf(MESSAGE_MANDATE_NOT_ITS_AUTH, "RunMandates", aid, m.Id)
+		}
+
+		_, claimed, apiErr := dbi.ClaimIdempotencyKey(ctx, key, fingerprint)
+
+		utils.AssertNoError(t, "Calling ClaimIdempotencyKey", apiErr)
+		utils.AssertTrue(t, "Claimed for ClaimIdempotencyKey with the key of a mandate", claimed)
+		utils.AssertNoError(t, "Calling CompleteIdempotencyKey", dbi.CompleteIdempotencyKey(ctx, key, aid))
+
+		report, apiErr := dbi.RunMandates(ctx)
+
+		utils.AssertNoError(t, fmt.Sprintf("Calling RunMandates with a key used for another request %v", i+1), apiErr)
+		utils.AssertEquals(t, fmt.Sprintf("Statuses of the runs with a key used for another request %v", i+1),
+			utils.JsonStringify([]string{MANDATE_RUN_FAILED}), utils.JsonStringify(runStatuses(report.Runs)))
+		utils.AssertEquals(t, fmt.Sprintf("Reason of the run with a key used for another request %v", i+1), reason, report.Runs[0].Reason)
+
+		a, _ := dbi.GetAuthorisation(ctx, aid)
+		utils.AssertEquals(t, "Captured of the other customer's authorisation", 0, a.Captured)
+
+		m, _ = dbi.GetMandate(ctx, m.Id)
+	}
+}
+
+func TestMemoryMandates(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 1000)
+	defer dbi.Close()
+
+	testMandates(t, dbi, c, v)
+}
+
+func TestMemoryMandateCompleteFails(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 1000)
+	defer dbi.Close()
+
+	testMandateCompleteFails(t, dbi, c, v)
+}
+
+func TestMemoryMandateChangedDuringRun(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 1000)
+	defer dbi.Close()
+
+	testMandateChangedDuringRun(t, dbi, c, v)
+}
+
+func TestMemoryMandateClosedCard(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 1000)
+	defer dbi.Close()
+
+	testMandateClosedCard(t, dbi, c, v)
+}
+
+func TestMemoryMandateForeignKey(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 1000)
+	defer dbi.Close()
+
+	testMandateForeignKey(t, dbi, c, v)
+}
@@ -0,0 +1,301 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	// The merchant category controls of a card, with a single row of NULLs if it has none
+	QUERY_GET_CARD_MCC_CONTROLS = `SELECT c.id, m.mcc, m.control
+                            FROM cards c
+                            LEFT OUTER JOIN card_mcc_controls m ON (m.card_id = c.id)
+                            WHERE c.id = ?
+                            ORDER BY m.mcc`
+
+	// Controls are replaced whole, deleting then inserting, as limits are
+	QUERY_DELETE_CARD_MCC_CONTROLS = "DELETE FROM card_mcc_controls WHERE card_id = ?"
+	QUERY_ADD_CARD_MCC_CONTROL     = "INSERT INTO card_mcc_controls (card_id, mcc, control) VALUES (?, ?, ?)"
+
+	MCC_CONTROL_ALLOW = "ALLOW"
+	MCC_CONTROL_BLOCK = "BLOCK"
+
+	// An ISO 18245 merchant category code is 4 digits
+	MCC_LENGTH = 4
+
+	MESSAGE_BAD_MCC                 = "%v: mcc %v is not %v digits"
+	MESSAGE_MCC_ALLOWED_AND_BLOCKED = "%v: mcc %v is both allowed and blocked"
+
+	// Each message names the control which refused the authorisation
+	MESSAGE_MCC_BLOCKED     = "%v: card %v blocks merchant category %v"
+	MESSAGE_MCC_NOT_ALLOWED = "%v: card %v does not allow merchant category %v"
+	MESSAGE_MCC_NONE        = "%v: card %v allows only listed merchant categories and vendor %v has none"
+)
+
+// Check that a merchant category code is 4 digits. A vendor need not have one
+func checkMcc(mcc, context string) models.ApiError {
+
+	if mcc == "" {
+		return nil
+	}
+
+	if len(mcc) != MCC_LENGTH {
+		return models.ConstructApiError(400, MESSAGE_BAD_MCC, context, mcc, MCC_LENGTH)
+	}
+
+	for _, r := range mcc {
+		if r < '0' || r > '9' {
+			return models.ConstructApiError(400, MESSAGE_BAD_MCC, context, mcc, MCC_LENGTH)
+		}
+	}
+
+	return nil
+}
+
+// Returns a list of codes sorted without duplicates, checking each is a code
+func normaliseMccs(mccs []string, context string) ([]string, models.ApiError) {
+
+	normal := []string{}
+
+	for _, mcc := range mccs {
+
+		if mcc == "" {
+			return nil, models.ConstructApiError(400, MESSAGE_BAD_MCC, context, mcc, MCC_LENGTH)
+		}
+
+		if apiErr := checkMcc(mcc, context); apiErr != nil {
+			return nil, apiErr
+		}
+
+		if !contains(normal, mcc) {
+			normal = append(normal, mcc)
+		}
+	}
+
+	sort.Strings(normal)
+
+	return normal, nil
+}
+
+// Returns a card's controls with each list normalised, checking that no code is both allowed and blocked
+func normaliseMccControls(controls models.MccControls, context string) (models.MccControls, models.ApiError) {
+
+	allowed, apiErr := normaliseMccs(controls.Allowed, context)
+
+	if apiErr != nil {
+		return models.MccControls{}, apiErr
+	}
+
+	blocked, apiErr := normaliseMccs(controls.Blocked, context)
+
+	if apiErr != nil {
+		return models.MccControls{}, apiErr
+	}
+
+	for _, mcc := range blocked {
+		if contains(allowed, mcc) {
+			return models.MccControls{}, models.ConstructApiError(400, MESSAGE_MCC_ALLOWED_AND_BLOCKED, context, mcc)
+		}
+	}
+
+	return models.MccControls{Allowed: allowed, Blocked: blocked}, nil
+}
+
+// Check that a card's controls permit a payment to a vendor: its code must not be blocked, and if any codes are
+// allowed it must be one of them, so a vendor without a code is refused by a card which allows only some
+func checkMccControls(controls models.MccControls, c models.Card, v models.Vendor) models.ApiError {
+
+	if v.Mcc != "" && contains(controls.Blocked, v.Mcc) {
+		return models.ConstructApiError(LIMIT_EXCEEDED_STATUS, MESSAGE_MCC_BLOCKED, "Authorise", c.Id, v.Mcc)
+	}
+
+	if len(controls.Allowed) == 0 {
+		return nil
+	}
+
+	if v.Mcc == "" {
+		return models.ConstructApiError(LIMIT_EXCEEDED_STATUS, MESSAGE_MCC_NONE, "Authorise", c.Id, v.Id)
+	}
+
+	if !contains(controls.Allowed, v.Mcc) {
+		return models.ConstructApiError(LIMIT_EXCEEDED_STATUS, MESSAGE_MCC_NOT_ALLOWED, "Authorise", c.Id, v.Mcc)
+	}
+
+	return nil
+}
+
+// Read the merchant category controls of a card with QUERY_GET_CARD_MCC_CONTROLS
+func (c *dbConn) getMccControls(ctx context.Context, cardId int, context string) (models.MccControls, models.ApiError) {
+
+	var (
+		found   bool
+		id      int
+		mcc     sql.NullString
+		control sql.NullString
+	)
+
+	controls := models.MccControls{Allowed: []string{}, Blocked: []string{}}
+
+	qry := QUERY_GET_CARD_MCC_CONTROLS
+
+	err := c.prepareQry(ctx, qry)
+
+	if err != nil {
+		return controls, models.ErrorWrap(err)
+	}
+
+	rows, err := c.stmt(qry).QueryContext(ctx, cardId)
+
+	if err != nil {
+		return controls, models.ErrorWrap(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		err = rows.Scan(&id, &mcc, &control)
+
+		if err != nil {
+			return controls, models.ErrorWrap(err)
+		}
+
+		found = true
+
+		switch control.String {
+		case MCC_CONTROL_ALLOW:
+			controls.Allowed = append(controls.Allowed, mcc.String)
+		case MCC_CONTROL_BLOCK:
+			controls.Blocked = append(controls.Blocked, mcc.String)
+		}
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return controls, models.ErrorWrap(err)
+	}
+
+	if !found {
+		return controls, models.ConstructApiError(404, MESSAGE_BAD_ID, context, "card", cardId)
+	}
+
+	return controls, nil
+}
+
+// GetCardMccControls returns the merchant category codes which a card allows and blocks
+func (d *dbGate) GetCardMccControls(ctx context.Context, cardId int) (models.MccControls, models.ApiError) {
+	return d.reader(ctx).getMccControls(ctx, cardId, "GetCardMccControls")
+}
+
+// SetCardMccControls replaces the merchant category codes which a card allows and blocks, returning them
+func (d *dbGate) SetCardMccControls(ctx context.Context, cardId int, controls models.MccControls) (models.MccControls, models.ApiError) {
+
+	controls, apiErr := normaliseMccControls(controls, "SetCardMccControls")
+
+	if apiErr != nil {
+		return models.MccControls{}, apiErr
+	}
+
+	// check that the card exists, as a foreign key violation is not reported alike by every database
+	_, apiErr = d.getMccControls(ctx, cardId, "SetCardMccControls")
+
+	if apiErr != nil {
+		return models.MccControls{}, apiErr
+	}
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
+
+	if err != nil {
+		return models.MccControls{}, models.ErrorWrap(err)
+	}
+
+	defer tx.Rollback()
+
+	deleteQry, addQry := QUERY_DELETE_CARD_MCC_CONTROLS, QUERY_ADD_CARD_MCC_CONTROL
+
+	for _, qry := range []string{deleteQry, addQry} {
+
+		err = d.prepareQry(ctx, qry)
+
+		if err != nil {
+			return models.MccControls{}, models.ErrorWrap(err)
+		}
+	}
+
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(deleteQry)), deleteQry, cardId)
+
+	if res.apiErr != nil {
+		return models.MccControls{}, res.apiErr
+	}
+
+	add := tx.StmtContext(ctx, d.stmt(addQry))
+
+	for _, l := range []struct {
+		control string
+		mccs    []string
+	}{
+		{MCC_CONTROL_ALLOW, controls.Allowed},
+		{MCC_CONTROL_BLOCK, controls.Blocked},
+	} {
+		for _, mcc := range l.mccs {
+
+			res = d.exec(ctx, add, addQry, cardId, mcc, l.control)
+
+			if res.apiErr != nil {
+				return models.MccControls{}, res.apiErr
+			}
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return models.MccControls{}, models.ErrorWrap(err)
+	}
+
+	return controls, nil
+}
+
+// GetCardMccControls returns the merchant category codes which a card allows and blocks
+func (m *memGate) GetCardMccControls(ctx context.Context, cardId int) (models.MccControls, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.cards[cardId]; !ok {
+		return models.MccControls{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "GetCardMccControls", "card", cardId)
+	}
+
+	controls, ok := m.cardMccControls[cardId]
+
+	if !ok {
+		return models.MccControls{Allowed: []string{}, Blocked: []string{}}, nil
+	}
+
+	return controls, nil
+}
+
+// SetCardMccControls replaces the merchant category codes which a card allows and blocks, returning them
+func (m *memGate) SetCardMccControls(ctx context.Context, cardId int, controls models.MccControls) (models.MccControls, models.ApiError) {
+
+	controls, apiErr := normaliseMccControls(controls, "SetCardMccControls")
+
+	if apiErr != nil {
+		return models.MccControls{}, apiErr
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.cards[cardId]; !ok {
+		return models.MccControls{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "SetCardMccControls", "card", cardId)
+	}
+
+	m.cardMccControls[cardId] = controls
+
+	return controls, nil
+}
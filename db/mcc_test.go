@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestCheckMcc(t *testing.T) {
+
+	for _, mcc := range []string{"", "5812", "0742"} {
+		utils.AssertNoError(t, fmt.Sprintf("Calling checkMcc with '%v'", mcc), checkMcc(mcc, "test"))
+	}
+
+	for _, mcc := range []string{"581", "58120", "58a2", " 581"} {
+		utils.AssertEquals(t, fmt.Sprintf("Return status for calling checkMcc with '%v'", mcc), 400, checkMcc(mcc, "test").StatusCode())
+	}
+}
+
+// Sets a card's merchant category controls, checking their validation and normalisation, then authorises payments to
+// a vendor as its code is blocked, allowed, not allowed and absent, checking the code recorded on an authorisation
+func testMccControls(t *testing.T, dbi Dbi, c models.Card, v models.Vendor) {
+
+	ctx := context.Background()
+
+	_, apiErr := dbi.AddOrUpdateVendor(ctx, models.Vendor{Id: v.Id, VendorName: v.VendorName, Mcc: "58"})
+
+	utils.AssertEquals(t, "Return status for calling AddOrUpdateVendor with a bad mcc", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling AddOrUpdateVendor with a bad mcc",
+		fmt.Sprintf(MESSAGE_BAD_MCC, "AddOrUpdateVendor", "58", MCC_LENGTH), apiErr.Error())
+
+	_, apiErr = dbi.AddOrUpdateVendor(ctx, models.Vendor{Id: v.Id, VendorName: v.VendorName, Mcc: "5812"})
+	utils.AssertNoError(t, "Calling AddOrUpdateVendor with an mcc", apiErr)
+
+	controls, apiErr := dbi.GetCardMccControls(ctx, c.Id)
+
+	utils.AssertNoError(t, "Calling GetCardMccControls", apiErr)
+	utils.AssertEquals(t, "Controls of a card before any are set", `{"allowed":[],"blocked":[]}`, utils.JsonStringify(controls))
+
+	_, apiErr = dbi.GetCardMccControls(ctx, 9999)
+	utils.AssertEquals(t, "Return status for calling GetCardMccControls with an invalid id", 404, apiErr.StatusCode())
+
+	_, apiErr = dbi.SetCardMccControls(ctx, 9999, models.MccControls{})
+	utils.AssertEquals(t, "Return status for calling SetCardMccControls with an invalid id", 404, apiErr.StatusCode())
+
+	_, apiErr = dbi.SetCardMccControls(ctx, c.Id, models.MccControls{Blocked: []string{""}})
+	utils.AssertEquals(t, "Return status for calling SetCardMccControls with an empty mcc", 400, apiErr.StatusCode())
+
+	_, apiErr = dbi.SetCardMccControls(ctx, c.Id, models.MccControls{Allowed: []string{"5812"}, Blocked: []string{"5812"}})
+
+	utils.AssertEquals(t, "Return status for calling SetCardMccControls with an mcc both allowed and blocked", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling SetCardMccControls with an mcc both allowed and blocked",
+		fmt.Sprintf(MESSAGE_MCC_ALLOWED_AND_BLOCKED, "SetCardMccControls", "5812"), apiErr.Error())
+
+	controls, apiErr = dbi.SetCardMccControls(ctx, c.Id, models.MccControls{Blocked: []string{"7995", "5812", "7995"}})
+
+	utils.AssertNoError(t, "Calling SetCardMccControls", apiErr)
+	utils.AssertEquals(t, "Controls of a card, sorted without duplicates", `{"allowed":[],"blocked":["5812","7995"]}`, utils.JsonStringify(controls))
+
+	controls, _ = dbi.GetCardMccControls(ctx, c.Id)
+	utils.AssertEquals(t, "Controls of a card read back", `{"allowed":[],"blocked":["5812","7995"]}`, utils.JsonStringify(controls))
+
+	_, apiErr = dbi.Authorise(ctx, c.Id, v.Id, 200, "", "Coffee")
+
+	utils.AssertEquals(t, "Return status for calling Authorise with a blocked mcc", LIMIT_EXCEEDED_STATUS, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling Authorise with a blocked mcc",
+		fmt.Sprintf(MESSAGE_MCC_BLOCKED, "Authorise", c.Id, "5812"), apiErr.Error())
+
+	_, apiErr = dbi.SetCardMccControls(ctx, c.Id, models.MccControls{Allowed: []string{"5812", "5814"}})
+	utils.AssertNoError(t, "Calling SetCardMccControls", apiErr)
+
+	aid, apiErr := dbi.Authorise(ctx, c.Id, v.Id, 200, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise with an allowed mcc", apiErr)
+
+	a, _ := dbi.GetAuthorisation(ctx, aid)
+	utils.AssertEquals(t, "Mcc of an authorisation", "5812", a.Mcc)
+
+	_, apiErr = dbi.AddOrUpdateVendor(ctx, models.Vendor{Id: v.Id, VendorName: v.VendorName, Mcc: "7995"})
+	utils.AssertNoError(t, "Calling AddOrUpdateVendor with another mcc", apiErr)
+
+	a, _ = dbi.GetAuthorisation(ctx, aid)
+	utils.AssertEquals(t, "Mcc of an authorisation, which is that of its vendor when it was made", "5812", a.Mcc)
+
+	_, apiErr = dbi.Authorise(ctx, c.Id, v.Id, 200, "", "Bet")
+
+	utils.AssertEquals(t, "Return status for calling Authorise with an mcc not allowed", LIMIT_EXCEEDED_STATUS, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling Authorise with an mcc not allowed",
+		fmt.Sprintf(MESSAGE_MCC_NOT_ALLOWED, "Authorise", c.Id, "7995"), apiErr.Error())
+
+	_, apiErr = dbi.AddOrUpdateVendor(ctx, models.Vendor{Id: v.Id, VendorName: v.VendorName})
+	utils.AssertNoError(t, "Calling AddOrUpdateVendor without an mcc", apiErr)
+
+	_, apiErr = dbi.Authorise(ctx, c.Id, v.Id, 200, "", "Coffee")
+
+	utils.AssertEquals(t, "Return status for calling Authorise without an mcc when some are allowed", LIMIT_EXCEEDED_STATUS, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling Authorise without an mcc when some are allowed",
+		fmt.Sprintf(MESSAGE_MCC_NONE, "Authorise", c.Id, v.Id), apiErr.Error())
+
+	_, apiErr = dbi.SetCardMccControls(ctx, c.Id, models.MccControls{})
+	utils.AssertNoError(t, "Calling SetCardMccControls to clear the controls", apiErr)
+
+	aid, apiErr = dbi.Authorise(ctx, c.Id, v.Id, 200, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise without controls", apiErr)
+
+	a, _ = dbi.GetAuthorisation(ctx, aid)
+	utils.AssertEquals(t, "Mcc of an authorisation to a vendor without one", "", a.Mcc)
+}
+
+func TestMemoryMccControls(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 10000)
+	defer dbi.Close()
+
+	testMccControls(t, dbi, c, v)
+}
@@ -0,0 +1,1033 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+// Starting values for generated ids, matching the AUTO_INCREMENT values of the MySQL schema
+const (
+	MEMORY_FIRST_CUSTOMER_ID       = 1001
+	MEMORY_FIRST_VENDOR_ID         = 1001
+	MEMORY_FIRST_CARD_ID           = 100001
+	MEMORY_FIRST_MOVEMENT_ID       = 1001
+	MEMORY_FIRST_AUTHORISATION_ID  = 1001
+	MEMORY_FIRST_AUTH_MOVEMENT_ID  = 1001
+	MEMORY_FIRST_LEDGER_ENTRY_ID   = 1001
+	MEMORY_FIRST_LEDGER_POSTING_ID = 1001
+	MEMORY_FIRST_SETTLEMENT_ID     = 1001
+	MEMORY_FIRST_MANDATE_ID        = 1001
+	MEMORY_FIRST_MANDATE_RUN_ID    = 1001
+
+	MEMORY_TS_FORMAT = "2006-01-02 15:04:05"
+)
+
+// An in-memory implementation of Dbi using the same rules and errors as the MySQL implementation. Its operations
+// complete without blocking on anything but the mutex, so the contexts they take are not consulted
+type memGate struct {
+	mutex sync.Mutex
+
+	customers      map[int]models.Customer
+	vendors        map[int]models.Vendor
+	cards          map[int]models.Card
+	authorisations map[int]models.Authorisation
+	movements      []models.Movement
+	authMovements  []models.AuthMovement
+	idempotency    map[string]models.IdempotencyKey
+	ledgerEntries  []models.LedgerEntry
+	cardLimits     map[int]models.SpendingLimits
+	customerLimits map[int]models.SpendingLimits
+	settlements    []models.Settlement
+	vendorFees     map[int]models.FeeSchedule
+	categoryFees   map[string]models.FeeSchedule
+	// the merchant category controls of each card which has any
+	cardMccControls map[int]models.MccControls
+	// the settlement of each auth movement which has been settled
+	settledMovements map[int]int
+	mandates         map[int]models.Mandate
+	mandateRuns      []models.MandateRun
+
+	nextCustomerId      int
+	nextVendorId        int
+	nextCardId          int
+	nextMovementId      int
+	nextAuthorisationId int
+	nextAuthMovementId  int
+	nextLedgerEntryId   int
+	nextLedgerPostingId int
+	nextSettlementId    int
+	nextMandateId       int
+	nextMandateRunId    int
+
+	fx   FxRates
+	risk RiskEvaluator
+	fee  models.FeeSchedule
+}
+
+// NewMemoryDbi returns a new, empty, independent Dbi instance held in process memory, for local development and
+// testing, configured by any options which apply to it, such as WithFxRates and WithRiskEvaluator
+func NewMemoryDbi(options ...Option) Dbi {
+
+	var o dbOptions
+
+	for _, option := range options {
+		option(&o)
+	}
+
+	return &memGate{
+		customers:      make(map[int]models.Customer),
+		vendors:        make(map[int]models.Vendor),
+		cards:          make(map[int]models.Card),
+		authorisations: make(map[int]models.Authorisation),
+		idempotency:    make(map[string]models.IdempotencyKey),
+		cardLimits:     make(map[int]models.SpendingLimits),
+		customerLimits: make(map[int]models.SpendingLimits),
+		vendorFees:     make(map[int]models.FeeSchedule),
+		categoryFees:   make(map[string]models.FeeSchedule),
+
+		cardMccControls:  make(map[int]models.MccControls),
+		settledMovements: make(map[int]int),
+		mandates:         make(map[int]models.Mandate),
+
+		nextCustomerId:      MEMORY_FIRST_CUSTOMER_ID,
+		nextVendorId:        MEMORY_FIRST_VENDOR_ID,
+		nextCardId:          MEMORY_FIRST_CARD_ID,
+		nextMovementId:      MEMORY_FIRST_MOVEMENT_ID,
+		nextAuthorisationId: MEMORY_FIRST_AUTHORISATION_ID,
+		nextAuthMovementId:  MEMORY_FIRST_AUTH_MOVEMENT_ID,
+		nextLedgerEntryId:   MEMORY_FIRST_LEDGER_ENTRY_ID,
+		nextLedgerPostingId: MEMORY_FIRST_LEDGER_POSTING_ID,
+		nextSettlementId:    MEMORY_FIRST_SETTLEMENT_ID,
+		nextMandateId:       MEMORY_FIRST_MANDATE_ID,
+		nextMandateRunId:    MEMORY_FIRST_MANDATE_RUN_ID,
+
+		fx:   o.rates(),
+		risk: o.risk(),
+		fee:  o.settlementFee,
+	}
+}
+
+// Close is a no-op for the in-memory implementation
+func (m *memGate) Close() {
+}
+
+func memoryTs() string {
+	return clock().UTC().Format(MEMORY_TS_FORMAT)
+}
+
+// Return the [offset, offset + limit) bounds of a page within n items
+func pageBounds(n, offset, limit int) (int, int) {
+
+	if offset > n {
+		offset = n
+	}
+
+	end := offset + limit
+
+	if end > n {
+		end = n
+	}
+
+	return offset, end
+}
+
+// GetVendors returns a page of up to limit vendors starting at offset, and the total number of vendors
+func (m *memGate) GetVendors(ctx context.Context, offset, limit int) ([]models.Vendor, int, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	vs := m.sortedVendors()
+
+	from, to := pageBounds(len(vs), offset, limit)
+
+	if from == to {
+		return nil, len(vs), nil
+	}
+
+	return vs[from:to], len(vs), nil
+}
+
+// GetCustomers returns a page of up to limit customers starting at offset, and the total number of customers
+func (m *memGate) GetCustomers(ctx context.Context, offset, limit int) ([]models.Customer, int, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var cs []models.Customer
+
+	for _, c := range m.customers {
+		cs = append(cs, c)
+	}
+
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Id < cs[j].Id })
+
+	from, to := pageBounds(len(cs), offset, limit)
+
+	if from == to {
+		return nil, len(cs), nil
+	}
+
+	return cs[from:to], len(cs), nil
+}
+
+// GetCustomer returns a customer object including associated cards
+func (m *memGate) GetCustomer(ctx context.Context, id int) (models.Customer, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	cu, ok := m.customers[id]
+
+	if !ok {
+		return models.Customer{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "GetCustomer", "customer", id)
+	}
+
+	for _, c := range m.sortedCards() {
+		if c.CustomerId == id {
+			cu.Cards = append(cu.Cards, c)
+		}
+	}
+
+	return cu, nil
+}
+
+// GetVendor returns a vendor object, including associated authorisations
+func (m *memGate) GetVendor(ctx context.Context, id int) (models.Vendor, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	v, ok := m.vendors[id]
+
+	if !ok {
+		return models.Vendor{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "GetVendor", "vendor", id)
+	}
+
+	for _, a := range m.sortedAuthorisations() {
+		if a.VendorId == id {
+			v.Authorisations = append(v.Authorisations, a)
+		}
+	}
+
+	return v, nil
+}
+
+// GetCard returns a card object, including movements such as top-ups, payments, refunds
+func (m *memGate) GetCard(ctx context.Context, id int) (models.Card, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.cards[id]; !ok {
+		return models.Card{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "GetCard", "card", id)
+	}
+
+	return m.cardWithMovements(id), nil
+}
+
+// GetAuthorisation returns an authorisation object, including associated movements such as captures, refunds, reversals etc
+func (m *memGate) GetAuthorisation(ctx context.Context, id int) (models.Authorisation, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.authorisations[id]; !ok {
+		return models.Authorisation{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "GetAuthorisation", "authorisation", id)
+	}
+
+	return m.authorisationWithMovements(id), nil
+}
+
+// AddOrUpdateCustomer adds a customer taking a customer object, or if an id already exists updates an existing customer
+func (m *memGate) AddOrUpdateCustomer(ctx context.Context, c models.Customer) (models.Customer, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if c.Id > 0 {
+
+		existing, ok := m.customers[c.Id]
+
+		if !ok {
+			return models.Customer{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "AddOrUpdateCustomer", "customer", c.Id)
+		}
+
+		existing.Fullname = c.Fullname
+		m.customers[c.Id] = existing
+
+	} else {
+
+		c.Id = m.nextCustomerId
+		m.nextCustomerId++
+
+		m.customers[c.Id] = models.Customer{
+			Id:       c.Id,
+			Fullname: c.Fullname,
+		}
+	}
+
+	return c, nil
+}
+
+// AddOrUpdateVendor adds a vendor taking a vendor object, or if an id already exists updates an existing vendor
+func (m *memGate) AddOrUpdateVendor(ctx context.Context, v models.Vendor) (models.Vendor, models.ApiError) {
+
+	if apiErr := checkCategory(v.Category, "AddOrUpdateVendor"); apiErr != nil {
+		return models.Vendor{}, apiErr
+	}
+
+	if apiErr := checkMcc(v.Mcc, "AddOrUpdateVendor"); apiErr != nil {
+		return models.Vendor{}, apiErr
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if v.Id > 0 {
+
+		existing, ok := m.vendors[v.Id]
+
+		if !ok {
+			return models.Vendor{}, models.ConstructApiError(404, MESSAGE_BAD_ID, "AddOrUpdateVendor", "vendor", v.Id)
+		}
+
+		existing.VendorName = v.VendorName
+		existing.Category = v.Category
+		existing.Mcc = v.Mcc
+		m.vendors[v.Id] = existing
+
+	} else {
+
+		currency, apiErr := m.fx.checkCurrency(v.Currency, "AddOrUpdateVendor")
+
+		if apiErr != nil {
+			return models.Vendor{}, apiErr
+		}
+
+		v.Id = m.nextVendorId
+		v.Currency = currency
+		m.nextVendorId++
+
+		m.vendors[v.Id] = models.Vendor{
+			Id:         v.Id,
+			VendorName: v.VendorName,
+			Category:   v.Category,
+			Mcc:        v.Mcc,
+			Currency:   currency,
+		}
+	}
+
+	return v, nil
+}
+
+// AddCard adds a card to a customer in a currency, taking a customer id and returning a card object
+func (m *memGate) AddCard(ctx context.Context, customerId int, currency string) (models.Card, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	currency, apiErr := m.fx.checkCurrency(currency, "AddCard")
+
+	if apiErr != nil {
+		return models.Card{}, apiErr
+	}
+
+	if _, ok := m.customers[customerId]; !ok {
+		return models.Card{}, models.ConstructApiError(400, MESSAGE_BAD_ID, "AddCard", "customer", customerId)
+	}
+
+	c := models.Card{
+		CustomerId: customerId,
+		Id:         m.nextCardId,
+		Status:     CARD_STATUS_ACTIVE,
+		Currency:   currency,
+	}
+
+	m.nextCardId++
+
+	stored := c
+	stored.Ts = memoryTs()
+	m.cards[c.Id] = stored
+
+	return c, nil
+}
+
+// SetCardStatus changes the status of a card, recording the change in its movements. Closing a card pays out its
+// remaining balance. Returns the updated card
+func (m *memGate) SetCardStatus(ctx context.Context, cardId int, status, description string) (models.Card, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c, ok := m.cards[cardId]
+
+	if !ok {
+		return c, models.ConstructApiError(404, MESSAGE_BAD_ID, "getCard", "card", cardId)
+	}
+
+	if apiErr := checkCardTransition(c, status); apiErr != nil {
+		return c, apiErr
+	}
+
+	m.addMovement(cardId, 0, statusDescription(c.Status, status, description), "STATUS")
+
+	if status == CARD_STATUS_CLOSED && c.Balance > 0 {
+
+		m.updateCard(cardId, -c.Balance, -c.Balance)
+
+		id := m.addMovement(cardId, -c.Balance, MESSAGE_PAYOUT, "PAYOUT")
+
+		m.addLedgerEntry("PAYOUT", MESSAGE_PAYOUT, id, transfer(CardAvailableAccount(cardId), LEDGER_ACCOUNT_PAYOUT, c.Balance, c.Currency))
+	}
+
+	if status == CARD_STATUS_CLOSED {
+
+		// equivalent of QUERY_END_CARD_MANDATES
+		for id, md := range m.mandates {
+
+			if md.CardId == cardId && (md.Status == MANDATE_STATUS_ACTIVE || md.Status == MANDATE_STATUS_SUSPENDED) {
+				md.Status = MANDATE_STATUS_ENDED
+				md.RetryAt = ""
+				m.mandates[id] = md
+			}
+		}
+	}
+
+	c = m.cards[cardId]
+	c.Status = status
+	m.cards[cardId] = c
+
+	return m.cardWithMovements(cardId), nil
+}
+
+// Authorise requests authorisation of a payment in the vendor's currency and returns an authorisation code. The hold
+// on a card in another currency is the amount converted at the current rate, which is locked for the authorisation.
+// The hold must be within the spending limits of the card
+func (m *memGate) Authorise(ctx context.Context, cardId, vendorId, amount int, currency, description string) (int, models.ApiError) {
+
+	r, rate, apiErr := m.riskRequest(cardId, vendorId, amount, currency, description)
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	// the evaluation is made without the lock, so that an evaluator may read through the Dbi
+	status, reason, apiErr := evaluateRisk(ctx, m.risk, r)
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c, v, hold, now := m.cards[cardId], r.Vendor, r.Hold, r.Now
+
+	// equivalent of QUERY_HOLD_CARD, then the limits are checked again, as concurrent authorisations may have been
+	// made during the evaluation
+	if c.Available < hold || c.Status != CARD_STATUS_ACTIVE {
+		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE_FOR, "Authorise", models.Money{Amount: hold, Currency: c.Currency})
+	}
+
+	if apiErr := checkLimits(m.effectiveLimits(c), c, vendorId, hold, m.recentAuthorisations(cardId, now.Add(-RISK_HISTORY)), now); apiErr != nil {
+		return -1, apiErr
+	}
+
+	m.updateCard(cardId, 0, -hold)
+
+	a := models.Authorisation{
+		Id:           m.nextAuthorisationId,
+		Mcc:          v.Mcc,
+		Amount:       amount,
+		CardId:       cardId,
+		VendorId:     vendorId,
+		Description:  description,
+		Ts:           memoryTs(),
+		ExpiresAt:    expiryTime(now),
+		Currency:     r.Currency,
+		CardCurrency: c.Currency,
+		Rate:         rate,
+		Status:       status,
+	}
+
+	m.nextAuthorisationId++
+	m.authorisations[a.Id] = a
+
+	if status == AUTHORISATION_STATUS_REVIEW {
+		m.addAuthMovement(a.Id, 0, reason, "REVIEW")
+	}
+
+	m.addLedgerEntry("AUTHORISATION", description, a.Id, transfer(CardAvailableAccount(cardId), CardHeldAccount(cardId), hold, c.Currency))
+
+	return a.Id, nil
+}
+
+// Check an authorisation against the card and vendor and the card's limits, under the lock, returning the request for
+// its risk evaluation and the rate at which it is held
+func (m *memGate) riskRequest(cardId, vendorId, amount int, currency, description string) (RiskRequest, float64, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var r RiskRequest
+
+	v, ok := m.vendors[vendorId]
+
+	if !ok {
+		return r, 0, models.ConstructApiError(400, MESSAGE_BAD_ID, "Authorise", "vendor", vendorId)
+	}
+
+	c, ok := m.cards[cardId]
+
+	if !ok {
+		return r, 0, models.ConstructApiError(400, MESSAGE_BAD_ID, "Authorise", "card", cardId)
+	}
+
+	if apiErr := checkCardUsable(c, authorisableStatuses, "Authorise"); apiErr != nil {
+		return r, 0, apiErr
+	}
+
+	currency, apiErr := checkAmountCurrency(currency, v.Currency, "vendor", vendorId, "Authorise")
+
+	if apiErr != nil {
+		return r, 0, apiErr
+	}
+
+	rate, apiErr := m.fx.rate(currency, c.Currency, "Authorise")
+
+	if apiErr != nil {
+		return r, 0, apiErr
+	}
+
+	hold := convert(amount, rate, currency, c.Currency)
+
+	if c.Available < hold {
+		return r, 0, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "Authorise", models.Money{Amount: hold, Currency: c.Currency}, models.Money{Amount: c.Available, Currency: c.Currency})
+	}
+
+	now := clock()
+	history := m.recentAuthorisations(cardId, now.Add(-RISK_HISTORY))
+
+	if apiErr := checkLimits(m.effectiveLimits(c), c, vendorId, hold, history, now); apiErr != nil {
+		return r, 0, apiErr
+	}
+
+	if apiErr := checkMccControls(m.cardMccControls[cardId], c, v); apiErr != nil {
+		return r, 0, apiErr
+	}
+
+	r = RiskRequest{
+		Card:        c,
+		Vendor:      v,
+		Amount:      amount,
+		Currency:    currency,
+		Hold:        hold,
+		Description: description,
+		History:     history,
+		Now:         now,
+	}
+
+	return r, rate, nil
+}
+
+// TopUp simulates a top-up to a card and returns a top-up code
+func (m *memGate) TopUp(ctx context.Context, cardId, amount int, currency, description string) (int, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c, ok := m.cards[cardId]
+
+	if !ok {
+		return -1, models.ConstructApiError(400, MESSAGE_BAD_ID, "TopUp", "card", cardId)
+	}
+
+	if apiErr := checkCardUsable(c, topUpStatuses, "TopUp"); apiErr != nil {
+		return -1, apiErr
+	}
+
+	if _, apiErr := checkAmountCurrency(currency, c.Currency, "card", cardId, "TopUp"); apiErr != nil {
+		return -1, apiErr
+	}
+
+	m.updateCard(cardId, amount, amount)
+
+	id := m.addMovement(cardId, amount, description, "TOP-UP")
+
+	m.addLedgerEntry("TOP-UP", description, id, transfer(LEDGER_ACCOUNT_FUNDING, CardAvailableAccount(cardId), amount, c.Currency))
+
+	return id, nil
+}
+
+// Capture requests the capture of all or part of an authorised payment and returns a capture code
+func (m *memGate) Capture(ctx context.Context, authorisationId, amount int, currency string) (int, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	auth, ok := m.authorisations[authorisationId]
+
+	if !ok {
+		return -1, models.ConstructApiError(400, MESSAGE_BAD_ID, "Capture", "authorisation", authorisationId)
+	}
+
+	if _, apiErr := checkAmountCurrency(currency, auth.Currency, "authorisation", auth.Id, "Capture"); apiErr != nil {
+		return -1, apiErr
+	}
+
+	if expired(auth, clock()) {
+		return -1, models.ConstructApiError(400, MESSAGE_AUTHORISATION_EXPIRED, "Capture", auth.Id, auth.ExpiresAt)
+	}
+
+	if auth.Status == AUTHORISATION_STATUS_REVIEW {
+		return -1, models.ConstructApiError(409, MESSAGE_AUTHORISATION_IN_REVIEW, "Capture", auth.Id)
+	}
+
+	if amount > auth.Capturable() {
+		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "Capture", models.Money{Amount: amount, Currency: auth.Currency}, models.Money{Amount: auth.Capturable(), Currency: auth.Currency})
+	}
+
+	released := auth.Captured + auth.Reversed
+	cardAmount := cardChange(auth, released, released+amount)
+	fee := m.effectiveFees(m.vendors[auth.VendorId]).Fee(amount)
+
+	m.updateCard(auth.CardId, -cardAmount, 0)
+	m.updateAuthorisation(auth.Id, amount, 0, 0)
+	m.updateVendor(auth.VendorId, amount-fee)
+	m.addMovement(auth.CardId, -cardAmount, auth.Description, "PURCHASE")
+
+	id := m.addAuthMovement(auth.Id, amount, "Capture of "+models.FormatAmount(amount, auth.Currency), "CAPTURE")
+
+	m.addLedgerEntry("CAPTURE", auth.Description, id,
+		exchange(CardHeldAccount(auth.CardId), cardAmount, auth.CardCurrency, VendorAccount(auth.VendorId), amount, auth.Currency))
+
+	if fee > 0 {
+
+		description := captureFeeDescription(amount, auth.Currency)
+		feeId := m.addAuthMovement(auth.Id, -fee, description, "FEE")
+
+		m.addLedgerEntry("FEE", description, feeId, transfer(VendorAccount(auth.VendorId), LEDGER_ACCOUNT_FEES, fee, auth.Currency))
+	}
+
+	return id, nil
+}
+
+// Refund requests a refund all or part of a captured payment and returns a refund code
+func (m *memGate) Refund(ctx context.Context, authorisationId, amount int, currency, description string) (int, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	auth, ok := m.authorisations[authorisationId]
+
+	if !ok {
+		return -1, models.ConstructApiError(400, MESSAGE_BAD_ID, "Refund", "authorisation", authorisationId)
+	}
+
+	if _, apiErr := checkAmountCurrency(currency, auth.Currency, "authorisation", auth.Id, "Refund"); apiErr != nil {
+		return -1, apiErr
+	}
+
+	if amount > auth.Refundable() {
+		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "Refund", models.Money{Amount: amount, Currency: auth.Currency}, models.Money{Amount: auth.Refundable(), Currency: auth.Currency})
+	}
+
+	cardAmount := cardChange(auth, auth.Refunded, auth.Refunded+amount)
+
+	m.updateCard(auth.CardId, cardAmount, cardAmount)
+	m.updateAuthorisation(auth.Id, 0, amount, 0)
+	m.updateVendor(auth.VendorId, -amount)
+	m.addMovement(auth.CardId, cardAmount, description, "REFUND")
+
+	id := m.addAuthMovement(auth.Id, -amount, description, "REFUND")
+
+	m.addLedgerEntry("REFUND", description, id,
+		exchange(VendorAccount(auth.VendorId), amount, auth.Currency, CardAvailableAccount(auth.CardId), cardAmount, auth.CardCurrency))
+
+	return id, nil
+}
+
+// Reverse requests a reversal of all or part of a authorisation and returns a reversal code
+func (m *memGate) Reverse(ctx context.Context, authorisationId, amount int, currency, description string) (int, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	auth, ok := m.authorisations[authorisationId]
+
+	if !ok {
+		return -1, models.ConstructApiError(400, MESSAGE_BAD_ID, "Reverse", "authorisation", authorisationId)
+	}
+
+	if _, apiErr := checkAmountCurrency(currency, auth.Currency, "authorisation", auth.Id, "Reverse"); apiErr != nil {
+		return -1, apiErr
+	}
+
+	if amount > auth.Capturable() {
+		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "Reverse", models.Money{Amount: amount, Currency: auth.Currency}, models.Money{Amount: auth.Capturable(), Currency: auth.Currency})
+	}
+
+	return m.releaseHold(auth, amount, description, "REVERSAL"), nil
+}
+
+// ExpireAuthorisations reverses the uncaptured remainder of every authorisation past its expiry time, releasing the
+// hold on the card, and reports the authorisations expired
+func (m *memGate) ExpireAuthorisations(ctx context.Context) (models.ExpiryReport, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	report := models.ExpiryReport{
+		AmountsReleased: map[string]int{},
+		Codes:           []int{},
+	}
+
+	now := clock()
+
+	for _, auth := range m.sortedAuthorisations() {
+
+		amount := auth.Capturable()
+
+		if amount <= 0 || !expired(auth, now) {
+			continue
+		}
+
+		code := m.releaseHold(auth, amount, expiryDescription(amount, auth.Currency), "EXPIRY")
+
+		report.AuthorisationsExpired++
+		report.AmountReleased += amount
+		report.AmountsReleased[auth.Currency] += amount
+		report.Codes = append(report.Codes, code)
+	}
+
+	return report, nil
+}
+
+// ClaimIdempotencyKey records a new idempotency key with the fingerprint of the request using it, returning true.
+// If the key has already been claimed it returns the existing record and false, unless it was claimed for the same
+// request more than IDEMPOTENCY_CLAIM_TIMEOUT ago and never completed, when it is claimed again
+func (m *memGate) ClaimIdempotencyKey(ctx context.Context, key, fingerprint string) (models.IdempotencyKey, bool, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := clock()
+
+	k, ok := m.idempotency[key]
+
+	abandoned := ok && !k.Completed && k.Fingerprint == fingerprint && k.ClaimedAt <= datetime(now.Add(-IDEMPOTENCY_CLAIM_TIMEOUT))
+
+	if ok && !abandoned {
+		return k, false, nil
+	}
+
+	k = models.IdempotencyKey{
+		Key:         key,
+		Fingerprint: fingerprint,
+		ClaimedAt:   datetime(now),
+	}
+
+	m.idempotency[key] = k
+
+	return k, true, nil
+}
+
+// CompleteIdempotencyKey records the response id of the request which claimed an idempotency key
+func (m *memGate) CompleteIdempotencyKey(ctx context.Context, key string, responseId int) models.ApiError {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	k, ok := m.idempotency[key]
+
+	if !ok || k.Completed {
+		return models.ConstructApiError(500, MESSAGE_INVALID_ROW_UPDATE, "CompleteIdempotencyKey")
+	}
+
+	k.ResponseId = responseId
+	k.Completed = true
+	m.idempotency[key] = k
+
+	return nil
+}
+
+// ReleaseIdempotencyKey removes an idempotency key which has not been completed, so that its request can be retried
+func (m *memGate) ReleaseIdempotencyKey(ctx context.Context, key string) models.ApiError {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if k, ok := m.idempotency[key]; ok && !k.Completed {
+		delete(m.idempotency, key)
+	}
+
+	return nil
+}
+
+// GetLedgerEntries returns a page of up to limit ledger entries starting at offset, and the total number of entries
+func (m *memGate) GetLedgerEntries(ctx context.Context, offset, limit int) ([]models.LedgerEntry, int, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	start, end := pageBounds(len(m.ledgerEntries), offset, limit)
+
+	es := make([]models.LedgerEntry, end-start)
+	copy(es, m.ledgerEntries[start:end])
+
+	return es, len(m.ledgerEntries), nil
+}
+
+// GetAccountBalance returns the sum of the postings to a ledger account
+func (m *memGate) GetAccountBalance(ctx context.Context, account string) (int, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	balance := 0
+
+	for _, e := range m.ledgerEntries {
+		for _, p := range e.Postings {
+			if p.Account == account {
+				balance += p.Amount
+			}
+		}
+	}
+
+	return balance, nil
+}
+
+// Reconcile checks the balance invariants of every card, authorisation and vendor, and reports any breaks
+func (m *memGate) Reconcile(ctx context.Context) (models.ReconciliationReport, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	r := newReconciler()
+
+	ledger := make(map[string]int)
+
+	for _, e := range m.ledgerEntries {
+		for _, p := range e.Postings {
+			ledger[p.Account] += p.Amount
+		}
+	}
+
+	for _, c := range m.sortedCards() {
+
+		ct := cardTotals{
+			id:              c.Id,
+			balance:         c.Balance,
+			available:       c.Available,
+			ledgerAvailable: ledger[CardAvailableAccount(c.Id)],
+			ledgerHeld:      ledger[CardHeldAccount(c.Id)],
+		}
+
+		for _, mv := range m.movements {
+			if mv.CardId == c.Id {
+				ct.movements += mv.Amount
+			}
+		}
+
+		for _, a := range m.authorisations {
+			if a.CardId == c.Id {
+				ct.holds += heldAmount(a)
+			}
+		}
+
+		r.checkCard(ct)
+	}
+
+	for _, a := range m.sortedAuthorisations() {
+		r.checkAuthorisation(a)
+	}
+
+	for _, v := range m.sortedVendors() {
+		r.checkVendor(vendorTotals{
+			id:      v.Id,
+			balance: v.Balance,
+			ledger:  ledger[VendorAccount(v.Id)],
+		})
+	}
+
+	return r.result(), nil
+}
+
+// The following helpers must be called with the mutex held
+
+func (m *memGate) sortedCards() []models.Card {
+
+	var cs []models.Card
+
+	for _, c := range m.cards {
+		cs = append(cs, c)
+	}
+
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Id < cs[j].Id })
+
+	return cs
+}
+
+func (m *memGate) sortedVendors() []models.Vendor {
+
+	var vs []models.Vendor
+
+	for _, v := range m.vendors {
+		vs = append(vs, v)
+	}
+
+	sort.Slice(vs, func(i, j int) bool { return vs[i].Id < vs[j].Id })
+
+	return vs
+}
+
+func (m *memGate) sortedAuthorisations() []models.Authorisation {
+
+	var as []models.Authorisation
+
+	for _, a := range m.authorisations {
+		as = append(as, a)
+	}
+
+	sort.Slice(as, func(i, j int) bool { return as[i].Id < as[j].Id })
+
+	return as
+}
+
+// Equivalent of QUERY_UPDATE_CARD
+func (m *memGate) updateCard(id, balance, available int) {
+
+	c := m.cards[id]
+	c.Balance += balance
+	c.Available += available
+	c.Ts = memoryTs()
+	m.cards[id] = c
+}
+
+// Returns a card with its movements, as GetCard
+func (m *memGate) cardWithMovements(id int) models.Card {
+
+	c := m.cards[id]
+
+	for _, mv := range m.movements {
+		if mv.CardId == id {
+			c.Movements = append(c.Movements, mv)
+		}
+	}
+
+	return c
+}
+
+// Returns an authorisation with its movements, as GetAuthorisation
+func (m *memGate) authorisationWithMovements(id int) models.Authorisation {
+
+	a := m.authorisations[id]
+
+	for _, am := range m.authMovements {
+		if am.AuthorisationId == id {
+			a.Movements = append(a.Movements, am)
+		}
+	}
+
+	return a
+}
+
+// Equivalent of QUERY_UPDATE_VENDOR
+func (m *memGate) updateVendor(id, balance int) {
+
+	v := m.vendors[id]
+	v.Balance += balance
+	m.vendors[id] = v
+}
+
+// Equivalent of QUERY_CAPTURE_AUTH, QUERY_REFUND_AUTH and QUERY_REVERSE_AUTH. Ts is left as when the authorisation
+// was made
+func (m *memGate) updateAuthorisation(id, captured, refunded, reversed int) {
+
+	a := m.authorisations[id]
+	a.Captured += captured
+	a.Refunded += refunded
+	a.Reversed += reversed
+	m.authorisations[id] = a
+}
+
+// Equivalent of dbGate.releaseHold, returning the new authorisation movement id
+func (m *memGate) releaseHold(auth models.Authorisation, amount int, description, movementType string) int {
+
+	released := auth.Captured + auth.Reversed
+	cardAmount := cardChange(auth, released, released+amount)
+
+	m.updateCard(auth.CardId, 0, cardAmount)
+	m.updateAuthorisation(auth.Id, 0, 0, amount)
+
+	id := m.addAuthMovement(auth.Id, -amount, description, movementType)
+
+	m.addLedgerEntry(movementType, description, id, transfer(CardHeldAccount(auth.CardId), CardAvailableAccount(auth.CardId), cardAmount, auth.CardCurrency))
+
+	return id
+}
+
+// Equivalent of QUERY_ADD_MOVEMENT, returning the new movement id
+func (m *memGate) addMovement(cardId, amount int, description, movementType string) int {
+
+	mv := models.Movement{
+		Id:           m.nextMovementId,
+		CardId:       cardId,
+		Amount:       amount,
+		Description:  description,
+		MovementType: movementType,
+		Ts:           memoryTs(),
+	}
+
+	m.nextMovementId++
+	m.movements = append(m.movements, mv)
+
+	return mv.Id
+}
+
+// Equivalent of QUERY_ADD_AUTH_MOVEMENT, returning the new movement id
+func (m *memGate) addAuthMovement(authorisationId, amount int, description, movementType string) int {
+
+	am := models.AuthMovement{
+		Id:              m.nextAuthMovementId,
+		AuthorisationId: authorisationId,
+		Amount:          amount,
+		Description:     description,
+		MovementType:    movementType,
+		Ts:              memoryTs(),
+	}
+
+	m.nextAuthMovementId++
+	m.authMovements = append(m.authMovements, am)
+
+	return am.Id
+}
+
+// Equivalent of addLedgerEntry. The postings are generated by transfer so are always balanced
+func (m *memGate) addLedgerEntry(entryType, description string, reference int, postings []models.LedgerPosting) {
+
+	e := models.LedgerEntry{
+		Id:          m.nextLedgerEntryId,
+		EntryType:   entryType,
+		Description: description,
+		Reference:   reference,
+		Ts:          memoryTs(),
+	}
+
+	m.nextLedgerEntryId++
+
+	for _, p := range postings {
+
+		p.Id = m.nextLedgerPostingId
+		p.EntryId = e.Id
+
+		m.nextLedgerPostingId++
+		e.Postings = append(e.Postings, p)
+	}
+
+	m.ledgerEntries = append(m.ledgerEntries, e)
+}
@@ -0,0 +1,327 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+// Create a memory Dbi with a customer holding a card topped up with the given amount, and a vendor
+func memoryFixture(t *testing.T, topUp int, options ...Option) (Dbi, models.Card, models.Vendor) {
+
+	dbi := NewMemoryDbi(options...)
+
+	cu, apiErr := dbi.AddOrUpdateCustomer(context.Background(), models.Customer{Fullname: "Fred Bloggs"})
+	utils.AssertNoError(t, "Calling AddOrUpdateCustomer", apiErr)
+
+	c, apiErr := dbi.AddCard(context.Background(), cu.Id, "")
+	utils.AssertNoError(t, "Calling AddCard", apiErr)
+
+	v, apiErr := dbi.AddOrUpdateVendor(context.Background(), models.Vendor{VendorName: "Coffee Shop"})
+	utils.AssertNoError(t, "Calling AddOrUpdateVendor", apiErr)
+
+	if topUp > 0 {
+		_, apiErr = dbi.TopUp(context.Background(), c.Id, topUp, "", "Transfer from Bank")
+		utils.AssertNoError(t, "Calling TopUp", apiErr)
+	}
+
+	return dbi, c, v
+}
+
+func TestMemoryAddAndGet(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 0)
+	defer dbi.Close()
+
+	utils.AssertEquals(t, "Id of first customer", MEMORY_FIRST_CUSTOMER_ID, c.CustomerId)
+	utils.AssertEquals(t, "Id of first card", MEMORY_FIRST_CARD_ID, c.Id)
+	utils.AssertEquals(t, "Id of first vendor", MEMORY_FIRST_VENDOR_ID, v.Id)
+
+	cu, apiErr := dbi.GetCustomer(context.Background(), c.CustomerId)
+
+	utils.AssertNoError(t, "Calling GetCustomer", apiErr)
+	utils.AssertEquals(t, "Fullname for GetCustomer result", "Fred Bloggs", cu.Fullname)
+	utils.AssertEquals(t, "len(Cards) for GetCustomer result", 1, len(cu.Cards))
+
+	cu, apiErr = dbi.AddOrUpdateCustomer(context.Background(), models.Customer{Id: c.CustomerId, Fullname: "Jane Doe"})
+
+	utils.AssertNoError(t, "Calling AddOrUpdateCustomer with an id", apiErr)
+
+	cs, total, apiErr := dbi.GetCustomers(context.Background(), 0, 10)
+
+	utils.AssertNoError(t, "Calling GetCustomers", apiErr)
+	utils.AssertEquals(t, "Size of GetCustomers result", 1, len(cs))
+	utils.AssertEquals(t, "Total for GetCustomers result", 1, total)
+	utils.AssertEquals(t, "Fullname for GetCustomers result[0]", "Jane Doe", cs[0].Fullname)
+
+	_, apiErr = dbi.AddOrUpdateVendor(context.Background(), models.Vendor{VendorName: "Pub"})
+
+	utils.AssertNoError(t, "Calling AddOrUpdateVendor", apiErr)
+
+	vs, total, apiErr := dbi.GetVendors(context.Background(), 0, 10)
+
+	utils.AssertNoError(t, "Calling GetVendors", apiErr)
+	utils.AssertEquals(t, "Size of GetVendors result", 2, len(vs))
+	utils.AssertEquals(t, "Total for GetVendors result", 2, total)
+	utils.AssertEquals(t, "VendorName for GetVendors result[1]", "Pub", vs[1].VendorName)
+
+	vs, total, apiErr = dbi.GetVendors(context.Background(), 1, 10)
+
+	utils.AssertNoError(t, "Calling GetVendors with an offset", apiErr)
+	utils.AssertEquals(t, "Size of GetVendors result with an offset", 1, len(vs))
+	utils.AssertEquals(t, "Total for GetVendors result with an offset", 2, total)
+	utils.AssertEquals(t, "VendorName for GetVendors result[0] with an offset", "Pub", vs[0].VendorName)
+
+	vs, total, apiErr = dbi.GetVendors(context.Background(), 0, 1)
+
+	utils.AssertNoError(t, "Calling GetVendors with a limit", apiErr)
+	utils.AssertEquals(t, "Size of GetVendors result with a limit", 1, len(vs))
+	utils.AssertEquals(t, "VendorName for GetVendors result[0] with a limit", "Coffee Shop", vs[0].VendorName)
+
+	vs, total, apiErr = dbi.GetVendors(context.Background(), 5, 10)
+
+	utils.AssertNoError(t, "Calling GetVendors with an offset beyond the total", apiErr)
+	utils.AssertEquals(t, "Size of GetVendors result with an offset beyond the total", 0, len(vs))
+	utils.AssertEquals(t, "Total for GetVendors result with an offset beyond the total", 2, total)
+}
+
+func TestMemoryNotFound(t *testing.T) {
+
+	dbi := NewMemoryDbi()
+	defer dbi.Close()
+
+	_, apiErr := dbi.GetCustomer(context.Background(), 1001)
+
+	utils.AssertEquals(t, "Return status for calling GetCustomer with a bad id", 404, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling GetCustomer with bad id 1001", badIdMessage("GetCustomer", "customer", 1001), apiErr.Error())
+
+	_, apiErr = dbi.GetVendor(context.Background(), 1001)
+
+	utils.AssertEquals(t, "Return status for calling GetVendor with a bad id", 404, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling GetVendor with bad id 1001", badIdMessage("GetVendor", "vendor", 1001), apiErr.Error())
+
+	_, apiErr = dbi.GetCard(context.Background(), 100001)
+
+	utils.AssertEquals(t, "Return status for calling GetCard with a bad id", 404, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling GetCard with bad id 100001", badIdMessage("GetCard", "card", 100001), apiErr.Error())
+
+	_, apiErr = dbi.GetAuthorisation(context.Background(), 1001)
+
+	utils.AssertEquals(t, "Return status for calling GetAuthorisation with a bad id", 404, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling GetAuthorisation with bad id 1001", badIdMessage("GetAuthorisation", "authorisation", 1001), apiErr.Error())
+
+	_, apiErr = dbi.AddOrUpdateVendor(context.Background(), models.Vendor{Id: 1001, VendorName: "Pub"})
+
+	utils.AssertEquals(t, "Return status for calling AddOrUpdateVendor with a bad id", 404, apiErr.StatusCode())
+
+	_, apiErr = dbi.AddCard(context.Background(), 1099, "")
+
+	utils.AssertEquals(t, "Return status for calling AddCard with a bad customerId", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling AddCard with bad customerId 1099", badIdMessage("AddCard", "customer", 1099), apiErr.Error())
+}
+
+func TestMemoryAuthoriseCaptureRefund(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 1000)
+	defer dbi.Close()
+
+	aid, apiErr := dbi.Authorise(context.Background(), c.Id, v.Id, 250, "", "Coffee")
+
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+	utils.AssertEquals(t, "Authorisation id", MEMORY_FIRST_AUTHORISATION_ID, aid)
+
+	card, _ := dbi.GetCard(context.Background(), c.Id)
+
+	utils.AssertEquals(t, "Balance after Authorise", 1000, card.Balance)
+	utils.AssertEquals(t, "Available after Authorise", 750, card.Available)
+
+	_, apiErr = dbi.Capture(context.Background(), aid, 200, "")
+
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	_, apiErr = dbi.Capture(context.Background(), aid, 100, "")
+
+	utils.AssertEquals(t, "Return status for calling Capture with insufficient uncaptured funds", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling Capture with insufficient uncaptured funds", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE, "Capture", "£1.00", "£0.50"), apiErr.Error())
+
+	_, apiErr = dbi.Reverse(context.Background(), aid, 50, "", "No cake")
+
+	utils.AssertNoError(t, "Calling Reverse", apiErr)
+
+	_, apiErr = dbi.Refund(context.Background(), aid, 250, "", "Bad coffee")
+
+	utils.AssertEquals(t, "Return status for calling Refund with insufficient captured funds", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling Refund with insufficient captured funds", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE, "Refund", "£2.50", "£2.00"), apiErr.Error())
+
+	_, apiErr = dbi.Refund(context.Background(), aid, 80, "", "Bad coffee")
+
+	utils.AssertNoError(t, "Calling Refund", apiErr)
+
+	card, _ = dbi.GetCard(context.Background(), c.Id)
+
+	utils.AssertEquals(t, "Balance after Capture and Refund", 880, card.Balance)
+	utils.AssertEquals(t, "Available after Capture, Reverse and Refund", 880, card.Available)
+	utils.AssertEquals(t, "len(Movements) for GetCard result", 3, len(card.Movements))
+	utils.AssertEquals(t, "Movements[1].MovementType for GetCard result", "PURCHASE", card.Movements[1].MovementType)
+	utils.AssertEquals(t, "Movements[2].MovementType for GetCard result", "REFUND", card.Movements[2].MovementType)
+
+	vendor, _ := dbi.GetVendor(context.Background(), v.Id)
+
+	utils.AssertEquals(t, "Vendor balance after Capture and Refund", 120, vendor.Balance)
+	utils.AssertEquals(t, "len(Authorisations) for GetVendor result", 1, len(vendor.Authorisations))
+
+	auth, _ := dbi.GetAuthorisation(context.Background(), aid)
+
+	utils.AssertEquals(t, "Captured for GetAuthorisation result", 200, auth.Captured)
+	utils.AssertEquals(t, "Reversed for GetAuthorisation result", 50, auth.Reversed)
+	utils.AssertEquals(t, "Refunded for GetAuthorisation result", 80, auth.Refunded)
+	utils.AssertEquals(t, "len(Movements) for GetAuthorisation result", 3, len(auth.Movements))
+	utils.AssertEquals(t, "Movements[0].Description for GetAuthorisation result", "Capture of £2.00", auth.Movements[0].Description)
+}
+
+func TestMemoryAuthoriseBad(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 200)
+	defer dbi.Close()
+
+	_, apiErr := dbi.Authorise(context.Background(), c.Id, 9999, 100, "", "Coffee")
+
+	utils.AssertEquals(t, "Return status for calling Authorise with a bad vendorId", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling Authorise with a bad vendorId 9999", badIdMessage("Authorise", "vendor", 9999), apiErr.Error())
+
+	_, apiErr = dbi.Authorise(context.Background(), 9999, v.Id, 100, "", "Coffee")
+
+	utils.AssertEquals(t, "Return status for calling Authorise with a bad cardId", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling Authorise with a bad cardId 9999", badIdMessage("Authorise", "card", 9999), apiErr.Error())
+
+	aid, apiErr := dbi.Authorise(context.Background(), c.Id, v.Id, 210, "", "Coffee")
+
+	utils.AssertEquals(t, "Return status for calling Authorise with insufficient funds", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling Authorise with insufficient funds", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE, "Authorise", "£2.10", "£2.00"), apiErr.Error())
+	utils.AssertEquals(t, "Return status for calling Authorise with insufficient funds", -1, aid)
+
+	_, apiErr = dbi.TopUp(context.Background(), 9999, 100, "", "Transfer from Bank")
+
+	utils.AssertEquals(t, "Return status for calling TopUp with a invalid card", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling TopUp with an invalid card 9999", badIdMessage("TopUp", "card", 9999), apiErr.Error())
+
+	_, apiErr = dbi.Capture(context.Background(), 9999, 100, "")
+
+	utils.AssertEquals(t, "Return message for calling Capture with bad id", badIdMessage("Capture", "authorisation", 9999), apiErr.Error())
+
+	_, apiErr = dbi.Refund(context.Background(), 9999, 100, "", "Bad coffee")
+
+	utils.AssertEquals(t, "Return message for calling Refund with bad id", badIdMessage("Refund", "authorisation", 9999), apiErr.Error())
+
+	_, apiErr = dbi.Reverse(context.Background(), 9999, 100, "", "Bad coffee")
+
+	utils.AssertEquals(t, "Return message for calling Reverse with bad id", badIdMessage("Reverse", "authorisation", 9999), apiErr.Error())
+}
+
+func TestMemoryInstancesAreIndependent(t *testing.T) {
+
+	dbi1, _, _ := memoryFixture(t, 0)
+	dbi2 := NewMemoryDbi()
+
+	defer dbi1.Close()
+	defer dbi2.Close()
+
+	cs, _, apiErr := dbi2.GetCustomers(context.Background(), 0, 10)
+
+	utils.AssertNoError(t, "Calling GetCustomers", apiErr)
+	utils.AssertEquals(t, "Size of GetCustomers result for a second instance", 0, len(cs))
+}
+
+func TestMemoryIdempotencyKeys(t *testing.T) {
+
+	dbi := NewMemoryDbi()
+	defer dbi.Close()
+
+	_, claimed, apiErr := dbi.ClaimIdempotencyKey(context.Background(), "key-1", "abc123")
+
+	utils.AssertNoError(t, "Calling ClaimIdempotencyKey", apiErr)
+	utils.AssertTrue(t, "Claimed for ClaimIdempotencyKey with a new key", claimed)
+
+	k, claimed, apiErr := dbi.ClaimIdempotencyKey(context.Background(), "key-1", "def456")
+
+	utils.AssertNoError(t, "Calling ClaimIdempotencyKey", apiErr)
+	utils.AssertFalse(t, "Claimed for ClaimIdempotencyKey with a claimed key", claimed)
+	utils.AssertEquals(t, "Fingerprint for ClaimIdempotencyKey with a claimed key", "abc123", k.Fingerprint)
+	utils.AssertFalse(t, "Completed for ClaimIdempotencyKey with a claimed key", k.Completed)
+
+	utils.AssertNoError(t, "Calling ReleaseIdempotencyKey", dbi.ReleaseIdempotencyKey(context.Background(), "key-1"))
+
+	_, claimed, apiErr = dbi.ClaimIdempotencyKey(context.Background(), "key-1", "abc123")
+
+	utils.AssertNoError(t, "Calling ClaimIdempotencyKey", apiErr)
+	utils.AssertTrue(t, "Claimed for ClaimIdempotencyKey with a released key", claimed)
+
+	utils.AssertNoError(t, "Calling CompleteIdempotencyKey", dbi.CompleteIdempotencyKey(context.Background(), "key-1", 1009))
+	utils.AssertNoError(t, "Calling ReleaseIdempotencyKey", dbi.ReleaseIdempotencyKey(context.Background(), "key-1"))
+
+	k, claimed, apiErr = dbi.ClaimIdempotencyKey(context.Background(), "key-1", "abc123")
+
+	utils.AssertNoError(t, "Calling ClaimIdempotencyKey", apiErr)
+	utils.AssertFalse(t, "Claimed for ClaimIdempotencyKey with a completed key", claimed)
+	utils.AssertTrue(t, "Completed for ClaimIdempotencyKey with a completed key", k.Completed)
+	utils.AssertEquals(t, "ResponseId for ClaimIdempotencyKey with a completed key", 1009, k.ResponseId)
+}
+
+// Claims a key which is never completed, as by a request which failed after committing its operation, and checks that
+// it is taken over by a repeat of the request only once IDEMPOTENCY_CLAIM_TIMEOUT has passed
+func testAbandonedIdempotencyKeys(t *testing.T, dbi Dbi) {
+
+	defer fixClock(testNow)()
+
+	ctx := context.Background()
+
+	_, claimed, apiErr := dbi.ClaimIdempotencyKey(ctx, "key-1", "abc123")
+
+	utils.AssertNoError(t, "Calling ClaimIdempotencyKey", apiErr)
+	utils.AssertTrue(t, "Claimed for ClaimIdempotencyKey with a new key", claimed)
+
+	fixClock(testNow.Add(IDEMPOTENCY_CLAIM_TIMEOUT - time.Second))
+
+	k, claimed, apiErr := dbi.ClaimIdempotencyKey(ctx, "key-1", "abc123")
+
+	utils.AssertNoError(t, "Calling ClaimIdempotencyKey before the claim timeout", apiErr)
+	utils.AssertFalse(t, "Claimed for ClaimIdempotencyKey before the claim timeout", claimed)
+	utils.AssertFalse(t, "Completed for ClaimIdempotencyKey before the claim timeout", k.Completed)
+
+	fixClock(testNow.Add(IDEMPOTENCY_CLAIM_TIMEOUT))
+
+	_, claimed, apiErr = dbi.ClaimIdempotencyKey(ctx, "key-1", "def456")
+
+	utils.AssertNoError(t, "Calling ClaimIdempotencyKey for a different request after the claim timeout", apiErr)
+	utils.AssertFalse(t, "Claimed for ClaimIdempotencyKey for a different request after the claim timeout", claimed)
+
+	_, claimed, apiErr = dbi.ClaimIdempotencyKey(ctx, "key-1", "abc123")
+
+	utils.AssertNoError(t, "Calling ClaimIdempotencyKey after the claim timeout", apiErr)
+	utils.AssertTrue(t, "Claimed for ClaimIdempotencyKey after the claim timeout", claimed)
+
+	_, claimed, _ = dbi.ClaimIdempotencyKey(ctx, "key-1", "abc123")
+	utils.AssertFalse(t, "Claimed for ClaimIdempotencyKey again after it is taken over", claimed)
+
+	utils.AssertNoError(t, "Calling CompleteIdempotencyKey", dbi.CompleteIdempotencyKey(ctx, "key-1", 1009))
+
+	fixClock(testNow.Add(2 * IDEMPOTENCY_CLAIM_TIMEOUT))
+
+	k, claimed, apiErr = dbi.ClaimIdempotencyKey(ctx, "key-1", "abc123")
+
+	utils.AssertNoError(t, "Calling ClaimIdempotencyKey with a completed key", apiErr)
+	utils.AssertFalse(t, "Claimed for ClaimIdempotencyKey with a completed key after the claim timeout", claimed)
+	utils.AssertEquals(t, "ResponseId for ClaimIdempotencyKey with a completed key", 1009, k.ResponseId)
+}
+
+func TestMemoryAbandonedIdempotencyKeys(t *testing.T) {
+
+	dbi := NewMemoryDbi()
+	defer dbi.Close()
+
+	testAbandonedIdempotencyKeys(t, dbi)
+}
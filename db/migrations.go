@@ -0,0 +1,674 @@
+package db
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	QUERY_CREATE_SCHEMA_MIGRATIONS = `CREATE TABLE IF NOT EXISTS schema_migrations (
+                                        version     INT          NOT NULL,
+                                        description VARCHAR(256) NOT NULL,
+                                        applied_at  TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                                        PRIMARY KEY (version)
+                                      )
+                                        ENGINE = INNODB`
+
+	QUERY_GET_SCHEMA_VERSION    = "SELECT COALESCE(MAX(version), 0) FROM schema_migrations"
+	QUERY_ADD_SCHEMA_MIGRATION  = "INSERT INTO schema_migrations (version, description) VALUES (?, ?)"
+	QUERY_DROP_SCHEMA_MIGRATION = "DELETE FROM schema_migrations WHERE version = ?"
+
+	MESSAGE_SCHEMA_BEHIND     = "Fatal database error: schema version %v is behind the required version %v: run migrate up"
+	MESSAGE_BAD_SCHEMA_TARGET = "%v: no schema version %v"
+)
+
+// A numbered schema migration, with the statements which apply it and the statements which revert it
+type Migration struct {
+	Version     int
+	Description string
+	Up          []string
+	Down        []string
+}
+
+// The schema migrations in version order, for MySQL. Applied migrations must never be edited: add a new migration
+// instead, with its equivalent in postgresMigrations.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "baseline customers, vendors, cards, movements, authorisations and auth_movements",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS customers (
+              id       INT          NOT NULL AUTO_INCREMENT,
+              fullname VARCHAR(256) NOT NULL,
+              PRIMARY KEY (id)
+            )
+              ENGINE = INNODB AUTO_INCREMENT = 1001`,
+
+			`CREATE TABLE IF NOT EXISTS vendors (
+              id          INT          NOT NULL AUTO_INCREMENT,
+              vendor_name VARCHAR(256) NOT NULL,
+              balance     INT NOT NULL DEFAULT 0,
+              PRIMARY KEY (id)
+            )
+              ENGINE = INNODB AUTO_INCREMENT = 1001`,
+
+			`CREATE TABLE IF NOT EXISTS cards (
+              id          INT NOT NULL AUTO_INCREMENT,
+              customer_id INT NOT NULL,
+              balance     INT NOT NULL DEFAULT 0,
+              available   INT NOT NULL DEFAULT 0,
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+              PRIMARY KEY (id),
+              INDEX card_customer_idx (customer_id),
+              FOREIGN KEY (customer_id)
+              REFERENCES customers (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )
+              ENGINE = INNODB AUTO_INCREMENT = 100001`,
+
+			`CREATE TABLE IF NOT EXISTS movements (
+              id            INT          NOT NULL AUTO_INCREMENT,
+              card_id       INT,
+              movement_type VARCHAR(256) NOT NULL,
+              description   VARCHAR(256) NOT NULL,
+              amount        INT          NOT NULL,
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+              PRIMARY KEY (id),
+              INDEX movement_card_idx (card_id),
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )
+              ENGINE = INNODB AUTO_INCREMENT = 1001`,
+
+			`CREATE TABLE IF NOT EXISTS authorisations (
+              id          INT          NOT NULL AUTO_INCREMENT,
+              card_id     INT,
+              vendor_id   INT,
+              description VARCHAR(256) NOT NULL,
+              amount      INT          NOT NULL,
+              captured    INT          NOT NULL DEFAULT 0,
+              refunded    INT          NOT NULL DEFAULT 0,
+              reversed    INT          NOT NULL DEFAULT 0,
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+              PRIMARY KEY (id),
+              INDEX authorisation_card_idx (card_id),
+              INDEX authorisation_vendor_idx (vendor_id),
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT,
+              FOREIGN KEY (vendor_id)
+              REFERENCES vendors (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )
+              ENGINE = INNODB AUTO_INCREMENT = 1001`,
+
+			`CREATE TABLE IF NOT EXISTS auth_movements (
+              id               INT          NOT NULL AUTO_INCREMENT,
+              authorisation_id INT,
+              movement_type    VARCHAR(256) NOT NULL,
+              description      VARCHAR(256) NOT NULL,
+              amount           INT          NOT NULL,
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+              PRIMARY KEY (id),
+              INDEX movement_auth_idx (authorisation_id),
+              FOREIGN KEY (authorisation_id)
+              REFERENCES authorisations (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )
+              ENGINE = INNODB AUTO_INCREMENT = 1001`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS auth_movements",
+			"DROP TABLE IF EXISTS movements",
+			"DROP TABLE IF EXISTS authorisations",
+			"DROP TABLE IF EXISTS cards",
+			"DROP TABLE IF EXISTS customers",
+			"DROP TABLE IF EXISTS vendors",
+		},
+	},
+	{
+		Version:     2,
+		Description: "idempotency_keys",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS idempotency_keys (
+              idempotency_key VARCHAR(255) NOT NULL,
+              fingerprint     CHAR(64)     NOT NULL,
+              response_id     INT,
+              ts              TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+              PRIMARY KEY (idempotency_key)
+            )
+              ENGINE = INNODB`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS idempotency_keys",
+		},
+	},
+	{
+		Version:     3,
+		Description: "ledger_entries and ledger_postings",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS ledger_entries (
+              id           INT          NOT NULL AUTO_INCREMENT,
+              entry_type   VARCHAR(256) NOT NULL,
+              description  VARCHAR(256) NOT NULL,
+              reference_id INT          NOT NULL,
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+              PRIMARY KEY (id)
+            )
+              ENGINE = INNODB AUTO_INCREMENT = 1001`,
+
+			`CREATE TABLE IF NOT EXISTS ledger_postings (
+              id       INT         NOT NULL AUTO_INCREMENT,
+              entry_id INT         NOT NULL,
+              account  VARCHAR(64) NOT NULL,
+              amount   INT         NOT NULL,
+              PRIMARY KEY (id),
+              INDEX posting_entry_idx (entry_id),
+              INDEX posting_account_idx (account),
+              FOREIGN KEY (entry_id)
+              REFERENCES ledger_entries (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )
+              ENGINE = INNODB AUTO_INCREMENT = 1001`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS ledger_postings",
+			"DROP TABLE IF EXISTS ledger_entries",
+		},
+	},
+	{
+		Version:     4,
+		Description: "authorisations expires_at",
+		// existing authorisations are left with a NULL expiry, so never expire
+		Up: []string{
+			`ALTER TABLE authorisations
+              ADD COLUMN expires_at DATETIME NULL,
+              ADD INDEX authorisation_expiry_idx (expires_at)`,
+		},
+		Down: []string{
+			`ALTER TABLE authorisations
+              DROP INDEX authorisation_expiry_idx,
+              DROP COLUMN expires_at`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "cards status",
+		Up: []string{
+			`ALTER TABLE cards
+              ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'ACTIVE'`,
+		},
+		Down: []string{
+			`ALTER TABLE cards
+              DROP COLUMN status`,
+		},
+	},
+	{
+		Version:     6,
+		Description: "movements related_movement_id",
+		// the paired movement of a transfer, NULL for other movements
+		Up: []string{
+			`ALTER TABLE movements
+              ADD COLUMN related_movement_id INT NULL`,
+		},
+		Down: []string{
+			`ALTER TABLE movements
+              DROP COLUMN related_movement_id`,
+		},
+	},
+	{
+		Version:     7,
+		Description: "currencies",
+		// existing cards, vendors and authorisations are all in pounds; rate converts an authorisation's amounts
+		// into those of its card, and is fixed when it is made
+		Up: []string{
+			`ALTER TABLE cards
+              ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'GBP'`,
+			`ALTER TABLE vendors
+              ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'GBP'`,
+			`ALTER TABLE authorisations
+              ADD COLUMN currency      CHAR(3) NOT NULL DEFAULT 'GBP',
+              ADD COLUMN card_currency CHAR(3) NOT NULL DEFAULT 'GBP',
+              ADD COLUMN rate          DOUBLE  NOT NULL DEFAULT 1`,
+		},
+		Down: []string{
+			`ALTER TABLE authorisations
+              DROP COLUMN rate,
+              DROP COLUMN card_currency,
+              DROP COLUMN currency`,
+			`ALTER TABLE vendors
+              DROP COLUMN currency`,
+			`ALTER TABLE cards
+              DROP COLUMN currency`,
+		},
+	},
+	{
+		Version:     8,
+		Description: "card_limits and customer_limits",
+		// a limit of 0 is no limit, or for a card the customer's default
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS customer_limits (
+              customer_id           INT NOT NULL,
+              max_transaction       INT NOT NULL DEFAULT 0,
+              daily_spend           INT NOT NULL DEFAULT 0,
+              monthly_spend         INT NOT NULL DEFAULT 0,
+              hourly_authorisations INT NOT NULL DEFAULT 0,
+              vendor_daily_spend    INT NOT NULL DEFAULT 0,
+              PRIMARY KEY (customer_id),
+              FOREIGN KEY (customer_id)
+              REFERENCES customers (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )
+              ENGINE = INNODB`,
+
+			`CREATE TABLE IF NOT EXISTS card_limits (
+              card_id               INT NOT NULL,
+              max_transaction       INT NOT NULL DEFAULT 0,
+              daily_spend           INT NOT NULL DEFAULT 0,
+              monthly_spend         INT NOT NULL DEFAULT 0,
+              hourly_authorisations INT NOT NULL DEFAULT 0,
+              vendor_daily_spend    INT NOT NULL DEFAULT 0,
+              PRIMARY KEY (card_id),
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )
+              ENGINE = INNODB`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS card_limits",
+			"DROP TABLE IF EXISTS customer_limits",
+		},
+	},
+	{
+		Version:     9,
+		Description: "authorisations status",
+		// REVIEW for an authorisation held for review by the risk evaluation, which cannot be captured until cleared
+		Up: []string{
+			`ALTER TABLE authorisations
+              ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'APPROVED'`,
+		},
+		Down: []string{
+			`ALTER TABLE authorisations
+              DROP COLUMN status`,
+		},
+	},
+	{
+		Version:     10,
+		Description: "authorisations disputes",
+		// the amount of a dispute provisionally credited to the card or charged back, and its status, NULL if none
+		Up: []string{
+			`ALTER TABLE authorisations
+              ADD COLUMN disputed       INT         NOT NULL DEFAULT 0,
+              ADD COLUMN dispute_status VARCHAR(16) NULL`,
+		},
+		Down: []string{
+			`ALTER TABLE authorisations
+              DROP COLUMN dispute_status,
+              DROP COLUMN disputed`,
+		},
+	},
+	{
+		Version:     11,
+		Description: "settlements",
+		// the auth movements paid out to a vendor by a settlement are marked with it, so that each is settled once
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS settlements (
+              id           INT     NOT NULL AUTO_INCREMENT,
+              vendor_id    INT     NOT NULL,
+              captured     INT     NOT NULL DEFAULT 0,
+              refunded     INT     NOT NULL DEFAULT 0,
+              charged_back INT     NOT NULL DEFAULT 0,
+              fees         INT     NOT NULL DEFAULT 0,
+              net          INT     NOT NULL DEFAULT 0,
+              currency     CHAR(3) NOT NULL,
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+              PRIMARY KEY (id),
+              INDEX settlement_vendor_idx (vendor_id),
+              FOREIGN KEY (vendor_id)
+              REFERENCES vendors (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )
+              ENGINE = INNODB AUTO_INCREMENT = 1001`,
+
+			`ALTER TABLE auth_movements
+              ADD COLUMN settlement_id INT NULL,
+              ADD INDEX auth_movement_settlement_idx (settlement_id)`,
+		},
+		Down: []string{
+			`ALTER TABLE auth_movements
+              DROP INDEX auth_movement_settlement_idx,
+              DROP COLUMN settlement_id`,
+			"DROP TABLE IF EXISTS settlements",
+		},
+	},
+	{
+		Version:     12,
+		Description: "vendor fees",
+		// the fee schedule of a vendor, or else of its category, is charged on each capture and settled with it
+		Up: []string{
+			`ALTER TABLE vendors
+              ADD COLUMN category VARCHAR(32) NOT NULL DEFAULT ''`,
+
+			`CREATE TABLE IF NOT EXISTS category_fees (
+              category     VARCHAR(32) NOT NULL,
+              basis_points INT         NOT NULL DEFAULT 0,
+              fixed_amount INT         NOT NULL DEFAULT 0,
+              PRIMARY KEY (category)
+            )
+              ENGINE = INNODB`,
+
+			`CREATE TABLE IF NOT EXISTS vendor_fees (
+              vendor_id    INT NOT NULL,
+              basis_points INT NOT NULL DEFAULT 0,
+              fixed_amount INT NOT NULL DEFAULT 0,
+              PRIMARY KEY (vendor_id),
+              FOREIGN KEY (vendor_id)
+              REFERENCES vendors (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )
+              ENGINE = INNODB`,
+
+			`ALTER TABLE settlements
+              ADD COLUMN capture_fees INT NOT NULL DEFAULT 0`,
+		},
+		Down: []string{
+			`ALTER TABLE settlements
+              DROP COLUMN capture_fees`,
+			"DROP TABLE IF EXISTS vendor_fees",
+			"DROP TABLE IF EXISTS category_fees",
+			`ALTER TABLE vendors
+              DROP COLUMN category`,
+		},
+	},
+	{
+		Version:     13,
+		Description: "merchant category codes",
+		// the ISO 18245 code of a vendor, and that of an authorisation's vendor when it was made, '' if none. A card's
+		// controls allow or block a code each
+		Up: []string{
+			`ALTER TABLE vendors
+              ADD COLUMN mcc VARCHAR(4) NOT NULL DEFAULT ''`,
+
+			`ALTER TABLE authorisations
+              ADD COLUMN mcc VARCHAR(4) NOT NULL DEFAULT ''`,
+
+			`CREATE TABLE IF NOT EXISTS card_mcc_controls (
+              card_id INT        NOT NULL,
+              mcc     VARCHAR(4) NOT NULL,
+              control VARCHAR(8) NOT NULL,
+              PRIMARY KEY (card_id, mcc),
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )
+              ENGINE = INNODB`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS card_mcc_controls",
+			`ALTER TABLE authorisations
+              DROP COLUMN mcc`,
+			`ALTER TABLE vendors
+              DROP COLUMN mcc`,
+		},
+	},
+	{
+		Version:     14,
+		Description: "mandates",
+		// a mandate is charged when the later of next_run_at, the start of its period, and retry_at, set after a
+		// refusal for insufficient funds, has passed. Each attempt is recorded as a mandate run
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS mandates (
+              id          INT          NOT NULL AUTO_INCREMENT,
+              card_id     INT          NOT NULL,
+              vendor_id   INT          NOT NULL,
+              amount      INT          NOT NULL,
+              max_amount  INT          NOT NULL,
+              currency    CHAR(3)      NOT NULL,
+              frequency   VARCHAR(8)   NOT NULL,
+              description VARCHAR(255) NOT NULL,
+              end_date    VARCHAR(10)  NOT NULL DEFAULT '',
+              next_run_at DATETIME     NOT NULL,
+              retry_at    DATETIME     NULL,
+              failures    INT          NOT NULL DEFAULT 0,
+              status      VARCHAR(16)  NOT NULL DEFAULT 'ACTIVE',
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+              PRIMARY KEY (id),
+              INDEX mandate_due_idx (status, next_run_at),
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT,
+              FOREIGN KEY (vendor_id)
+              REFERENCES vendors (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )
+              ENGINE = INNODB AUTO_INCREMENT = 1001`,
+
+			`CREATE TABLE IF NOT EXISTS mandate_runs (
+              id               INT          NOT NULL AUTO_INCREMENT,
+              mandate_id       INT          NOT NULL,
+              authorisation_id INT          NULL,
+              amount           INT          NOT NULL,
+              status           VARCHAR(16)  NOT NULL,
+              reason           VARCHAR(255) NOT NULL DEFAULT '',
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+              PRIMARY KEY (id),
+              INDEX mandate_run_mandate_idx (mandate_id),
+              FOREIGN KEY (mandate_id)
+              REFERENCES mandates (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )
+              ENGINE = INNODB AUTO_INCREMENT = 1001`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS mandate_runs",
+			"DROP TABLE IF EXISTS mandates",
+		},
+	},
+	{
+		Version:     15,
+		Description: "mandate anchor days",
+		// the day of the month on which a monthly mandate's periods start, that on which it was added, and the last
+		// day of a shorter month. 0 for a mandate added before, whose periods start on the day of its next_run_at
+		Up: []string{
+			`ALTER TABLE mandates
+              ADD COLUMN anchor_day INT NOT NULL DEFAULT 0`,
+		},
+		Down: []string{
+			`ALTER TABLE mandates
+              DROP COLUMN anchor_day`,
+		},
+	},
+	{
+		Version:     16,
+		Description: "authorisations creation times",
+		// ts records when an authorisation was made, from which it counts towards the card's limits, rather than
+		// when it was last changed, as in the other dialects
+		Up: []string{
+			`ALTER TABLE authorisations
+              MODIFY ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+              ADD INDEX authorisation_card_ts_idx (card_id, ts)`,
+		},
+		Down: []string{
+			`ALTER TABLE authorisations
+              DROP INDEX authorisation_card_ts_idx,
+              MODIFY ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP`,
+		},
+	},
+	{
+		Version:     17,
+		Description: "ledger posting currencies",
+		// postings made before this migration have no currency
+		Up: []string{
+			"ALTER TABLE ledger_postings ADD COLUMN currency CHAR(3) NOT NULL DEFAULT ''",
+		},
+		Down: []string{
+			"ALTER TABLE ledger_postings DROP COLUMN currency",
+		},
+	},
+}
+
+// Migrations returns the schema migrations in version order. The statements are those for MySQL
+func Migrations() []Migration {
+	return migrations
+}
+
+// LatestSchemaVersion returns the schema version required by this package
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the last migration applied to a database, or 0 if none has been applied
+func SchemaVersion(db *sql.DB) (int, models.ApiError) {
+
+	var version int
+
+	err := db.QueryRow(QUERY_GET_SCHEMA_VERSION).Scan(&version)
+
+	if err != nil {
+
+		if dialectOf(db).noSuchTable(err) {
+			return 0, nil
+		}
+
+		return 0, models.ErrorWrap(err)
+	}
+
+	return version, nil
+}
+
+// CheckSchemaVersion returns an error if a database has not been migrated up to the latest schema version
+func CheckSchemaVersion(db *sql.DB) models.ApiError {
+
+	version, apiErr := SchemaVersion(db)
+
+	if apiErr != nil {
+		return apiErr
+	}
+
+	if version < LatestSchemaVersion() {
+		return models.ConstructApiError(http.StatusServiceUnavailable, MESSAGE_SCHEMA_BEHIND, version, LatestSchemaVersion())
+	}
+
+	return nil
+}
+
+// MigrateUp applies the migrations after the current schema version up to and including the target version,
+// returning the migrations applied
+func MigrateUp(db *sql.DB, target int) ([]Migration, models.ApiError) {
+
+	var applied []Migration
+
+	if target < 0 || target > LatestSchemaVersion() {
+		return applied, models.ConstructApiError(400, MESSAGE_BAD_SCHEMA_TARGET, "MigrateUp", target)
+	}
+
+	dl := dialectOf(db)
+
+	_, err := db.Exec(dl.createSchemaMigrations)
+
+	if err != nil {
+		return applied, models.ErrorWrap(err)
+	}
+
+	version, apiErr := SchemaVersion(db)
+
+	if apiErr != nil {
+		return applied, apiErr
+	}
+
+	for _, m := range dl.migrations {
+
+		if m.Version <= version || m.Version > target {
+			continue
+		}
+
+		apiErr = applyMigration(db, m.Up, dl.rewrite(QUERY_ADD_SCHEMA_MIGRATION), m.Version, m.Description)
+
+		if apiErr != nil {
+			return applied, apiErr
+		}
+
+		applied = append(applied, m)
+	}
+
+	return applied, nil
+}
+
+// MigrateDown reverts the migrations after the target version down from the current schema version, returning the
+// migrations reverted
+func MigrateDown(db *sql.DB, target int) ([]Migration, models.ApiError) {
+
+	var reverted []Migration
+
+	if target < 0 || target > LatestSchemaVersion() {
+		return reverted, models.ConstructApiError(400, MESSAGE_BAD_SCHEMA_TARGET, "MigrateDown", target)
+	}
+
+	version, apiErr := SchemaVersion(db)
+
+	if apiErr != nil {
+		return reverted, apiErr
+	}
+
+	dl := dialectOf(db)
+
+	for i := len(dl.migrations) - 1; i >= 0; i-- {
+
+		m := dl.migrations[i]
+
+		if m.Version > version || m.Version <= target {
+			continue
+		}
+
+		apiErr = applyMigration(db, m.Down, dl.rewrite(QUERY_DROP_SCHEMA_MIGRATION), m.Version)
+
+		if apiErr != nil {
+			return reverted, apiErr
+		}
+
+		reverted = append(reverted, m)
+	}
+
+	return reverted, nil
+}
+
+// Execute the statements of a migration, then record the change of version. MySQL DDL statements commit implicitly
+// so cannot be rolled back, which is why the Up statements are written to be safely re-run where MySQL allows it.
+// The Postgres statements are run the same way, so are also written to be re-run.
+func applyMigration(db *sql.DB, statements []string, versionQry string, versionArgs ...interface{}) models.ApiError {
+
+	for _, statement := range statements {
+
+		_, err := db.Exec(statement)
+
+		if err != nil {
+			return models.ErrorWrap(err)
+		}
+	}
+
+	_, err := db.Exec(versionQry, versionArgs...)
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	return nil
+}
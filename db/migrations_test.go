@@ -0,0 +1,141 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestMigrationVersionsAreSequential(t *testing.T) {
+
+	for i, m := range Migrations() {
+		utils.AssertEquals(t, "Version of migration "+m.Description, i+1, m.Version)
+		utils.AssertTrue(t, "Migration "+m.Description+" has up statements", len(m.Up) > 0)
+		utils.AssertTrue(t, "Migration "+m.Description+" has down statements", len(m.Down) > 0)
+	}
+}
+
+func TestSchemaVersionNoTable(t *testing.T) {
+
+	mockDb, expecter, _ := sqlmock.New()
+	defer mockDb.Close()
+
+	err := &mysql.MySQLError{
+		Number:  MYSQL_ERROR_NO_SUCH_TABLE,
+		Message: "(No such table)",
+	}
+
+	expecter.ExpectQuery(esc(QUERY_GET_SCHEMA_VERSION)).WillReturnError(err)
+
+	version, apiErr := SchemaVersion(mockDb)
+
+	utils.AssertNoError(t, "Calling SchemaVersion without a schema_migrations table", apiErr)
+	utils.AssertEquals(t, "Schema version without a schema_migrations table", 0, version)
+	utils.AssertNoError(t, "Calling ExpectationsWereMet", expecter.ExpectationsWereMet())
+}
+
+func TestCheckSchemaVersionBehind(t *testing.T) {
+
+	mockDb, expecter, _ := sqlmock.New()
+	defer mockDb.Close()
+
+	expected := sqlmock.NewRows([]string{"version"}).AddRow(LatestSchemaVersion() - 1)
+
+	expecter.ExpectQuery(esc(QUERY_GET_SCHEMA_VERSION)).WillReturnRows(expected)
+
+	apiErr := CheckSchemaVersion(mockDb)
+
+	utils.AssertEquals(t, "Return status for CheckSchemaVersion with a schema behind", 503, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for CheckSchemaVersion with a schema behind",
+		fmt.Sprintf(MESSAGE_SCHEMA_BEHIND, LatestSchemaVersion()-1, LatestSchemaVersion()), apiErr.Error())
+	utils.AssertNoError(t, "Calling ExpectationsWereMet", expecter.ExpectationsWereMet())
+}
+
+func TestCheckSchemaVersionLatest(t *testing.T) {
+
+	mockDb, expecter, _ := sqlmock.New()
+	defer mockDb.Close()
+
+	expected := sqlmock.NewRows([]string{"version"}).AddRow(LatestSchemaVersion())
+
+	expecter.ExpectQuery(esc(QUERY_GET_SCHEMA_VERSION)).WillReturnRows(expected)
+
+	utils.AssertNoError(t, "Calling CheckSchemaVersion with the latest schema", CheckSchemaVersion(mockDb))
+	utils.AssertNoError(t, "Calling ExpectationsWereMet", expecter.ExpectationsWereMet())
+}
+
+func TestMigrateUp(t *testing.T) {
+
+	mockDb, expecter, _ := sqlmock.New()
+	defer mockDb.Close()
+
+	expecter.ExpectExec(esc(QUERY_CREATE_SCHEMA_MIGRATIONS)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	expected := sqlmock.NewRows([]string{"version"}).AddRow(1)
+
+	expecter.ExpectQuery(esc(QUERY_GET_SCHEMA_VERSION)).WillReturnRows(expected)
+
+	// only the migrations after version 1 should be applied
+	for _, m := range Migrations()[1:] {
+
+		for _, statement := range m.Up {
+			expecter.ExpectExec(esc(statement)).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+
+		expecter.ExpectExec(esc(QUERY_ADD_SCHEMA_MIGRATION)).WithArgs(m.Version, m.Description).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	applied, apiErr := MigrateUp(mockDb, LatestSchemaVersion())
+
+	utils.AssertNoError(t, "Calling MigrateUp", apiErr)
+	utils.AssertEquals(t, "Number of migrations applied by MigrateUp", LatestSchemaVersion()-1, len(applied))
+	utils.AssertNoError(t, "Calling ExpectationsWereMet", expecter.ExpectationsWereMet())
+}
+
+func TestMigrateDown(t *testing.T) {
+
+	mockDb, expecter, _ := sqlmock.New()
+	defer mockDb.Close()
+
+	expected := sqlmock.NewRows([]string{"version"}).AddRow(LatestSchemaVersion())
+
+	expecter.ExpectQuery(esc(QUERY_GET_SCHEMA_VERSION)).WillReturnRows(expected)
+
+	for i := len(Migrations()) - 1; i >= 0; i-- {
+
+		m := Migrations()[i]
+
+		for _, statement := range m.Down {
+			expecter.ExpectExec(esc(statement)).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+
+		expecter.ExpectExec(esc(QUERY_DROP_SCHEMA_MIGRATION)).WithArgs(m.Version).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	reverted, apiErr := MigrateDown(mockDb, 0)
+
+	utils.AssertNoError(t, "Calling MigrateDown", apiErr)
+	utils.AssertEquals(t, "Number of migrations reverted by MigrateDown", LatestSchemaVersion(), len(reverted))
+	utils.AssertEquals(t, "First migration reverted by MigrateDown", LatestSchemaVersion(), reverted[0].Version)
+	utils.AssertNoError(t, "Calling ExpectationsWereMet", expecter.ExpectationsWereMet())
+}
+
+func TestMigrateBadTarget(t *testing.T) {
+
+	mockDb, _, _ := sqlmock.New()
+	defer mockDb.Close()
+
+	_, apiErr := MigrateUp(mockDb, LatestSchemaVersion()+1)
+
+	utils.AssertEquals(t, "Return status for MigrateUp to an unknown version", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for MigrateUp to an unknown version",
+		fmt.Sprintf(MESSAGE_BAD_SCHEMA_TARGET, "MigrateUp", LatestSchemaVersion()+1), apiErr.Error())
+
+	_, apiErr = MigrateDown(mockDb, -1)
+
+	utils.AssertEquals(t, "Return status for MigrateDown to an unknown version", 400, apiErr.StatusCode())
+}
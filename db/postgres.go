@@ -0,0 +1,494 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	POSTGRES_CREATE_SCHEMA_MIGRATIONS = `CREATE TABLE IF NOT EXISTS schema_migrations (
+                                        version     INT          NOT NULL,
+                                        description VARCHAR(256) NOT NULL,
+                                        applied_at  TIMESTAMP DEFAULT (now() AT TIME ZONE 'UTC'),
+                                        PRIMARY KEY (version)
+                                      )`
+)
+
+// The inserts whose callers use the id of the new row, which Postgres returns from the insert itself
+var insertsReturningId = map[string]bool{
+	QUERY_ADD_VENDOR:            true,
+	QUERY_ADD_CUSTOMER:          true,
+	QUERY_ADD_CARD:              true,
+	QUERY_ADD_AUTHORISATION:     true,
+	QUERY_ADD_MOVEMENT:          true,
+	QUERY_ADD_TRANSFER_MOVEMENT: true,
+	QUERY_ADD_AUTH_MOVEMENT:     true,
+	QUERY_ADD_LEDGER_ENTRY:      true,
+	QUERY_ADD_LEDGER_POSTING:    true,
+	QUERY_ADD_SETTLEMENT:        true,
+	QUERY_ADD_MANDATE:           true,
+	QUERY_ADD_MANDATE_RUN:       true,
+}
+
+// Rewrite a MySQL query for Postgres, numbering its ? placeholders as $1, $2... and returning the id of the new row
+// from an insert. None of the queries contains a literal ?
+func postgresQuery(qry string) string {
+
+	var b strings.Builder
+
+	n := 0
+
+	for _, r := range qry {
+
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+
+	if insertsReturningId[qry] {
+		b.WriteString(" RETURNING id")
+	}
+
+	return b.String()
+}
+
+// The Postgres equivalents of the MySQL migrations, version for version. Timestamps default to UTC, as MySQL
+// TIMESTAMPs are read through a UTC connection. MySQL's ON UPDATE CURRENT_TIMESTAMP has no equivalent without a
+// trigger, so ts records when a row was created.
+var postgresMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "baseline customers, vendors, cards, movements, authorisations and auth_movements",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS customers (
+              id       INT GENERATED BY DEFAULT AS IDENTITY (START WITH 1001),
+              fullname VARCHAR(256) NOT NULL,
+              PRIMARY KEY (id)
+            )`,
+
+			`CREATE TABLE IF NOT EXISTS vendors (
+              id          INT GENERATED BY DEFAULT AS IDENTITY (START WITH 1001),
+              vendor_name VARCHAR(256) NOT NULL,
+              balance     INT NOT NULL DEFAULT 0,
+              PRIMARY KEY (id)
+            )`,
+
+			`CREATE TABLE IF NOT EXISTS cards (
+              id          INT GENERATED BY DEFAULT AS IDENTITY (START WITH 100001),
+              customer_id INT NOT NULL,
+              balance     INT NOT NULL DEFAULT 0,
+              available   INT NOT NULL DEFAULT 0,
+              ts TIMESTAMP DEFAULT (now() AT TIME ZONE 'UTC'),
+              PRIMARY KEY (id),
+              FOREIGN KEY (customer_id)
+              REFERENCES customers (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			"CREATE INDEX IF NOT EXISTS card_customer_idx ON cards (customer_id)",
+
+			`CREATE TABLE IF NOT EXISTS movements (
+              id            INT GENERATED BY DEFAULT AS IDENTITY (START WITH 1001),
+              card_id       INT,
+              movement_type VARCHAR(256) NOT NULL,
+              description   VARCHAR(256) NOT NULL,
+              amount        INT          NOT NULL,
+              ts TIMESTAMP DEFAULT (now() AT TIME ZONE 'UTC'),
+              PRIMARY KEY (id),
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			"CREATE INDEX IF NOT EXISTS movement_card_idx ON movements (card_id)",
+
+			`CREATE TABLE IF NOT EXISTS authorisations (
+              id          INT GENERATED BY DEFAULT AS IDENTITY (START WITH 1001),
+              card_id     INT,
+              vendor_id   INT,
+              description VARCHAR(256) NOT NULL,
+              amount      INT          NOT NULL,
+              captured    INT          NOT NULL DEFAULT 0,
+              refunded    INT          NOT NULL DEFAULT 0,
+              reversed    INT          NOT NULL DEFAULT 0,
+              ts TIMESTAMP DEFAULT (now() AT TIME ZONE 'UTC'),
+              PRIMARY KEY (id),
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT,
+              FOREIGN KEY (vendor_id)
+              REFERENCES vendors (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			"CREATE INDEX IF NOT EXISTS authorisation_card_idx ON authorisations (card_id)",
+			"CREATE INDEX IF NOT EXISTS authorisation_vendor_idx ON authorisations (vendor_id)",
+
+			`CREATE TABLE IF NOT EXISTS auth_movements (
+              id               INT GENERATED BY DEFAULT AS IDENTITY (START WITH 1001),
+              authorisation_id INT,
+              movement_type    VARCHAR(256) NOT NULL,
+              description      VARCHAR(256) NOT NULL,
+              amount           INT          NOT NULL,
+              ts TIMESTAMP DEFAULT (now() AT TIME ZONE 'UTC'),
+              PRIMARY KEY (id),
+              FOREIGN KEY (authorisation_id)
+              REFERENCES authorisations (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			"CREATE INDEX IF NOT EXISTS movement_auth_idx ON auth_movements (authorisation_id)",
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS auth_movements",
+			"DROP TABLE IF EXISTS movements",
+			"DROP TABLE IF EXISTS authorisations",
+			"DROP TABLE IF EXISTS cards",
+			"DROP TABLE IF EXISTS customers",
+			"DROP TABLE IF EXISTS vendors",
+		},
+	},
+	{
+		Version:     2,
+		Description: "idempotency_keys",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS idempotency_keys (
+              idempotency_key VARCHAR(255) NOT NULL,
+              fingerprint     CHAR(64)     NOT NULL,
+              response_id     INT,
+              ts              TIMESTAMP DEFAULT (now() AT TIME ZONE 'UTC'),
+              PRIMARY KEY (idempotency_key)
+            )`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS idempotency_keys",
+		},
+	},
+	{
+		Version:     3,
+		Description: "ledger_entries and ledger_postings",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS ledger_entries (
+              id           INT GENERATED BY DEFAULT AS IDENTITY (START WITH 1001),
+              entry_type   VARCHAR(256) NOT NULL,
+              description  VARCHAR(256) NOT NULL,
+              reference_id INT          NOT NULL,
+              ts TIMESTAMP DEFAULT (now() AT TIME ZONE 'UTC'),
+              PRIMARY KEY (id)
+            )`,
+
+			`CREATE TABLE IF NOT EXISTS ledger_postings (
+              id       INT GENERATED BY DEFAULT AS IDENTITY (START WITH 1001),
+              entry_id INT         NOT NULL,
+              account  VARCHAR(64) NOT NULL,
+              amount   INT         NOT NULL,
+              PRIMARY KEY (id),
+              FOREIGN KEY (entry_id)
+              REFERENCES ledger_entries (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			"CREATE INDEX IF NOT EXISTS posting_entry_idx ON ledger_postings (entry_id)",
+			"CREATE INDEX IF NOT EXISTS posting_account_idx ON ledger_postings (account)",
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS ledger_postings",
+			"DROP TABLE IF EXISTS ledger_entries",
+		},
+	},
+	{
+		Version:     4,
+		Description: "authorisations expires_at",
+		Up: []string{
+			"ALTER TABLE authorisations ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP NULL",
+			"CREATE INDEX IF NOT EXISTS authorisation_expiry_idx ON authorisations (expires_at)",
+		},
+		Down: []string{
+			"DROP INDEX IF EXISTS authorisation_expiry_idx",
+			"ALTER TABLE authorisations DROP COLUMN IF EXISTS expires_at",
+		},
+	},
+	{
+		Version:     5,
+		Description: "cards status",
+		Up: []string{
+			"ALTER TABLE cards ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'ACTIVE'",
+		},
+		Down: []string{
+			"ALTER TABLE cards DROP COLUMN IF EXISTS status",
+		},
+	},
+	{
+		Version:     6,
+		Description: "movements related_movement_id",
+		Up: []string{
+			"ALTER TABLE movements ADD COLUMN IF NOT EXISTS related_movement_id INT NULL",
+		},
+		Down: []string{
+			"ALTER TABLE movements DROP COLUMN IF EXISTS related_movement_id",
+		},
+	},
+	{
+		Version:     7,
+		Description: "currencies",
+		Up: []string{
+			"ALTER TABLE cards ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'GBP'",
+			"ALTER TABLE vendors ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'GBP'",
+			`ALTER TABLE authorisations
+              ADD COLUMN IF NOT EXISTS currency      CHAR(3)          NOT NULL DEFAULT 'GBP',
+              ADD COLUMN IF NOT EXISTS card_currency CHAR(3)          NOT NULL DEFAULT 'GBP',
+              ADD COLUMN IF NOT EXISTS rate          DOUBLE PRECISION NOT NULL DEFAULT 1`,
+		},
+		Down: []string{
+			`ALTER TABLE authorisations
+              DROP COLUMN IF EXISTS rate,
+              DROP COLUMN IF EXISTS card_currency,
+              DROP COLUMN IF EXISTS currency`,
+			"ALTER TABLE vendors DROP COLUMN IF EXISTS currency",
+			"ALTER TABLE cards DROP COLUMN IF EXISTS currency",
+		},
+	},
+	{
+		Version:     8,
+		Description: "card_limits and customer_limits",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS customer_limits (
+              customer_id           INT NOT NULL,
+              max_transaction       INT NOT NULL DEFAULT 0,
+              daily_spend           INT NOT NULL DEFAULT 0,
+              monthly_spend         INT NOT NULL DEFAULT 0,
+              hourly_authorisations INT NOT NULL DEFAULT 0,
+              vendor_daily_spend    INT NOT NULL DEFAULT 0,
+              PRIMARY KEY (customer_id),
+              FOREIGN KEY (customer_id)
+              REFERENCES customers (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			`CREATE TABLE IF NOT EXISTS card_limits (
+              card_id               INT NOT NULL,
+              max_transaction       INT NOT NULL DEFAULT 0,
+              daily_spend           INT NOT NULL DEFAULT 0,
+              monthly_spend         INT NOT NULL DEFAULT 0,
+              hourly_authorisations INT NOT NULL DEFAULT 0,
+              vendor_daily_spend    INT NOT NULL DEFAULT 0,
+              PRIMARY KEY (card_id),
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS card_limits",
+			"DROP TABLE IF EXISTS customer_limits",
+		},
+	},
+	{
+		Version:     9,
+		Description: "authorisations status",
+		Up: []string{
+			"ALTER TABLE authorisations ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'APPROVED'",
+		},
+		Down: []string{
+			"ALTER TABLE authorisations DROP COLUMN IF EXISTS status",
+		},
+	},
+	{
+		Version:     10,
+		Description: "authorisations disputes",
+		Up: []string{
+			`ALTER TABLE authorisations
+              ADD COLUMN IF NOT EXISTS disputed       INT         NOT NULL DEFAULT 0,
+              ADD COLUMN IF NOT EXISTS dispute_status VARCHAR(16) NULL`,
+		},
+		Down: []string{
+			`ALTER TABLE authorisations
+              DROP COLUMN IF EXISTS dispute_status,
+              DROP COLUMN IF EXISTS disputed`,
+		},
+	},
+	{
+		Version:     11,
+		Description: "settlements",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS settlements (
+              id           INT GENERATED BY DEFAULT AS IDENTITY (START WITH 1001),
+              vendor_id    INT     NOT NULL,
+              captured     INT     NOT NULL DEFAULT 0,
+              refunded     INT     NOT NULL DEFAULT 0,
+              charged_back INT     NOT NULL DEFAULT 0,
+              fees         INT     NOT NULL DEFAULT 0,
+              net          INT     NOT NULL DEFAULT 0,
+              currency     CHAR(3) NOT NULL,
+              ts TIMESTAMP DEFAULT (now() AT TIME ZONE 'UTC'),
+              PRIMARY KEY (id),
+              FOREIGN KEY (vendor_id)
+              REFERENCES vendors (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			"CREATE INDEX IF NOT EXISTS settlement_vendor_idx ON settlements (vendor_id)",
+			"ALTER TABLE auth_movements ADD COLUMN IF NOT EXISTS settlement_id INT NULL",
+			"CREATE INDEX IF NOT EXISTS auth_movement_settlement_idx ON auth_movements (settlement_id)",
+		},
+		Down: []string{
+			"DROP INDEX IF EXISTS auth_movement_settlement_idx",
+			"ALTER TABLE auth_movements DROP COLUMN IF EXISTS settlement_id",
+			"DROP TABLE IF EXISTS settlements",
+		},
+	},
+	{
+		Version:     12,
+		Description: "vendor fees",
+		Up: []string{
+			"ALTER TABLE vendors ADD COLUMN IF NOT EXISTS category VARCHAR(32) NOT NULL DEFAULT ''",
+
+			`CREATE TABLE IF NOT EXISTS category_fees (
+              category     VARCHAR(32) NOT NULL,
+              basis_points INT         NOT NULL DEFAULT 0,
+              fixed_amount INT         NOT NULL DEFAULT 0,
+              PRIMARY KEY (category)
+            )`,
+
+			`CREATE TABLE IF NOT EXISTS vendor_fees (
+              vendor_id    INT NOT NULL,
+              basis_points INT NOT NULL DEFAULT 0,
+              fixed_amount INT NOT NULL DEFAULT 0,
+              PRIMARY KEY (vendor_id),
+              FOREIGN KEY (vendor_id)
+              REFERENCES vendors (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			"ALTER TABLE settlements ADD COLUMN IF NOT EXISTS capture_fees INT NOT NULL DEFAULT 0",
+		},
+		Down: []string{
+			"ALTER TABLE settlements DROP COLUMN IF EXISTS capture_fees",
+			"DROP TABLE IF EXISTS vendor_fees",
+			"DROP TABLE IF EXISTS category_fees",
+			"ALTER TABLE vendors DROP COLUMN IF EXISTS category",
+		},
+	},
+	{
+		Version:     13,
+		Description: "merchant category codes",
+		Up: []string{
+			"ALTER TABLE vendors ADD COLUMN IF NOT EXISTS mcc VARCHAR(4) NOT NULL DEFAULT ''",
+			"ALTER TABLE authorisations ADD COLUMN IF NOT EXISTS mcc VARCHAR(4) NOT NULL DEFAULT ''",
+
+			`CREATE TABLE IF NOT EXISTS card_mcc_controls (
+              card_id INT        NOT NULL,
+              mcc     VARCHAR(4) NOT NULL,
+              control VARCHAR(8) NOT NULL,
+              PRIMARY KEY (card_id, mcc),
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS card_mcc_controls",
+			"ALTER TABLE authorisations DROP COLUMN IF EXISTS mcc",
+			"ALTER TABLE vendors DROP COLUMN IF EXISTS mcc",
+		},
+	},
+	{
+		Version:     14,
+		Description: "mandates",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS mandates (
+              id          INT GENERATED BY DEFAULT AS IDENTITY (START WITH 1001),
+              card_id     INT          NOT NULL,
+              vendor_id   INT          NOT NULL,
+              amount      INT          NOT NULL,
+              max_amount  INT          NOT NULL,
+              currency    CHAR(3)      NOT NULL,
+              frequency   VARCHAR(8)   NOT NULL,
+              description VARCHAR(255) NOT NULL,
+              end_date    VARCHAR(10)  NOT NULL DEFAULT '',
+              next_run_at TIMESTAMP    NOT NULL,
+              retry_at    TIMESTAMP    NULL,
+              failures    INT          NOT NULL DEFAULT 0,
+              status      VARCHAR(16)  NOT NULL DEFAULT 'ACTIVE',
+              ts TIMESTAMP DEFAULT (now() AT TIME ZONE 'UTC'),
+              PRIMARY KEY (id),
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT,
+              FOREIGN KEY (vendor_id)
+              REFERENCES vendors (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			"CREATE INDEX IF NOT EXISTS mandate_due_idx ON mandates (status, next_run_at)",
+
+			`CREATE TABLE IF NOT EXISTS mandate_runs (
+              id               INT GENERATED BY DEFAULT AS IDENTITY (START WITH 1001),
+              mandate_id       INT          NOT NULL,
+              authorisation_id INT          NULL,
+              amount           INT          NOT NULL,
+              status           VARCHAR(16)  NOT NULL,
+              reason           VARCHAR(255) NOT NULL DEFAULT '',
+              ts TIMESTAMP DEFAULT (now() AT TIME ZONE 'UTC'),
+              PRIMARY KEY (id),
+              FOREIGN KEY (mandate_id)
+              REFERENCES mandates (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			"CREATE INDEX IF NOT EXISTS mandate_run_mandate_idx ON mandate_runs (mandate_id)",
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS mandate_runs",
+			"DROP TABLE IF EXISTS mandates",
+		},
+	},
+	{
+		Version:     15,
+		Description: "mandate anchor days",
+		Up: []string{
+			"ALTER TABLE mandates ADD COLUMN IF NOT EXISTS anchor_day INT NOT NULL DEFAULT 0",
+		},
+		Down: []string{
+			"ALTER TABLE mandates DROP COLUMN IF EXISTS anchor_day",
+		},
+	},
+	{
+		Version:     16,
+		Description: "authorisations creation times",
+		Up: []string{
+			"CREATE INDEX IF NOT EXISTS authorisation_card_ts_idx ON authorisations (card_id, ts)",
+		},
+		Down: []string{
+			"DROP INDEX IF EXISTS authorisation_card_ts_idx",
+		},
+	},
+	{
+		Version:     17,
+		Description: "ledger posting currencies",
+		Up: []string{
+			"ALTER TABLE ledger_postings ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT ''",
+		},
+		Down: []string{
+			"ALTER TABLE ledger_postings DROP COLUMN IF EXISTS currency",
+		},
+	},
+}
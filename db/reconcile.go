@@ -0,0 +1,268 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	QUERY_RECONCILE_CARDS = `SELECT c.id, c.balance, c.available,
+                            COALESCE((SELECT SUM(m.amount) FROM movements m WHERE m.card_id = c.id), 0),
+                            COALESCE((SELECT SUM(p.amount) FROM ledger_postings p WHERE p.account = CONCAT('card-available:', c.id)), 0),
+                            COALESCE((SELECT SUM(p.amount) FROM ledger_postings p WHERE p.account = CONCAT('card-held:', c.id)), 0)
+                            FROM cards c
+                            ORDER BY c.id`
+
+	QUERY_RECONCILE_AUTHORISATIONS = "SELECT id, amount, captured, reversed, refunded, card_id, currency, card_currency, rate, disputed FROM authorisations ORDER BY id"
+
+	QUERY_RECONCILE_VENDORS = `SELECT v.id, v.balance,
+                            COALESCE((SELECT SUM(p.amount) FROM ledger_postings p WHERE p.account = CONCAT('vendor:', v.id)), 0)
+                            FROM vendors v
+                            ORDER BY v.id`
+
+	CHECK_CARD_MOVEMENTS        = "card-balance-movements"
+	CHECK_CARD_HOLDS            = "card-available-holds"
+	CHECK_CARD_LEDGER_BALANCE   = "card-balance-ledger"
+	CHECK_CARD_LEDGER_AVAILABLE = "card-available-ledger"
+	CHECK_AUTH_CAPTURABLE       = "authorisation-captured-reversed"
+	CHECK_AUTH_REFUNDABLE       = "authorisation-refunded"
+	CHECK_VENDOR_LEDGER         = "vendor-balance-ledger"
+)
+
+// The stored and derived totals of a card which are checked by reconciliation
+type cardTotals struct {
+	id              int
+	balance         int
+	available       int
+	movements       int
+	holds           int
+	ledgerAvailable int
+	ledgerHeld      int
+}
+
+// The stored and derived totals of a vendor which are checked by reconciliation
+type vendorTotals struct {
+	id      int
+	balance int
+	ledger  int
+}
+
+// Accumulates the breaks found by reconciliation
+type reconciler struct {
+	report models.ReconciliationReport
+}
+
+func newReconciler() *reconciler {
+	return &reconciler{
+		report: models.ReconciliationReport{
+			Breaks: []models.ReconciliationBreak{},
+		},
+	}
+}
+
+func (r *reconciler) check(check, objectType string, id, expected, actual int, format string, args ...interface{}) {
+
+	if expected == actual {
+		return
+	}
+
+	r.report.Breaks = append(r.report.Breaks, models.ReconciliationBreak{
+		Check:       check,
+		ObjectType:  objectType,
+		Id:          id,
+		Expected:    expected,
+		Actual:      actual,
+		Description: fmt.Sprintf("%v %v: ", objectType, id) + fmt.Sprintf(format, args...),
+	})
+}
+
+// Returns the amount an authorisation holds on its card: the amount neither captured nor reversed, in the card's
+// currency. The totals are converted rather than the remainder, as Capture and Reverse release the hold
+func heldAmount(a models.Authorisation) int {
+	return cardAmount(a, a.Amount) - cardAmount(a, a.Captured+a.Reversed)
+}
+
+// The balance of a card is the sum of its movements, and the amount available is the balance less the amounts held by
+// authorisations which have been neither captured nor reversed. Both should agree with the ledger.
+func (r *reconciler) checkCard(ct cardTotals) {
+
+	r.report.CardsChecked++
+
+	r.check(CHECK_CARD_MOVEMENTS, "card", ct.id, ct.movements, ct.balance,
+		"balance %v does not equal the sum of its movements %v", ct.balance, ct.movements)
+	r.check(CHECK_CARD_HOLDS, "card", ct.id, ct.balance-ct.holds, ct.available,
+		"available %v does not equal balance %v less open holds %v", ct.available, ct.balance, ct.holds)
+	r.check(CHECK_CARD_LEDGER_AVAILABLE, "card", ct.id, ct.ledgerAvailable, ct.available,
+		"available %v does not equal its ledger account %v", ct.available, ct.ledgerAvailable)
+	r.check(CHECK_CARD_LEDGER_BALANCE, "card", ct.id, ct.ledgerAvailable+ct.ledgerHeld, ct.balance,
+		"balance %v does not equal its ledger accounts %v", ct.balance, ct.ledgerAvailable+ct.ledgerHeld)
+}
+
+// The rules behind Authorisation.Capturable() and Authorisation.Refundable()
+func (r *reconciler) checkAuthorisation(a models.Authorisation) {
+
+	r.report.AuthorisationsChecked++
+
+	if a.Captured+a.Reversed > a.Amount {
+		r.check(CHECK_AUTH_CAPTURABLE, "authorisation", a.Id, a.Amount, a.Captured+a.Reversed,
+			"captured %v plus reversed %v exceeds amount %v", a.Captured, a.Reversed, a.Amount)
+	}
+
+	if a.Refunded+a.Disputed > a.Captured {
+		r.check(CHECK_AUTH_REFUNDABLE, "authorisation", a.Id, a.Captured, a.Refunded+a.Disputed,
+			"refunded %v plus disputed %v exceeds captured %v", a.Refunded, a.Disputed, a.Captured)
+	}
+}
+
+// The balance of a vendor should agree with the ledger
+func (r *reconciler) checkVendor(vt vendorTotals) {
+
+	r.report.VendorsChecked++
+
+	r.check(CHECK_VENDOR_LEDGER, "vendor", vt.id, vt.ledger, vt.balance,
+		"balance %v does not equal its ledger account %v", vt.balance, vt.ledger)
+}
+
+func (r *reconciler) result() models.ReconciliationReport {
+
+	r.report.Ok = len(r.report.Breaks) == 0
+
+	return r.report
+}
+
+// Reconcile checks the balance invariants of every card, authorisation and vendor, and reports any breaks
+func (d *dbGate) Reconcile(ctx context.Context) (models.ReconciliationReport, models.ApiError) {
+
+	var (
+		cards []cardTotals
+		auths []models.Authorisation
+	)
+
+	r := newReconciler()
+
+	qry := QUERY_RECONCILE_CARDS
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return r.report, models.ErrorWrap(err)
+	}
+
+	rows, err := d.stmt(qry).QueryContext(ctx)
+
+	if err != nil {
+		return r.report, models.ErrorWrap(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var ct cardTotals
+
+		err := rows.Scan(&ct.id, &ct.balance, &ct.available, &ct.movements, &ct.ledgerAvailable, &ct.ledgerHeld)
+
+		if err != nil {
+			return r.report, models.ErrorWrap(err)
+		}
+
+		cards = append(cards, ct)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return r.report, models.ErrorWrap(err)
+	}
+
+	qry = QUERY_RECONCILE_AUTHORISATIONS
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return r.report, models.ErrorWrap(err)
+	}
+
+	authRows, err := d.stmt(qry).QueryContext(ctx)
+
+	if err != nil {
+		return r.report, models.ErrorWrap(err)
+	}
+
+	defer authRows.Close()
+
+	for authRows.Next() {
+
+		var a models.Authorisation
+
+		err := authRows.Scan(&a.Id, &a.Amount, &a.Captured, &a.Reversed, &a.Refunded, &a.CardId, &a.Currency, &a.CardCurrency, &a.Rate, &a.Disputed)
+
+		if err != nil {
+			return r.report, models.ErrorWrap(err)
+		}
+
+		auths = append(auths, a)
+	}
+
+	err = authRows.Err()
+
+	if err != nil {
+		return r.report, models.ErrorWrap(err)
+	}
+
+	// the holds are converted into the currency of each card at the rates of its authorisations, which SQL cannot
+	// round as Authorise and Capture do, so are totalled here
+	holds := make(map[int]int)
+
+	for _, a := range auths {
+		holds[a.CardId] += heldAmount(a)
+	}
+
+	for _, ct := range cards {
+		ct.holds = holds[ct.id]
+		r.checkCard(ct)
+	}
+
+	for _, a := range auths {
+		r.checkAuthorisation(a)
+	}
+
+	qry = QUERY_RECONCILE_VENDORS
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return r.report, models.ErrorWrap(err)
+	}
+
+	vendorRows, err := d.stmt(qry).QueryContext(ctx)
+
+	if err != nil {
+		return r.report, models.ErrorWrap(err)
+	}
+
+	defer vendorRows.Close()
+
+	for vendorRows.Next() {
+
+		var vt vendorTotals
+
+		err := vendorRows.Scan(&vt.id, &vt.balance, &vt.ledger)
+
+		if err != nil {
+			return r.report, models.ErrorWrap(err)
+		}
+
+		r.checkVendor(vt)
+	}
+
+	err = vendorRows.Err()
+
+	if err != nil {
+		return r.report, models.ErrorWrap(err)
+	}
+
+	return r.result(), nil
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestReconcile(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		//c.id, c.balance, c.available, movements, ledger available, ledger held
+		expected := sqlmock.NewRows([]string{"id", "balance", "available", "movements", "ledger_available", "ledger_held"}).
+			AddRow(100001, 1000, 750, 1000, 750, 250).
+			AddRow(100002, 1000, 1000, 900, 900, 0)
+
+		expecter.ExpectPrepare(esc(QUERY_RECONCILE_CARDS)).ExpectQuery().WillReturnRows(expected)
+
+		//id, amount, captured, reversed, refunded, card_id, currency, card_currency, rate, disputed
+		expected = sqlmock.NewRows([]string{"id", "amount", "captured", "reversed", "refunded", "card_id", "currency", "card_currency", "rate", "disputed"}).
+			AddRow(1001, 250, 0, 0, 0, 100001, "GBP", "GBP", 1.0, 0).
+			AddRow(1002, 250, 200, 100, 250, 100003, "GBP", "GBP", 1.0, 0)
+
+		expecter.ExpectPrepare(esc(QUERY_RECONCILE_AUTHORISATIONS)).ExpectQuery().WillReturnRows(expected)
+
+		//v.id, v.balance, ledger
+		expected = sqlmock.NewRows([]string{"id", "balance", "ledger"}).
+			AddRow(1001, 200, 200)
+
+		expecter.ExpectPrepare(esc(QUERY_RECONCILE_VENDORS)).ExpectQuery().WillReturnRows(expected)
+
+		report, apiErr := dbi.Reconcile(context.Background())
+
+		utils.AssertNoError(t, "Calling Reconcile", apiErr)
+		utils.AssertFalse(t, "Ok for Reconcile result with breaks", report.Ok)
+		utils.AssertEquals(t, "CardsChecked for Reconcile result", 2, report.CardsChecked)
+		utils.AssertEquals(t, "AuthorisationsChecked for Reconcile result", 2, report.AuthorisationsChecked)
+		utils.AssertEquals(t, "VendorsChecked for Reconcile result", 1, report.VendorsChecked)
+
+		checks := []string{CHECK_CARD_MOVEMENTS, CHECK_CARD_LEDGER_AVAILABLE, CHECK_CARD_LEDGER_BALANCE, CHECK_AUTH_CAPTURABLE, CHECK_AUTH_REFUNDABLE}
+
+		utils.AssertEquals(t, "Number of breaks for Reconcile result", len(checks), len(report.Breaks))
+
+		for i, check := range checks {
+			utils.AssertEquals(t, "Check of break", check, report.Breaks[i].Check)
+		}
+
+		utils.AssertEquals(t, "Id of first break", 100002, report.Breaks[0].Id)
+		utils.AssertEquals(t, "Description of first break", "card 100002: balance 1000 does not equal the sum of its movements 900", report.Breaks[0].Description)
+		utils.AssertEquals(t, "Description of last break", "authorisation 1002: refunded 250 plus disputed 0 exceeds captured 200", report.Breaks[4].Description)
+	})
+}
+
+func TestMemoryReconcile(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 1000)
+	defer dbi.Close()
+
+	aid, apiErr := dbi.Authorise(context.Background(), c.Id, v.Id, 400, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	_, apiErr = dbi.Capture(context.Background(), aid, 300, "")
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	_, apiErr = dbi.Refund(context.Background(), aid, 100, "", "Cold coffee")
+	utils.AssertNoError(t, "Calling Refund", apiErr)
+
+	report, apiErr := dbi.Reconcile(context.Background())
+
+	utils.AssertNoError(t, "Calling Reconcile", apiErr)
+	utils.AssertTrue(t, "Ok for Reconcile result", report.Ok)
+	utils.AssertEquals(t, "Number of breaks for Reconcile result", 0, len(report.Breaks))
+	utils.AssertEquals(t, "CardsChecked for Reconcile result", 1, report.CardsChecked)
+
+	// simulate a bad manual edit of the card and the authorisation
+	m := dbi.(*memGate)
+
+	corrupted := m.cards[c.Id]
+	corrupted.Available += 50
+	m.cards[c.Id] = corrupted
+
+	auth := m.authorisations[aid]
+	auth.Refunded = 350
+	m.authorisations[aid] = auth
+
+	report, apiErr = dbi.Reconcile(context.Background())
+
+	utils.AssertNoError(t, "Calling Reconcile", apiErr)
+	utils.AssertFalse(t, "Ok for Reconcile result after corruption", report.Ok)
+
+	expected := []models.ReconciliationBreak{
+		{
+			Check:       CHECK_CARD_HOLDS,
+			ObjectType:  "card",
+			Id:          c.Id,
+			Expected:    700,
+			Actual:      750,
+			Description: "card 100001: available 750 does not equal balance 800 less open holds 100",
+		},
+		{
+			Check:       CHECK_CARD_LEDGER_AVAILABLE,
+			ObjectType:  "card",
+			Id:          c.Id,
+			Expected:    700,
+			Actual:      750,
+			Description: "card 100001: available 750 does not equal its ledger account 700",
+		},
+		{
+			Check:       CHECK_AUTH_REFUNDABLE,
+			ObjectType:  "authorisation",
+			Id:          aid,
+			Expected:    300,
+			Actual:      350,
+			Description: "authorisation 1001: refunded 350 plus disputed 0 exceeds captured 300",
+		},
+	}
+
+	utils.AssertEquals(t, "Breaks for Reconcile result after corruption", utils.JsonStringify(expected), utils.JsonStringify(report.Breaks))
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+// An Option configures a Dbi made by NewDbi
+type Option func(*dbOptions)
+
+type dbOptions struct {
+	replicaDsn    string
+	replica       *sql.DB
+	fxRates       FxRates
+	riskEvaluator RiskEvaluator
+	settlementFee models.FeeSchedule
+}
+
+// WithReplica sends the read methods of a Dbi, such as GetCard and GetVendors, to a read replica with the given DSN.
+// An empty DSN leaves all reads on the primary
+func WithReplica(replicaDsn string) Option {
+
+	return func(o *dbOptions) {
+		o.replicaDsn = replicaDsn
+	}
+}
+
+// WithInjectedReplica sends the read methods of a Dbi to an injected replica connection (for testing)
+func WithInjectedReplica(replica *sql.DB) Option {
+
+	return func(o *dbOptions) {
+		o.replica = replica
+	}
+}
+
+type readYourWritesKey struct{}
+
+// WithReadYourWrites returns a context whose reads are made from the primary rather than the replica, so that they
+// see writes which have not yet reached the replica
+func WithReadYourWrites(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readYourWritesKey{}, true)
+}
+
+// ReadYourWrites reports whether reads made with a context are pinned to the primary
+func ReadYourWrites(ctx context.Context) bool {
+
+	pinned, _ := ctx.Value(readYourWritesKey{}).(bool)
+
+	return pinned
+}
+
+// Returns the connection for the read methods: the replica, unless there is none or the context pins reads to the
+// primary. The checks made before a write always read the primary, as a lagging replica could pass a check the
+// primary would fail
+func (d *dbGate) reader(ctx context.Context) *dbConn {
+
+	if d.replica == nil || ReadYourWrites(ctx) {
+		return d.dbConn
+	}
+
+	return d.replica
+}
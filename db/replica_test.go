@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/merlincox/cardapi/utils"
+)
+
+// Like testWrapper, but with separate expectations for the primary and the replica connection
+func replicaTestWrapper(t *testing.T, callback func(*testing.T, sqlmock.Sqlmock, sqlmock.Sqlmock, Dbi)) {
+
+	defer fixClock(testNow)()
+
+	mockPrimary, primary, _ := sqlmock.New()
+	mockReplica, replica, _ := sqlmock.New()
+
+	dbi, _ := NewDbi("", mockPrimary, WithInjectedReplica(mockReplica))
+	defer dbi.Close()
+
+	callback(t, primary, replica, dbi)
+
+	utils.AssertNoError(t, "Calling ExpectationsWereMet for the primary", primary.ExpectationsWereMet())
+	utils.AssertNoError(t, "Calling ExpectationsWereMet for the replica", replica.ExpectationsWereMet())
+}
+
+func TestReplicaGetCard(t *testing.T) {
+	replicaTestWrapper(t, func(t *testing.T, primary, replica sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"c.id", "c.balance", "c.available", "c.customer_id", "c.status", "c.tc", "m.id", "m.amount", "m.description", "m.movement_type", "m.ts", "m.related_movement_id", "c.currency"}).
+			AddRow(int64(100001), 12676, 12089, 1001, "ACTIVE", "2019-01-24 01:00:10", nil, nil, nil, nil, nil, nil, "GBP")
+
+		replica.ExpectPrepare(esc(QUERY_GET_CARD_ALL)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		c, apiErr := dbi.GetCard(context.Background(), 100001)
+
+		utils.AssertNoError(t, "Calling GetCard with a replica", apiErr)
+		utils.AssertEquals(t, "Balance for GetCard result from the replica", 12676, c.Balance)
+	})
+}
+
+func TestReplicaGetVendors(t *testing.T) {
+	replicaTestWrapper(t, func(t *testing.T, primary, replica sqlmock.Sqlmock, dbi Dbi) {
+
+		replica.ExpectPrepare(esc(QUERY_COUNT_VENDORS)).ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(1))
+
+		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"}).
+			AddRow(int64(1001), "Coffee Shop", 999, "GBP", "", "")
+
+		replica.ExpectPrepare(esc(QUERY_GET_VENDORS)).ExpectQuery().WithArgs(100, 0).WillReturnRows(expected)
+
+		vs, total, apiErr := dbi.GetVendors(context.Background(), 0, 100)
+
+		utils.AssertNoError(t, "Calling GetVendors with a replica", apiErr)
+		utils.AssertEquals(t, "Total for GetVendors result from the replica", 1, total)
+		utils.AssertEquals(t, "len(Vendors) for GetVendors result from the replica", 1, len(vs))
+	})
+}
+
+func TestReplicaReadYourWrites(t *testing.T) {
+	replicaTestWrapper(t, func(t *testing.T, primary, replica sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"c.id", "c.balance", "c.available", "c.customer_id", "c.status", "c.tc", "m.id", "m.amount", "m.description", "m.movement_type", "m.ts", "m.related_movement_id", "c.currency"}).
+			AddRow(int64(100001), 12676, 12089, 1001, "ACTIVE", "2019-01-24 01:00:10", nil, nil, nil, nil, nil, nil, "GBP")
+
+		primary.ExpectPrepare(esc(QUERY_GET_CARD_ALL)).ExpectQuery().WithArgs(100001).WillReturnRows(expected)
+
+		ctx := WithReadYourWrites(context.Background())
+
+		utils.AssertTrue(t, "ReadYourWrites for a pinned context", ReadYourWrites(ctx))
+		utils.AssertTrue(t, "ReadYourWrites for an unpinned context", !ReadYourWrites(context.Background()))
+
+		_, apiErr := dbi.GetCard(ctx, 100001)
+
+		utils.AssertNoError(t, "Calling GetCard with reads pinned to the primary", apiErr)
+	})
+}
+
+func TestReplicaAuthoriseChecksPrimary(t *testing.T) {
+	replicaTestWrapper(t, func(t *testing.T, primary, replica sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"})
+
+		primary.ExpectPrepare(esc(QUERY_GET_VENDOR)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
+
+		_, apiErr := dbi.Authorise(context.Background(), 100001, 1001, 210, "", "Coffee")
+
+		utils.AssertEquals(t, "Return status for calling Authorise with a vendor unknown to the primary", 400, apiErr.StatusCode())
+	})
+}
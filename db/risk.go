@@ -0,0 +1,298 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	// The outcomes of a risk evaluation
+	RISK_APPROVE = "APPROVE"
+	RISK_DECLINE = "DECLINE"
+	RISK_REVIEW  = "REVIEW"
+
+	// The statuses of an authorisation. One in REVIEW holds its funds but cannot be captured until it is cleared
+	AUTHORISATION_STATUS_APPROVED = "APPROVED"
+	AUTHORISATION_STATUS_REVIEW   = "REVIEW"
+
+	// How far back the history of a card given to the risk evaluation goes. It covers the windows of the spending
+	// limits too, so that one read of the history serves both
+	RISK_HISTORY = 90 * 24 * time.Hour
+
+	// A guarded update which only affects an authorisation still in review
+	QUERY_CLEAR_AUTHORISATION = `UPDATE authorisations SET status = 'APPROVED' WHERE id = ? AND status = 'REVIEW'`
+
+	// The status of an authorisation declined by the risk evaluation, as for one refused by a spending limit
+	RISK_DECLINED_STATUS = http.StatusPaymentRequired
+
+	MESSAGE_RISK_DECLINED               = "%v: card %v declined by risk evaluation: %v"
+	MESSAGE_BAD_RISK_OUTCOME            = "%v: unknown risk evaluation outcome %v"
+	MESSAGE_AUTHORISATION_IN_REVIEW     = "%v: authorisation %v is held for review"
+	MESSAGE_AUTHORISATION_NOT_IN_REVIEW = "%v: authorisation %v is not held for review"
+
+	MESSAGE_CLEARED = "Cleared from review"
+)
+
+// RiskRequest is what a RiskEvaluator is given of an authorisation about to be made. The amounts of the rules are in
+// the minor unit of the card's currency, so compare the hold rather than the amount
+type RiskRequest struct {
+	Card        models.Card
+	Vendor      models.Vendor
+	Amount      int
+	Currency    string
+	Hold        int
+	Description string
+	// The authorisations made on the card in the RISK_HISTORY, in the order they were made
+	History []models.Authorisation
+	Now     time.Time
+}
+
+// RiskDecision is the outcome of a risk evaluation, RISK_APPROVE, RISK_DECLINE or RISK_REVIEW, and the reason for it
+type RiskDecision struct {
+	Outcome string
+	Reason  string
+}
+
+// A RiskEvaluator scores each authorisation before it is made. An error from it refuses the authorisation. It is called
+// outside any transaction or lock of the store, so may read through the Dbi
+type RiskEvaluator interface {
+	Evaluate(ctx context.Context, r RiskRequest) (RiskDecision, models.ApiError)
+}
+
+// RiskEvaluatorFunc adapts a function to a RiskEvaluator
+type RiskEvaluatorFunc func(ctx context.Context, r RiskRequest) (RiskDecision, models.ApiError)
+
+func (f RiskEvaluatorFunc) Evaluate(ctx context.Context, r RiskRequest) (RiskDecision, models.ApiError) {
+	return f(ctx, r)
+}
+
+// ApproveAll is a RiskEvaluator which approves every authorisation
+var ApproveAll = RiskEvaluatorFunc(func(ctx context.Context, r RiskRequest) (RiskDecision, models.ApiError) {
+	return RiskDecision{Outcome: RISK_APPROVE}, nil
+})
+
+// RiskRules is the rule-based RiskEvaluator used unless another is configured. A rule with a threshold of 0 is off
+type RiskRules struct {
+	// Review a hold over this multiple of the card's average hold, once the card has MinHistory authorisations
+	AverageMultiple int
+	MinHistory      int
+	// Decline an authorisation when the card already has BurstCount authorisations within the BurstWindow
+	BurstCount  int
+	BurstWindow time.Duration
+	// Review a first payment to a vendor with a hold over this amount
+	NewVendorAmount int
+}
+
+// The rules used unless another RiskEvaluator is configured
+var DefaultRiskRules = RiskRules{
+	AverageMultiple: 5,
+	MinHistory:      3,
+	BurstCount:      5,
+	BurstWindow:     10 * time.Minute,
+	NewVendorAmount: 25000,
+}
+
+// Evaluate applies the rules in turn, a decline taking precedence over a review
+func (rules RiskRules) Evaluate(ctx context.Context, r RiskRequest) (RiskDecision, models.ApiError) {
+
+	format := func(amount int) string {
+		return models.FormatAmount(amount, r.Card.Currency)
+	}
+
+	var (
+		burst, total int
+		knownVendor  bool
+	)
+
+	for _, a := range r.History {
+
+		if authorisedSince(a, r.Now.Add(-rules.BurstWindow)) {
+			burst++
+		}
+
+		if a.VendorId == r.Vendor.Id {
+			knownVendor = true
+		}
+
+		total += cardAmount(a, a.Amount)
+	}
+
+	if rules.BurstCount > 0 && burst >= rules.BurstCount {
+		return RiskDecision{RISK_DECLINE, fmt.Sprintf("%v authorisations in the last %v", burst, rules.BurstWindow)}, nil
+	}
+
+	if rules.NewVendorAmount > 0 && !knownVendor && r.Hold > rules.NewVendorAmount {
+		return RiskDecision{RISK_REVIEW, fmt.Sprintf("first payment to vendor %v of %v is over %v", r.Vendor.Id, format(r.Hold), format(rules.NewVendorAmount))}, nil
+	}
+
+	if rules.AverageMultiple > 0 && len(r.History) > 0 && len(r.History) >= rules.MinHistory {
+
+		average := total / len(r.History)
+
+		if r.Hold > rules.AverageMultiple*average {
+			return RiskDecision{RISK_REVIEW, fmt.Sprintf("%v is over %v times the card's average of %v", format(r.Hold), rules.AverageMultiple, format(average))}, nil
+		}
+	}
+
+	return RiskDecision{Outcome: RISK_APPROVE}, nil
+}
+
+// WithRiskEvaluator sets the RiskEvaluator of a Dbi, in place of the DefaultRiskRules
+func WithRiskEvaluator(evaluator RiskEvaluator) Option {
+
+	return func(o *dbOptions) {
+		o.riskEvaluator = evaluator
+	}
+}
+
+// Returns the RiskEvaluator of the options, or the default
+func (o dbOptions) risk() RiskEvaluator {
+
+	if o.riskEvaluator == nil {
+		return DefaultRiskRules
+	}
+
+	return o.riskEvaluator
+}
+
+// Evaluate the risk of an authorisation, returning the status it is to be made in and the reason for any review, or
+// the error which refuses it
+func evaluateRisk(ctx context.Context, evaluator RiskEvaluator, r RiskRequest) (string, string, models.ApiError) {
+
+	decision, apiErr := evaluator.Evaluate(ctx, r)
+
+	if apiErr != nil {
+		return "", "", apiErr
+	}
+
+	switch decision.Outcome {
+	case RISK_APPROVE:
+		return AUTHORISATION_STATUS_APPROVED, "", nil
+	case RISK_REVIEW:
+		return AUTHORISATION_STATUS_REVIEW, decision.Reason, nil
+	case RISK_DECLINE:
+		return "", "", models.ConstructApiError(RISK_DECLINED_STATUS, MESSAGE_RISK_DECLINED, "Authorise", r.Card.Id, decision.Reason)
+	}
+
+	return "", "", models.ConstructApiError(500, MESSAGE_BAD_RISK_OUTCOME, "Authorise", decision.Outcome)
+}
+
+// ClearAuthorisation clears an authorisation held for review, so that it can be captured, recording the clearance in
+// its movements. Returns the updated authorisation
+func (d *dbGate) ClearAuthorisation(ctx context.Context, authorisationId int, description string) (models.Authorisation, models.ApiError) {
+
+	auth, apiErr := d.getAuthorisation(ctx, authorisationId)
+
+	if apiErr != nil {
+
+		if apiErr.StatusCode() == 500 {
+			return auth, apiErr
+		}
+
+		return auth, models.ConstructApiError(404, MESSAGE_BAD_ID, "ClearAuthorisation", "authorisation", authorisationId)
+	}
+
+	if auth.Status != AUTHORISATION_STATUS_REVIEW {
+		return auth, models.ConstructApiError(409, MESSAGE_AUTHORISATION_NOT_IN_REVIEW, "ClearAuthorisation", auth.Id)
+	}
+
+	if description == "" {
+		description = MESSAGE_CLEARED
+	}
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	defer tx.Rollback()
+
+	qry := QUERY_CLEAR_AUTHORISATION
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, auth.Id)
+
+	if res.apiErr != nil {
+		return auth, res.apiErr
+	}
+
+	// cleared by another request since it was read
+	if res.numRowsAffected != 1 {
+		return auth, models.ConstructApiError(409, MESSAGE_AUTHORISATION_NOT_IN_REVIEW, "ClearAuthorisation", auth.Id)
+	}
+
+	qry = QUERY_ADD_AUTH_MOVEMENT
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, auth.Id, 0, description, "CLEARED")
+
+	if res.apiErr != nil {
+		return auth, res.apiErr
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return auth, models.ErrorWrap(err)
+	}
+
+	return d.GetAuthorisation(WithReadYourWrites(ctx), auth.Id)
+}
+
+// Returns the authorisations made on a card since a time, in the order they were made
+func (m *memGate) recentAuthorisations(cardId int, since time.Time) []models.Authorisation {
+
+	var recent []models.Authorisation
+
+	for _, a := range m.sortedAuthorisations() {
+		if a.CardId == cardId && authorisedSince(a, since) {
+			recent = append(recent, a)
+		}
+	}
+
+	return recent
+}
+
+// ClearAuthorisation clears an authorisation held for review, so that it can be captured, recording the clearance in
+// its movements. Returns the updated authorisation
+func (m *memGate) ClearAuthorisation(ctx context.Context, authorisationId int, description string) (models.Authorisation, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	auth, ok := m.authorisations[authorisationId]
+
+	if !ok {
+		return auth, models.ConstructApiError(404, MESSAGE_BAD_ID, "ClearAuthorisation", "authorisation", authorisationId)
+	}
+
+	if auth.Status != AUTHORISATION_STATUS_REVIEW {
+		return auth, models.ConstructApiError(409, MESSAGE_AUTHORISATION_NOT_IN_REVIEW, "ClearAuthorisation", auth.Id)
+	}
+
+	if description == "" {
+		description = MESSAGE_CLEARED
+	}
+
+	auth.Status = AUTHORISATION_STATUS_APPROVED
+	m.authorisations[auth.Id] = auth
+
+	m.addAuthMovement(auth.Id, 0, description, "CLEARED")
+
+	return m.authorisationWithMovements(auth.Id), nil
+}
@@ -0,0 +1,262 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestRiskRules(t *testing.T) {
+
+	ctx := context.Background()
+
+	auth := func(vendorId, amount int, at time.Time) models.Authorisation {
+		return models.Authorisation{VendorId: vendorId, Amount: amount, Currency: "GBP", CardCurrency: "GBP", Rate: 1, Ts: datetime(at)}
+	}
+
+	r := RiskRequest{
+		Card:   models.Card{Id: 100001, Currency: "GBP"},
+		Vendor: models.Vendor{Id: 1001},
+		Hold:   1100,
+		Now:    testNow,
+		History: []models.Authorisation{
+			auth(1001, 200, testNow.Add(-48*time.Hour)),
+			auth(1002, 300, testNow.Add(-24*time.Hour)),
+			auth(1001, 100, testNow.Add(-time.Hour)),
+		},
+	}
+
+	decision, apiErr := DefaultRiskRules.Evaluate(ctx, r)
+
+	utils.AssertNoError(t, "Calling Evaluate", apiErr)
+	utils.AssertEquals(t, "Outcome for a hold over 5 times the average", RISK_REVIEW, decision.Outcome)
+	utils.AssertEquals(t, "Reason for a hold over 5 times the average", "£11.00 is over 5 times the card's average of £2.00", decision.Reason)
+
+	decision, _ = RiskRules{AverageMultiple: 5, MinHistory: 4}.Evaluate(ctx, r)
+
+	utils.AssertEquals(t, "Outcome for a hold over 5 times the average with too little history", RISK_APPROVE, decision.Outcome)
+
+	r.Hold = 1000
+	decision, _ = DefaultRiskRules.Evaluate(ctx, r)
+
+	utils.AssertEquals(t, "Outcome for a hold within 5 times the average", RISK_APPROVE, decision.Outcome)
+
+	r.Vendor.Id = 1003
+	r.Hold = 30000
+	r.History = nil
+	decision, _ = DefaultRiskRules.Evaluate(ctx, r)
+
+	utils.AssertEquals(t, "Outcome for a first payment to a vendor over the threshold", RISK_REVIEW, decision.Outcome)
+	utils.AssertEquals(t, "Reason for a first payment to a vendor over the threshold", "first payment to vendor 1003 of £300.00 is over £250.00", decision.Reason)
+
+	r.Hold = 100
+
+	for i := 0; i < 5; i++ {
+		r.History = append(r.History, auth(1003, 100, testNow.Add(-time.Duration(i)*time.Minute)))
+	}
+
+	decision, _ = DefaultRiskRules.Evaluate(ctx, r)
+
+	utils.AssertEquals(t, "Outcome for a burst of authorisations", RISK_DECLINE, decision.Outcome)
+	utils.AssertEquals(t, "Reason for a burst of authorisations", "5 authorisations in the last 10m0s", decision.Reason)
+
+	decision, _ = RiskRules{}.Evaluate(ctx, r)
+
+	utils.AssertEquals(t, "Outcome with every rule off", RISK_APPROVE, decision.Outcome)
+}
+
+func TestEvaluateRisk(t *testing.T) {
+
+	ctx := context.Background()
+	r := RiskRequest{Card: models.Card{Id: 100001}}
+
+	returning := func(outcome string) RiskEvaluator {
+		return RiskEvaluatorFunc(func(ctx context.Context, r RiskRequest) (RiskDecision, models.ApiError) {
+			return RiskDecision{Outcome: outcome, Reason: "testing"}, nil
+		})
+	}
+
+	status, _, apiErr := evaluateRisk(ctx, ApproveAll, r)
+
+	utils.AssertNoError(t, "Calling evaluateRisk with an approval", apiErr)
+	utils.AssertEquals(t, "Status for an approval", AUTHORISATION_STATUS_APPROVED, status)
+
+	status, reason, apiErr := evaluateRisk(ctx, returning(RISK_REVIEW), r)
+
+	utils.AssertNoError(t, "Calling evaluateRisk with a review", apiErr)
+	utils.AssertEquals(t, "Status for a review", AUTHORISATION_STATUS_REVIEW, status)
+	utils.AssertEquals(t, "Reason for a review", "testing", reason)
+
+	_, _, apiErr = evaluateRisk(ctx, returning(RISK_DECLINE), r)
+
+	utils.AssertEquals(t, "Return status for a decline", RISK_DECLINED_STATUS, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for a decline", fmt.Sprintf(MESSAGE_RISK_DECLINED, "Authorise", 100001, "testing"), apiErr.Error())
+
+	_, _, apiErr = evaluateRisk(ctx, returning("MAYBE"), r)
+
+	utils.AssertEquals(t, "Return status for an unknown outcome", 500, apiErr.StatusCode())
+}
+
+func TestCaptureInReview(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"id", "amount", "card_id", "vendor_id", "description", "captured", "reversed", "refunded", "expires_at", "currency", "card_currency", "rate", "status", "disputed", "dispute_status"}).
+			AddRow(int64(1005), 250, 100001, 1002, "Coffee", 0, 0, 0, nil, "GBP", "GBP", 1.0, "REVIEW", 0, nil)
+
+		expecter.ExpectPrepare(esc(QUERY_GET_AUTHORISATION)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
+
+		aid, apiErr := dbi.Capture(context.Background(), 1005, 250, "")
+
+		utils.AssertEquals(t, "Return status for calling Capture on an authorisation in review", 409, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling Capture on an authorisation in review",
+			fmt.Sprintf(MESSAGE_AUTHORISATION_IN_REVIEW, "Capture", 1005), apiErr.Error())
+		utils.AssertEquals(t, "Capture id", -1, aid)
+	})
+}
+
+// Authorises a large first payment to a vendor, which is held for review until cleared, then a burst of payments,
+// the last of which is declined, under the DefaultRiskRules
+func testRisk(t *testing.T, dbi Dbi, c models.Card, v models.Vendor) {
+
+	defer fixClock(testNow)()
+
+	ctx := context.Background()
+
+	aid, apiErr := dbi.Authorise(ctx, c.Id, v.Id, 30000, "", "Television")
+	utils.AssertNoError(t, "Calling Authorise for a large first payment to a vendor", apiErr)
+
+	a, _ := dbi.GetAuthorisation(ctx, aid)
+
+	utils.AssertEquals(t, "Status of the authorisation held for review", AUTHORISATION_STATUS_REVIEW, a.Status)
+	utils.AssertEquals(t, "Number of movements of the authorisation held for review", 1, len(a.Movements))
+	utils.AssertEquals(t, "Movement type of the review", "REVIEW", a.Movements[0].MovementType)
+	utils.AssertEquals(t, "Description of the review", "first payment to vendor "+fmt.Sprint(v.Id)+" of £300.00 is over £250.00", a.Movements[0].Description)
+
+	card, _ := dbi.GetCard(ctx, c.Id)
+	utils.AssertEquals(t, "Available while the authorisation is held for review", 100000-30000, card.Available)
+
+	_, apiErr = dbi.Capture(ctx, aid, 30000, "")
+
+	utils.AssertEquals(t, "Return status for calling Capture on an authorisation in review", 409, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling Capture on an authorisation in review",
+		fmt.Sprintf(MESSAGE_AUTHORISATION_IN_REVIEW, "Capture", aid), apiErr.Error())
+
+	_, apiErr = dbi.ClearAuthorisation(ctx, 9999, "")
+	utils.AssertEquals(t, "Return status for calling ClearAuthorisation with an invalid id", 404, apiErr.StatusCode())
+
+	a, apiErr = dbi.ClearAuthorisation(ctx, aid, "")
+
+	utils.AssertNoError(t, "Calling ClearAuthorisation", apiErr)
+	utils.AssertEquals(t, "Status of the cleared authorisation", AUTHORISATION_STATUS_APPROVED, a.Status)
+	utils.AssertEquals(t, "Number of movements of the cleared authorisation", 2, len(a.Movements))
+	utils.AssertEquals(t, "Movement type of the clearance", "CLEARED", a.Movements[1].MovementType)
+	utils.AssertEquals(t, "Description of the clearance", MESSAGE_CLEARED, a.Movements[1].Description)
+
+	_, apiErr = dbi.ClearAuthorisation(ctx, aid, "")
+
+	utils.AssertEquals(t, "Return status for clearing an authorisation twice", 409, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for clearing an authorisation twice",
+		fmt.Sprintf(MESSAGE_AUTHORISATION_NOT_IN_REVIEW, "ClearAuthorisation", aid), apiErr.Error())
+
+	_, apiErr = dbi.Capture(ctx, aid, 30000, "")
+	utils.AssertNoError(t, "Calling Capture on the cleared authorisation", apiErr)
+
+	for i := 0; i < 4; i++ {
+		aid, apiErr = dbi.Authorise(ctx, c.Id, v.Id, 100, "", "Coffee")
+		utils.AssertNoError(t, "Calling Authorise in a burst", apiErr)
+	}
+
+	a, _ = dbi.GetAuthorisation(ctx, aid)
+	utils.AssertEquals(t, "Status of an approved authorisation", AUTHORISATION_STATUS_APPROVED, a.Status)
+
+	_, apiErr = dbi.Authorise(ctx, c.Id, v.Id, 100, "", "Coffee")
+
+	utils.AssertEquals(t, "Return status for calling Authorise after a burst", RISK_DECLINED_STATUS, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling Authorise after a burst",
+		fmt.Sprintf(MESSAGE_RISK_DECLINED, "Authorise", c.Id, "5 authorisations in the last 10m0s"), apiErr.Error())
+
+	card, _ = dbi.GetCard(ctx, c.Id)
+	utils.AssertEquals(t, "Available after the declined authorisation", 100000-30000-400, card.Available)
+}
+
+func TestMemoryRisk(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 100000)
+	defer dbi.Close()
+
+	testRisk(t, dbi, c, v)
+}
+
+func TestMemoryRiskEvaluator(t *testing.T) {
+
+	defer fixClock(testNow)()
+
+	var requests []RiskRequest
+
+	evaluator := RiskEvaluatorFunc(func(ctx context.Context, r RiskRequest) (RiskDecision, models.ApiError) {
+		requests = append(requests, r)
+		return RiskDecision{Outcome: RISK_APPROVE}, nil
+	})
+
+	dbi, c, v := memoryFixture(t, 1000, WithRiskEvaluator(evaluator))
+	defer dbi.Close()
+
+	ctx := context.Background()
+
+	aid, apiErr := dbi.Authorise(ctx, c.Id, v.Id, 250, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	_, apiErr = dbi.Authorise(ctx, c.Id, v.Id, 150, "", "Cake")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	utils.AssertEquals(t, "Number of evaluations", 2, len(requests))
+	utils.AssertEquals(t, "Vendor of the evaluation", v.Id, requests[1].Vendor.Id)
+	utils.AssertEquals(t, "Hold of the evaluation", 150, requests[1].Hold)
+	utils.AssertEquals(t, "Description of the evaluation", "Cake", requests[1].Description)
+	utils.AssertEquals(t, "History length of the evaluation", 1, len(requests[1].History))
+	utils.AssertEquals(t, "History of the evaluation", aid, requests[1].History[0].Id)
+}
+
+func TestMemoryRiskEvaluatorReadsDbi(t *testing.T) {
+
+	var dbi Dbi
+
+	// an evaluator which declines a card with limits of its own, read through the Dbi
+	evaluator := RiskEvaluatorFunc(func(ctx context.Context, r RiskRequest) (RiskDecision, models.ApiError) {
+
+		limits, apiErr := dbi.GetCardLimits(ctx, r.Card.Id)
+
+		if apiErr != nil {
+			return RiskDecision{}, apiErr
+		}
+
+		if limits.DailySpend > 0 {
+			return RiskDecision{Outcome: RISK_DECLINE, Reason: "card limited"}, nil
+		}
+
+		return RiskDecision{Outcome: RISK_APPROVE}, nil
+	})
+
+	dbi, c, v := memoryFixture(t, 1000, WithRiskEvaluator(evaluator))
+	defer dbi.Close()
+
+	ctx := context.Background()
+
+	_, apiErr := dbi.Authorise(ctx, c.Id, v.Id, 250, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise with an evaluator which reads through the Dbi", apiErr)
+
+	_, apiErr = dbi.SetCardLimits(ctx, c.Id, models.SpendingLimits{DailySpend: 5000})
+	utils.AssertNoError(t, "Calling SetCardLimits", apiErr)
+
+	_, apiErr = dbi.Authorise(ctx, c.Id, v.Id, 250, "", "Coffee")
+
+	utils.AssertEquals(t, "Return status for calling Authorise declined by an evaluator which reads through the Dbi", RISK_DECLINED_STATUS, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling Authorise declined by an evaluator which reads through the Dbi",
+		fmt.Sprintf(MESSAGE_RISK_DECLINED, "Authorise", c.Id, "card limited"), apiErr.Error())
+}
@@ -0,0 +1,497 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	// The vendors with auth movements which change their balance and have not yet been settled
+	QUERY_GET_UNSETTLED_VENDORS = `SELECT DISTINCT a.vendor_id FROM auth_movements m
+                            JOIN authorisations a ON (a.id = m.authorisation_id)
+                            WHERE m.settlement_id IS NULL AND m.movement_type IN ('CAPTURE', 'FEE', 'REFUND', 'CHARGEBACK')
+                            ORDER BY a.vendor_id`
+
+	QUERY_ADD_SETTLEMENT = "INSERT INTO settlements (vendor_id, currency) VALUES (?, ?)"
+
+	// Marks the unsettled auth movements of a vendor as settled by a batch. Movements made by a transaction which has
+	// not yet committed are left for the next settlement
+	QUERY_MARK_SETTLED = `UPDATE auth_movements SET settlement_id = ?
+                            WHERE settlement_id IS NULL AND movement_type IN ('CAPTURE', 'FEE', 'REFUND', 'CHARGEBACK')
+                            AND authorisation_id IN (SELECT id FROM authorisations WHERE vendor_id = ?)`
+
+	QUERY_GET_SETTLED_TOTALS = `SELECT movement_type, COALESCE(SUM(amount), 0) FROM auth_movements WHERE settlement_id = ?
+                            GROUP BY movement_type`
+
+	QUERY_UPDATE_SETTLEMENT = "UPDATE settlements SET captured = ?, capture_fees = ?, refunded = ?, charged_back = ?, fees = ?, net = ? WHERE id = ?"
+
+	QUERY_GET_SETTLEMENT = `SELECT id, vendor_id, captured, capture_fees, refunded, charged_back, fees, net, currency, ts FROM settlements
+                            WHERE id = ?`
+
+	QUERY_COUNT_SETTLEMENTS = "SELECT COUNT(*) FROM settlements WHERE vendor_id = ?"
+
+	QUERY_GET_SETTLEMENTS = `SELECT id, vendor_id, captured, capture_fees, refunded, charged_back, fees, net, currency, ts FROM settlements
+                            WHERE vendor_id = ?
+                            ORDER BY id LIMIT ? OFFSET ?`
+
+	// The account which receives the fees charged on captures and deducted from settlements
+	LEDGER_ACCOUNT_FEES = "fees"
+
+	MESSAGE_SETTLEMENT = "Settlement of vendor %v"
+)
+
+// The types of the auth movements which change the balance of a vendor, so are settled
+var settledMovementTypes = []string{"CAPTURE", "FEE", "REFUND", "CHARGEBACK"}
+
+// WithSettlementFee sets the fee deducted from each settlement batch of a Dbi, which is none unless set
+func WithSettlementFee(fee models.FeeSchedule) Option {
+
+	return func(o *dbOptions) {
+		o.settlementFee = fee
+	}
+}
+
+// Adds an auth movement being settled to the totals of a batch
+func addToSettlement(s *models.Settlement, movementType string, amount int) {
+
+	switch movementType {
+	case "CAPTURE":
+		s.Captured += amount
+	case "FEE":
+		s.CaptureFees -= amount
+	case "REFUND":
+		s.Refunded -= amount
+	case "CHARGEBACK":
+		s.ChargedBack -= amount
+	}
+}
+
+// Returns the amount payable to a vendor by a batch before the settlement fee: the captures less the fees charged on
+// them, the refunds and the chargebacks. This is what the batch takes from the vendor's balance
+func settlementPayable(s models.Settlement) int {
+	return s.Captured - (s.CaptureFees + s.Refunded + s.ChargedBack)
+}
+
+// Applies the fee schedule to a batch, setting its fees and the net amount paid out
+func applySettlementFee(s *models.Settlement, fee models.FeeSchedule) {
+
+	s.Fees = fee.Fee(settlementPayable(*s))
+	s.Net = settlementPayable(*s) - s.Fees
+}
+
+// Returns the postings of a batch, which pay the payable amount out of the vendor's account, net of the fees
+func settlementPostings(s models.Settlement) []models.LedgerPosting {
+
+	postings := transfer(VendorAccount(s.VendorId), LEDGER_ACCOUNT_PAYOUT, s.Net, s.Currency)
+
+	if s.Fees > 0 {
+		postings[0].Amount -= s.Fees
+		postings = append(postings, models.LedgerPosting{Account: LEDGER_ACCOUNT_FEES, Amount: s.Fees, Currency: s.Currency})
+	}
+
+	return postings
+}
+
+// SettleVendors settles every vendor with captures, refunds or chargebacks since its last settlement, grouping them
+// into a batch which is paid out net of fees, and reports the batches and their payout file. A vendor whose refunds and
+// chargebacks since its last settlement equal or exceed its captures is not settled, and they carry forward to the next
+// run. Each vendor is settled in its own transaction, so on an error the report holds the batches already committed
+func (d *dbGate) SettleVendors(ctx context.Context) (models.SettlementReport, models.ApiError) {
+
+	var (
+		ids []int
+		err error
+	)
+
+	report := models.SettlementReport{
+		Settlements: []models.Settlement{},
+	}
+
+	qry := QUERY_GET_UNSETTLED_VENDORS
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return report, models.ErrorWrap(err)
+	}
+
+	rows, err := d.stmt(qry).QueryContext(ctx)
+
+	if err != nil {
+		return report, models.ErrorWrap(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var id int
+
+		err := rows.Scan(&id)
+
+		if err != nil {
+			return report, models.ErrorWrap(err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return report, models.ErrorWrap(err)
+	}
+
+	for _, id := range ids {
+
+		s, settled, apiErr := d.settleVendor(ctx, id)
+
+		if apiErr != nil {
+			report.PayoutFile = models.PayoutFile(report.Settlements)
+			return report, apiErr
+		}
+
+		if settled {
+			report.Settlements = append(report.Settlements, s)
+		}
+	}
+
+	report.PayoutFile = models.PayoutFile(report.Settlements)
+
+	return report, nil
+}
+
+// Settle a vendor in a transaction, returning the batch and true, or false if nothing is payable
+func (d *dbGate) settleVendor(ctx context.Context, vendorId int) (models.Settlement, bool, models.ApiError) {
+
+	v, apiErr := d.getVendor(ctx, vendorId)
+
+	if apiErr != nil {
+		return models.Settlement{}, false, apiErr
+	}
+
+	s := models.Settlement{
+		VendorId: v.Id,
+		Currency: v.Currency,
+	}
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
+
+	if err != nil {
+		return s, false, models.ErrorWrap(err)
+	}
+
+	defer tx.Rollback()
+
+	qry := QUERY_ADD_SETTLEMENT
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return s, false, models.ErrorWrap(err)
+	}
+
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, v.Id, v.Currency)
+
+	if res.apiErr != nil {
+		return s, false, res.apiErr
+	}
+
+	s.Id = res.lastInsertedId
+
+	qry = QUERY_MARK_SETTLED
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return s, false, models.ErrorWrap(err)
+	}
+
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, s.Id, v.Id)
+
+	if res.apiErr != nil {
+		return s, false, res.apiErr
+	}
+
+	apiErr = d.getSettledTotals(ctx, tx, &s)
+
+	if apiErr != nil {
+		return s, false, apiErr
+	}
+
+	// the rollback leaves the movements unsettled
+	if settlementPayable(s) <= 0 {
+		return s, false, nil
+	}
+
+	applySettlementFee(&s, d.fee)
+
+	qry = QUERY_UPDATE_SETTLEMENT
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return s, false, models.ErrorWrap(err)
+	}
+
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, s.Captured, s.CaptureFees, s.Refunded, s.ChargedBack, s.Fees, s.Net, s.Id)
+
+	if res.apiErr != nil {
+		return s, false, res.apiErr
+	}
+
+	qry = QUERY_UPDATE_VENDOR
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return s, false, models.ErrorWrap(err)
+	}
+
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, -settlementPayable(s), v.Id)
+
+	if res.apiErr != nil {
+		return s, false, res.apiErr
+	}
+
+	apiErr = d.addLedgerEntry(ctx, tx, "SETTLEMENT", fmt.Sprintf(MESSAGE_SETTLEMENT, v.Id), s.Id, settlementPostings(s))
+
+	if apiErr != nil {
+		return s, false, apiErr
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return s, false, models.ErrorWrap(err)
+	}
+
+	s, apiErr = d.getSettlement(ctx, s.Id)
+
+	return s, apiErr == nil, apiErr
+}
+
+// Totals the auth movements marked as settled by a batch within its transaction
+func (d *dbGate) getSettledTotals(ctx context.Context, tx *sql.Tx, s *models.Settlement) models.ApiError {
+
+	qry := QUERY_GET_SETTLED_TOTALS
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	rows, err := tx.StmtContext(ctx, d.stmt(qry)).QueryContext(ctx, s.Id)
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			movementType string
+			amount       int
+		)
+
+		err := rows.Scan(&movementType, &amount)
+
+		if err != nil {
+			return models.ErrorWrap(err)
+		}
+
+		addToSettlement(s, movementType, amount)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	return nil
+}
+
+// Scan a row of QUERY_GET_SETTLEMENT or QUERY_GET_SETTLEMENTS
+func scanSettlement(scan func(dest ...interface{}) error) (models.Settlement, error) {
+
+	var s models.Settlement
+
+	err := scan(&s.Id, &s.VendorId, &s.Captured, &s.CaptureFees, &s.Refunded, &s.ChargedBack, &s.Fees, &s.Net, &s.Currency, scanDatetime(&s.Ts))
+
+	return s, err
+}
+
+func (d *dbGate) getSettlement(ctx context.Context, id int) (models.Settlement, models.ApiError) {
+
+	qry := QUERY_GET_SETTLEMENT
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return models.Settlement{}, models.ErrorWrap(err)
+	}
+
+	s, err := scanSettlement(d.stmt(qry).QueryRowContext(ctx, id).Scan)
+
+	if err != nil {
+		return s, models.ErrorWrap(err)
+	}
+
+	return s, nil
+}
+
+// GetSettlements returns a page of up to limit settlement batches of a vendor starting at offset, oldest first, and
+// the total number of its batches
+func (d *dbGate) GetSettlements(ctx context.Context, vendorId, offset, limit int) ([]models.Settlement, int, models.ApiError) {
+
+	var (
+		ss  []models.Settlement
+		err error
+	)
+
+	conn := d.reader(ctx)
+
+	_, apiErr := conn.getVendor(ctx, vendorId)
+
+	if apiErr != nil {
+		return ss, 0, apiErr
+	}
+
+	total, apiErr := conn.count(ctx, QUERY_COUNT_SETTLEMENTS, vendorId)
+
+	if apiErr != nil {
+		return ss, 0, apiErr
+	}
+
+	qry := QUERY_GET_SETTLEMENTS
+
+	err = conn.prepareQry(ctx, qry)
+
+	if err != nil {
+		return ss, 0, models.ErrorWrap(err)
+	}
+
+	rows, err := conn.stmt(qry).QueryContext(ctx, vendorId, limit, offset)
+
+	if err != nil {
+		return ss, 0, models.ErrorWrap(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		s, err := scanSettlement(rows.Scan)
+
+		if err != nil {
+			return ss, 0, models.ErrorWrap(err)
+		}
+
+		ss = append(ss, s)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return ss, 0, models.ErrorWrap(err)
+	}
+
+	return ss, total, nil
+}
+
+// SettleVendors settles every vendor with captures, refunds or chargebacks since its last settlement, grouping them
+// into a batch which is paid out net of fees, and reports the batches and their payout file. A vendor whose refunds and
+// chargebacks since its last settlement equal or exceed its captures is not settled, and they carry forward to the next
+// run
+func (m *memGate) SettleVendors(ctx context.Context) (models.SettlementReport, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	report := models.SettlementReport{
+		Settlements: []models.Settlement{},
+	}
+
+	batches := make(map[int]*models.Settlement)
+	movements := make(map[int][]int)
+
+	for _, am := range m.authMovements {
+
+		if _, settled := m.settledMovements[am.Id]; settled || !contains(settledMovementTypes, am.MovementType) {
+			continue
+		}
+
+		vendorId := m.authorisations[am.AuthorisationId].VendorId
+
+		if batches[vendorId] == nil {
+			batches[vendorId] = &models.Settlement{VendorId: vendorId, Currency: m.vendors[vendorId].Currency}
+		}
+
+		addToSettlement(batches[vendorId], am.MovementType, am.Amount)
+		movements[vendorId] = append(movements[vendorId], am.Id)
+	}
+
+	for _, v := range m.sortedVendors() {
+
+		s := batches[v.Id]
+
+		if s == nil || settlementPayable(*s) <= 0 {
+			continue
+		}
+
+		applySettlementFee(s, m.fee)
+
+		s.Id = m.nextSettlementId
+		s.Ts = memoryTs()
+		m.nextSettlementId++
+
+		for _, id := range movements[v.Id] {
+			m.settledMovements[id] = s.Id
+		}
+
+		m.settlements = append(m.settlements, *s)
+		m.updateVendor(v.Id, -settlementPayable(*s))
+		m.addLedgerEntry("SETTLEMENT", fmt.Sprintf(MESSAGE_SETTLEMENT, v.Id), s.Id, settlementPostings(*s))
+
+		report.Settlements = append(report.Settlements, *s)
+	}
+
+	report.PayoutFile = models.PayoutFile(report.Settlements)
+
+	return report, nil
+}
+
+// GetSettlements returns a page of up to limit settlement batches of a vendor starting at offset, oldest first, and
+// the total number of its batches
+func (m *memGate) GetSettlements(ctx context.Context, vendorId, offset, limit int) ([]models.Settlement, int, models.ApiError) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.vendors[vendorId]; !ok {
+		return nil, 0, models.ConstructApiError(404, MESSAGE_BAD_ID, "getVendor", "vendor", vendorId)
+	}
+
+	var ss []models.Settlement
+
+	for _, s := range m.settlements {
+		if s.VendorId == vendorId {
+			ss = append(ss, s)
+		}
+	}
+
+	from, to := pageBounds(len(ss), offset, limit)
+
+	if from == to {
+		return nil, len(ss), nil
+	}
+
+	return ss[from:to], len(ss), nil
+}
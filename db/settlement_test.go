@@ -0,0 +1,167 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestSettlementPostings(t *testing.T) {
+
+	s := models.Settlement{VendorId: 1001, Captured: 2600, Refunded: 100}
+
+	applySettlementFee(&s, models.FeeSchedule{BasisPoints: 150, Fixed: 20})
+
+	utils.AssertEquals(t, "Fees of the batch", 58, s.Fees)
+	utils.AssertEquals(t, "Net of the batch", 2442, s.Net)
+
+	expected := []models.LedgerPosting{
+		{Account: VendorAccount(1001), Amount: -2500},
+		{Account: LEDGER_ACCOUNT_PAYOUT, Amount: 2442},
+		{Account: LEDGER_ACCOUNT_FEES, Amount: 58},
+	}
+
+	utils.AssertEquals(t, "Postings of the batch", utils.JsonStringify(expected), utils.JsonStringify(settlementPostings(s)))
+}
+
+func TestSettleVendorsNothingPayable(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		expected := sqlmock.NewRows([]string{"vendor_id"}).AddRow(1001)
+
+		expecter.ExpectPrepare(esc(QUERY_GET_UNSETTLED_VENDORS)).ExpectQuery().WillReturnRows(expected)
+
+		expected = sqlmock.NewRows([]string{"id", "vendor_name", "balance", "currency", "category", "mcc"}).
+			AddRow(int64(1001), "Coffee Shop", -200, "GBP", "", "")
+
+		expecter.ExpectPrepare(esc(QUERY_GET_VENDOR)).ExpectQuery().WithArgs(1001).WillReturnRows(expected)
+
+		expecter.ExpectBegin()
+
+		expecter.ExpectPrepare(esc(QUERY_ADD_SETTLEMENT))
+		// This duplication seems to be necessary for tx.Stmt(..)
+		expecter.ExpectPrepare(esc(QUERY_ADD_SETTLEMENT)).ExpectExec().WithArgs(1001, "GBP").WillReturnResult(sqlmock.NewResult(1005, 1))
+
+		expecter.ExpectPrepare(esc(QUERY_MARK_SETTLED))
+		expecter.ExpectPrepare(esc(QUERY_MARK_SETTLED)).ExpectExec().WithArgs(1005, 1001).WillReturnResult(sqlmock.NewResult(0, 2))
+
+		expected = sqlmock.NewRows([]string{"movement_type", "amount"}).
+			AddRow("CAPTURE", 500).
+			AddRow("REFUND", -700)
+
+		expecter.ExpectPrepare(esc(QUERY_GET_SETTLED_TOTALS))
+		expecter.ExpectPrepare(esc(QUERY_GET_SETTLED_TOTALS)).ExpectQuery().WithArgs(1005).WillReturnRows(expected)
+
+		expecter.ExpectRollback()
+
+		report, apiErr := dbi.SettleVendors(context.Background())
+
+		utils.AssertNoError(t, "Calling SettleVendors", apiErr)
+		utils.AssertEquals(t, "Number of batches when refunds exceed captures", 0, len(report.Settlements))
+	})
+}
+
+// Settles a vendor's captures less refunds net of a 1.5% plus 20p fee, then a run with nothing to settle, then refunds
+// exceeding captures, which carry forward into the next batch
+func testSettlement(t *testing.T, dbi Dbi, c models.Card, v models.Vendor) {
+
+	ctx := context.Background()
+
+	first, apiErr := dbi.Authorise(ctx, c.Id, v.Id, 2000, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	_, apiErr = dbi.Capture(ctx, first, 2000, "")
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	second, apiErr := dbi.Authorise(ctx, c.Id, v.Id, 1000, "", "Cake")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	_, apiErr = dbi.Capture(ctx, second, 600, "")
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	_, apiErr = dbi.Refund(ctx, first, 100, "", "Cold")
+	utils.AssertNoError(t, "Calling Refund", apiErr)
+
+	report, apiErr := dbi.SettleVendors(ctx)
+
+	utils.AssertNoError(t, "Calling SettleVendors", apiErr)
+	utils.AssertEquals(t, "Number of batches", 1, len(report.Settlements))
+
+	s := report.Settlements[0]
+
+	utils.AssertEquals(t, "Vendor of the batch", v.Id, s.VendorId)
+	utils.AssertEquals(t, "Captured in the batch", 2600, s.Captured)
+	utils.AssertEquals(t, "Refunded in the batch", 100, s.Refunded)
+	utils.AssertEquals(t, "Fees of the batch", 58, s.Fees)
+	utils.AssertEquals(t, "Net of the batch", 2442, s.Net)
+	utils.AssertEquals(t, "Currency of the batch", "GBP", s.Currency)
+	utils.AssertEquals(t, "Payout file of the run", models.PayoutFile(report.Settlements), report.PayoutFile)
+	utils.AssertTrue(t, "Payout file has a line for the batch",
+		strings.Contains(report.PayoutFile, fmt.Sprintf("\n%v,%v,GBP,2600,", s.Id, v.Id)))
+
+	v, _ = dbi.GetVendor(ctx, v.Id)
+	utils.AssertEquals(t, "Vendor balance after settlement", 0, v.Balance)
+
+	fees, _ := dbi.GetAccountBalance(ctx, LEDGER_ACCOUNT_FEES)
+	utils.AssertEquals(t, "Balance of the fees account", 58, fees)
+
+	report, apiErr = dbi.SettleVendors(ctx)
+
+	utils.AssertNoError(t, "Calling SettleVendors with nothing to settle", apiErr)
+	utils.AssertEquals(t, "Number of batches with nothing to settle", 0, len(report.Settlements))
+
+	_, apiErr = dbi.Capture(ctx, second, 400, "")
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	_, apiErr = dbi.Refund(ctx, second, 500, "", "Stale")
+	utils.AssertNoError(t, "Calling Refund", apiErr)
+
+	report, _ = dbi.SettleVendors(ctx)
+	utils.AssertEquals(t, "Number of batches when refunds exceed captures", 0, len(report.Settlements))
+
+	v, _ = dbi.GetVendor(ctx, v.Id)
+	utils.AssertEquals(t, "Vendor balance when refunds exceed captures", -100, v.Balance)
+
+	third, apiErr := dbi.Authorise(ctx, c.Id, v.Id, 300, "", "Tea")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	_, apiErr = dbi.Capture(ctx, third, 300, "")
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	report, _ = dbi.SettleVendors(ctx)
+
+	utils.AssertEquals(t, "Number of batches after refunds carried forward", 1, len(report.Settlements))
+	utils.AssertEquals(t, "Captured in the batch after refunds carried forward", 700, report.Settlements[0].Captured)
+	utils.AssertEquals(t, "Refunded in the batch after refunds carried forward", 500, report.Settlements[0].Refunded)
+	utils.AssertEquals(t, "Net of the batch after refunds carried forward", 200-23, report.Settlements[0].Net)
+
+	ss, total, apiErr := dbi.GetSettlements(ctx, v.Id, 0, 100)
+
+	utils.AssertNoError(t, "Calling GetSettlements", apiErr)
+	utils.AssertEquals(t, "Total of the vendor's batches", 2, total)
+	utils.AssertEquals(t, "First of the vendor's batches", s.Id, ss[0].Id)
+	utils.AssertEquals(t, "Second of the vendor's batches", report.Settlements[0].Id, ss[1].Id)
+	utils.AssertEquals(t, "Payout file regenerated from the stored batch", report.PayoutFile, models.PayoutFile(ss[1:]))
+
+	_, _, apiErr = dbi.GetSettlements(ctx, 9999, 0, 100)
+	utils.AssertEquals(t, "Return status for calling GetSettlements with an invalid id", 404, apiErr.StatusCode())
+
+	r, apiErr := dbi.Reconcile(ctx)
+
+	utils.AssertNoError(t, "Calling Reconcile", apiErr)
+	utils.AssertTrue(t, "Ok for Reconcile after settlements", r.Ok)
+}
+
+func TestMemorySettlement(t *testing.T) {
+
+	dbi, c, v := memoryFixture(t, 10000, WithSettlementFee(models.FeeSchedule{BasisPoints: 150, Fixed: 20}))
+	defer dbi.Close()
+
+	testSettlement(t, dbi, c, v)
+}
@@ -0,0 +1,485 @@
+package db
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	SQLITE_CREATE_SCHEMA_MIGRATIONS = `CREATE TABLE IF NOT EXISTS schema_migrations (
+                                        version     INTEGER      NOT NULL,
+                                        description VARCHAR(256) NOT NULL,
+                                        applied_at  TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                                        PRIMARY KEY (version)
+                                      )`
+
+	// The extended result codes of the constraint violations which the Dbi methods handle
+	SQLITE_ERROR_DUPLICATE_KEY = 1555 // SQLITE_CONSTRAINT_PRIMARYKEY
+	SQLITE_ERROR_UNIQUE        = 2067 // SQLITE_CONSTRAINT_UNIQUE
+	SQLITE_ERROR_FOREIGN_KEY   = 787  // SQLITE_CONSTRAINT_FOREIGNKEY
+
+	// Options added to every SQLite DSN. Foreign keys are only enforced when enabled on each connection. Transactions
+	// take the write lock when they begin, so that concurrent writers wait for it rather than fail with SQLITE_BUSY
+	// when upgrading a read lock, and WAL lets reads carry on while a write is in progress.
+	SQLITE_DSN_OPTIONS = "_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)&_pragma=journal_mode(wal)&_txlock=immediate"
+)
+
+var concatRegexp = regexp.MustCompile(`CONCAT\(('[^']*'), ([\w.]+)\)`)
+
+// Rewrite a MySQL query for SQLite, which concatenates with || rather than CONCAT. SQLite takes ? placeholders and
+// supports LastInsertId, so nothing else changes
+func sqliteQuery(qry string) string {
+	return concatRegexp.ReplaceAllString(qry, "($1 || $2)")
+}
+
+// Returns the statement which makes a new table's AUTOINCREMENT ids start at start, as the MySQL AUTO_INCREMENT
+// table options do. SQLite keeps the last id of each table in sqlite_sequence, and removes it when the table is dropped
+func sqliteStartIds(table string, start int) string {
+
+	return fmt.Sprintf(`INSERT INTO sqlite_sequence (name, seq)
+              SELECT '%v', %v WHERE NOT EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = '%v')`, table, start-1, table)
+}
+
+// The SQLite equivalents of the MySQL migrations, version for version, so that an SQLite database file has the same
+// schema as one built by rebuild_db.sh. As for Postgres, ts records when a row was created
+var sqliteMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "baseline customers, vendors, cards, movements, authorisations and auth_movements",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS customers (
+              id       INTEGER      PRIMARY KEY AUTOINCREMENT,
+              fullname VARCHAR(256) NOT NULL
+            )`,
+
+			sqliteStartIds("customers", 1001),
+
+			`CREATE TABLE IF NOT EXISTS vendors (
+              id          INTEGER      PRIMARY KEY AUTOINCREMENT,
+              vendor_name VARCHAR(256) NOT NULL,
+              balance     INT NOT NULL DEFAULT 0
+            )`,
+
+			sqliteStartIds("vendors", 1001),
+
+			`CREATE TABLE IF NOT EXISTS cards (
+              id          INTEGER PRIMARY KEY AUTOINCREMENT,
+              customer_id INT NOT NULL,
+              balance     INT NOT NULL DEFAULT 0,
+              available   INT NOT NULL DEFAULT 0,
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+              FOREIGN KEY (customer_id)
+              REFERENCES customers (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			sqliteStartIds("cards", 100001),
+
+			"CREATE INDEX IF NOT EXISTS card_customer_idx ON cards (customer_id)",
+
+			`CREATE TABLE IF NOT EXISTS movements (
+              id            INTEGER      PRIMARY KEY AUTOINCREMENT,
+              card_id       INT,
+              movement_type VARCHAR(256) NOT NULL,
+              description   VARCHAR(256) NOT NULL,
+              amount        INT          NOT NULL,
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			sqliteStartIds("movements", 1001),
+
+			"CREATE INDEX IF NOT EXISTS movement_card_idx ON movements (card_id)",
+
+			`CREATE TABLE IF NOT EXISTS authorisations (
+              id          INTEGER      PRIMARY KEY AUTOINCREMENT,
+              card_id     INT,
+              vendor_id   INT,
+              description VARCHAR(256) NOT NULL,
+              amount      INT          NOT NULL,
+              captured    INT          NOT NULL DEFAULT 0,
+              refunded    INT          NOT NULL DEFAULT 0,
+              reversed    INT          NOT NULL DEFAULT 0,
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT,
+              FOREIGN KEY (vendor_id)
+              REFERENCES vendors (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			sqliteStartIds("authorisations", 1001),
+
+			"CREATE INDEX IF NOT EXISTS authorisation_card_idx ON authorisations (card_id)",
+			"CREATE INDEX IF NOT EXISTS authorisation_vendor_idx ON authorisations (vendor_id)",
+
+			`CREATE TABLE IF NOT EXISTS auth_movements (
+              id               INTEGER      PRIMARY KEY AUTOINCREMENT,
+              authorisation_id INT,
+              movement_type    VARCHAR(256) NOT NULL,
+              description      VARCHAR(256) NOT NULL,
+              amount           INT          NOT NULL,
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+              FOREIGN KEY (authorisation_id)
+              REFERENCES authorisations (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			sqliteStartIds("auth_movements", 1001),
+
+			"CREATE INDEX IF NOT EXISTS movement_auth_idx ON auth_movements (authorisation_id)",
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS auth_movements",
+			"DROP TABLE IF EXISTS movements",
+			"DROP TABLE IF EXISTS authorisations",
+			"DROP TABLE IF EXISTS cards",
+			"DROP TABLE IF EXISTS customers",
+			"DROP TABLE IF EXISTS vendors",
+		},
+	},
+	{
+		Version:     2,
+		Description: "idempotency_keys",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS idempotency_keys (
+              idempotency_key VARCHAR(255) NOT NULL,
+              fingerprint     CHAR(64)     NOT NULL,
+              response_id     INT,
+              ts              TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+              PRIMARY KEY (idempotency_key)
+            )`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS idempotency_keys",
+		},
+	},
+	{
+		Version:     3,
+		Description: "ledger_entries and ledger_postings",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS ledger_entries (
+              id           INTEGER      PRIMARY KEY AUTOINCREMENT,
+              entry_type   VARCHAR(256) NOT NULL,
+              description  VARCHAR(256) NOT NULL,
+              reference_id INT          NOT NULL,
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+            )`,
+
+			sqliteStartIds("ledger_entries", 1001),
+
+			`CREATE TABLE IF NOT EXISTS ledger_postings (
+              id       INTEGER     PRIMARY KEY AUTOINCREMENT,
+              entry_id INT         NOT NULL,
+              account  VARCHAR(64) NOT NULL,
+              amount   INT         NOT NULL,
+              FOREIGN KEY (entry_id)
+              REFERENCES ledger_entries (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			sqliteStartIds("ledger_postings", 1001),
+
+			"CREATE INDEX IF NOT EXISTS posting_entry_idx ON ledger_postings (entry_id)",
+			"CREATE INDEX IF NOT EXISTS posting_account_idx ON ledger_postings (account)",
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS ledger_postings",
+			"DROP TABLE IF EXISTS ledger_entries",
+		},
+	},
+	{
+		Version:     4,
+		Description: "authorisations expires_at",
+		Up: []string{
+			"ALTER TABLE authorisations ADD COLUMN expires_at DATETIME NULL",
+			"CREATE INDEX IF NOT EXISTS authorisation_expiry_idx ON authorisations (expires_at)",
+		},
+		Down: []string{
+			"DROP INDEX IF EXISTS authorisation_expiry_idx",
+			"ALTER TABLE authorisations DROP COLUMN expires_at",
+		},
+	},
+	{
+		Version:     5,
+		Description: "cards status",
+		Up: []string{
+			"ALTER TABLE cards ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'ACTIVE'",
+		},
+		Down: []string{
+			"ALTER TABLE cards DROP COLUMN status",
+		},
+	},
+	{
+		Version:     6,
+		Description: "movements related_movement_id",
+		Up: []string{
+			"ALTER TABLE movements ADD COLUMN related_movement_id INT NULL",
+		},
+		Down: []string{
+			"ALTER TABLE movements DROP COLUMN related_movement_id",
+		},
+	},
+	{
+		Version:     7,
+		Description: "currencies",
+		// SQLite adds and drops one column per statement
+		Up: []string{
+			"ALTER TABLE cards ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'GBP'",
+			"ALTER TABLE vendors ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'GBP'",
+			"ALTER TABLE authorisations ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'GBP'",
+			"ALTER TABLE authorisations ADD COLUMN card_currency CHAR(3) NOT NULL DEFAULT 'GBP'",
+			"ALTER TABLE authorisations ADD COLUMN rate REAL NOT NULL DEFAULT 1",
+		},
+		Down: []string{
+			"ALTER TABLE authorisations DROP COLUMN rate",
+			"ALTER TABLE authorisations DROP COLUMN card_currency",
+			"ALTER TABLE authorisations DROP COLUMN currency",
+			"ALTER TABLE vendors DROP COLUMN currency",
+			"ALTER TABLE cards DROP COLUMN currency",
+		},
+	},
+	{
+		Version:     8,
+		Description: "card_limits and customer_limits",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS customer_limits (
+              customer_id           INT NOT NULL,
+              max_transaction       INT NOT NULL DEFAULT 0,
+              daily_spend           INT NOT NULL DEFAULT 0,
+              monthly_spend         INT NOT NULL DEFAULT 0,
+              hourly_authorisations INT NOT NULL DEFAULT 0,
+              vendor_daily_spend    INT NOT NULL DEFAULT 0,
+              PRIMARY KEY (customer_id),
+              FOREIGN KEY (customer_id)
+              REFERENCES customers (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			`CREATE TABLE IF NOT EXISTS card_limits (
+              card_id               INT NOT NULL,
+              max_transaction       INT NOT NULL DEFAULT 0,
+              daily_spend           INT NOT NULL DEFAULT 0,
+              monthly_spend         INT NOT NULL DEFAULT 0,
+              hourly_authorisations INT NOT NULL DEFAULT 0,
+              vendor_daily_spend    INT NOT NULL DEFAULT 0,
+              PRIMARY KEY (card_id),
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS card_limits",
+			"DROP TABLE IF EXISTS customer_limits",
+		},
+	},
+	{
+		Version:     9,
+		Description: "authorisations status",
+		Up: []string{
+			"ALTER TABLE authorisations ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'APPROVED'",
+		},
+		Down: []string{
+			"ALTER TABLE authorisations DROP COLUMN status",
+		},
+	},
+	{
+		Version:     10,
+		Description: "authorisations disputes",
+		Up: []string{
+			"ALTER TABLE authorisations ADD COLUMN disputed INT NOT NULL DEFAULT 0",
+			"ALTER TABLE authorisations ADD COLUMN dispute_status VARCHAR(16) NULL",
+		},
+		Down: []string{
+			"ALTER TABLE authorisations DROP COLUMN dispute_status",
+			"ALTER TABLE authorisations DROP COLUMN disputed",
+		},
+	},
+	{
+		Version:     11,
+		Description: "settlements",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS settlements (
+              id           INTEGER PRIMARY KEY AUTOINCREMENT,
+              vendor_id    INT     NOT NULL,
+              captured     INT     NOT NULL DEFAULT 0,
+              refunded     INT     NOT NULL DEFAULT 0,
+              charged_back INT     NOT NULL DEFAULT 0,
+              fees         INT     NOT NULL DEFAULT 0,
+              net          INT     NOT NULL DEFAULT 0,
+              currency     CHAR(3) NOT NULL,
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+              FOREIGN KEY (vendor_id)
+              REFERENCES vendors (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			sqliteStartIds("settlements", 1001),
+
+			"CREATE INDEX IF NOT EXISTS settlement_vendor_idx ON settlements (vendor_id)",
+			"ALTER TABLE auth_movements ADD COLUMN settlement_id INT NULL",
+			"CREATE INDEX IF NOT EXISTS auth_movement_settlement_idx ON auth_movements (settlement_id)",
+		},
+		Down: []string{
+			"DROP INDEX IF EXISTS auth_movement_settlement_idx",
+			"ALTER TABLE auth_movements DROP COLUMN settlement_id",
+			"DROP TABLE IF EXISTS settlements",
+		},
+	},
+	{
+		Version:     12,
+		Description: "vendor fees",
+		Up: []string{
+			"ALTER TABLE vendors ADD COLUMN category VARCHAR(32) NOT NULL DEFAULT ''",
+
+			`CREATE TABLE IF NOT EXISTS category_fees (
+              category     VARCHAR(32) NOT NULL,
+              basis_points INT         NOT NULL DEFAULT 0,
+              fixed_amount INT         NOT NULL DEFAULT 0,
+              PRIMARY KEY (category)
+            )`,
+
+			`CREATE TABLE IF NOT EXISTS vendor_fees (
+              vendor_id    INT NOT NULL,
+              basis_points INT NOT NULL DEFAULT 0,
+              fixed_amount INT NOT NULL DEFAULT 0,
+              PRIMARY KEY (vendor_id),
+              FOREIGN KEY (vendor_id)
+              REFERENCES vendors (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			"ALTER TABLE settlements ADD COLUMN capture_fees INT NOT NULL DEFAULT 0",
+		},
+		Down: []string{
+			"ALTER TABLE settlements DROP COLUMN capture_fees",
+			"DROP TABLE IF EXISTS vendor_fees",
+			"DROP TABLE IF EXISTS category_fees",
+			"ALTER TABLE vendors DROP COLUMN category",
+		},
+	},
+	{
+		Version:     13,
+		Description: "merchant category codes",
+		Up: []string{
+			"ALTER TABLE vendors ADD COLUMN mcc VARCHAR(4) NOT NULL DEFAULT ''",
+			"ALTER TABLE authorisations ADD COLUMN mcc VARCHAR(4) NOT NULL DEFAULT ''",
+
+			`CREATE TABLE IF NOT EXISTS card_mcc_controls (
+              card_id INT        NOT NULL,
+              mcc     VARCHAR(4) NOT NULL,
+              control VARCHAR(8) NOT NULL,
+              PRIMARY KEY (card_id, mcc),
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS card_mcc_controls",
+			"ALTER TABLE authorisations DROP COLUMN mcc",
+			"ALTER TABLE vendors DROP COLUMN mcc",
+		},
+	},
+	{
+		Version:     14,
+		Description: "mandates",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS mandates (
+              id          INTEGER PRIMARY KEY AUTOINCREMENT,
+              card_id     INT          NOT NULL,
+              vendor_id   INT          NOT NULL,
+              amount      INT          NOT NULL,
+              max_amount  INT          NOT NULL,
+              currency    CHAR(3)      NOT NULL,
+              frequency   VARCHAR(8)   NOT NULL,
+              description VARCHAR(255) NOT NULL,
+              end_date    VARCHAR(10)  NOT NULL DEFAULT '',
+              next_run_at DATETIME     NOT NULL,
+              retry_at    DATETIME     NULL,
+              failures    INT          NOT NULL DEFAULT 0,
+              status      VARCHAR(16)  NOT NULL DEFAULT 'ACTIVE',
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+              FOREIGN KEY (card_id)
+              REFERENCES cards (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT,
+              FOREIGN KEY (vendor_id)
+              REFERENCES vendors (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			sqliteStartIds("mandates", 1001),
+
+			"CREATE INDEX IF NOT EXISTS mandate_due_idx ON mandates (status, next_run_at)",
+
+			`CREATE TABLE IF NOT EXISTS mandate_runs (
+              id               INTEGER PRIMARY KEY AUTOINCREMENT,
+              mandate_id       INT          NOT NULL,
+              authorisation_id INT          NULL,
+              amount           INT          NOT NULL,
+              status           VARCHAR(16)  NOT NULL,
+              reason           VARCHAR(255) NOT NULL DEFAULT '',
+              ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+              FOREIGN KEY (mandate_id)
+              REFERENCES mandates (id)
+                ON DELETE RESTRICT
+                ON UPDATE RESTRICT
+            )`,
+
+			sqliteStartIds("mandate_runs", 1001),
+
+			"CREATE INDEX IF NOT EXISTS mandate_run_mandate_idx ON mandate_runs (mandate_id)",
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS mandate_runs",
+			"DROP TABLE IF EXISTS mandates",
+		},
+	},
+	{
+		Version:     15,
+		Description: "mandate anchor days",
+		Up: []string{
+			"ALTER TABLE mandates ADD COLUMN anchor_day INT NOT NULL DEFAULT 0",
+		},
+		Down: []string{
+			"ALTER TABLE mandates DROP COLUMN anchor_day",
+		},
+	},
+	{
+		Version:     16,
+		Description: "authorisations creation times",
+		Up: []string{
+			"CREATE INDEX IF NOT EXISTS authorisation_card_ts_idx ON authorisations (card_id, ts)",
+		},
+		Down: []string{
+			"DROP INDEX IF EXISTS authorisation_card_ts_idx",
+		},
+	},
+	{
+		Version:     17,
+		Description: "ledger posting currencies",
+		Up: []string{
+			"ALTER TABLE ledger_postings ADD COLUMN currency CHAR(3) NOT NULL DEFAULT ''",
+		},
+		Down: []string{
+			"ALTER TABLE ledger_postings DROP COLUMN currency",
+		},
+	},
+}
@@ -0,0 +1,439 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+// Returns a Dbi on a new SQLite database file migrated to the latest schema, and a function to close and remove it.
+// Unlike the sqlmock tests, these run the real queries and transactions
+func sqliteDbi(t *testing.T, options ...Option) (Dbi, func()) {
+
+	dir, err := ioutil.TempDir("", "cardapi")
+	utils.AssertNoError(t, "Creating a temporary directory", err)
+
+	db, apiErr := Open("file:" + filepath.Join(dir, "cardapi.db"))
+	utils.AssertNoError(t, "Opening an SQLite database", apiErr)
+
+	_, apiErr = MigrateUp(db, LatestSchemaVersion())
+	utils.AssertNoError(t, "Calling MigrateUp on SQLite", apiErr)
+
+	dbi, apiErr := NewDbi("", db, options...)
+	utils.AssertNoError(t, "Calling NewDbi with an SQLite connection", apiErr)
+
+	return dbi, func() {
+		dbi.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// Like memoryFixture, on SQLite
+func sqliteFixture(t *testing.T, topUp int, options ...Option) (Dbi, models.Card, models.Vendor, func()) {
+
+	dbi, cleanup := sqliteDbi(t, options...)
+
+	cu, apiErr := dbi.AddOrUpdateCustomer(context.Background(), models.Customer{Fullname: "Fred Bloggs"})
+	utils.AssertNoError(t, "Calling AddOrUpdateCustomer", apiErr)
+
+	c, apiErr := dbi.AddCard(context.Background(), cu.Id, "")
+	utils.AssertNoError(t, "Calling AddCard", apiErr)
+
+	v, apiErr := dbi.AddOrUpdateVendor(context.Background(), models.Vendor{VendorName: "Coffee Shop"})
+	utils.AssertNoError(t, "Calling AddOrUpdateVendor", apiErr)
+
+	if topUp > 0 {
+		_, apiErr = dbi.TopUp(context.Background(), c.Id, topUp, "", "Transfer from Bank")
+		utils.AssertNoError(t, "Calling TopUp", apiErr)
+	}
+
+	return dbi, c, v, cleanup
+}
+
+func TestSqliteMigrations(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "cardapi")
+	utils.AssertNoError(t, "Creating a temporary directory", err)
+	defer os.RemoveAll(dir)
+
+	db, apiErr := Open("file:" + filepath.Join(dir, "cardapi.db"))
+	utils.AssertNoError(t, "Opening an SQLite database", apiErr)
+	defer db.Close()
+
+	version, apiErr := SchemaVersion(db)
+
+	utils.AssertNoError(t, "Calling SchemaVersion on a new SQLite database", apiErr)
+	utils.AssertEquals(t, "Schema version of a new SQLite database", 0, version)
+
+	applied, apiErr := MigrateUp(db, LatestSchemaVersion())
+
+	utils.AssertNoError(t, "Calling MigrateUp on SQLite", apiErr)
+	utils.AssertEquals(t, "Number of migrations applied", len(migrations), len(applied))
+	utils.AssertNoError(t, "Calling CheckSchemaVersion on SQLite", CheckSchemaVersion(db))
+
+	reverted, apiErr := MigrateDown(db, 0)
+
+	utils.AssertNoError(t, "Calling MigrateDown on SQLite", apiErr)
+	utils.AssertEquals(t, "Number of migrations reverted", len(migrations), len(reverted))
+
+	// the ids start again from their initial values
+	_, apiErr = MigrateUp(db, LatestSchemaVersion())
+	utils.AssertNoError(t, "Calling MigrateUp again on SQLite", apiErr)
+
+	dbi, apiErr := NewDbi("", db)
+	utils.AssertNoError(t, "Calling NewDbi with an SQLite connection", apiErr)
+
+	cu, apiErr := dbi.AddOrUpdateCustomer(context.Background(), models.Customer{Fullname: "Fred Bloggs"})
+
+	utils.AssertNoError(t, "Calling AddOrUpdateCustomer", apiErr)
+	utils.AssertEquals(t, "Id of first customer on SQLite", 1001, cu.Id)
+
+	c, apiErr := dbi.AddCard(context.Background(), cu.Id, "")
+
+	utils.AssertNoError(t, "Calling AddCard", apiErr)
+	utils.AssertEquals(t, "Id of first card on SQLite", 100001, c.Id)
+}
+
+func TestSqliteMigrationsMatch(t *testing.T) {
+
+	utils.AssertEquals(t, "Number of SQLite migrations", len(migrations), len(sqliteMigrations))
+
+	for i, m := range sqliteMigrations {
+		utils.AssertEquals(t, "Version of SQLite migration "+m.Description, migrations[i].Version, m.Version)
+		utils.AssertEquals(t, "Description of SQLite migration", migrations[i].Description, m.Description)
+	}
+}
+
+func TestSqliteQuery(t *testing.T) {
+
+	utils.AssertEquals(t, "SQLite concatenation", "p.account = ('vendor:' || v.id)", sqliteQuery("p.account = CONCAT('vendor:', v.id)"))
+}
+
+func TestSqliteAddAndGet(t *testing.T) {
+
+	dbi, c, v, cleanup := sqliteFixture(t, 0)
+	defer cleanup()
+
+	cu, apiErr := dbi.GetCustomer(context.Background(), c.CustomerId)
+
+	utils.AssertNoError(t, "Calling GetCustomer", apiErr)
+	utils.AssertEquals(t, "Fullname for GetCustomer result", "Fred Bloggs", cu.Fullname)
+	utils.AssertEquals(t, "len(Cards) for GetCustomer result", 1, len(cu.Cards))
+	utils.AssertEquals(t, "Ts format for GetCustomer card", len(DATETIME_FORMAT), len(cu.Cards[0].Ts))
+
+	v.VendorName = "Coffee House"
+
+	_, apiErr = dbi.AddOrUpdateVendor(context.Background(), v)
+	utils.AssertNoError(t, "Calling AddOrUpdateVendor to update", apiErr)
+
+	vs, total, apiErr := dbi.GetVendors(context.Background(), 0, 10)
+
+	utils.AssertNoError(t, "Calling GetVendors", apiErr)
+	utils.AssertEquals(t, "Total for GetVendors result", 1, total)
+	utils.AssertEquals(t, "VendorName for GetVendors result", "Coffee House", vs[0].VendorName)
+
+	_, apiErr = dbi.TopUp(context.Background(), c.Id, 1000, "", "Transfer from Bank")
+	utils.AssertNoError(t, "Calling TopUp", apiErr)
+
+	aid, apiErr := dbi.Authorise(context.Background(), c.Id, v.Id, 250, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	vendor, apiErr := dbi.GetVendor(context.Background(), v.Id)
+
+	utils.AssertNoError(t, "Calling GetVendor", apiErr)
+	utils.AssertEquals(t, "len(Authorisations) for GetVendor result", 1, len(vendor.Authorisations))
+	utils.AssertEquals(t, "Id of the authorisation for GetVendor result", aid, vendor.Authorisations[0].Id)
+	utils.AssertEquals(t, "Amount of the authorisation for GetVendor result", 250, vendor.Authorisations[0].Amount)
+
+	_, apiErr = dbi.AddCard(context.Background(), 9999, "")
+
+	utils.AssertEquals(t, "Return status for calling AddCard with a bad customerId", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling AddCard with bad customerId 9999", badIdMessage("AddCard", "customer", 9999), apiErr.Error())
+
+	_, apiErr = dbi.GetCard(context.Background(), 9999)
+
+	utils.AssertEquals(t, "Return status for calling GetCard with a bad id", 404, apiErr.StatusCode())
+}
+
+func TestSqliteAuthoriseCaptureRefund(t *testing.T) {
+
+	dbi, c, v, cleanup := sqliteFixture(t, 1000)
+	defer cleanup()
+
+	aid, apiErr := dbi.Authorise(context.Background(), c.Id, v.Id, 250, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	_, apiErr = dbi.Capture(context.Background(), aid, 200, "")
+	utils.AssertNoError(t, "Calling Capture", apiErr)
+
+	_, apiErr = dbi.Capture(context.Background(), aid, 100, "")
+
+	utils.AssertEquals(t, "Return status for calling Capture with insufficient uncaptured funds", 400, apiErr.StatusCode())
+	utils.AssertEquals(t, "Return message for calling Capture with insufficient uncaptured funds", fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE, "Capture", "£1.00", "£0.50"), apiErr.Error())
+
+	_, apiErr = dbi.Reverse(context.Background(), aid, 50, "", "No cake")
+	utils.AssertNoError(t, "Calling Reverse", apiErr)
+
+	_, apiErr = dbi.Refund(context.Background(), aid, 80, "", "Bad coffee")
+	utils.AssertNoError(t, "Calling Refund", apiErr)
+
+	card, apiErr := dbi.GetCard(context.Background(), c.Id)
+
+	utils.AssertNoError(t, "Calling GetCard", apiErr)
+	utils.AssertEquals(t, "Balance after Capture and Refund", 880, card.Balance)
+	utils.AssertEquals(t, "Available after Capture, Reverse and Refund", 880, card.Available)
+	utils.AssertEquals(t, "len(Movements) for GetCard result", 3, len(card.Movements))
+
+	vendor, apiErr := dbi.GetVendor(context.Background(), v.Id)
+
+	utils.AssertNoError(t, "Calling GetVendor", apiErr)
+	utils.AssertEquals(t, "Vendor balance after Capture and Refund", 120, vendor.Balance)
+
+	auth, apiErr := dbi.GetAuthorisation(context.Background(), aid)
+
+	utils.AssertNoError(t, "Calling GetAuthorisation", apiErr)
+	utils.AssertEquals(t, "Captured for GetAuthorisation result", 200, auth.Captured)
+	utils.AssertEquals(t, "Reversed for GetAuthorisation result", 50, auth.Reversed)
+	utils.AssertEquals(t, "Refunded for GetAuthorisation result", 80, auth.Refunded)
+	utils.AssertEquals(t, "len(Movements) for GetAuthorisation result", 3, len(auth.Movements))
+
+	report, apiErr := dbi.Reconcile(context.Background())
+
+	utils.AssertNoError(t, "Calling Reconcile", apiErr)
+	utils.AssertTrue(t, "Ok for Reconcile result", report.Ok)
+	utils.AssertEquals(t, "CardsChecked for Reconcile result", 1, report.CardsChecked)
+
+	funding, apiErr := dbi.GetAccountBalance(context.Background(), LEDGER_ACCOUNT_FUNDING)
+
+	utils.AssertNoError(t, "Calling GetAccountBalance", apiErr)
+	utils.AssertEquals(t, "Funding against the ledger", -1000, funding)
+}
+
+func TestSqliteExpireAuthorisations(t *testing.T) {
+
+	defer fixClock(testNow)()
+
+	dbi, c, v, cleanup := sqliteFixture(t, 1000)
+	defer cleanup()
+
+	aid, apiErr := dbi.Authorise(context.Background(), c.Id, v.Id, 400, "", "Coffee")
+	utils.AssertNoError(t, "Calling Authorise", apiErr)
+
+	report, apiErr := dbi.ExpireAuthorisations(context.Background())
+
+	utils.AssertNoError(t, "Calling ExpireAuthorisations before expiry", apiErr)
+	utils.AssertEquals(t, "AuthorisationsExpired before expiry", 0, report.AuthorisationsExpired)
+
+	fixClock(testNow.Add(AUTHORISATION_EXPIRY))
+
+	report, apiErr = dbi.ExpireAuthorisations(context.Background())
+
+	utils.AssertNoError(t, "Calling ExpireAuthorisations after expiry", apiErr)
+	utils.AssertEquals(t, "AuthorisationsExpired after expiry", 1, report.AuthorisationsExpired)
+	utils.AssertEquals(t, "AmountReleased after expiry", 400, report.AmountReleased)
+	utils.AssertEquals(t, "AmountsReleased after expiry", 400, report.AmountsReleased["GBP"])
+
+	a, apiErr := dbi.GetAuthorisation(context.Background(), aid)
+
+	utils.AssertNoError(t, "Calling GetAuthorisation", apiErr)
+	utils.AssertEquals(t, "ExpiresAt for GetAuthorisation result", expiryTime(testNow), a.ExpiresAt)
+	utils.AssertEquals(t, "Capturable after expiry", 0, a.Capturable())
+}
+
+func TestSqliteCardStatus(t *testing.T) {
+
+	dbi, c, _, cleanup := sqliteFixture(t, 500)
+	defer cleanup()
+
+	card, apiErr := dbi.SetCardStatus(context.Background(), c.Id, CARD_STATUS_CLOSED, "Lost")
+
+	utils.AssertNoError(t, "Calling SetCardStatus to close", apiErr)
+	utils.AssertEquals(t, "Status after closing", CARD_STATUS_CLOSED, card.Status)
+	utils.AssertEquals(t, "Balance after closing", 0, card.Balance)
+
+	payout, _ := dbi.GetAccountBalance(context.Background(), LEDGER_ACCOUNT_PAYOUT)
+
+	utils.AssertEquals(t, "Payout against the ledger", 500, payout)
+}
+
+func TestSqliteIdempotencyKeys(t *testing.T) {
+
+	dbi, cleanup := sqliteDbi(t)
+	defer cleanup()
+
+	_, claimed, apiErr := dbi.ClaimIdempotencyKey(context.Background(), "key-1", "abc123")
+
+	utils.AssertNoError(t, "Calling ClaimIdempotencyKey", apiErr)
+	utils.AssertTrue(t, "Claimed for ClaimIdempotencyKey with a new key", claimed)
+
+	utils.AssertNoError(t, "Calling CompleteIdempotencyKey", dbi.CompleteIdempotencyKey(context.Background(), "key-1", 1009))
+
+	k, claimed, apiErr := dbi.ClaimIdempotencyKey(context.Background(), "key-1", "abc123")
+
+	utils.AssertNoError(t, "Calling ClaimIdempotencyKey", apiErr)
+	utils.AssertFalse(t, "Claimed for ClaimIdempotencyKey with a claimed key", claimed)
+	utils.AssertTrue(t, "Completed for ClaimIdempotencyKey with a completed key", k.Completed)
+	utils.AssertEquals(t, "ResponseId for ClaimIdempotencyKey with a completed key", 1009, k.ResponseId)
+}
+
+func TestSqliteConcurrentAuthorise(t *testing.T) {
+
+	// the burst of authorisations would otherwise be declined by the risk rules
+	dbi, c, v, cleanup := sqliteFixture(t, 1000, WithRiskEvaluator(ApproveAll))
+	defer cleanup()
+
+	testConcurrentAuthorise(t, dbi, c.Id, v.Id)
+}
+
+func TestSqliteConcurrentCapture(t *testing.T) {
+
+	// the burst of authorisations would otherwise be declined by the risk rules
+	dbi, c, v, cleanup := sqliteFixture(t, 1000, WithRiskEvaluator(ApproveAll))
+	defer cleanup()
+
+	testConcurrentCapture(t, dbi, c.Id, v.Id)
+}
+
+func TestSqliteConcurrentCaptureReverse(t *testing.T) {
+
+	// the burst of authorisations would otherwise be declined by the risk rules
+	dbi, c, v, cleanup := sqliteFixture(t, 1000, WithRiskEvaluator(ApproveAll))
+	defer cleanup()
+
+	testConcurrentCaptureReverse(t, dbi, c.Id, v.Id)
+}
+
+func TestSqliteConcurrentSpendCap(t *testing.T) {
+
+	// the burst of authorisations would otherwise be declined by the risk rules
+	dbi, c, v, cleanup := sqliteFixture(t, 1000, WithRiskEvaluator(ApproveAll))
+	defer cleanup()
+
+	testConcurrentSpendCap(t, dbi, c.Id, v.Id)
+}
+
+func TestSqliteTransfer(t *testing.T) {
+
+	dbi, c, _, cleanup := sqliteFixture(t, 1000)
+	defer cleanup()
+
+	testTransfer(t, dbi, c)
+}
+
+func TestSqliteFx(t *testing.T) {
+
+	dbi, c, _, cleanup := sqliteFixture(t, 2000)
+	defer cleanup()
+
+	testFx(t, dbi, c)
+}
+
+func TestSqliteLimits(t *testing.T) {
+
+	dbi, c, v, cleanup := sqliteFixture(t, 10000)
+	defer cleanup()
+
+	testLimits(t, dbi, c, v)
+}
+
+func TestSqliteRisk(t *testing.T) {
+
+	dbi, c, v, cleanup := sqliteFixture(t, 100000)
+	defer cleanup()
+
+	testRisk(t, dbi, c, v)
+}
+
+func TestSqliteDisputes(t *testing.T) {
+
+	dbi, c, v, cleanup := sqliteFixture(t, 10000)
+	defer cleanup()
+
+	testDisputes(t, dbi, c, v)
+}
+
+func TestSqliteDisputeClosedCard(t *testing.T) {
+
+	dbi, c, v, cleanup := sqliteFixture(t, 10000)
+	defer cleanup()
+
+	testDisputeClosedCard(t, dbi, c, v)
+}
+
+func TestSqliteSettlement(t *testing.T) {
+
+	dbi, c, v, cleanup := sqliteFixture(t, 10000, WithSettlementFee(models.FeeSchedule{BasisPoints: 150, Fixed: 20}))
+	defer cleanup()
+
+	testSettlement(t, dbi, c, v)
+}
+
+func TestSqliteFees(t *testing.T) {
+
+	dbi, c, v, cleanup := sqliteFixture(t, 10000)
+	defer cleanup()
+
+	testFees(t, dbi, c, v)
+}
+
+func TestSqliteMccControls(t *testing.T) {
+
+	dbi, c, v, cleanup := sqliteFixture(t, 10000)
+	defer cleanup()
+
+	testMccControls(t, dbi, c, v)
+}
+
+func TestSqliteMandates(t *testing.T) {
+
+	dbi, c, v, cleanup := sqliteFixture(t, 1000)
+	defer cleanup()
+
+	testMandates(t, dbi, c, v)
+}
+
+func TestSqliteMandateCompleteFails(t *testing.T) {
+
+	dbi, c, v, cleanup := sqliteFixture(t, 1000)
+	defer cleanup()
+
+	testMandateCompleteFails(t, dbi, c, v)
+}
+
+func TestSqliteMandateChangedDuringRun(t *testing.T) {
+
+	dbi, c, v, cleanup := sqliteFixture(t, 1000)
+	defer cleanup()
+
+	testMandateChangedDuringRun(t, dbi, c, v)
+}
+
+func TestSqliteMandateClosedCard(t *testing.T) {
+
+	dbi, c, v, cleanup := sqliteFixture(t, 1000)
+	defer cleanup()
+
+	testMandateClosedCard(t, dbi, c, v)
+}
+
+func TestSqliteMandateForeignKey(t *testing.T) {
+
+	dbi, c, v, cleanup := sqliteFixture(t, 1000)
+	defer cleanup()
+
+	testMandateForeignKey(t, dbi, c, v)
+}
+
+func TestSqliteAbandonedIdempotencyKeys(t *testing.T) {
+
+	dbi, cleanup := sqliteDbi(t)
+	defer cleanup()
+
+	testAbandonedIdempotencyKeys(t, dbi)
+}
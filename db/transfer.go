@@ -0,0 +1,271 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/merlincox/cardapi/models"
+)
+
+const (
+	// The debit is conditional on the available funds, and both sides on the status, as for QUERY_HOLD_CARD
+	QUERY_TRANSFER_OUT_CARD = `UPDATE cards SET balance = balance - ?, available = available - ? WHERE id = ? AND available >= ? AND status = 'ACTIVE'`
+	QUERY_TRANSFER_IN_CARD  = `UPDATE cards SET balance = balance + ?, available = available + ? WHERE id = ? AND status = 'ACTIVE'`
+
+	QUERY_ADD_TRANSFER_MOVEMENT = `INSERT INTO movements (card_id, amount, description, movement_type, related_movement_id)
+                                     VALUES (?, ?, ?, ?, ?)`
+	QUERY_LINK_MOVEMENT = `UPDATE movements SET related_movement_id = ? WHERE id = ?`
+
+	MESSAGE_TRANSFER_SAME_CARD  = "%v: cannot transfer from card %v to itself"
+	MESSAGE_TRANSFER_CURRENCIES = "%v: cannot transfer from card %v in %v to card %v in %v"
+)
+
+// The statuses in which a card may be transferred from or to. Unlike a top-up, a transfer to a frozen card is refused,
+// since the sender could not then recover the funds
+var (
+	transferOutStatuses = []string{CARD_STATUS_ACTIVE}
+	transferInStatuses  = []string{CARD_STATUS_ACTIVE}
+)
+
+// Transfer moves funds from the available balance of one card to another, recording a TRANSFER-OUT movement on the
+// first and a TRANSFER-IN movement on the second, each referencing the other. Returns the id of the TRANSFER-OUT movement
+func (d *dbGate) Transfer(ctx context.Context, fromCardId, toCardId, amount int, currency, description string) (int, models.ApiError) {
+
+	if fromCardId == toCardId {
+		return -1, models.ConstructApiError(400, MESSAGE_TRANSFER_SAME_CARD, "Transfer", fromCardId)
+	}
+
+	from, apiErr := d.getCard(ctx, fromCardId)
+
+	if apiErr != nil {
+
+		if apiErr.StatusCode() == 500 {
+			return -1, apiErr
+		}
+
+		return -1, models.ConstructApiError(400, MESSAGE_BAD_ID, "Transfer", "card", fromCardId)
+	}
+
+	to, apiErr := d.getCard(ctx, toCardId)
+
+	if apiErr != nil {
+
+		if apiErr.StatusCode() == 500 {
+			return -1, apiErr
+		}
+
+		return -1, models.ConstructApiError(400, MESSAGE_BAD_ID, "Transfer", "card", toCardId)
+	}
+
+	apiErr = checkCardUsable(from, transferOutStatuses, "Transfer")
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	apiErr = checkCardUsable(to, transferInStatuses, "Transfer")
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	currency, apiErr = checkTransferCurrencies(from, to, currency)
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	if from.Available < amount {
+		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "Transfer", models.Money{Amount: amount, Currency: currency}, models.Money{Amount: from.Available, Currency: currency})
+	}
+
+	tx, err := d.dbx.BeginTx(ctx, nil)
+
+	if err != nil {
+		return -1, models.ErrorWrap(err)
+	}
+
+	defer tx.Rollback()
+
+	debit := func() models.ApiError {
+		return d.transferCard(ctx, tx, QUERY_TRANSFER_OUT_CARD, fromCardId, amount, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE_FOR, "Transfer", models.Money{Amount: amount, Currency: currency}), amount)
+	}
+
+	credit := func() models.ApiError {
+		return d.transferCard(ctx, tx, QUERY_TRANSFER_IN_CARD, toCardId, amount, models.ConstructApiError(409, MESSAGE_CARD_STATUS_CHANGED, "Transfer", toCardId))
+	}
+
+	// the cards are updated in id order, so that opposing transfers between the same cards take their row locks in the
+	// same order rather than deadlocking
+	first, second := debit, credit
+
+	if toCardId < fromCardId {
+		first, second = credit, debit
+	}
+
+	if apiErr = first(); apiErr != nil {
+		return -1, apiErr
+	}
+
+	if apiErr = second(); apiErr != nil {
+		return -1, apiErr
+	}
+
+	qry := QUERY_ADD_TRANSFER_MOVEMENT
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return -1, models.ErrorWrap(err)
+	}
+
+	stmt := tx.StmtContext(ctx, d.stmt(qry))
+
+	res := d.exec(ctx, stmt, qry, fromCardId, -amount, description, "TRANSFER-OUT", nil)
+
+	if res.apiErr != nil {
+		return -1, res.apiErr
+	}
+
+	outId := res.lastInsertedId
+
+	res = d.exec(ctx, stmt, qry, toCardId, amount, description, "TRANSFER-IN", outId)
+
+	if res.apiErr != nil {
+		return -1, res.apiErr
+	}
+
+	inId := res.lastInsertedId
+
+	qry = QUERY_LINK_MOVEMENT
+
+	err = d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return -1, models.ErrorWrap(err)
+	}
+
+	res = d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, inId, outId)
+
+	if res.apiErr != nil {
+		return -1, res.apiErr
+	}
+
+	apiErr = d.addLedgerEntry(ctx, tx, "TRANSFER", description, outId, transfer(CardAvailableAccount(fromCardId), CardAvailableAccount(toCardId), amount, from.Currency))
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return -1, models.ErrorWrap(err)
+	}
+
+	return outId, nil
+}
+
+// Check that a transfer is between cards in the same currency, as the currency of the amount if given must also be,
+// returning the currency of the amount
+func checkTransferCurrencies(from, to models.Card, currency string) (string, models.ApiError) {
+
+	if from.Currency != to.Currency {
+		return currency, models.ConstructApiError(400, MESSAGE_TRANSFER_CURRENCIES, "Transfer", from.Id, from.Currency, to.Id, to.Currency)
+	}
+
+	return checkAmountCurrency(currency, from.Currency, "card", from.Id, "Transfer")
+}
+
+// Apply one side of a transfer to a card within a transaction, returning failErr if the guarded update does not
+// affect the card. Any further guard arguments follow the standard ones
+func (d *dbGate) transferCard(ctx context.Context, tx *sql.Tx, qry string, cardId, amount int, failErr models.ApiError, guardArgs ...interface{}) models.ApiError {
+
+	err := d.prepareQry(ctx, qry)
+
+	if err != nil {
+		return models.ErrorWrap(err)
+	}
+
+	args := append([]interface{}{amount, amount, cardId}, guardArgs...)
+
+	res := d.exec(ctx, tx.StmtContext(ctx, d.stmt(qry)), qry, args...)
+
+	if res.apiErr != nil {
+		return res.apiErr
+	}
+
+	if res.numRowsAffected != 1 {
+		return failErr
+	}
+
+	return nil
+}
+
+// Transfer moves funds from the available balance of one card to another, recording a TRANSFER-OUT movement on the
+// first and a TRANSFER-IN movement on the second, each referencing the other. Returns the id of the TRANSFER-OUT movement
+func (m *memGate) Transfer(ctx context.Context, fromCardId, toCardId, amount int, currency, description string) (int, models.ApiError) {
+
+	if fromCardId == toCardId {
+		return -1, models.ConstructApiError(400, MESSAGE_TRANSFER_SAME_CARD, "Transfer", fromCardId)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	from, ok := m.cards[fromCardId]
+
+	if !ok {
+		return -1, models.ConstructApiError(400, MESSAGE_BAD_ID, "Transfer", "card", fromCardId)
+	}
+
+	to, ok := m.cards[toCardId]
+
+	if !ok {
+		return -1, models.ConstructApiError(400, MESSAGE_BAD_ID, "Transfer", "card", toCardId)
+	}
+
+	if apiErr := checkCardUsable(from, transferOutStatuses, "Transfer"); apiErr != nil {
+		return -1, apiErr
+	}
+
+	if apiErr := checkCardUsable(to, transferInStatuses, "Transfer"); apiErr != nil {
+		return -1, apiErr
+	}
+
+	currency, apiErr := checkTransferCurrencies(from, to, currency)
+
+	if apiErr != nil {
+		return -1, apiErr
+	}
+
+	if from.Available < amount {
+		return -1, models.ConstructApiError(400, MESSAGE_INSUFFICIENT_AVAILABLE, "Transfer", models.Money{Amount: amount, Currency: currency}, models.Money{Amount: from.Available, Currency: currency})
+	}
+
+	m.updateCard(fromCardId, -amount, -amount)
+	m.updateCard(toCardId, amount, amount)
+
+	outId := m.addMovement(fromCardId, -amount, description, "TRANSFER-OUT")
+	inId := m.addMovement(toCardId, amount, description, "TRANSFER-IN")
+
+	m.linkMovements(outId, inId)
+
+	m.addLedgerEntry("TRANSFER", description, outId, transfer(CardAvailableAccount(fromCardId), CardAvailableAccount(toCardId), amount, from.Currency))
+
+	return outId, nil
+}
+
+// Equivalent of QUERY_LINK_MOVEMENT, for both movements of a transfer
+func (m *memGate) linkMovements(outId, inId int) {
+
+	for i, mv := range m.movements {
+
+		switch mv.Id {
+		case outId:
+			m.movements[i].RelatedMovementId = inId
+		case inId:
+			m.movements[i].RelatedMovementId = outId
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func TestTransferOK(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		ep := expecter.ExpectPrepare(esc(QUERY_GET_CARD))
+
+		ep.ExpectQuery().WithArgs(100001).WillReturnRows(sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 1000, 750, "ACTIVE", "2019-01-24 01:00:10", "GBP"))
+		ep.ExpectQuery().WithArgs(100002).WillReturnRows(sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100002), 0, 0, "ACTIVE", "2019-01-24 01:00:10", "GBP"))
+
+		expecter.ExpectBegin()
+
+		expecter.ExpectPrepare(esc(QUERY_TRANSFER_OUT_CARD))
+		expecter.ExpectPrepare(esc(QUERY_TRANSFER_OUT_CARD)).ExpectExec().WithArgs(500, 500, 100001, 500).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		expecter.ExpectPrepare(esc(QUERY_TRANSFER_IN_CARD))
+		expecter.ExpectPrepare(esc(QUERY_TRANSFER_IN_CARD)).ExpectExec().WithArgs(500, 500, 100002).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		expecter.ExpectPrepare(esc(QUERY_ADD_TRANSFER_MOVEMENT))
+		ep = expecter.ExpectPrepare(esc(QUERY_ADD_TRANSFER_MOVEMENT))
+		ep.ExpectExec().WithArgs(100001, -500, "Share of dinner", "TRANSFER-OUT", nil).WillReturnResult(sqlmock.NewResult(1009, 1))
+		ep.ExpectExec().WithArgs(100002, 500, "Share of dinner", "TRANSFER-IN", 1009).WillReturnResult(sqlmock.NewResult(1010, 1))
+
+		expecter.ExpectPrepare(esc(QUERY_LINK_MOVEMENT))
+		expecter.ExpectPrepare(esc(QUERY_LINK_MOVEMENT)).ExpectExec().WithArgs(1010, 1009).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		expectLedgerEntry(expecter, "TRANSFER", "Share of dinner", 1009, transfer(CardAvailableAccount(100001), CardAvailableAccount(100002), 500, "GBP"))
+
+		expecter.ExpectCommit()
+
+		id, apiErr := dbi.Transfer(context.Background(), 100001, 100002, 500, "", "Share of dinner")
+
+		utils.AssertNoError(t, "Calling Transfer", apiErr)
+		utils.AssertEquals(t, "Transfer-out movement id", 1009, id)
+	})
+}
+
+func TestTransferToLowerCardId(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		ep := expecter.ExpectPrepare(esc(QUERY_GET_CARD))
+
+		ep.ExpectQuery().WithArgs(100002).WillReturnRows(sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100002), 1000, 1000, "ACTIVE", "2019-01-24 01:00:10", "GBP"))
+		ep.ExpectQuery().WithArgs(100001).WillReturnRows(sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 0, 0, "ACTIVE", "2019-01-24 01:00:10", "GBP"))
+
+		expecter.ExpectBegin()
+
+		// the lower card id is updated first, so here the credit comes before the debit
+		expecter.ExpectPrepare(esc(QUERY_TRANSFER_IN_CARD))
+		expecter.ExpectPrepare(esc(QUERY_TRANSFER_IN_CARD)).ExpectExec().WithArgs(500, 500, 100001).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		expecter.ExpectPrepare(esc(QUERY_TRANSFER_OUT_CARD))
+		expecter.ExpectPrepare(esc(QUERY_TRANSFER_OUT_CARD)).ExpectExec().WithArgs(500, 500, 100002, 500).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		expecter.ExpectRollback()
+
+		_, apiErr := dbi.Transfer(context.Background(), 100002, 100001, 500, "", "Share of dinner")
+
+		utils.AssertEquals(t, "Return status for calling Transfer after a concurrent spend", 400, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling Transfer after a concurrent spend",
+			fmt.Sprintf(MESSAGE_INSUFFICIENT_AVAILABLE_FOR, "Transfer", "£5.00"), apiErr.Error())
+	})
+}
+
+func TestTransferFrozenCard(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		ep := expecter.ExpectPrepare(esc(QUERY_GET_CARD))
+
+		ep.ExpectQuery().WithArgs(100001).WillReturnRows(sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100001), 1000, 750, "ACTIVE", "2019-01-24 01:00:10", "GBP"))
+		ep.ExpectQuery().WithArgs(100002).WillReturnRows(sqlmock.NewRows([]string{"id", "balance", "available", "status", "tc", "currency"}).
+			AddRow(int64(100002), 0, 0, "FROZEN", "2019-01-24 01:00:10", "GBP"))
+
+		_, apiErr := dbi.Transfer(context.Background(), 100001, 100002, 500, "", "Share of dinner")
+
+		utils.AssertEquals(t, "Return status for calling Transfer to a frozen card", 403, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling Transfer to a frozen card",
+			fmt.Sprintf(MESSAGE_CARD_NOT_USABLE, "Transfer", 100002, "FROZEN"), apiErr.Error())
+	})
+}
+
+func TestTransferSameCard(t *testing.T) {
+	testWrapper(t, func(t *testing.T, expecter sqlmock.Sqlmock, dbi Dbi) {
+
+		_, apiErr := dbi.Transfer(context.Background(), 100001, 100001, 500, "", "Share of dinner")
+
+		utils.AssertEquals(t, "Return status for calling Transfer to the same card", 400, apiErr.StatusCode())
+		utils.AssertEquals(t, "Return message for calling Transfer to the same card",
+			fmt.Sprintf(MESSAGE_TRANSFER_SAME_CARD, "Transfer", 100001), apiErr.Error())
+	})
+}
+
+// Transfers between a topped-up card and a second card, checking the paired movements and the balances
+func testTransfer(t *testing.T, dbi Dbi, c models.Card) {
+
+	to, apiErr := dbi.AddCard(context.Background(), c.CustomerId, "")
+	utils.AssertNoError(t, "Calling AddCard", apiErr)
+
+	outId, apiErr := dbi.Transfer(context.Background(), c.Id, to.Id, 400, "", "Share of dinner")
+	utils.AssertNoError(t, "Calling Transfer", apiErr)
+
+	_, apiErr = dbi.Transfer(context.Background(), c.Id, to.Id, 700, "", "Share of dinner")
+	utils.AssertEquals(t, "Return status for calling Transfer with insufficient funds", 400, apiErr.StatusCode())
+
+	from, _ := dbi.GetCard(context.Background(), c.Id)
+	received, _ := dbi.GetCard(context.Background(), to.Id)
+
+	utils.AssertEquals(t, "Balance of the sending card", 600, from.Balance)
+	utils.AssertEquals(t, "Available of the receiving card", 400, received.Available)
+
+	out := from.Movements[len(from.Movements)-1]
+	in := received.Movements[len(received.Movements)-1]
+
+	utils.AssertEquals(t, "Id of the TRANSFER-OUT movement", outId, out.Id)
+	utils.AssertEquals(t, "MovementType of the sending movement", "TRANSFER-OUT", out.MovementType)
+	utils.AssertEquals(t, "MovementType of the receiving movement", "TRANSFER-IN", in.MovementType)
+	utils.AssertEquals(t, "RelatedMovementId of the TRANSFER-OUT movement", in.Id, out.RelatedMovementId)
+	utils.AssertEquals(t, "RelatedMovementId of the TRANSFER-IN movement", out.Id, in.RelatedMovementId)
+
+	_, apiErr = dbi.SetCardStatus(context.Background(), to.Id, CARD_STATUS_CLOSED, "")
+	utils.AssertNoError(t, "Calling SetCardStatus to close", apiErr)
+
+	_, apiErr = dbi.Transfer(context.Background(), c.Id, to.Id, 100, "", "Share of dinner")
+	utils.AssertEquals(t, "Return status for calling Transfer to a closed card", 403, apiErr.StatusCode())
+
+	r, apiErr := dbi.Reconcile(context.Background())
+
+	utils.AssertNoError(t, "Calling Reconcile", apiErr)
+	utils.AssertTrue(t, "Ok for Reconcile after transfers", r.Ok)
+}
+
+func TestMemoryTransfer(t *testing.T) {
+
+	dbi, c, _ := memoryFixture(t, 1000)
+	defer dbi.Close()
+
+	testTransfer(t, dbi, c)
+}
@@ -0,0 +1,127 @@
+// This is the schema migration executable
+//
+// Usage: migrate [-dsn DSN] up [version] | down [version] | status
+//
+// up migrates to the latest schema version, or to the given version. down reverts the latest migration, or reverts
+// migrations down to the given version (0 to revert them all). The DSN, a MySQL DSN, a PostgreSQL connection URL
+// (postgres://...) or an SQLite file URI (file:cardapi.db), defaults to the MYSQLDSN environment variable.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/merlincox/cardapi/db"
+)
+
+func main() {
+
+	dsn := flag.String("dsn", os.Getenv("MYSQLDSN"), "MySQL DSN, PostgreSQL URL or SQLite file URI of the database to migrate")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [-dsn DSN] up [version] | down [version] | status\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dbx, apiErr := db.Open(*dsn)
+
+	if apiErr != nil {
+		log.Fatal(apiErr.Error())
+	}
+
+	defer dbx.Close()
+
+	version, apiErr := db.SchemaVersion(dbx)
+
+	if apiErr != nil {
+		log.Fatalf("Failed to read schema version: %v", apiErr.Error())
+	}
+
+	switch flag.Arg(0) {
+
+	case "up":
+
+		applied, apiErr := db.MigrateUp(dbx, targetVersion(db.LatestSchemaVersion()))
+
+		for _, m := range applied {
+			log.Printf("Applied migration %v: %v", m.Version, m.Description)
+		}
+
+		if apiErr != nil {
+			log.Fatalf("Migration failed: %v", apiErr.Error())
+		}
+
+	case "down":
+
+		previous := version - 1
+
+		if previous < 0 {
+			previous = 0
+		}
+
+		reverted, apiErr := db.MigrateDown(dbx, targetVersion(previous))
+
+		for _, m := range reverted {
+			log.Printf("Reverted migration %v: %v", m.Version, m.Description)
+		}
+
+		if apiErr != nil {
+			log.Fatalf("Migration failed: %v", apiErr.Error())
+		}
+
+	case "status":
+
+		for _, m := range db.Migrations() {
+
+			state := "pending"
+
+			if m.Version <= version {
+				state = "applied"
+			}
+
+			fmt.Printf("%4d  %-8v %v\n", m.Version, state, m.Description)
+		}
+
+		fmt.Printf("Schema version %v of %v\n", version, db.LatestSchemaVersion())
+
+		return
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	version, apiErr = db.SchemaVersion(dbx)
+
+	if apiErr != nil {
+		log.Fatalf("Failed to read schema version: %v", apiErr.Error())
+	}
+
+	log.Printf("Schema version is now %v of %v", version, db.LatestSchemaVersion())
+}
+
+// Return the version given as the second argument, or the default if there is none
+func targetVersion(defaultVersion int) int {
+
+	if flag.NArg() < 2 {
+		return defaultVersion
+	}
+
+	target, err := strconv.Atoi(flag.Arg(1))
+
+	if err != nil {
+		log.Fatalf("Malformed version: %v", flag.Arg(1))
+	}
+
+	return target
+}
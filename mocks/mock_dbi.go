@@ -5,6 +5,7 @@
 package mocks
 
 import (
+	context "context"
 	gomock "github.com/golang/mock/gomock"
 	models "github.com/merlincox/cardapi/models"
 	reflect "reflect"
@@ -34,68 +35,108 @@ func (m *MockDbi) EXPECT() *MockDbiMockRecorder {
 }
 
 // AddCard mocks base method
-func (m *MockDbi) AddCard(arg0 int) (models.Card, models.ApiError) {
-	ret := m.ctrl.Call(m, "AddCard", arg0)
+func (m *MockDbi) AddCard(arg0 context.Context, arg1 int, arg2 string) (models.Card, models.ApiError) {
+	ret := m.ctrl.Call(m, "AddCard", arg0, arg1, arg2)
 	ret0, _ := ret[0].(models.Card)
 	ret1, _ := ret[1].(models.ApiError)
 	return ret0, ret1
 }
 
 // AddCard indicates an expected call of AddCard
-func (mr *MockDbiMockRecorder) AddCard(arg0 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddCard", reflect.TypeOf((*MockDbi)(nil).AddCard), arg0)
+func (mr *MockDbiMockRecorder) AddCard(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddCard", reflect.TypeOf((*MockDbi)(nil).AddCard), arg0, arg1, arg2)
 }
 
 // AddOrUpdateCustomer mocks base method
-func (m *MockDbi) AddOrUpdateCustomer(arg0 models.Customer) (models.Customer, models.ApiError) {
-	ret := m.ctrl.Call(m, "AddOrUpdateCustomer", arg0)
+func (m *MockDbi) AddOrUpdateCustomer(arg0 context.Context, arg1 models.Customer) (models.Customer, models.ApiError) {
+	ret := m.ctrl.Call(m, "AddOrUpdateCustomer", arg0, arg1)
 	ret0, _ := ret[0].(models.Customer)
 	ret1, _ := ret[1].(models.ApiError)
 	return ret0, ret1
 }
 
 // AddOrUpdateCustomer indicates an expected call of AddOrUpdateCustomer
-func (mr *MockDbiMockRecorder) AddOrUpdateCustomer(arg0 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddOrUpdateCustomer", reflect.TypeOf((*MockDbi)(nil).AddOrUpdateCustomer), arg0)
+func (mr *MockDbiMockRecorder) AddOrUpdateCustomer(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddOrUpdateCustomer", reflect.TypeOf((*MockDbi)(nil).AddOrUpdateCustomer), arg0, arg1)
+}
+
+// AddOrUpdateMandate mocks base method
+func (m *MockDbi) AddOrUpdateMandate(arg0 context.Context, arg1 models.Mandate) (models.Mandate, models.ApiError) {
+	ret := m.ctrl.Call(m, "AddOrUpdateMandate", arg0, arg1)
+	ret0, _ := ret[0].(models.Mandate)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// AddOrUpdateMandate indicates an expected call of AddOrUpdateMandate
+func (mr *MockDbiMockRecorder) AddOrUpdateMandate(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddOrUpdateMandate", reflect.TypeOf((*MockDbi)(nil).AddOrUpdateMandate), arg0, arg1)
 }
 
 // AddOrUpdateVendor mocks base method
-func (m *MockDbi) AddOrUpdateVendor(arg0 models.Vendor) (models.Vendor, models.ApiError) {
-	ret := m.ctrl.Call(m, "AddOrUpdateVendor", arg0)
+func (m *MockDbi) AddOrUpdateVendor(arg0 context.Context, arg1 models.Vendor) (models.Vendor, models.ApiError) {
+	ret := m.ctrl.Call(m, "AddOrUpdateVendor", arg0, arg1)
 	ret0, _ := ret[0].(models.Vendor)
 	ret1, _ := ret[1].(models.ApiError)
 	return ret0, ret1
 }
 
 // AddOrUpdateVendor indicates an expected call of AddOrUpdateVendor
-func (mr *MockDbiMockRecorder) AddOrUpdateVendor(arg0 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddOrUpdateVendor", reflect.TypeOf((*MockDbi)(nil).AddOrUpdateVendor), arg0)
+func (mr *MockDbiMockRecorder) AddOrUpdateVendor(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddOrUpdateVendor", reflect.TypeOf((*MockDbi)(nil).AddOrUpdateVendor), arg0, arg1)
 }
 
 // Authorise mocks base method
-func (m *MockDbi) Authorise(arg0, arg1, arg2 int, arg3 string) (int, models.ApiError) {
-	ret := m.ctrl.Call(m, "Authorise", arg0, arg1, arg2, arg3)
+func (m *MockDbi) Authorise(arg0 context.Context, arg1, arg2, arg3 int, arg4, arg5 string) (int, models.ApiError) {
+	ret := m.ctrl.Call(m, "Authorise", arg0, arg1, arg2, arg3, arg4, arg5)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(models.ApiError)
 	return ret0, ret1
 }
 
 // Authorise indicates an expected call of Authorise
-func (mr *MockDbiMockRecorder) Authorise(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Authorise", reflect.TypeOf((*MockDbi)(nil).Authorise), arg0, arg1, arg2, arg3)
+func (mr *MockDbiMockRecorder) Authorise(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Authorise", reflect.TypeOf((*MockDbi)(nil).Authorise), arg0, arg1, arg2, arg3, arg4, arg5)
 }
 
 // Capture mocks base method
-func (m *MockDbi) Capture(arg0, arg1 int) (int, models.ApiError) {
-	ret := m.ctrl.Call(m, "Capture", arg0, arg1)
+func (m *MockDbi) Capture(arg0 context.Context, arg1, arg2 int, arg3 string) (int, models.ApiError) {
+	ret := m.ctrl.Call(m, "Capture", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(models.ApiError)
 	return ret0, ret1
 }
 
 // Capture indicates an expected call of Capture
-func (mr *MockDbiMockRecorder) Capture(arg0, arg1 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Capture", reflect.TypeOf((*MockDbi)(nil).Capture), arg0, arg1)
+func (mr *MockDbiMockRecorder) Capture(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Capture", reflect.TypeOf((*MockDbi)(nil).Capture), arg0, arg1, arg2, arg3)
+}
+
+// ClaimIdempotencyKey mocks base method
+func (m *MockDbi) ClaimIdempotencyKey(arg0 context.Context, arg1, arg2 string) (models.IdempotencyKey, bool, models.ApiError) {
+	ret := m.ctrl.Call(m, "ClaimIdempotencyKey", arg0, arg1, arg2)
+	ret0, _ := ret[0].(models.IdempotencyKey)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(models.ApiError)
+	return ret0, ret1, ret2
+}
+
+// ClaimIdempotencyKey indicates an expected call of ClaimIdempotencyKey
+func (mr *MockDbiMockRecorder) ClaimIdempotencyKey(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimIdempotencyKey", reflect.TypeOf((*MockDbi)(nil).ClaimIdempotencyKey), arg0, arg1, arg2)
+}
+
+// ClearAuthorisation mocks base method
+func (m *MockDbi) ClearAuthorisation(arg0 context.Context, arg1 int, arg2 string) (models.Authorisation, models.ApiError) {
+	ret := m.ctrl.Call(m, "ClearAuthorisation", arg0, arg1, arg2)
+	ret0, _ := ret[0].(models.Authorisation)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// ClearAuthorisation indicates an expected call of ClearAuthorisation
+func (mr *MockDbiMockRecorder) ClearAuthorisation(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClearAuthorisation", reflect.TypeOf((*MockDbi)(nil).ClearAuthorisation), arg0, arg1, arg2)
 }
 
 // Close mocks base method
@@ -108,119 +149,420 @@ func (mr *MockDbiMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockDbi)(nil).Close))
 }
 
+// CompleteIdempotencyKey mocks base method
+func (m *MockDbi) CompleteIdempotencyKey(arg0 context.Context, arg1 string, arg2 int) models.ApiError {
+	ret := m.ctrl.Call(m, "CompleteIdempotencyKey", arg0, arg1, arg2)
+	ret0, _ := ret[0].(models.ApiError)
+	return ret0
+}
+
+// CompleteIdempotencyKey indicates an expected call of CompleteIdempotencyKey
+func (mr *MockDbiMockRecorder) CompleteIdempotencyKey(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompleteIdempotencyKey", reflect.TypeOf((*MockDbi)(nil).CompleteIdempotencyKey), arg0, arg1, arg2)
+}
+
+// ExpireAuthorisations mocks base method
+func (m *MockDbi) ExpireAuthorisations(arg0 context.Context) (models.ExpiryReport, models.ApiError) {
+	ret := m.ctrl.Call(m, "ExpireAuthorisations", arg0)
+	ret0, _ := ret[0].(models.ExpiryReport)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// ExpireAuthorisations indicates an expected call of ExpireAuthorisations
+func (mr *MockDbiMockRecorder) ExpireAuthorisations(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExpireAuthorisations", reflect.TypeOf((*MockDbi)(nil).ExpireAuthorisations), arg0)
+}
+
+// GetAccountBalance mocks base method
+func (m *MockDbi) GetAccountBalance(arg0 context.Context, arg1 string) (int, models.ApiError) {
+	ret := m.ctrl.Call(m, "GetAccountBalance", arg0, arg1)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// GetAccountBalance indicates an expected call of GetAccountBalance
+func (mr *MockDbiMockRecorder) GetAccountBalance(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAccountBalance", reflect.TypeOf((*MockDbi)(nil).GetAccountBalance), arg0, arg1)
+}
+
 // GetAuthorisation mocks base method
-func (m *MockDbi) GetAuthorisation(arg0 int) (models.Authorisation, models.ApiError) {
-	ret := m.ctrl.Call(m, "GetAuthorisation", arg0)
+func (m *MockDbi) GetAuthorisation(arg0 context.Context, arg1 int) (models.Authorisation, models.ApiError) {
+	ret := m.ctrl.Call(m, "GetAuthorisation", arg0, arg1)
 	ret0, _ := ret[0].(models.Authorisation)
 	ret1, _ := ret[1].(models.ApiError)
 	return ret0, ret1
 }
 
 // GetAuthorisation indicates an expected call of GetAuthorisation
-func (mr *MockDbiMockRecorder) GetAuthorisation(arg0 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAuthorisation", reflect.TypeOf((*MockDbi)(nil).GetAuthorisation), arg0)
+func (mr *MockDbiMockRecorder) GetAuthorisation(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAuthorisation", reflect.TypeOf((*MockDbi)(nil).GetAuthorisation), arg0, arg1)
 }
 
 // GetCard mocks base method
-func (m *MockDbi) GetCard(arg0 int) (models.Card, models.ApiError) {
-	ret := m.ctrl.Call(m, "GetCard", arg0)
+func (m *MockDbi) GetCard(arg0 context.Context, arg1 int) (models.Card, models.ApiError) {
+	ret := m.ctrl.Call(m, "GetCard", arg0, arg1)
 	ret0, _ := ret[0].(models.Card)
 	ret1, _ := ret[1].(models.ApiError)
 	return ret0, ret1
 }
 
 // GetCard indicates an expected call of GetCard
-func (mr *MockDbiMockRecorder) GetCard(arg0 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCard", reflect.TypeOf((*MockDbi)(nil).GetCard), arg0)
+func (mr *MockDbiMockRecorder) GetCard(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCard", reflect.TypeOf((*MockDbi)(nil).GetCard), arg0, arg1)
+}
+
+// GetCardLimits mocks base method
+func (m *MockDbi) GetCardLimits(arg0 context.Context, arg1 int) (models.SpendingLimits, models.ApiError) {
+	ret := m.ctrl.Call(m, "GetCardLimits", arg0, arg1)
+	ret0, _ := ret[0].(models.SpendingLimits)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// GetCardLimits indicates an expected call of GetCardLimits
+func (mr *MockDbiMockRecorder) GetCardLimits(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCardLimits", reflect.TypeOf((*MockDbi)(nil).GetCardLimits), arg0, arg1)
+}
+
+// GetCardMccControls mocks base method
+func (m *MockDbi) GetCardMccControls(arg0 context.Context, arg1 int) (models.MccControls, models.ApiError) {
+	ret := m.ctrl.Call(m, "GetCardMccControls", arg0, arg1)
+	ret0, _ := ret[0].(models.MccControls)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// GetCardMccControls indicates an expected call of GetCardMccControls
+func (mr *MockDbiMockRecorder) GetCardMccControls(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCardMccControls", reflect.TypeOf((*MockDbi)(nil).GetCardMccControls), arg0, arg1)
 }
 
 // GetCustomer mocks base method
-func (m *MockDbi) GetCustomer(arg0 int) (models.Customer, models.ApiError) {
-	ret := m.ctrl.Call(m, "GetCustomer", arg0)
+func (m *MockDbi) GetCustomer(arg0 context.Context, arg1 int) (models.Customer, models.ApiError) {
+	ret := m.ctrl.Call(m, "GetCustomer", arg0, arg1)
 	ret0, _ := ret[0].(models.Customer)
 	ret1, _ := ret[1].(models.ApiError)
 	return ret0, ret1
 }
 
 // GetCustomer indicates an expected call of GetCustomer
-func (mr *MockDbiMockRecorder) GetCustomer(arg0 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCustomer", reflect.TypeOf((*MockDbi)(nil).GetCustomer), arg0)
+func (mr *MockDbiMockRecorder) GetCustomer(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCustomer", reflect.TypeOf((*MockDbi)(nil).GetCustomer), arg0, arg1)
 }
 
 // GetCustomers mocks base method
-func (m *MockDbi) GetCustomers() ([]models.Customer, models.ApiError) {
-	ret := m.ctrl.Call(m, "GetCustomers")
+func (m *MockDbi) GetCustomers(arg0 context.Context, arg1, arg2 int) ([]models.Customer, int, models.ApiError) {
+	ret := m.ctrl.Call(m, "GetCustomers", arg0, arg1, arg2)
 	ret0, _ := ret[0].([]models.Customer)
+	ret1, _ := ret[1].(int)
+	ret2, _ := ret[2].(models.ApiError)
+	return ret0, ret1, ret2
+}
+
+// GetCustomers indicates an expected call of GetCustomers
+func (mr *MockDbiMockRecorder) GetCustomers(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCustomers", reflect.TypeOf((*MockDbi)(nil).GetCustomers), arg0, arg1, arg2)
+}
+
+// GetLedgerEntries mocks base method
+func (m *MockDbi) GetLedgerEntries(arg0 context.Context, arg1, arg2 int) ([]models.LedgerEntry, int, models.ApiError) {
+	ret := m.ctrl.Call(m, "GetLedgerEntries", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]models.LedgerEntry)
+	ret1, _ := ret[1].(int)
+	ret2, _ := ret[2].(models.ApiError)
+	return ret0, ret1, ret2
+}
+
+// GetLedgerEntries indicates an expected call of GetLedgerEntries
+func (mr *MockDbiMockRecorder) GetLedgerEntries(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLedgerEntries", reflect.TypeOf((*MockDbi)(nil).GetLedgerEntries), arg0, arg1, arg2)
+}
+
+// GetMandate mocks base method
+func (m *MockDbi) GetMandate(arg0 context.Context, arg1 int) (models.Mandate, models.ApiError) {
+	ret := m.ctrl.Call(m, "GetMandate", arg0, arg1)
+	ret0, _ := ret[0].(models.Mandate)
 	ret1, _ := ret[1].(models.ApiError)
 	return ret0, ret1
 }
 
-// GetCustomers indicates an expected call of GetCustomers
-func (mr *MockDbiMockRecorder) GetCustomers() *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCustomers", reflect.TypeOf((*MockDbi)(nil).GetCustomers))
+// GetMandate indicates an expected call of GetMandate
+func (mr *MockDbiMockRecorder) GetMandate(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMandate", reflect.TypeOf((*MockDbi)(nil).GetMandate), arg0, arg1)
+}
+
+// GetSettlements mocks base method
+func (m *MockDbi) GetSettlements(arg0 context.Context, arg1, arg2, arg3 int) ([]models.Settlement, int, models.ApiError) {
+	ret := m.ctrl.Call(m, "GetSettlements", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].([]models.Settlement)
+	ret1, _ := ret[1].(int)
+	ret2, _ := ret[2].(models.ApiError)
+	return ret0, ret1, ret2
+}
+
+// GetSettlements indicates an expected call of GetSettlements
+func (mr *MockDbiMockRecorder) GetSettlements(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSettlements", reflect.TypeOf((*MockDbi)(nil).GetSettlements), arg0, arg1, arg2, arg3)
 }
 
 // GetVendor mocks base method
-func (m *MockDbi) GetVendor(arg0 int) (models.Vendor, models.ApiError) {
-	ret := m.ctrl.Call(m, "GetVendor", arg0)
+func (m *MockDbi) GetVendor(arg0 context.Context, arg1 int) (models.Vendor, models.ApiError) {
+	ret := m.ctrl.Call(m, "GetVendor", arg0, arg1)
 	ret0, _ := ret[0].(models.Vendor)
 	ret1, _ := ret[1].(models.ApiError)
 	return ret0, ret1
 }
 
 // GetVendor indicates an expected call of GetVendor
-func (mr *MockDbiMockRecorder) GetVendor(arg0 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetVendor", reflect.TypeOf((*MockDbi)(nil).GetVendor), arg0)
+func (mr *MockDbiMockRecorder) GetVendor(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetVendor", reflect.TypeOf((*MockDbi)(nil).GetVendor), arg0, arg1)
+}
+
+// GetVendorFees mocks base method
+func (m *MockDbi) GetVendorFees(arg0 context.Context, arg1 int) (models.FeeSchedule, models.ApiError) {
+	ret := m.ctrl.Call(m, "GetVendorFees", arg0, arg1)
+	ret0, _ := ret[0].(models.FeeSchedule)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// GetVendorFees indicates an expected call of GetVendorFees
+func (mr *MockDbiMockRecorder) GetVendorFees(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetVendorFees", reflect.TypeOf((*MockDbi)(nil).GetVendorFees), arg0, arg1)
 }
 
 // GetVendors mocks base method
-func (m *MockDbi) GetVendors() ([]models.Vendor, models.ApiError) {
-	ret := m.ctrl.Call(m, "GetVendors")
+func (m *MockDbi) GetVendors(arg0 context.Context, arg1, arg2 int) ([]models.Vendor, int, models.ApiError) {
+	ret := m.ctrl.Call(m, "GetVendors", arg0, arg1, arg2)
 	ret0, _ := ret[0].([]models.Vendor)
+	ret1, _ := ret[1].(int)
+	ret2, _ := ret[2].(models.ApiError)
+	return ret0, ret1, ret2
+}
+
+// GetVendors indicates an expected call of GetVendors
+func (mr *MockDbiMockRecorder) GetVendors(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetVendors", reflect.TypeOf((*MockDbi)(nil).GetVendors), arg0, arg1, arg2)
+}
+
+// OpenDispute mocks base method
+func (m *MockDbi) OpenDispute(arg0 context.Context, arg1, arg2 int, arg3, arg4 string) (models.Authorisation, models.ApiError) {
+	ret := m.ctrl.Call(m, "OpenDispute", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(models.Authorisation)
 	ret1, _ := ret[1].(models.ApiError)
 	return ret0, ret1
 }
 
-// GetVendors indicates an expected call of GetVendors
-func (mr *MockDbiMockRecorder) GetVendors() *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetVendors", reflect.TypeOf((*MockDbi)(nil).GetVendors))
+// OpenDispute indicates an expected call of OpenDispute
+func (mr *MockDbiMockRecorder) OpenDispute(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OpenDispute", reflect.TypeOf((*MockDbi)(nil).OpenDispute), arg0, arg1, arg2, arg3, arg4)
+}
+
+// Reconcile mocks base method
+func (m *MockDbi) Reconcile(arg0 context.Context) (models.ReconciliationReport, models.ApiError) {
+	ret := m.ctrl.Call(m, "Reconcile", arg0)
+	ret0, _ := ret[0].(models.ReconciliationReport)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// Reconcile indicates an expected call of Reconcile
+func (mr *MockDbiMockRecorder) Reconcile(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Reconcile", reflect.TypeOf((*MockDbi)(nil).Reconcile), arg0)
 }
 
 // Refund mocks base method
-func (m *MockDbi) Refund(arg0, arg1 int, arg2 string) (int, models.ApiError) {
-	ret := m.ctrl.Call(m, "Refund", arg0, arg1, arg2)
+func (m *MockDbi) Refund(arg0 context.Context, arg1, arg2 int, arg3, arg4 string) (int, models.ApiError) {
+	ret := m.ctrl.Call(m, "Refund", arg0, arg1, arg2, arg3, arg4)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(models.ApiError)
 	return ret0, ret1
 }
 
 // Refund indicates an expected call of Refund
-func (mr *MockDbiMockRecorder) Refund(arg0, arg1, arg2 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Refund", reflect.TypeOf((*MockDbi)(nil).Refund), arg0, arg1, arg2)
+func (mr *MockDbiMockRecorder) Refund(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Refund", reflect.TypeOf((*MockDbi)(nil).Refund), arg0, arg1, arg2, arg3, arg4)
+}
+
+// ReleaseIdempotencyKey mocks base method
+func (m *MockDbi) ReleaseIdempotencyKey(arg0 context.Context, arg1 string) models.ApiError {
+	ret := m.ctrl.Call(m, "ReleaseIdempotencyKey", arg0, arg1)
+	ret0, _ := ret[0].(models.ApiError)
+	return ret0
+}
+
+// ReleaseIdempotencyKey indicates an expected call of ReleaseIdempotencyKey
+func (mr *MockDbiMockRecorder) ReleaseIdempotencyKey(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseIdempotencyKey", reflect.TypeOf((*MockDbi)(nil).ReleaseIdempotencyKey), arg0, arg1)
 }
 
 // Reverse mocks base method
-func (m *MockDbi) Reverse(arg0, arg1 int, arg2 string) (int, models.ApiError) {
-	ret := m.ctrl.Call(m, "Reverse", arg0, arg1, arg2)
+func (m *MockDbi) Reverse(arg0 context.Context, arg1, arg2 int, arg3, arg4 string) (int, models.ApiError) {
+	ret := m.ctrl.Call(m, "Reverse", arg0, arg1, arg2, arg3, arg4)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(models.ApiError)
 	return ret0, ret1
 }
 
 // Reverse indicates an expected call of Reverse
-func (mr *MockDbiMockRecorder) Reverse(arg0, arg1, arg2 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Reverse", reflect.TypeOf((*MockDbi)(nil).Reverse), arg0, arg1, arg2)
+func (mr *MockDbiMockRecorder) Reverse(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Reverse", reflect.TypeOf((*MockDbi)(nil).Reverse), arg0, arg1, arg2, arg3, arg4)
+}
+
+// RunMandates mocks base method
+func (m *MockDbi) RunMandates(arg0 context.Context) (models.MandateReport, models.ApiError) {
+	ret := m.ctrl.Call(m, "RunMandates", arg0)
+	ret0, _ := ret[0].(models.MandateReport)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// RunMandates indicates an expected call of RunMandates
+func (mr *MockDbiMockRecorder) RunMandates(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RunMandates", reflect.TypeOf((*MockDbi)(nil).RunMandates), arg0)
+}
+
+// SetCardLimits mocks base method
+func (m *MockDbi) SetCardLimits(arg0 context.Context, arg1 int, arg2 models.SpendingLimits) (models.SpendingLimits, models.ApiError) {
+	ret := m.ctrl.Call(m, "SetCardLimits", arg0, arg1, arg2)
+	ret0, _ := ret[0].(models.SpendingLimits)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// SetCardLimits indicates an expected call of SetCardLimits
+func (mr *MockDbiMockRecorder) SetCardLimits(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetCardLimits", reflect.TypeOf((*MockDbi)(nil).SetCardLimits), arg0, arg1, arg2)
+}
+
+// SetCardMccControls mocks base method
+func (m *MockDbi) SetCardMccControls(arg0 context.Context, arg1 int, arg2 models.MccControls) (models.MccControls, models.ApiError) {
+	ret := m.ctrl.Call(m, "SetCardMccControls", arg0, arg1, arg2)
+	ret0, _ := ret[0].(models.MccControls)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// SetCardMccControls indicates an expected call of SetCardMccControls
+func (mr *MockDbiMockRecorder) SetCardMccControls(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetCardMccControls", reflect.TypeOf((*MockDbi)(nil).SetCardMccControls), arg0, arg1, arg2)
+}
+
+// SetCardStatus mocks base method
+func (m *MockDbi) SetCardStatus(arg0 context.Context, arg1 int, arg2, arg3 string) (models.Card, models.ApiError) {
+	ret := m.ctrl.Call(m, "SetCardStatus", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(models.Card)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// SetCardStatus indicates an expected call of SetCardStatus
+func (mr *MockDbiMockRecorder) SetCardStatus(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetCardStatus", reflect.TypeOf((*MockDbi)(nil).SetCardStatus), arg0, arg1, arg2, arg3)
+}
+
+// SetCategoryFees mocks base method
+func (m *MockDbi) SetCategoryFees(arg0 context.Context, arg1 string, arg2 models.FeeSchedule) (models.FeeSchedule, models.ApiError) {
+	ret := m.ctrl.Call(m, "SetCategoryFees", arg0, arg1, arg2)
+	ret0, _ := ret[0].(models.FeeSchedule)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// SetCategoryFees indicates an expected call of SetCategoryFees
+func (mr *MockDbiMockRecorder) SetCategoryFees(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetCategoryFees", reflect.TypeOf((*MockDbi)(nil).SetCategoryFees), arg0, arg1, arg2)
+}
+
+// SetCustomerLimits mocks base method
+func (m *MockDbi) SetCustomerLimits(arg0 context.Context, arg1 int, arg2 models.SpendingLimits) (models.SpendingLimits, models.ApiError) {
+	ret := m.ctrl.Call(m, "SetCustomerLimits", arg0, arg1, arg2)
+	ret0, _ := ret[0].(models.SpendingLimits)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// SetCustomerLimits indicates an expected call of SetCustomerLimits
+func (mr *MockDbiMockRecorder) SetCustomerLimits(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetCustomerLimits", reflect.TypeOf((*MockDbi)(nil).SetCustomerLimits), arg0, arg1, arg2)
+}
+
+// SetDisputeStatus mocks base method
+func (m *MockDbi) SetDisputeStatus(arg0 context.Context, arg1 int, arg2, arg3 string) (models.Authorisation, models.ApiError) {
+	ret := m.ctrl.Call(m, "SetDisputeStatus", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(models.Authorisation)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// SetDisputeStatus indicates an expected call of SetDisputeStatus
+func (mr *MockDbiMockRecorder) SetDisputeStatus(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetDisputeStatus", reflect.TypeOf((*MockDbi)(nil).SetDisputeStatus), arg0, arg1, arg2, arg3)
+}
+
+// SetMandateStatus mocks base method
+func (m *MockDbi) SetMandateStatus(arg0 context.Context, arg1 int, arg2 string) (models.Mandate, models.ApiError) {
+	ret := m.ctrl.Call(m, "SetMandateStatus", arg0, arg1, arg2)
+	ret0, _ := ret[0].(models.Mandate)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// SetMandateStatus indicates an expected call of SetMandateStatus
+func (mr *MockDbiMockRecorder) SetMandateStatus(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMandateStatus", reflect.TypeOf((*MockDbi)(nil).SetMandateStatus), arg0, arg1, arg2)
+}
+
+// SetVendorFees mocks base method
+func (m *MockDbi) SetVendorFees(arg0 context.Context, arg1 int, arg2 models.FeeSchedule) (models.FeeSchedule, models.ApiError) {
+	ret := m.ctrl.Call(m, "SetVendorFees", arg0, arg1, arg2)
+	ret0, _ := ret[0].(models.FeeSchedule)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// SetVendorFees indicates an expected call of SetVendorFees
+func (mr *MockDbiMockRecorder) SetVendorFees(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetVendorFees", reflect.TypeOf((*MockDbi)(nil).SetVendorFees), arg0, arg1, arg2)
+}
+
+// SettleVendors mocks base method
+func (m *MockDbi) SettleVendors(arg0 context.Context) (models.SettlementReport, models.ApiError) {
+	ret := m.ctrl.Call(m, "SettleVendors", arg0)
+	ret0, _ := ret[0].(models.SettlementReport)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// SettleVendors indicates an expected call of SettleVendors
+func (mr *MockDbiMockRecorder) SettleVendors(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SettleVendors", reflect.TypeOf((*MockDbi)(nil).SettleVendors), arg0)
 }
 
 // TopUp mocks base method
-func (m *MockDbi) TopUp(arg0, arg1 int, arg2 string) (int, models.ApiError) {
-	ret := m.ctrl.Call(m, "TopUp", arg0, arg1, arg2)
+func (m *MockDbi) TopUp(arg0 context.Context, arg1, arg2 int, arg3, arg4 string) (int, models.ApiError) {
+	ret := m.ctrl.Call(m, "TopUp", arg0, arg1, arg2, arg3, arg4)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(models.ApiError)
 	return ret0, ret1
 }
 
 // TopUp indicates an expected call of TopUp
-func (mr *MockDbiMockRecorder) TopUp(arg0, arg1, arg2 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TopUp", reflect.TypeOf((*MockDbi)(nil).TopUp), arg0, arg1, arg2)
+func (mr *MockDbiMockRecorder) TopUp(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TopUp", reflect.TypeOf((*MockDbi)(nil).TopUp), arg0, arg1, arg2, arg3, arg4)
+}
+
+// Transfer mocks base method
+func (m *MockDbi) Transfer(arg0 context.Context, arg1, arg2, arg3 int, arg4, arg5 string) (int, models.ApiError) {
+	ret := m.ctrl.Call(m, "Transfer", arg0, arg1, arg2, arg3, arg4, arg5)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(models.ApiError)
+	return ret0, ret1
+}
+
+// Transfer indicates an expected call of Transfer
+func (mr *MockDbiMockRecorder) Transfer(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Transfer", reflect.TypeOf((*MockDbi)(nil).Transfer), arg0, arg1, arg2, arg3, arg4, arg5)
 }
@@ -4,26 +4,36 @@ package models
 
 // AuthMovement: Authorisation movement: capture, refund or reversal
 type AuthMovement struct {
-	Amount          int    `json:"amount"`
-	AuthorisationId int    `json:"authorisationId"`
-	Description     string `json:"description"`
-	Id              int    `json:"id"`
-	MovementType    string `json:"movementType"`
-	Ts              string `json:"ts"`
+	Amount          int               `json:"amount"`
+	AuthorisationId int               `json:"authorisationId"`
+	Description     string            `json:"description"`
+	Display         map[string]string `json:"display,omitempty"`
+	Id              int               `json:"id"`
+	MovementType    string            `json:"movementType"`
+	Ts              string            `json:"ts"`
 }
 
 // Authorisation: Authorisation: an authorised payment which may be partially or fully captured, refunded or reversed
 type Authorisation struct {
-	Amount      int            `json:"amount"`
-	Captured    int            `json:"captured"`
-	CardId      int            `json:"cardId"`
-	Description string         `json:"description"`
-	Id          int            `json:"id"`
-	Movements   []AuthMovement `json:"movements,omitempty"`
-	Refunded    int            `json:"refunded"`
-	Reversed    int            `json:"reversed"`
-	Ts          string         `json:"ts"`
-	VendorId    int            `json:"vendorId"`
+	Amount        int               `json:"amount"`
+	Captured      int               `json:"captured"`
+	CardCurrency  string            `json:"cardCurrency"`
+	CardId        int               `json:"cardId"`
+	Currency      string            `json:"currency"`
+	Description   string            `json:"description"`
+	Display       map[string]string `json:"display,omitempty"`
+	DisputeStatus string            `json:"disputeStatus,omitempty"`
+	Disputed      int               `json:"disputed,omitempty"`
+	ExpiresAt     string            `json:"expiresAt,omitempty"`
+	Id            int               `json:"id"`
+	Mcc           string            `json:"mcc,omitempty"`
+	Movements     []AuthMovement    `json:"movements,omitempty"`
+	Rate          float64           `json:"rate"`
+	Refunded      int               `json:"refunded"`
+	Reversed      int               `json:"reversed"`
+	Status        string            `json:"status,omitempty"`
+	Ts            string            `json:"ts"`
+	VendorId      int               `json:"vendorId"`
 }
 
 // CalculationResult: Calculation Result
@@ -37,12 +47,26 @@ type CalculationResult struct {
 
 // Card: Card with balance and availability
 type Card struct {
-	Available  int        `json:"available"`
-	Balance    int        `json:"balance"`
-	CustomerId int        `json:"customerId"`
-	Id         int        `json:"id"`
-	Movements  []Movement `json:"movements,omitempty"`
-	Ts         string     `json:"ts"`
+	Available  int               `json:"available"`
+	Balance    int               `json:"balance"`
+	Currency   string            `json:"currency"`
+	CustomerId int               `json:"customerId"`
+	Display    map[string]string `json:"display,omitempty"`
+	Id         int               `json:"id"`
+	Movements  []Movement        `json:"movements,omitempty"`
+	Status     string            `json:"status"`
+	Ts         string            `json:"ts"`
+}
+
+// CardStatusRequest: Request to change the status of a card
+type CardStatusRequest struct {
+	Description string `json:"description,omitempty"`
+	Status      string `json:"status"`
+}
+
+// ClearRequest: Request to clear an authorisation held for review
+type ClearRequest struct {
+	Description string `json:"description,omitempty"`
 }
 
 // CodeRequest: Request for a code such as an authorisation code
@@ -50,7 +74,9 @@ type CodeRequest struct {
 	Amount          int    `json:"amount"`
 	AuthorisationId int    `json:"authorisationId,omitempty"`
 	CardId          int    `json:"cardId,omitempty"`
+	Currency        string `json:"currency,omitempty"`
 	Description     string `json:"description,omitempty"`
+	ToCardId        int    `json:"toCardId,omitempty"`
 	VendorId        int    `json:"vendorId,omitempty"`
 }
 
@@ -73,18 +99,185 @@ type CustomerList struct {
 	Total  int        `json:"total"`
 }
 
+// DisputeRequest: Request to open a dispute on an authorisation or change its status
+type DisputeRequest struct {
+	Amount      int    `json:"amount,omitempty"`
+	Currency    string `json:"currency,omitempty"`
+	Description string `json:"description,omitempty"`
+	Status      string `json:"status,omitempty"`
+}
+
 // Empty: (No description)
 type Empty struct {
 }
 
+// ExpiryReport: The result of sweeping expired authorisations and releasing their holds
+type ExpiryReport struct {
+	AmountReleased        int               `json:"amountReleased"`
+	AmountsReleased       map[string]int    `json:"amountsReleased"`
+	AuthorisationsExpired int               `json:"authorisationsExpired"`
+	Codes                 []int             `json:"codes"`
+	Display               map[string]string `json:"display,omitempty"`
+}
+
+// FeeSchedule: Fee schedule: a percentage of a captured amount, in basis points, plus a fixed amount in the minor unit of its currency
+type FeeSchedule struct {
+	BasisPoints int `json:"basisPoints"`
+	Fixed       int `json:"fixed"`
+}
+
+// LedgerEntry: Ledger entry: a balanced set of postings recording one money movement
+type LedgerEntry struct {
+	Description string          `json:"description"`
+	EntryType   string          `json:"entryType"`
+	Id          int             `json:"id"`
+	Postings    []LedgerPosting `json:"postings"`
+	Reference   int             `json:"reference"`
+	Ts          string          `json:"ts"`
+}
+
+// LedgerEntryList: A list of ledger entries
+type LedgerEntryList struct {
+	Items  []LedgerEntry `json:"items"`
+	Offset int           `json:"offset"`
+	Total  int           `json:"total"`
+}
+
+// LedgerPosting: Ledger posting: a signed amount credited (positive) or debited (negative) to an account
+type LedgerPosting struct {
+	Account  string            `json:"account"`
+	Amount   int               `json:"amount"`
+	Currency string            `json:"currency,omitempty"`
+	Display  map[string]string `json:"display,omitempty"`
+	EntryId  int               `json:"entryId"`
+	Id       int               `json:"id"`
+}
+
+// Mandate: Recurring mandate: a customer's permission for a vendor to take up to a ceiling from a card each period
+type Mandate struct {
+	Amount      int               `json:"amount"`
+	AnchorDay   int               `json:"anchorDay,omitempty"`
+	CardId      int               `json:"cardId"`
+	Currency    string            `json:"currency,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Display     map[string]string `json:"display,omitempty"`
+	EndDate     string            `json:"endDate,omitempty"`
+	Failures    int               `json:"failures"`
+	Frequency   string            `json:"frequency"`
+	Id          int               `json:"id"`
+	MaxAmount   int               `json:"maxAmount"`
+	NextRunAt   string            `json:"nextRunAt,omitempty"`
+	RetryAt     string            `json:"retryAt,omitempty"`
+	Runs        []MandateRun      `json:"runs,omitempty"`
+	Status      string            `json:"status,omitempty"`
+	Ts          string            `json:"ts,omitempty"`
+	VendorId    int               `json:"vendorId"`
+}
+
+// MandateReport: The result of charging the mandates which are due
+type MandateReport struct {
+	Failed    int          `json:"failed"`
+	Runs      []MandateRun `json:"runs"`
+	Succeeded int          `json:"succeeded"`
+	Suspended int          `json:"suspended"`
+}
+
+// MandateRun: An attempt to charge a mandate for a period, through an authorisation which is captured in full
+type MandateRun struct {
+	Amount          int               `json:"amount"`
+	AuthorisationId int               `json:"authorisationId,omitempty"`
+	Currency        string            `json:"currency,omitempty"`
+	Display         map[string]string `json:"display,omitempty"`
+	Id              int               `json:"id"`
+	MandateId       int               `json:"mandateId"`
+	Reason          string            `json:"reason,omitempty"`
+	Status          string            `json:"status"`
+	Ts              string            `json:"ts,omitempty"`
+}
+
+// MandateStatusRequest: Request to change the status of a mandate
+type MandateStatusRequest struct {
+	Status string `json:"status"`
+}
+
+// MccControls: Merchant category controls of a card: the ISO 18245 codes it may not be used with, and if any are allowed the only codes it may be used with
+type MccControls struct {
+	Allowed []string `json:"allowed"`
+	Blocked []string `json:"blocked"`
+}
+
 // Movement: Card movement: top-up, purchase or refund
 type Movement struct {
-	Amount       int    `json:"amount"`
-	CardId       int    `json:"cardId"`
-	Description  string `json:"description"`
-	Id           int    `json:"id"`
-	MovementType string `json:"movementType"`
-	Ts           string `json:"ts"`
+	Amount            int               `json:"amount"`
+	CardId            int               `json:"cardId"`
+	Description       string            `json:"description"`
+	Display           map[string]string `json:"display,omitempty"`
+	Id                int               `json:"id"`
+	MovementType      string            `json:"movementType"`
+	RelatedMovementId int               `json:"relatedMovementId,omitempty"`
+	Ts                string            `json:"ts"`
+}
+
+// ReconciliationBreak: A break of a balance invariant found by reconciliation
+type ReconciliationBreak struct {
+	Actual      int    `json:"actual"`
+	Check       string `json:"check"`
+	Description string `json:"description"`
+	Expected    int    `json:"expected"`
+	Id          int    `json:"id"`
+	ObjectType  string `json:"objectType"`
+}
+
+// ReconciliationReport: The result of checking the balance invariants of every card, authorisation and vendor
+type ReconciliationReport struct {
+	AuthorisationsChecked int                   `json:"authorisationsChecked"`
+	Breaks                []ReconciliationBreak `json:"breaks"`
+	CardsChecked          int                   `json:"cardsChecked"`
+	Ok                    bool                  `json:"ok"`
+	VendorsChecked        int                   `json:"vendorsChecked"`
+}
+
+// ScheduledReport: The result of a scheduled run: the expiry sweep, then the mandates charged
+type ScheduledReport struct {
+	Expiry   ExpiryReport  `json:"expiry"`
+	Mandates MandateReport `json:"mandates"`
+}
+
+// Settlement: Settlement batch: the captures, refunds and chargebacks of a vendor since its last settlement, paid out net of fees
+type Settlement struct {
+	CaptureFees int               `json:"captureFees"`
+	Captured    int               `json:"captured"`
+	ChargedBack int               `json:"chargedBack"`
+	Currency    string            `json:"currency"`
+	Display     map[string]string `json:"display,omitempty"`
+	Fees        int               `json:"fees"`
+	Id          int               `json:"id"`
+	Net         int               `json:"net"`
+	Refunded    int               `json:"refunded"`
+	Ts          string            `json:"ts"`
+	VendorId    int               `json:"vendorId"`
+}
+
+// SettlementList: A list of settlement batches
+type SettlementList struct {
+	Items  []Settlement `json:"items"`
+	Offset int          `json:"offset"`
+	Total  int          `json:"total"`
+}
+
+// SettlementReport: The result of a settlement run: a batch for each vendor with an amount payable
+type SettlementReport struct {
+	PayoutFile  string       `json:"payoutFile"`
+	Settlements []Settlement `json:"settlements"`
+}
+
+// SpendingLimits: Spending limits of a card, or the defaults for the cards of a customer
+type SpendingLimits struct {
+	DailySpend           int `json:"dailySpend"`
+	HourlyAuthorisations int `json:"hourlyAuthorisations"`
+	MaxTransaction       int `json:"maxTransaction"`
+	MonthlySpend         int `json:"monthlySpend"`
+	VendorDailySpend     int `json:"vendorDailySpend"`
 }
 
 // Status: API status information
@@ -98,10 +291,14 @@ type Status struct {
 
 // Vendor: Vendor: a very simple representation of a vendor
 type Vendor struct {
-	Authorisations []Authorisation `json:"authorisations,omitempty"`
-	Balance        int             `json:"balance,omitempty"`
-	Id             int             `json:"id"`
-	VendorName     string          `json:"vendorName"`
+	Authorisations []Authorisation   `json:"authorisations,omitempty"`
+	Balance        int               `json:"balance,omitempty"`
+	Category       string            `json:"category,omitempty"`
+	Currency       string            `json:"currency,omitempty"`
+	Display        map[string]string `json:"display,omitempty"`
+	Id             int               `json:"id"`
+	Mcc            string            `json:"mcc,omitempty"`
+	VendorName     string            `json:"vendorName"`
 }
 
 // VendorList: A list of vendors
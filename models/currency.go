@@ -0,0 +1,137 @@
+package models
+
+import (
+	"fmt"
+	"math"
+
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+// The currency of cards and vendors added without one, and of all amounts before currencies were introduced
+const DEFAULT_CURRENCY = "GBP"
+
+// An ISO 4217 currency. Amounts are integers in its minor unit, such as pence, of which there are 10^Digits to the
+// major unit
+type Currency struct {
+	Code   string
+	Symbol string
+	Digits int
+}
+
+// The currencies which amounts may be in
+var currencies = map[string]Currency{
+	"GBP": {Code: "GBP", Symbol: "£", Digits: 2},
+	"EUR": {Code: "EUR", Symbol: "€", Digits: 2},
+	"USD": {Code: "USD", Symbol: "$", Digits: 2},
+	"CAD": {Code: "CAD", Symbol: "CA$", Digits: 2},
+	"AUD": {Code: "AUD", Symbol: "A$", Digits: 2},
+	"CHF": {Code: "CHF", Symbol: "CHF ", Digits: 2},
+	"SEK": {Code: "SEK", Symbol: "SEK ", Digits: 2},
+	"JPY": {Code: "JPY", Symbol: "¥", Digits: 0},
+}
+
+// The languages which write the currency symbol after an amount, separated by a no-break space, such as 1.234,50 £ in
+// German. Other languages write it before, as English does
+var symbolAfterLanguages = []language.Tag{
+	language.Czech,
+	language.Danish,
+	language.Finnish,
+	language.French,
+	language.German,
+	language.Italian,
+	language.Norwegian,
+	language.Polish,
+	language.Spanish,
+	language.Swedish,
+}
+
+// Whether a language writes the currency symbol after an amount
+func symbolAfter(tag language.Tag) bool {
+
+	base, _ := tag.Base()
+
+	for _, l := range symbolAfterLanguages {
+
+		if b, _ := l.Base(); b == base {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LookupCurrency returns the currency with an ISO 4217 code, and false if it is not one amounts may be in
+func LookupCurrency(code string) (Currency, bool) {
+
+	c, ok := currencies[code]
+
+	return c, ok
+}
+
+// FormatAmount formats an amount in the minor unit of a currency with its symbol, such as £12.50 for 1250 GBP
+func FormatAmount(amount int, code string) string {
+
+	c, ok := LookupCurrency(code)
+
+	if !ok {
+		return fmt.Sprintf("%v %v", amount, code)
+	}
+
+	sign := ""
+
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	return fmt.Sprintf("%v%v%.*f", sign, c.Symbol, c.Digits, float64(amount)/math.Pow10(c.Digits))
+}
+
+// FormatAmountIn formats an amount like FormatAmount, with the currency symbol, its position, the digit grouping and
+// the decimal separator of a language, such as 1.234,50 £ for 123450 GBP in German
+func FormatAmountIn(amount int, code string, tag language.Tag) string {
+
+	c, ok := LookupCurrency(code)
+
+	if !ok {
+		return FormatAmount(amount, code)
+	}
+
+	unit, err := currency.ParseISO(c.Code)
+
+	if err != nil {
+		return FormatAmount(amount, code)
+	}
+
+	sign := ""
+
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	p := message.NewPrinter(tag)
+
+	symbol := p.Sprint(currency.Symbol(unit))
+	digits := p.Sprint(number.Decimal(float64(amount)/math.Pow10(c.Digits), number.Scale(c.Digits)))
+
+	if symbolAfter(tag) {
+		return sign + digits + "\u00a0" + symbol
+	}
+
+	return sign + symbol + digits
+}
+
+// Money is an amount in the minor unit of a currency. As an argument of ConstructApiError it is formatted by
+// FormatAmount, and by FormatAmountIn when the error is localized by LocalizeError
+type Money struct {
+	Amount   int
+	Currency string
+}
+
+func (m Money) String() string {
+	return FormatAmount(m.Amount, m.Currency)
+}
@@ -0,0 +1,269 @@
+package models
+
+import (
+	"golang.org/x/text/language"
+)
+
+// Display returns a copy of an API object with its amounts, and those of the objects it contains, also formatted for
+// display in a language in their Display fields, keyed by the JSON name of each amount. Objects without amounts are
+// returned unchanged
+func Display(data interface{}, tag language.Tag) interface{} {
+
+	switch d := data.(type) {
+
+	case Card:
+		return d.displayed(tag)
+
+	case Vendor:
+		return d.displayed(tag)
+
+	case Authorisation:
+		return d.displayed(tag)
+
+	case Customer:
+
+		if d.Cards != nil {
+
+			cards := make([]Card, len(d.Cards))
+
+			for i, c := range d.Cards {
+				cards[i] = c.displayed(tag)
+			}
+
+			d.Cards = cards
+		}
+
+		return d
+
+	case VendorList:
+
+		if d.Items != nil {
+
+			vendors := make([]Vendor, len(d.Items))
+
+			for i, v := range d.Items {
+				vendors[i] = v.displayed(tag)
+			}
+
+			d.Items = vendors
+		}
+
+		return d
+
+	case ExpiryReport:
+		return d.displayed(tag)
+
+	case LedgerEntryList:
+
+		if d.Items != nil {
+
+			entries := make([]LedgerEntry, len(d.Items))
+
+			for i, e := range d.Items {
+				entries[i] = e.displayed(tag)
+			}
+
+			d.Items = entries
+		}
+
+		return d
+
+	case Settlement:
+		return d.displayed(tag)
+
+	case SettlementList:
+		d.Items = displayedSettlements(d.Items, tag)
+		return d
+
+	case SettlementReport:
+		d.Settlements = displayedSettlements(d.Settlements, tag)
+		return d
+
+	case Mandate:
+		return d.displayed(tag)
+
+	case MandateRun:
+		return d.displayed(tag)
+
+	case MandateReport:
+		d.Runs = displayedMandateRuns(d.Runs, tag)
+		return d
+	}
+
+	return data
+}
+
+func (c Card) displayed(tag language.Tag) Card {
+
+	c.Display = map[string]string{
+		"balance":   FormatAmountIn(c.Balance, c.Currency, tag),
+		"available": FormatAmountIn(c.Available, c.Currency, tag),
+	}
+
+	if c.Movements != nil {
+
+		movements := make([]Movement, len(c.Movements))
+
+		for i, m := range c.Movements {
+			m.Display = map[string]string{
+				"amount": FormatAmountIn(m.Amount, c.Currency, tag),
+			}
+			movements[i] = m
+		}
+
+		c.Movements = movements
+	}
+
+	return c
+}
+
+func (v Vendor) displayed(tag language.Tag) Vendor {
+
+	v.Display = map[string]string{
+		"balance": FormatAmountIn(v.Balance, v.Currency, tag),
+	}
+
+	if v.Authorisations != nil {
+
+		authorisations := make([]Authorisation, len(v.Authorisations))
+
+		for i, a := range v.Authorisations {
+			authorisations[i] = a.displayed(tag)
+		}
+
+		v.Authorisations = authorisations
+	}
+
+	return v
+}
+
+// The amount released in each currency is keyed by amountsReleased and its code, such as amountsReleased.GBP
+func (r ExpiryReport) displayed(tag language.Tag) ExpiryReport {
+
+	r.Display = map[string]string{}
+
+	for code, amount := range r.AmountsReleased {
+		r.Display["amountsReleased."+code] = FormatAmountIn(amount, code, tag)
+	}
+
+	return r
+}
+
+// Postings made before posting currencies were recorded are not displayed
+func (e LedgerEntry) displayed(tag language.Tag) LedgerEntry {
+
+	if e.Postings != nil {
+
+		postings := make([]LedgerPosting, len(e.Postings))
+
+		for i, p := range e.Postings {
+
+			if p.Currency != "" {
+				p.Display = map[string]string{
+					"amount": FormatAmountIn(p.Amount, p.Currency, tag),
+				}
+			}
+
+			postings[i] = p
+		}
+
+		e.Postings = postings
+	}
+
+	return e
+}
+
+func (s Settlement) displayed(tag language.Tag) Settlement {
+
+	s.Display = map[string]string{
+		"captured":    FormatAmountIn(s.Captured, s.Currency, tag),
+		"captureFees": FormatAmountIn(s.CaptureFees, s.Currency, tag),
+		"refunded":    FormatAmountIn(s.Refunded, s.Currency, tag),
+		"chargedBack": FormatAmountIn(s.ChargedBack, s.Currency, tag),
+		"fees":        FormatAmountIn(s.Fees, s.Currency, tag),
+		"net":         FormatAmountIn(s.Net, s.Currency, tag),
+	}
+
+	return s
+}
+
+func displayedSettlements(ss []Settlement, tag language.Tag) []Settlement {
+
+	if ss == nil {
+		return nil
+	}
+
+	displayed := make([]Settlement, len(ss))
+
+	for i, s := range ss {
+		displayed[i] = s.displayed(tag)
+	}
+
+	return displayed
+}
+
+func (m Mandate) displayed(tag language.Tag) Mandate {
+
+	m.Display = map[string]string{
+		"amount":    FormatAmountIn(m.Amount, m.Currency, tag),
+		"maxAmount": FormatAmountIn(m.MaxAmount, m.Currency, tag),
+	}
+
+	m.Runs = displayedMandateRuns(m.Runs, tag)
+
+	return m
+}
+
+func (r MandateRun) displayed(tag language.Tag) MandateRun {
+
+	r.Display = map[string]string{
+		"amount": FormatAmountIn(r.Amount, r.Currency, tag),
+	}
+
+	return r
+}
+
+func displayedMandateRuns(runs []MandateRun, tag language.Tag) []MandateRun {
+
+	if runs == nil {
+		return nil
+	}
+
+	displayed := make([]MandateRun, len(runs))
+
+	for i, r := range runs {
+		displayed[i] = r.displayed(tag)
+	}
+
+	return displayed
+}
+
+func (a Authorisation) displayed(tag language.Tag) Authorisation {
+
+	a.Display = map[string]string{
+		"amount":   FormatAmountIn(a.Amount, a.Currency, tag),
+		"captured": FormatAmountIn(a.Captured, a.Currency, tag),
+		"refunded": FormatAmountIn(a.Refunded, a.Currency, tag),
+		"reversed": FormatAmountIn(a.Reversed, a.Currency, tag),
+	}
+
+	if a.Disputed != 0 {
+		a.Display["disputed"] = FormatAmountIn(a.Disputed, a.Currency, tag)
+	}
+
+	if a.Movements != nil {
+
+		movements := make([]AuthMovement, len(a.Movements))
+
+		for i, m := range a.Movements {
+			m.Display = map[string]string{
+				"amount": FormatAmountIn(m.Amount, a.Currency, tag),
+			}
+			movements[i] = m
+		}
+
+		a.Movements = movements
+	}
+
+	return a
+}
@@ -2,9 +2,13 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"math"
 	"net/http"
+
+	"golang.org/x/text/language"
 )
 
 // ApiError interface to generate a JSON response body, return error codes, fulfil the error interface
@@ -22,6 +26,10 @@ type ApiErrorBody struct {
 
 type errBody struct {
 	body ApiErrorBody
+
+	// kept so that the message can be formatted again for another language
+	format string
+	args   []interface{}
 }
 
 func (err errBody) Error() string {
@@ -45,10 +53,51 @@ func ConstructApiError(code int, format string, a ...interface{}) ApiError {
 			Message: fmt.Sprintf(format, a...),
 			Code:    code,
 		},
+		format: format,
+		args:   a,
 	}
 }
 
-// ErrorWrap an error into an ApiError
+// LocalizeError returns an ApiError whose message has its Money arguments formatted for a language. Errors without
+// them are returned unchanged. Other arguments, such as ids, are not localized
+func LocalizeError(err ApiError, tag language.Tag) ApiError {
+
+	e, ok := err.(errBody)
+
+	if !ok {
+		return err
+	}
+
+	localized := false
+	args := make([]interface{}, len(e.args))
+
+	for i, arg := range e.args {
+
+		if m, isMoney := arg.(Money); isMoney {
+			arg = FormatAmountIn(m.Amount, m.Currency, tag)
+			localized = true
+		}
+
+		args[i] = arg
+	}
+
+	if !localized {
+		return err
+	}
+
+	return ConstructApiError(e.body.Code, e.format, args...)
+}
+
+// HasFormat is true if an ApiError was made by ConstructApiError with a message format, which identifies the error
+// whatever its arguments
+func HasFormat(err ApiError, format string) bool {
+
+	e, ok := err.(errBody)
+
+	return ok && e.format == format
+}
+
+// ErrorWrap an error into an ApiError. A passed deadline is a 504, as the request has been abandoned before completion
 func ErrorWrap(err error) ApiError {
 
 	apiErr, ok := err.(ApiError)
@@ -57,6 +106,10 @@ func ErrorWrap(err error) ApiError {
 		return apiErr
 	}
 
+	if err == context.DeadlineExceeded {
+		return ConstructApiError(http.StatusGatewayTimeout, "Deadline exceeded: %v", err.Error())
+	}
+
 	return errBody{
 		body: ApiErrorBody{
 			Message: err.Error(),
@@ -70,9 +123,21 @@ func (auth Authorisation) Capturable() int {
 	return auth.Amount - (auth.Captured + auth.Reversed)
 }
 
-// Amount that can be refunded
+// Amount that can be refunded or disputed: the amount captured less any refunded, and any under dispute or charged back
 func (auth Authorisation) Refundable() int {
-	return auth.Captured - auth.Refunded
+	return auth.Captured - (auth.Refunded + auth.Disputed)
+}
+
+// Fee on an amount, rounded to the nearest minor unit. It never exceeds the amount
+func (f FeeSchedule) Fee(amount int) int {
+
+	fee := int(math.Round(float64(amount)*float64(f.BasisPoints)/10000)) + f.Fixed
+
+	if fee > amount {
+		return amount
+	}
+
+	return fee
 }
 
 // Placeholder type which can receive null values in database scans in the place of Movement or AuthMovement
@@ -83,6 +148,7 @@ type NullableMovement struct {
 	Amount       sql.NullInt64
 	Description  sql.NullString
 	Ts           sql.NullString
+	RelatedId    sql.NullInt64
 }
 
 // Returns true if non null. Note that the id must be set in the query scan
@@ -93,12 +159,13 @@ func (nm NullableMovement) Valid() bool {
 // Generates a 'ordinary' Movement from the NullableMovement
 func (nm NullableMovement) Movement() Movement {
 	return Movement{
-		Id:           int(nm.Id.Int64),
-		CardId:       int(nm.ParentId.Int64),
-		MovementType: nm.MovementType.String,
-		Amount:       int(nm.Amount.Int64),
-		Description:  nm.Description.String,
-		Ts:           nm.Ts.String,
+		Id:                int(nm.Id.Int64),
+		CardId:            int(nm.ParentId.Int64),
+		MovementType:      nm.MovementType.String,
+		Amount:            int(nm.Amount.Int64),
+		Description:       nm.Description.String,
+		Ts:                nm.Ts.String,
+		RelatedMovementId: int(nm.RelatedId.Int64),
 	}
 }
 
@@ -116,15 +183,18 @@ func (nm NullableMovement) AuthMovement() AuthMovement {
 
 // Placeholder type which can receive null values in database scans in the place of Authorisation
 type NullableAuthorisation struct {
-	Amount      sql.NullInt64
-	Captured    sql.NullInt64
-	CardId      sql.NullInt64
-	Description sql.NullString
-	Id          sql.NullInt64
-	Refunded    sql.NullInt64
-	Reversed    sql.NullInt64
-	Ts          sql.NullString
-	VendorId    sql.NullInt64
+	Amount       sql.NullInt64
+	Captured     sql.NullInt64
+	CardCurrency sql.NullString
+	CardId       sql.NullInt64
+	Currency     sql.NullString
+	Description  sql.NullString
+	Id           sql.NullInt64
+	Rate         sql.NullFloat64
+	Refunded     sql.NullInt64
+	Reversed     sql.NullInt64
+	Ts           sql.NullString
+	VendorId     sql.NullInt64
 }
 
 // Returns true if non null. Note that the id must be set in the query scan
@@ -135,15 +205,18 @@ func (na NullableAuthorisation) Valid() bool {
 // Generate san 'ordinary' Authorisation from the NullableAuthorisation
 func (na NullableAuthorisation) Authorisation() Authorisation {
 	return Authorisation{
-		Amount:      int(na.Amount.Int64),
-		Captured:    int(na.Captured.Int64),
-		CardId:      int(na.CardId.Int64),
-		Description: na.Description.String,
-		Id:          int(na.Id.Int64),
-		Refunded:    int(na.Refunded.Int64),
-		Reversed:    int(na.Reversed.Int64),
-		Ts:          na.Ts.String,
-		VendorId:    int(na.VendorId.Int64),
+		Amount:       int(na.Amount.Int64),
+		Captured:     int(na.Captured.Int64),
+		CardCurrency: na.CardCurrency.String,
+		CardId:       int(na.CardId.Int64),
+		Currency:     na.Currency.String,
+		Description:  na.Description.String,
+		Id:           int(na.Id.Int64),
+		Rate:         na.Rate.Float64,
+		Refunded:     int(na.Refunded.Int64),
+		Reversed:     int(na.Reversed.Int64),
+		Ts:           na.Ts.String,
+		VendorId:     int(na.VendorId.Int64),
 	}
 }
 
@@ -151,8 +224,10 @@ func (na NullableAuthorisation) Authorisation() Authorisation {
 type NullableCard struct {
 	Available  sql.NullInt64
 	Balance    sql.NullInt64
+	Currency   sql.NullString
 	CustomerId sql.NullInt64
 	Id         sql.NullInt64
+	Status     sql.NullString
 	Ts         sql.NullString
 }
 
@@ -166,8 +241,20 @@ func (nc NullableCard) Card() Card {
 	return Card{
 		Available:  int(nc.Available.Int64),
 		Balance:    int(nc.Balance.Int64),
+		Currency:   nc.Currency.String,
 		CustomerId: int(nc.CustomerId.Int64),
 		Id:         int(nc.Id.Int64),
+		Status:     nc.Status.String,
 		Ts:         nc.Ts.String,
 	}
 }
+
+// An idempotency key, with the fingerprint of the request which claimed it and the id of its response once completed
+type IdempotencyKey struct {
+	Key         string
+	Fingerprint string
+	ResponseId  int
+	Completed   bool
+	// when the key was claimed, as a DATETIME value, recorded by the in-memory implementation
+	ClaimedAt string
+}
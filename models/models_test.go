@@ -1,10 +1,14 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"strings"
 	"testing"
 
+	"golang.org/x/text/language"
+
 	"github.com/merlincox/cardapi/utils"
 )
 
@@ -68,6 +72,14 @@ func TestErrorWrap(t *testing.T) {
 	utils.AssertEquals(t, "API error body", errBody2, err2.ErrorBody())
 }
 
+func TestErrorWrapDeadlineExceeded(t *testing.T) {
+
+	err := ErrorWrap(context.DeadlineExceeded)
+
+	utils.AssertEquals(t, "Deadline exceeded error string", "Deadline exceeded: context deadline exceeded", err.Error())
+	utils.AssertEquals(t, "Deadline exceeded error code", 504, err.StatusCode())
+}
+
 func TestAuthorisation_Capturable(t *testing.T) {
 
 	a := Authorisation{
@@ -108,6 +120,16 @@ func TestAuthorisation_Refundable(t *testing.T) {
 	utils.AssertEquals(t, "Refundable", 25, a.Refundable())
 }
 
+func TestFeeSchedule_Fee(t *testing.T) {
+
+	fee := FeeSchedule{BasisPoints: 150, Fixed: 20}
+
+	utils.AssertEquals(t, "Fee on 25.00 at 1.5% plus 0.20, rounded up", 58, fee.Fee(2500))
+	utils.AssertEquals(t, "Fee on 1.00 at 1.5% plus 0.20, rounded down", 22, fee.Fee(100))
+	utils.AssertEquals(t, "Fee on an amount smaller than it", 10, fee.Fee(10))
+	utils.AssertEquals(t, "Fee of an empty schedule", 0, FeeSchedule{}.Fee(2500))
+}
+
 func TestNullableAuthorisation_Valid(t *testing.T) {
 
 	na := NullableAuthorisation{}
@@ -149,8 +171,10 @@ func TestNullableAuthorisation_Authorisation(t *testing.T) {
 		Amount:      sql.NullInt64{Int64: 1000},
 		Captured:    sql.NullInt64{Int64: 100},
 		CardId:      sql.NullInt64{Int64: 100001},
+		Currency:    sql.NullString{String: "EUR"},
 		Description: sql.NullString{String: "Testing"},
 		Id:          sql.NullInt64{Int64: 1001},
+		Rate:        sql.NullFloat64{Float64: 0.85},
 		Refunded:    sql.NullInt64{Int64: 99},
 		Reversed:    sql.NullInt64{Int64: 98},
 		Ts:          sql.NullString{String: "fake"},
@@ -161,8 +185,10 @@ func TestNullableAuthorisation_Authorisation(t *testing.T) {
 		Amount:      1000,
 		Captured:    100,
 		CardId:      100001,
+		Currency:    "EUR",
 		Description: "Testing",
 		Id:          1001,
+		Rate:        0.85,
 		Refunded:    99,
 		Reversed:    98,
 		Ts:          "fake",
@@ -172,8 +198,10 @@ func TestNullableAuthorisation_Authorisation(t *testing.T) {
 	utils.AssertEquals(t, "NullableAuthorisation Authorisation.Amount", expected.Amount, na.Authorisation().Amount)
 	utils.AssertEquals(t, "NullableAuthorisation Authorisation.Captured", expected.Captured, na.Authorisation().Captured)
 	utils.AssertEquals(t, "NullableAuthorisation Authorisation.CardId", expected.CardId, na.Authorisation().CardId)
+	utils.AssertEquals(t, "NullableAuthorisation Authorisation.Currency", expected.Currency, na.Authorisation().Currency)
 	utils.AssertEquals(t, "NullableAuthorisation Authorisation.Description", expected.Description, na.Authorisation().Description)
 	utils.AssertEquals(t, "NullableAuthorisation Authorisation.Id", expected.Id, na.Authorisation().Id)
+	utils.AssertEquals(t, "NullableAuthorisation Authorisation.Rate", expected.Rate, na.Authorisation().Rate)
 	utils.AssertEquals(t, "NullableAuthorisation Authorisation.Refunded", expected.Refunded, na.Authorisation().Refunded)
 	utils.AssertEquals(t, "NullableAuthorisation Authorisation.Reversed", expected.Reversed, na.Authorisation().Reversed)
 	utils.AssertEquals(t, "NullableAuthorisation Authorisation.Ts", expected.Ts, na.Authorisation().Ts)
@@ -199,7 +227,7 @@ func TestNullableMovement_Movement(t *testing.T) {
 		Ts:           "fake",
 	}
 
-	utils.AssertEquals(t, "NullableMovement Movement", expected, nm.Movement())
+	utils.AssertEquals(t, "NullableMovement Movement", utils.JsonStringify(expected), utils.JsonStringify(nm.Movement()))
 }
 
 func TestNullableMovement_AuthMovement(t *testing.T) {
@@ -221,7 +249,7 @@ func TestNullableMovement_AuthMovement(t *testing.T) {
 		Ts:              "fake",
 	}
 
-	utils.AssertEquals(t, "NullableMovement AuthMovement", expected, nm.AuthMovement())
+	utils.AssertEquals(t, "NullableMovement AuthMovement", utils.JsonStringify(expected), utils.JsonStringify(nm.AuthMovement()))
 }
 
 func TestNullableCard_Card(t *testing.T) {
@@ -247,3 +275,150 @@ func TestNullableCard_Card(t *testing.T) {
 	utils.AssertEquals(t, "NullableCard Card.Id", expected.Id, nc.Card().Id)
 	utils.AssertEquals(t, "NullableCard Card.Ts", expected.Ts, nc.Card().Ts)
 }
+
+func TestFormatAmount(t *testing.T) {
+
+	utils.AssertEquals(t, "FormatAmount in GBP", "£12.50", FormatAmount(1250, "GBP"))
+	utils.AssertEquals(t, "FormatAmount in EUR", "€0.05", FormatAmount(5, "EUR"))
+	utils.AssertEquals(t, "FormatAmount of a negative amount", "-$2.10", FormatAmount(-210, "USD"))
+	utils.AssertEquals(t, "FormatAmount in a currency without a minor unit", "¥1250", FormatAmount(1250, "JPY"))
+	utils.AssertEquals(t, "FormatAmount in an unknown currency", "1250 XTS", FormatAmount(1250, "XTS"))
+}
+
+func TestFormatAmountIn(t *testing.T) {
+
+	utils.AssertEquals(t, "FormatAmountIn in English", "£1,234.50", FormatAmountIn(123450, "GBP", language.BritishEnglish))
+	utils.AssertEquals(t, "FormatAmountIn in German", "1.234,50\u00a0£", FormatAmountIn(123450, "GBP", language.German))
+	utils.AssertEquals(t, "FormatAmountIn in a German region", "1.234,50\u00a0£", FormatAmountIn(123450, "GBP", language.MustParse("de-DE")))
+	utils.AssertEquals(t, "FormatAmountIn of a negative amount", "-0,05\u00a0€", FormatAmountIn(-5, "EUR", language.German))
+	utils.AssertEquals(t, "FormatAmountIn with the symbol of a language", "US$12.50", FormatAmountIn(1250, "USD", language.BritishEnglish))
+	utils.AssertEquals(t, "FormatAmountIn in a language which writes the symbol first", "$12.50", FormatAmountIn(1250, "USD", language.AmericanEnglish))
+	utils.AssertEquals(t, "FormatAmountIn in a currency without a minor unit", "¥1,250", FormatAmountIn(1250, "JPY", language.AmericanEnglish))
+	utils.AssertEquals(t, "FormatAmountIn in an unknown currency", "1250 XTS", FormatAmountIn(1250, "XTS", language.German))
+}
+
+func TestLocalizeError(t *testing.T) {
+
+	err := ConstructApiError(400, "%v: insufficient funds: %v exceeds available %v", "Capture", Money{Amount: 123450, Currency: "GBP"}, Money{Amount: 100000, Currency: "GBP"})
+
+	utils.AssertEquals(t, "Message of an error with Money arguments", "Capture: insufficient funds: £1234.50 exceeds available £1000.00", err.Error())
+
+	localized := LocalizeError(err, language.German)
+
+	utils.AssertEquals(t, "Message of a localized error", "Capture: insufficient funds: 1.234,50\u00a0£ exceeds available 1.000,00\u00a0£", localized.Error())
+	utils.AssertEquals(t, "Code of a localized error", 400, localized.StatusCode())
+
+	plain := ConstructApiError(404, "GetCard: no card with id: %v", 1234567)
+
+	utils.AssertEquals(t, "Message of a localized error without Money arguments", "GetCard: no card with id: 1234567", LocalizeError(plain, language.German).Error())
+}
+
+func TestHasFormat(t *testing.T) {
+
+	format := "%v: insufficient funds for amount %v"
+
+	err := ConstructApiError(400, format, "Authorise", Money{Amount: 250, Currency: "GBP"})
+
+	utils.AssertTrue(t, "HasFormat of an error with its format", HasFormat(err, format))
+	utils.AssertTrue(t, "HasFormat of an error with another format", !HasFormat(err, "%v: no %v with id: %v"))
+	utils.AssertTrue(t, "HasFormat of a wrapped error", !HasFormat(ErrorWrap(errors.New(format)), format))
+}
+
+func TestDisplay(t *testing.T) {
+
+	card := Card{
+		Balance:   123450,
+		Available: 100000,
+		Currency:  "GBP",
+		Movements: []Movement{{Amount: -2500}},
+	}
+
+	displayed := Display(card, language.German).(Card)
+
+	utils.AssertEquals(t, "Displayed balance of a card", "1.234,50\u00a0£", displayed.Display["balance"])
+	utils.AssertEquals(t, "Displayed available of a card", "1.000,00\u00a0£", displayed.Display["available"])
+	utils.AssertEquals(t, "Displayed amount of a card movement", "-25,00\u00a0£", displayed.Movements[0].Display["amount"])
+	utils.AssertTrue(t, "Movements of the card displayed unchanged", card.Movements[0].Display == nil)
+
+	vendors := VendorList{
+		Items: []Vendor{{
+			Balance:        5000,
+			Currency:       "EUR",
+			Authorisations: []Authorisation{{Amount: 1000, Captured: 333, Currency: "EUR"}},
+		}},
+	}
+
+	displayedVendors := Display(vendors, language.BritishEnglish).(VendorList)
+
+	utils.AssertEquals(t, "Displayed balance of a listed vendor", "€50.00", displayedVendors.Items[0].Display["balance"])
+	utils.AssertEquals(t, "Displayed captured of a vendor's authorisation", "€3.33", displayedVendors.Items[0].Authorisations[0].Display["captured"])
+
+	expiry := ExpiryReport{AmountReleased: 1500, AmountsReleased: map[string]int{"GBP": 250, "EUR": 1250}}
+
+	displayedExpiry := Display(expiry, language.BritishEnglish).(ExpiryReport)
+
+	utils.AssertEquals(t, "Displayed amount released in pounds", "£2.50", displayedExpiry.Display["amountsReleased.GBP"])
+	utils.AssertEquals(t, "Displayed amount released in euros", "€12.50", displayedExpiry.Display["amountsReleased.EUR"])
+
+	entries := LedgerEntryList{
+		Items: []LedgerEntry{{
+			Postings: []LedgerPosting{{Account: "funding", Amount: -2000, Currency: "GBP"}, {Account: "card-available:100001", Amount: 2000}},
+		}},
+	}
+
+	displayedEntries := Display(entries, language.German).(LedgerEntryList)
+
+	utils.AssertEquals(t, "Displayed amount of a ledger posting", "-20,00\u00a0£", displayedEntries.Items[0].Postings[0].Display["amount"])
+	utils.AssertTrue(t, "Ledger posting without a currency displayed unchanged", displayedEntries.Items[0].Postings[1].Display == nil)
+	utils.AssertTrue(t, "Postings of the ledger entries displayed unchanged", entries.Items[0].Postings[0].Display == nil)
+
+	report := SettlementReport{
+		Settlements: []Settlement{{Currency: "EUR", Captured: 260000, CaptureFees: 2600, Fees: 58, Net: 257342}},
+	}
+
+	displayedReport := Display(report, language.German).(SettlementReport)
+
+	utils.AssertEquals(t, "Displayed net of a settlement batch", "2.573,42\u00a0€", displayedReport.Settlements[0].Display["net"])
+	utils.AssertEquals(t, "Displayed capture fees of a settlement batch", "26,00\u00a0€", displayedReport.Settlements[0].Display["captureFees"])
+	utils.AssertTrue(t, "Batches of the report displayed unchanged", report.Settlements[0].Display == nil)
+
+	settlements := SettlementList{Items: []Settlement{{Currency: "GBP", Refunded: 100}}}
+
+	displayedSettlements := Display(settlements, language.BritishEnglish).(SettlementList)
+
+	utils.AssertEquals(t, "Displayed refunded of a listed settlement batch", "£1.00", displayedSettlements.Items[0].Display["refunded"])
+
+	mandate := Mandate{Amount: 1250, MaxAmount: 2000, Currency: "EUR", Runs: []MandateRun{{Amount: 1250, Currency: "EUR"}}}
+
+	displayedMandate := Display(mandate, language.German).(Mandate)
+
+	utils.AssertEquals(t, "Displayed amount of a mandate", "12,50\u00a0€", displayedMandate.Display["amount"])
+	utils.AssertEquals(t, "Displayed maxAmount of a mandate", "20,00\u00a0€", displayedMandate.Display["maxAmount"])
+	utils.AssertEquals(t, "Displayed amount of a mandate's run", "12,50\u00a0€", displayedMandate.Runs[0].Display["amount"])
+	utils.AssertTrue(t, "Runs of the mandate displayed unchanged", mandate.Runs[0].Display == nil)
+
+	mandates := MandateReport{Runs: []MandateRun{{Amount: 500, Currency: "GBP"}}}
+
+	displayedMandates := Display(mandates, language.BritishEnglish).(MandateReport)
+
+	utils.AssertEquals(t, "Displayed amount of a reported mandate run", "£5.00", displayedMandates.Runs[0].Display["amount"])
+
+	status := Status{Branch: "testing"}
+
+	utils.AssertEquals(t, "Display of an object without amounts", status, Display(status, language.German))
+}
+
+func TestPayoutFile(t *testing.T) {
+
+	ss := []Settlement{
+		{Id: 7, VendorId: 1001, Currency: "GBP", Captured: 2600, CaptureFees: 26, Refunded: 100, Fees: 58, Net: 2416},
+		{Id: 8, VendorId: 1002, Currency: "EUR", Captured: 500, ChargedBack: 200, Net: 300},
+	}
+
+	expected := "settlement_id,vendor_id,currency,captured,capture_fees,refunded,charged_back,fees,net\n" +
+		"7,1001,GBP,2600,26,100,0,58,2416\n" +
+		"8,1002,EUR,500,0,0,200,0,300\n"
+
+	utils.AssertEquals(t, "Payout file of two batches", expected, PayoutFile(ss))
+	utils.AssertEquals(t, "Payout file of no batches", expected[:strings.Index(expected, "\n")+1], PayoutFile(nil))
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+)
+
+// The columns of a payout file. The amounts are in the minor unit of the currency
+var PayoutHeader = []string{"settlement_id", "vendor_id", "currency", "captured", "capture_fees", "refunded", "charged_back", "fees", "net"}
+
+// PayoutFile returns the payout file of settlement batches as CSV, with a header and a line for each batch keyed by its
+// id. It depends only on the stored batches, so the file of a run can be regenerated from them
+func PayoutFile(settlements []Settlement) string {
+
+	var buf bytes.Buffer
+
+	w := csv.NewWriter(&buf)
+
+	w.Write(PayoutHeader)
+
+	for _, s := range settlements {
+		w.Write([]string{
+			strconv.Itoa(s.Id),
+			strconv.Itoa(s.VendorId),
+			s.Currency,
+			strconv.Itoa(s.Captured),
+			strconv.Itoa(s.CaptureFees),
+			strconv.Itoa(s.Refunded),
+			strconv.Itoa(s.ChargedBack),
+			strconv.Itoa(s.Fees),
+			strconv.Itoa(s.Net),
+		})
+	}
+
+	w.Flush()
+
+	return buf.String()
+}
@@ -0,0 +1,59 @@
+// This is the reconciliation executable, which checks the balance invariants of every card, authorisation and vendor
+//
+// Usage: reconcile [-dsn DSN] [-json]
+//
+// Each break is reported with the ids involved, and the exit status is 1 if there are any. The DSN defaults to the
+// MYSQLDSN environment variable.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/merlincox/cardapi/db"
+	"github.com/merlincox/cardapi/utils"
+)
+
+func main() {
+
+	dsn := flag.String("dsn", os.Getenv("MYSQLDSN"), "MySQL DSN, PostgreSQL URL or SQLite file URI of the database to reconcile")
+	asJson := flag.Bool("json", false, "write the report as JSON")
+
+	flag.Parse()
+
+	dbi, apiErr := db.NewDbi(*dsn, nil)
+
+	if apiErr != nil {
+		log.Fatalf("Fatal database error: %v", apiErr.Error())
+	}
+
+	defer dbi.Close()
+
+	report, apiErr := dbi.Reconcile(context.Background())
+
+	if apiErr != nil {
+		log.Fatalf("Reconciliation failed: %v", apiErr.Error())
+	}
+
+	if *asJson {
+
+		fmt.Println(utils.JsonStringify(report))
+
+	} else {
+
+		for _, b := range report.Breaks {
+			fmt.Printf("%-32v %v\n", b.Check, b.Description)
+		}
+
+		fmt.Printf("Checked %v cards, %v authorisations and %v vendors: %v breaks\n",
+			report.CardsChecked, report.AuthorisationsChecked, report.VendorsChecked, len(report.Breaks))
+	}
+
+	if !report.Ok {
+		dbi.Close()
+		os.Exit(1)
+	}
+}
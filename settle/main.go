@@ -0,0 +1,187 @@
+// This is the settlement executable, which settles every vendor with captures, refunds or chargebacks since its last
+// settlement and writes the payout file of the run
+//
+// Usage: settle [-dsn DSN] [-dir DIR] [-json] [-vendor ID [-batches ID,...]]
+//
+// The payout file is written to DIR as payouts-YYYYMMDDTHHMMSS.csv, with a line for each batch keyed by its id. With
+// -vendor nothing is settled, and the payout file is regenerated from the stored batches of the vendor, or only those
+// given by -batches, as listed by /vendor/{id}/settlements. The DSN defaults to the MYSQLDSN environment variable.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/merlincox/cardapi/db"
+	"github.com/merlincox/cardapi/models"
+	"github.com/merlincox/cardapi/utils"
+)
+
+// The page size for reading the stored batches of a vendor
+const settlementsPage = 100
+
+func main() {
+
+	dsn := flag.String("dsn", os.Getenv("MYSQLDSN"), "MySQL DSN, PostgreSQL URL or SQLite file URI of the database to settle")
+	dir := flag.String("dir", ".", "directory to write the payout file to")
+	asJson := flag.Bool("json", false, "write the report as JSON")
+	vendorId := flag.Int("vendor", 0, "regenerate the payout file of the stored batches of this vendor instead of settling")
+	batches := flag.String("batches", "", "comma-separated ids of the batches to regenerate the payout file of, all by default")
+
+	flag.Parse()
+
+	err := run(*dsn, *dir, *asJson, *vendorId, *batches)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(dsn, dir string, asJson bool, vendorId int, batches string) error {
+
+	dbi, apiErr := db.NewDbi(dsn, nil)
+
+	if apiErr != nil {
+		return fmt.Errorf("Fatal database error: %v", apiErr.Error())
+	}
+
+	defer dbi.Close()
+
+	ctx := context.Background()
+
+	if vendorId != 0 {
+		return regenerate(ctx, dbi, dir, vendorId, batches)
+	}
+
+	report, apiErr := dbi.SettleVendors(ctx)
+
+	if apiErr != nil {
+
+		if len(report.Settlements) == 0 {
+			return fmt.Errorf("Settlement failed: %v", apiErr.Error())
+		}
+
+		path, err := writePayoutFile(dir, report.PayoutFile)
+
+		if err != nil {
+			return fmt.Errorf("Settlement failed after settling batches %v: %v, and writing their payout file failed: %v",
+				batchIds(report.Settlements), apiErr.Error(), err)
+		}
+
+		return fmt.Errorf("Settlement failed after settling batches %v, written to payout file %v: %v",
+			batchIds(report.Settlements), path, apiErr.Error())
+	}
+
+	path, err := writePayoutFile(dir, report.PayoutFile)
+
+	if err != nil {
+		return fmt.Errorf("Writing the payout file of batches %v failed, regenerate it with -vendor and -batches: %v",
+			batchIds(report.Settlements), err)
+	}
+
+	if asJson {
+
+		fmt.Println(utils.JsonStringify(report))
+
+	} else {
+
+		for _, s := range report.Settlements {
+			fmt.Printf("%-8v vendor %-8v %v\n", s.Id, s.VendorId, models.FormatAmount(s.Net, s.Currency))
+		}
+
+		fmt.Printf("Settled %v vendors, payout file %v\n", len(report.Settlements), path)
+	}
+
+	return nil
+}
+
+// Write the payout file of the stored batches of a vendor, all of them or only those listed
+func regenerate(ctx context.Context, dbi db.Dbi, dir string, vendorId int, batches string) error {
+
+	wanted := make(map[int]bool)
+
+	if batches != "" {
+		for _, field := range strings.Split(batches, ",") {
+
+			id, err := strconv.Atoi(strings.TrimSpace(field))
+
+			if err != nil {
+				return fmt.Errorf("Malformed batch id %q", field)
+			}
+
+			wanted[id] = true
+		}
+	}
+
+	var ss []models.Settlement
+
+	for offset := 0; ; offset += settlementsPage {
+
+		page, total, apiErr := dbi.GetSettlements(ctx, vendorId, offset, settlementsPage)
+
+		if apiErr != nil {
+			return fmt.Errorf("Reading the batches of vendor %v failed: %v", vendorId, apiErr.Error())
+		}
+
+		for _, s := range page {
+			if batches == "" || wanted[s.Id] {
+				ss = append(ss, s)
+				delete(wanted, s.Id)
+			}
+		}
+
+		if offset+settlementsPage >= total {
+			break
+		}
+	}
+
+	if len(wanted) != 0 {
+
+		var missing []int
+
+		for id := range wanted {
+			missing = append(missing, id)
+		}
+
+		sort.Ints(missing)
+
+		return fmt.Errorf("Vendor %v has no batches %v", vendorId, missing)
+	}
+
+	path, err := writePayoutFile(dir, models.PayoutFile(ss))
+
+	if err != nil {
+		return fmt.Errorf("Writing the payout file failed: %v", err)
+	}
+
+	fmt.Printf("Regenerated the payout file of %v batches, payout file %v\n", len(ss), path)
+
+	return nil
+}
+
+func writePayoutFile(dir, content string) (string, error) {
+
+	path := filepath.Join(dir, fmt.Sprintf("payouts-%v.csv", time.Now().UTC().Format("20060102T150405")))
+
+	return path, ioutil.WriteFile(path, []byte(content), 0644)
+}
+
+func batchIds(ss []models.Settlement) []int {
+
+	ids := make([]int, len(ss))
+
+	for i, s := range ss {
+		ids[i] = s.Id
+	}
+
+	return ids
+}